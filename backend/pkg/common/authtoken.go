@@ -10,6 +10,7 @@ import (
 	"time"
 
 	"github.com/golang-jwt/jwt/v5"
+	"github.com/google/uuid"
 )
 
 var secretKey = []byte("super-secret-shh")
@@ -22,34 +23,45 @@ const AppCtx ContextKey = "appCtx"
 const authHeader string = "Authorization"
 const authHeaderPrefix string = "Bearer "
 
+// how long access tokens last, refresh tokens are exchanged for new ones
+const AccessTokenTTL = 15 * time.Minute
+
 var (
 	errInvalidAuthHeader = errors.New("invalid auth header")
 	errInvalidToken      = errors.New("invalid auth token")
 	errTokenParse        = errors.New("could not parse token")
+	errTokenRevoked      = errors.New("auth token revoked")
 )
 
-func SetUserIDMiddlewareHandler(next http.Handler) http.Handler {
-	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-		if ok := setUserID(r); !ok {
-			w.WriteHeader(http.StatusUnauthorized)
-			return
-		}
-		next.ServeHTTP(w, r)
-	})
+// SetUserIDMiddlewareHandler puts the user id from the request's token in its context,
+// rejecting tokens that are invalid or revoked in the list. a nil list revokes nothing.
+func SetUserIDMiddlewareHandler(revocations *RevocationList) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if ok := setUserID(r, revocations); !ok {
+				w.WriteHeader(http.StatusUnauthorized)
+				return
+			}
+			next.ServeHTTP(w, r)
+		})
+	}
 }
 
-func SetUserIDMiddleware(next http.HandlerFunc) http.HandlerFunc {
-	return func(w http.ResponseWriter, r *http.Request) {
-		if ok := setUserID(r); !ok {
-			w.WriteHeader(http.StatusUnauthorized)
-			return
+// SetUserIDMiddleware is SetUserIDMiddlewareHandler for a http.HandlerFunc
+func SetUserIDMiddleware(revocations *RevocationList) func(http.HandlerFunc) http.HandlerFunc {
+	return func(next http.HandlerFunc) http.HandlerFunc {
+		return func(w http.ResponseWriter, r *http.Request) {
+			if ok := setUserID(r, revocations); !ok {
+				w.WriteHeader(http.StatusUnauthorized)
+				return
+			}
+			next.ServeHTTP(w, r)
 		}
-		next.ServeHTTP(w, r)
 	}
 }
 
-func setUserID(r *http.Request) bool {
-	token, err := getToken(r)
+func setUserID(r *http.Request, revocations *RevocationList) bool {
+	token, err := getToken(r, revocations)
 	if err != nil {
 		log.Println(err)
 		return false
@@ -75,8 +87,8 @@ func setUserID(r *http.Request) bool {
 	return true
 }
 
-func getToken(r *http.Request) (*jwt.Token, error) {
-	// Extract the Bearer token from Authorization header & check expiry
+func getToken(r *http.Request, revocations *RevocationList) (*jwt.Token, error) {
+	// Extract the Bearer token from Authorization header
 	headerStr := r.Header.Get(authHeader)
 
 	if !strings.HasPrefix(headerStr, authHeaderPrefix) {
@@ -91,18 +103,28 @@ func getToken(r *http.Request) (*jwt.Token, error) {
 		return nil, errInvalidToken
 	}
 
-	//TODO: check expiry
-	iat, _ := token.Claims.GetIssuedAt()
-	log.Println("iat:", iat)
+	claims, ok := token.Claims.(jwt.MapClaims)
+	if !ok {
+		return nil, errInvalidToken
+	}
+	jti, _ := claims["jti"].(string)
+	revoked, err := revocations.Revoked(r.Context(), jti)
+	if err != nil {
+		// fail open, a revoked token still expires within AccessTokenTTL
+		revocations.logUnavailable(err)
+	}
+	if revoked {
+		return nil, errTokenRevoked
+	}
 
 	return token, nil
 }
 
 func parseToken(tokenStr string) (*jwt.Token, error) {
-	// todo: see jwt.Parse docstring for alg checking
+	// expiry is checked by jwt.Parse, and required so every token lapses
 	token, err := jwt.Parse(tokenStr, func(token *jwt.Token) (any, error) {
 		return secretKey, nil
-	})
+	}, jwt.WithValidMethods([]string{jwt.SigningMethodHS256.Alg()}), jwt.WithExpirationRequired())
 
 	if err != nil {
 		return nil, err
@@ -119,23 +141,57 @@ func parseToken(tokenStr string) (*jwt.Token, error) {
 	if userId == 0 {
 		return nil, errors.New("failed to get user id from token")
 	}
+	if claims, ok := token.Claims.(jwt.MapClaims); !ok || claims["jti"] == nil {
+		return nil, errors.New("token has no id")
+	}
 
 	return token, nil
 }
 
-func CreateUserToken(user *User) (string, error) {
+// AccessToken identifies an access token, with what's needed to revoke it
+type AccessToken struct {
+	// the jti claim
+	ID        string
+	ExpiresAt time.Time
+}
+
+// NewAccessToken returns an id and expiry for a token to be signed
+func NewAccessToken() AccessToken {
+	return AccessToken{
+		ID:        uuid.NewString(),
+		ExpiresAt: time.Now().UTC().Add(AccessTokenTTL).Truncate(time.Second),
+	}
+}
+
+// Sign creates the token for the user
+func (t AccessToken) Sign(user *User) (string, error) {
 	log.Printf("Creating token for user: %+v", user)
 	token := jwt.NewWithClaims(jwt.SigningMethodHS256,
 		jwt.MapClaims{
 			"sub": strconv.Itoa(int(user.ID)),
+			"jti": t.ID,
 			"iat": time.Now().UTC().Unix(),
-			"exp": time.Now().UTC().Add(15 * time.Minute).Unix(),
+			"exp": t.ExpiresAt.Unix(),
 		})
 
-	tokenString, err := token.SignedString(secretKey)
+	return token.SignedString(secretKey)
+}
+
+// AccessTokenFromRequest returns the id and expiry of the valid token the request is
+// authorised with. it isn't checked against a revocation list.
+func AccessTokenFromRequest(r *http.Request) (AccessToken, error) {
+	token, err := getToken(r, nil)
+	if err != nil {
+		return AccessToken{}, err
+	}
+	exp, err := token.Claims.GetExpirationTime()
 	if err != nil {
-		return "", err
+		return AccessToken{}, err
 	}
+	jti, _ := token.Claims.(jwt.MapClaims)["jti"].(string)
+	return AccessToken{ID: jti, ExpiresAt: exp.Time}, nil
+}
 
-	return tokenString, nil
+func CreateUserToken(user *User) (string, error) {
+	return NewAccessToken().Sign(user)
 }
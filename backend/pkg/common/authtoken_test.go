@@ -35,12 +35,57 @@ func TestGetToken(t *testing.T) {
 			r.Header.Add(authHeader, authHeaderPrefix+"monkey")
 			return name, r, nil, errTokenParse
 		},
+		func() (string, *http.Request, *jwt.Token, error) {
+			name := "error when token expired"
+			token := jwt.NewWithClaims(jwt.SigningMethodHS256,
+				jwt.MapClaims{
+					"sub": "3",
+					"jti": "abc",
+					"iat": time.Now().Add(-time.Hour).Unix(),
+					"exp": time.Now().Add(-time.Minute).Unix(),
+				})
+
+			tokenString, _ := token.SignedString(secretKey)
+			r := httptest.NewRequest("post", "/", nil)
+			r.Header.Add(authHeader, authHeaderPrefix+tokenString)
+			return name, r, nil, errTokenParse
+		},
+		func() (string, *http.Request, *jwt.Token, error) {
+			name := "error when token never expires"
+			token := jwt.NewWithClaims(jwt.SigningMethodHS256,
+				jwt.MapClaims{
+					"sub": "3",
+					"jti": "abc",
+					"iat": time.Now().Unix(),
+				})
+
+			tokenString, _ := token.SignedString(secretKey)
+			r := httptest.NewRequest("post", "/", nil)
+			r.Header.Add(authHeader, authHeaderPrefix+tokenString)
+			return name, r, nil, errTokenParse
+		},
+		func() (string, *http.Request, *jwt.Token, error) {
+			name := "error when token has no id"
+			token := jwt.NewWithClaims(jwt.SigningMethodHS256,
+				jwt.MapClaims{
+					"sub": "3",
+					"iat": time.Now().Unix(),
+					"exp": time.Now().Add(time.Minute).Unix(),
+				})
+
+			tokenString, _ := token.SignedString(secretKey)
+			r := httptest.NewRequest("post", "/", nil)
+			r.Header.Add(authHeader, authHeaderPrefix+tokenString)
+			return name, r, nil, errTokenParse
+		},
 		func() (string, *http.Request, *jwt.Token, error) {
 			name := "success"
 			token := jwt.NewWithClaims(jwt.SigningMethodHS256,
 				jwt.MapClaims{
 					"sub": "3",
+					"jti": "abc",
 					"iat": time.Now().Unix(),
+					"exp": time.Now().Add(time.Minute).Unix(),
 				})
 
 			tokenString, _ := token.SignedString(secretKey)
@@ -53,7 +98,7 @@ func TestGetToken(t *testing.T) {
 		name, r, want, wantErr := tt()
 
 		t.Run(name, func(t *testing.T) {
-			result, err := getToken(r)
+			result, err := getToken(r, nil)
 
 			assert.Equal(t, err, wantErr)
 			if want != nil {
@@ -77,6 +122,14 @@ func TestCreateUserToken(t *testing.T) {
 			sub, _ := tk.Claims.GetSubject()
 			return sub == "12345"
 		}},
+		{claim: "jti", check: func(tk *jwt.Token) bool {
+			jti, _ := tk.Claims.(jwt.MapClaims)["jti"].(string)
+			return jti != ""
+		}},
+		{claim: "exp", check: func(tk *jwt.Token) bool {
+			exp, _ := tk.Claims.GetExpirationTime()
+			return exp != nil && time.Until(exp.Time) > AccessTokenTTL-time.Second
+		}},
 		{claim: "iat", check: func(tk *jwt.Token) bool {
 			iat, _ := tk.Claims.GetIssuedAt()
 			now := time.Now().Unix()
@@ -109,9 +162,24 @@ func TestSetUserID(t *testing.T) {
 	token, _ := CreateUserToken(&User{ID: 123})
 	r.Header.Add(authHeader, authHeaderPrefix+token)
 
-	setUserID(r)
+	setUserID(r, nil)
 
 	result, ok := r.Context().Value(UserIDKey).(int32)
 	assert.Equal(t, ok, true)
 	assert.Equal(t, int(result), 123)
 }
+
+func TestAccessTokenFromRequest(t *testing.T) {
+	access := NewAccessToken()
+	token, _ := access.Sign(&User{ID: 123})
+	r := httptest.NewRequest("get", "/", nil)
+	r.Header.Add(authHeader, authHeaderPrefix+token)
+
+	result, err := AccessTokenFromRequest(r)
+	assert.Equal(t, nil, err)
+	assert.Equal(t, access.ID, result.ID)
+	assert.Equal(t, access.ExpiresAt.Unix(), result.ExpiresAt.Unix())
+
+	_, err = AccessTokenFromRequest(httptest.NewRequest("get", "/", nil))
+	assert.Equal(t, errInvalidAuthHeader, err)
+}
@@ -0,0 +1,282 @@
+package common
+
+import (
+	"container/list"
+	"context"
+	"errors"
+	"log"
+	"math/rand/v2"
+	"sync"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+)
+
+// how an entity is cached
+type CacheConfig struct {
+	TTL time.Duration
+	// error a loader returns when there's nothing to cache. when set, misses are remembered for
+	// NegativeTTL and this error returned for them without loading again.
+	NotFound    error
+	NegativeTTL time.Duration
+	// expiries are spread by up to this fraction of the TTL either way, so entries cached
+	// together don't all expire together
+	Jitter float64
+	// entries kept in process while there's no redis
+	LocalSize int
+	// never cached in process, loaded every time while there's no redis. for entities that
+	// are evicted by other services, which can't reach the in-process cache.
+	RedisOnly bool
+}
+
+// CacheConfigs are the configs of each cached entity
+var CacheConfigs = map[RedisEntityKey]CacheConfig{
+	RedisKeyUser: {
+		TTL:         5 * time.Minute,
+		NotFound:    ErrUserNotFound,
+		NegativeTTL: 30 * time.Second,
+		Jitter:      0.1,
+		LocalSize:   10_000,
+	},
+	// also evicted by cache-invalidator whenever one of the user's accounts changes
+	RedisKeyUserAccounts: {
+		TTL:       time.Minute,
+		Jitter:    0.1,
+		RedisOnly: true,
+	},
+	RedisKeyBanks: {
+		TTL:       time.Hour,
+		Jitter:    0.1,
+		LocalSize: 1,
+	},
+}
+
+// stored for remembered misses. never valid json so can't clash with a value.
+var notFoundMarker = []byte("!notfound")
+
+// where cached values are kept, encoded
+type cacheStore interface {
+	get(ctx context.Context, key string) ([]byte, bool, error)
+	set(ctx context.Context, key string, value []byte, ttl time.Duration) error
+}
+
+// Cache is a cache-aside layer for one entity, in redis or, while redis is unreachable, in process.
+// concurrent misses on a key share a single load. a nil Cache loads every time.
+type Cache[T any] struct {
+	entity RedisEntityKey
+	config CacheConfig
+	redis  *Redis
+	local  *lruCacheStore
+	logger *log.Logger
+
+	mu      sync.Mutex
+	loading map[string]*cacheLoad[T]
+}
+
+// a load in progress, shared by everyone missing on the key meanwhile
+type cacheLoad[T any] struct {
+	done  chan struct{}
+	value T
+	err   error
+}
+
+// NewCache caches the entity with its config from CacheConfigs, in redis whenever it's
+// reachable and otherwise in an in-process LRU. rds may be nil to only cache in process.
+func NewCache[T any](entity RedisEntityKey, rds *Redis, logger *log.Logger) *Cache[T] {
+	return NewCacheWithConfig[T](entity, CacheConfigs[entity], rds, logger)
+}
+
+func NewCacheWithConfig[T any](entity RedisEntityKey, config CacheConfig, rds *Redis, logger *log.Logger) *Cache[T] {
+	return &Cache[T]{
+		entity:  entity,
+		config:  config,
+		redis:   rds,
+		local:   newLRUCacheStore(max(config.LocalSize, 1)),
+		logger:  logger,
+		loading: make(map[string]*cacheLoad[T]),
+	}
+}
+
+// redis if it's reachable, otherwise the in-process LRU
+func (c *Cache[T]) store() cacheStore {
+	if client := c.redis.Client(); client != nil {
+		return &redisCacheStore{client}
+	}
+	return c.local
+}
+
+// Get returns the cached value for id, or loads, caches and returns it on a miss.
+// cache failures are logged and fall back to loading.
+func (c *Cache[T]) Get(ctx context.Context, id string, load func() (T, error)) (T, error) {
+	if c == nil || (c.config.RedisOnly && c.redis.Client() == nil) {
+		return load()
+	}
+
+	key := RedisKey(c.entity, id)
+	if value, err, ok := c.cached(ctx, key); ok {
+		return value, err
+	}
+
+	c.mu.Lock()
+	if l, ok := c.loading[key]; ok {
+		c.mu.Unlock()
+		select {
+		case <-l.done:
+			return l.value, l.err
+		case <-ctx.Done():
+			var zero T
+			return zero, ctx.Err()
+		}
+	}
+	l := &cacheLoad[T]{done: make(chan struct{})}
+	c.loading[key] = l
+	c.mu.Unlock()
+
+	defer func() {
+		c.mu.Lock()
+		delete(c.loading, key)
+		c.mu.Unlock()
+		close(l.done)
+	}()
+
+	l.value, l.err = load()
+	c.remember(ctx, key, l.value, l.err)
+	return l.value, l.err
+}
+
+// looks up the key, ok is false on a miss
+func (c *Cache[T]) cached(ctx context.Context, key string) (value T, err error, ok bool) {
+	b, found, err := c.store().get(ctx, key)
+	if err != nil {
+		c.logger.Printf("failed to get %s from cache: %v", key, err)
+		return value, nil, false
+	}
+	if !found {
+		return value, nil, false
+	}
+
+	if string(b) == string(notFoundMarker) {
+		if c.config.NotFound == nil {
+			return value, nil, false
+		}
+		return value, c.config.NotFound, true
+	}
+
+	v, err := FromBytes[T](b)
+	if err != nil {
+		c.logger.Printf("failed to decode cached %s: %v", key, err)
+		return value, nil, false
+	}
+	return *v, nil, true
+}
+
+// caches the result of a load, if there's one to cache
+func (c *Cache[T]) remember(ctx context.Context, key string, value T, loadErr error) {
+	var (
+		b   []byte
+		ttl time.Duration
+	)
+	switch {
+	case loadErr == nil:
+		var err error
+		if b, err = ToBytes(value); err != nil {
+			c.logger.Printf("failed to encode %s for cache: %v", key, err)
+			return
+		}
+		ttl = c.config.TTL
+	case c.config.NotFound != nil && c.config.NegativeTTL > 0 && errors.Is(loadErr, c.config.NotFound):
+		b, ttl = notFoundMarker, c.config.NegativeTTL
+	default:
+		return
+	}
+
+	if err := c.store().set(ctx, key, b, jitter(ttl, c.config.Jitter)); err != nil {
+		c.logger.Printf("failed to cache %s: %v", key, err)
+	}
+}
+
+// spreads ttl by up to the fraction either way
+func jitter(ttl time.Duration, fraction float64) time.Duration {
+	if fraction <= 0 {
+		return ttl
+	}
+	return ttl + time.Duration(float64(ttl)*fraction*(2*rand.Float64()-1))
+}
+
+type redisCacheStore struct {
+	client redis.UniversalClient
+}
+
+func (r *redisCacheStore) get(ctx context.Context, key string) ([]byte, bool, error) {
+	b, err := r.client.Get(ctx, key).Bytes()
+	if err == redis.Nil {
+		return nil, false, nil
+	}
+	return b, err == nil, err
+}
+
+func (r *redisCacheStore) set(ctx context.Context, key string, value []byte, ttl time.Duration) error {
+	return r.client.Set(ctx, key, value, ttl).Err()
+}
+
+// in-process cache, evicting the least recently used entry once full
+type lruCacheStore struct {
+	mu      sync.Mutex
+	size    int
+	order   *list.List // front is most recently used
+	entries map[string]*list.Element
+	now     func() time.Time
+}
+
+type lruEntry struct {
+	key     string
+	value   []byte
+	expires time.Time
+}
+
+func newLRUCacheStore(size int) *lruCacheStore {
+	return &lruCacheStore{
+		size:    size,
+		order:   list.New(),
+		entries: make(map[string]*list.Element),
+		now:     time.Now,
+	}
+}
+
+func (s *lruCacheStore) get(_ context.Context, key string) ([]byte, bool, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	el, ok := s.entries[key]
+	if !ok {
+		return nil, false, nil
+	}
+	e := el.Value.(*lruEntry)
+	if !s.now().Before(e.expires) {
+		s.order.Remove(el)
+		delete(s.entries, key)
+		return nil, false, nil
+	}
+	s.order.MoveToFront(el)
+	return e.value, true, nil
+}
+
+func (s *lruCacheStore) set(_ context.Context, key string, value []byte, ttl time.Duration) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	e := &lruEntry{key: key, value: value, expires: s.now().Add(ttl)}
+	if el, ok := s.entries[key]; ok {
+		el.Value = e
+		s.order.MoveToFront(el)
+		return nil
+	}
+
+	s.entries[key] = s.order.PushFront(e)
+	for s.order.Len() > s.size {
+		oldest := s.order.Back()
+		s.order.Remove(oldest)
+		delete(s.entries, oldest.Value.(*lruEntry).key)
+	}
+	return nil
+}
@@ -0,0 +1,231 @@
+package common
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/bmizerany/assert"
+	"github.com/redis/go-redis/v9"
+)
+
+func testCache[T any](config CacheConfig) *Cache[T] {
+	return NewCacheWithConfig[T](RedisKeyUser, config, nil, AppLogger())
+}
+
+func TestCacheLoadsOnce(t *testing.T) {
+	c := testCache[[]Account](CacheConfig{TTL: time.Minute})
+	loads := 0
+	load := func() ([]Account, error) {
+		loads++
+		return []Account{{AccountID: 1, Balance: 100}}, nil
+	}
+
+	for range 3 {
+		accs, err := c.Get(context.Background(), "1", load)
+		assert.Equal(t, nil, err)
+		assert.Equal(t, []Account{{AccountID: 1, Balance: 100}}, accs)
+	}
+	assert.Equal(t, 1, loads)
+
+	// other ids are cached separately
+	_, _ = c.Get(context.Background(), "2", load)
+	assert.Equal(t, 2, loads)
+}
+
+func TestCacheNegative(t *testing.T) {
+	c := testCache[User](CacheConfig{TTL: time.Minute, NotFound: ErrUserNotFound, NegativeTTL: time.Minute})
+	loads := 0
+
+	for range 2 {
+		_, err := c.Get(context.Background(), "9", func() (User, error) {
+			loads++
+			return User{}, ErrUserNotFound
+		})
+		assert.Equal(t, ErrUserNotFound, err)
+	}
+	assert.Equal(t, 1, loads)
+
+	// other failures are never cached
+	failing := errors.New("db down")
+	for range 2 {
+		_, err := c.Get(context.Background(), "10", func() (User, error) {
+			loads++
+			return User{}, failing
+		})
+		assert.Equal(t, failing, err)
+	}
+	assert.Equal(t, 3, loads)
+}
+
+func TestCacheWithoutNegativeTTL(t *testing.T) {
+	c := testCache[User](CacheConfig{TTL: time.Minute})
+	loads := 0
+
+	for range 2 {
+		_, _ = c.Get(context.Background(), "9", func() (User, error) {
+			loads++
+			return User{}, ErrUserNotFound
+		})
+	}
+	assert.Equal(t, 2, loads)
+}
+
+func TestCacheCoalescesLoads(t *testing.T) {
+	c := testCache[int](CacheConfig{TTL: time.Minute})
+	var loads atomic.Int32
+	release := make(chan struct{})
+
+	var wg sync.WaitGroup
+	results := make([]int, 10)
+	for i := range results {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			results[i], _ = c.Get(context.Background(), "1", func() (int, error) {
+				loads.Add(1)
+				<-release
+				return 42, nil
+			})
+		}()
+	}
+
+	// let every caller miss before the load finishes
+	time.Sleep(20 * time.Millisecond)
+	close(release)
+	wg.Wait()
+
+	assert.Equal(t, int32(1), loads.Load())
+	for _, r := range results {
+		assert.Equal(t, 42, r)
+	}
+}
+
+func TestCacheWaiterCancelled(t *testing.T) {
+	c := testCache[int](CacheConfig{TTL: time.Minute})
+	release := make(chan struct{})
+	defer close(release)
+
+	go func() {
+		_, _ = c.Get(context.Background(), "1", func() (int, error) {
+			<-release
+			return 1, nil
+		})
+	}()
+	time.Sleep(10 * time.Millisecond)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	_, err := c.Get(ctx, "1", func() (int, error) {
+		t.Error("expected to wait for the load in progress")
+		return 0, nil
+	})
+	assert.Equal(t, context.DeadlineExceeded, err)
+}
+
+func TestNilCacheLoads(t *testing.T) {
+	var c *Cache[int]
+	loads := 0
+	for range 2 {
+		v, err := c.Get(context.Background(), "1", func() (int, error) {
+			loads++
+			return 7, nil
+		})
+		assert.Equal(t, nil, err)
+		assert.Equal(t, 7, v)
+	}
+	assert.Equal(t, 2, loads)
+}
+
+func TestCacheRedisFailureLoads(t *testing.T) {
+	// attached but failing, as between redis going away and the next health check
+	rds := newRedis(redis.NewClient(&redis.Options{Addr: "127.0.0.1:1", MaxRetries: -1}), time.Second, AppLogger())
+	rds.healthy.Store(true)
+	defer rds.Close()
+	c := NewCacheWithConfig[int](RedisKeyUser, CacheConfig{TTL: time.Minute}, rds, AppLogger())
+
+	loads := 0
+	for range 2 {
+		v, err := c.Get(context.Background(), "1", func() (int, error) {
+			loads++
+			return 7, nil
+		})
+		assert.Equal(t, nil, err)
+		assert.Equal(t, 7, v)
+	}
+	assert.Equal(t, 2, loads)
+}
+
+func TestCacheRedisDetachedUsesLocal(t *testing.T) {
+	rds := newRedis(redis.NewClient(&redis.Options{Addr: "127.0.0.1:1", MaxRetries: -1}), time.Second, AppLogger())
+	defer rds.Close()
+	c := NewCacheWithConfig[int](RedisKeyUser, CacheConfig{TTL: time.Minute}, rds, AppLogger())
+
+	loads := 0
+	for range 2 {
+		_, _ = c.Get(context.Background(), "1", func() (int, error) {
+			loads++
+			return 7, nil
+		})
+	}
+	assert.Equal(t, 1, loads)
+}
+
+func TestCacheRedisOnlyDetachedLoads(t *testing.T) {
+	rds := newRedis(redis.NewClient(&redis.Options{Addr: "127.0.0.1:1", MaxRetries: -1}), time.Second, AppLogger())
+	defer rds.Close()
+	c := NewCacheWithConfig[int](RedisKeyUserAccounts, CacheConfig{TTL: time.Minute, RedisOnly: true}, rds, AppLogger())
+
+	loads := 0
+	for range 2 {
+		_, _ = c.Get(context.Background(), "1", func() (int, error) {
+			loads++
+			return 7, nil
+		})
+	}
+	assert.Equal(t, 2, loads)
+}
+
+func TestLRUCacheStore(t *testing.T) {
+	s := newLRUCacheStore(2)
+	now := time.Now()
+	s.now = func() time.Time { return now }
+	ctx := context.Background()
+
+	_ = s.set(ctx, "a", []byte("1"), time.Minute)
+	_ = s.set(ctx, "b", []byte("2"), time.Minute)
+	// a is now the most recently used, so b goes when c is added
+	_, found, _ := s.get(ctx, "a")
+	assert.Equal(t, true, found)
+	_ = s.set(ctx, "c", []byte("3"), 2*time.Minute)
+
+	_, found, _ = s.get(ctx, "b")
+	assert.Equal(t, false, found)
+	v, found, _ := s.get(ctx, "c")
+	assert.Equal(t, true, found)
+	assert.Equal(t, []byte("3"), v)
+
+	// expired entries are misses
+	now = now.Add(time.Minute)
+	_, found, _ = s.get(ctx, "a")
+	assert.Equal(t, false, found)
+	_, found, _ = s.get(ctx, "c")
+	assert.Equal(t, true, found)
+}
+
+func TestJitter(t *testing.T) {
+	assert.Equal(t, time.Minute, jitter(time.Minute, 0))
+
+	spread := false
+	for range 100 {
+		d := jitter(time.Minute, 0.1)
+		if d < 54*time.Second || d > 66*time.Second {
+			t.Fatalf("jittered ttl %s outside 10%% of a minute", d)
+		}
+		spread = spread || d != time.Minute
+	}
+	assert.Equal(t, true, spread)
+}
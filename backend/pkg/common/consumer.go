@@ -0,0 +1,236 @@
+package common
+
+import (
+	"cmp"
+	"context"
+	"errors"
+	"fmt"
+	"hash/fnv"
+	"io"
+	"log"
+	"slices"
+	"sync"
+	"time"
+
+	"github.com/segmentio/kafka-go"
+)
+
+// ErrUnprocessable marks a message which will never succeed, e.g. one that can't be parsed.
+// it is committed rather than retried.
+var ErrUnprocessable = errors.New("unprocessable message")
+
+// Unprocessable wraps err so the message is committed rather than retried
+func Unprocessable(err error) error {
+	return fmt.Errorf("%w: %w", ErrUnprocessable, err)
+}
+
+// MessageHandler processes a single message. once it returns nil the message can be committed.
+type MessageHandler func(ctx context.Context, msg kafka.Message) error
+
+const (
+	retryBackoffMin = 100 * time.Millisecond
+	retryBackoffMax = 10 * time.Second
+)
+
+// Process runs the handler until it succeeds or the message is unprocessable, backing off
+// between attempts. an error is only returned if ctx is done first, in which case the
+// message must not be committed.
+func Process(ctx context.Context, msg kafka.Message, handler MessageHandler, logger *log.Logger) error {
+	backoff := retryBackoffMin
+	for attempt := 1; ; attempt++ {
+		err := handler(ctx, msg)
+		if err == nil {
+			return nil
+		}
+		if errors.Is(err, ErrUnprocessable) {
+			logger.Printf("dropping message %s: %v", MessageID(msg), err)
+			return nil
+		}
+
+		logger.Printf("attempt %d at message %s failed, retrying in %s: %v", attempt, MessageID(msg), backoff, err)
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(backoff):
+		}
+		backoff = min(backoff*2, retryBackoffMax)
+	}
+}
+
+// Consume handles messages one at a time, committing each once processed, until ctx is
+// done or the reader is closed. delivery is at-least-once so handlers must be idempotent.
+func Consume(ctx context.Context, reader KafkaReader, handler MessageHandler, logger *log.Logger) {
+	for {
+		msg, err := reader.FetchMessage(ctx)
+		if err != nil {
+			if ctx.Err() != nil || errors.Is(err, io.EOF) {
+				return
+			}
+			logger.Println("FETCH MSG ERROR", err)
+			continue
+		}
+
+		if err := Process(ctx, msg, handler, logger); err != nil {
+			logger.Printf("stopped before processing %s, it will be redelivered", MessageID(msg))
+			return
+		}
+
+		if err := reader.CommitMessages(ctx, msg); err != nil {
+			logger.Printf("failed to commit %s, it will be redelivered: %v", MessageID(msg), err)
+		}
+	}
+}
+
+// messages fetched but waiting for their lane, per lane
+const laneDepth = 16
+
+// ConsumeOrdered handles messages on up to concurrency lanes at once, until ctx is done or the
+// reader is closed. messages with the same key on the same partition always share a lane, so
+// are handled in the order they were fetched, while other keys and partitions carry on in
+// parallel. offsets are committed once a message and everything fetched before it on its
+// partition are done, so a slow key holds back commits but never has them skip past it.
+func ConsumeOrdered(ctx context.Context, reader KafkaReader, handler MessageHandler, concurrency int, logger *log.Logger) {
+	if concurrency <= 1 {
+		Consume(ctx, reader, handler, logger)
+		return
+	}
+
+	offsets := NewOffsetTracker()
+	var (
+		commitMu sync.Mutex
+		wg       sync.WaitGroup
+	)
+
+	lanes := make([]chan kafka.Message, concurrency)
+	for i := range lanes {
+		lanes[i] = make(chan kafka.Message, laneDepth)
+		wg.Add(1)
+		go func(lane <-chan kafka.Message) {
+			defer wg.Done()
+			for msg := range lane {
+				// once stopping, whatever's left in the lane is redelivered
+				if ctx.Err() != nil {
+					continue
+				}
+				if err := Process(ctx, msg, handler, logger); err != nil {
+					continue
+				}
+
+				// serialised so a slow commit can't overwrite a newer offset
+				commitMu.Lock()
+				if committable, ok := offsets.Done(msg); ok {
+					if err := reader.CommitMessages(ctx, committable); err != nil {
+						logger.Printf("failed to commit %s, it will be redelivered: %v", MessageID(committable), err)
+					}
+				}
+				commitMu.Unlock()
+			}
+		}(lanes[i])
+	}
+
+	defer func() {
+		for _, lane := range lanes {
+			close(lane)
+		}
+		wg.Wait()
+	}()
+
+	for {
+		msg, err := reader.FetchMessage(ctx)
+		if err != nil {
+			if ctx.Err() != nil || errors.Is(err, io.EOF) {
+				return
+			}
+			logger.Println("FETCH MSG ERROR", err)
+			continue
+		}
+
+		offsets.Track(msg)
+		// blocks while the lane is full, which stops fetching until it catches up
+		select {
+		case lanes[laneFor(msg, concurrency)] <- msg:
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+// picks the lane for a message from its partition and key
+func laneFor(msg kafka.Message, lanes int) int {
+	h := fnv.New32a()
+	h.Write([]byte{byte(msg.Partition >> 24), byte(msg.Partition >> 16), byte(msg.Partition >> 8), byte(msg.Partition)})
+	h.Write(msg.Key)
+	return int(h.Sum32() % uint32(lanes))
+}
+
+// OffsetTracker works out what can be committed when messages are processed out of order.
+// a message is committable once it and every earlier offset fetched on its partition is done.
+// after a rebalance a partition can be fetched again from its last commit, so an offset may be
+// tracked more than once, and is only done once every copy of it is.
+type OffsetTracker struct {
+	mu sync.Mutex
+	// sorted by offset
+	pending map[int][]*trackedMessage
+	// the newest offset returned as committable on each partition
+	committed map[int]int64
+}
+
+type trackedMessage struct {
+	msg kafka.Message
+	// copies fetched but not yet done
+	inFlight int
+}
+
+func NewOffsetTracker() *OffsetTracker {
+	return &OffsetTracker{pending: map[int][]*trackedMessage{}, committed: map[int]int64{}}
+}
+
+// Track records a fetched message
+func (t *OffsetTracker) Track(msg kafka.Message) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	if committed, ok := t.committed[msg.Partition]; ok && msg.Offset <= committed {
+		return
+	}
+	pending := t.pending[msg.Partition]
+	i, found := findOffset(pending, msg.Offset)
+	if found {
+		pending[i].inFlight++
+		return
+	}
+	t.pending[msg.Partition] = slices.Insert(pending, i, &trackedMessage{msg: msg, inFlight: 1})
+}
+
+// Done marks a message processed and returns the newest message on its partition
+// which can now be committed, if any
+func (t *OffsetTracker) Done(msg kafka.Message) (kafka.Message, bool) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	pending := t.pending[msg.Partition]
+	if i, found := findOffset(pending, msg.Offset); found && pending[i].inFlight > 0 {
+		pending[i].inFlight--
+	}
+
+	var (
+		committable kafka.Message
+		n           int
+	)
+	for n < len(pending) && pending[n].inFlight == 0 {
+		committable = pending[n].msg
+		n++
+	}
+	t.pending[msg.Partition] = pending[n:]
+	if n > 0 {
+		t.committed[msg.Partition] = committable.Offset
+	}
+	return committable, n > 0
+}
+
+// returns where the offset is in pending, or where it would go
+func findOffset(pending []*trackedMessage, offset int64) (int, bool) {
+	return slices.BinarySearchFunc(pending, offset, func(m *trackedMessage, offset int64) int {
+		return cmp.Compare(m.msg.Offset, offset)
+	})
+}
@@ -0,0 +1,281 @@
+package common
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"slices"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/segmentio/kafka-go"
+	tu "github.com/timkins666/distributed-playground/backend/pkg/testutils"
+)
+
+func testMessages(n int) []kafka.Message {
+	msgs := make([]kafka.Message, n)
+	for i := range msgs {
+		msgs[i] = kafka.Message{Topic: "t", Offset: int64(i)}
+	}
+	return msgs
+}
+
+func TestConsumeCommitsAfterProcessing(t *testing.T) {
+	reader := &tu.MockKafkaReader{Messages: testMessages(3)}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	var handled []int64
+	Consume(ctx, reader, func(_ context.Context, msg kafka.Message) error {
+		handled = append(handled, msg.Offset)
+		if len(handled) == 3 {
+			cancel()
+		}
+		return nil
+	}, AppLogger())
+
+	if len(handled) != 3 || len(reader.Committed) != 3 {
+		t.Errorf("expected 3 handled and committed, got %v and %d", handled, len(reader.Committed))
+	}
+}
+
+func TestConsumeRedeliversAfterCrash(t *testing.T) {
+	reader := &tu.MockKafkaReader{Messages: testMessages(3)}
+
+	// crash while the second message is being handled
+	ctx, crash := context.WithCancel(context.Background())
+	Consume(ctx, reader, func(_ context.Context, msg kafka.Message) error {
+		if msg.Offset == 1 {
+			crash()
+			return errors.New("db went away")
+		}
+		return nil
+	}, AppLogger())
+
+	if len(reader.Committed) != 1 || reader.Committed[0].Offset != 0 {
+		t.Fatalf("expected only the first message committed, got %+v", reader.Committed)
+	}
+
+	reader.Restart()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	var redelivered []int64
+	Consume(ctx, reader, func(_ context.Context, msg kafka.Message) error {
+		redelivered = append(redelivered, msg.Offset)
+		if msg.Offset == 2 {
+			cancel()
+		}
+		return nil
+	}, AppLogger())
+
+	if len(redelivered) != 2 || redelivered[0] != 1 {
+		t.Errorf("expected messages 1 and 2 redelivered, got %v", redelivered)
+	}
+}
+
+func TestProcess(t *testing.T) {
+	msg := kafka.Message{Topic: "t"}
+
+	t.Run("retries until success", func(t *testing.T) {
+		attempts := 0
+		err := Process(context.Background(), msg, func(context.Context, kafka.Message) error {
+			attempts++
+			if attempts < 3 {
+				return errors.New("transient")
+			}
+			return nil
+		}, AppLogger())
+
+		if err != nil || attempts != 3 {
+			t.Errorf("expected success after 3 attempts, got %d: %v", attempts, err)
+		}
+	})
+
+	t.Run("unprocessable is not retried", func(t *testing.T) {
+		attempts := 0
+		err := Process(context.Background(), msg, func(context.Context, kafka.Message) error {
+			attempts++
+			return Unprocessable(errors.New("bad json"))
+		}, AppLogger())
+
+		if err != nil || attempts != 1 {
+			t.Errorf("expected 1 attempt and no error, got %d: %v", attempts, err)
+		}
+	})
+
+	t.Run("gives up when cancelled", func(t *testing.T) {
+		ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+		defer cancel()
+
+		err := Process(ctx, msg, func(context.Context, kafka.Message) error {
+			return errors.New("transient")
+		}, AppLogger())
+
+		if !errors.Is(err, context.DeadlineExceeded) {
+			t.Errorf("expected deadline exceeded, got %v", err)
+		}
+	})
+}
+
+func TestOffsetTracker(t *testing.T) {
+	msgs := testMessages(3)
+	tracker := NewOffsetTracker()
+	for _, m := range msgs {
+		tracker.Track(m)
+	}
+
+	// finishing out of order can't commit past the unfinished first message
+	if _, ok := tracker.Done(msgs[2]); ok {
+		t.Error("expected nothing committable")
+	}
+	if _, ok := tracker.Done(msgs[1]); ok {
+		t.Error("expected nothing committable")
+	}
+
+	committable, ok := tracker.Done(msgs[0])
+	if !ok || committable.Offset != 2 {
+		t.Errorf("expected offset 2 committable, got %d %t", committable.Offset, ok)
+	}
+}
+
+func TestOffsetTrackerRefetched(t *testing.T) {
+	msgs := testMessages(3)
+	tracker := NewOffsetTracker()
+	for _, m := range msgs {
+		tracker.Track(m)
+	}
+	if committable, ok := tracker.Done(msgs[0]); !ok || committable.Offset != 0 {
+		t.Errorf("expected offset 0 committable, got %d %t", committable.Offset, ok)
+	}
+
+	// a rebalance hands the partition back from its last commit, while the first fetch
+	// of offsets 1 and 2 is still in progress
+	for _, m := range msgs {
+		tracker.Track(m)
+	}
+
+	if _, ok := tracker.Done(msgs[1]); ok {
+		t.Error("expected nothing committable while a copy of offset 1 is in progress")
+	}
+	if _, ok := tracker.Done(msgs[2]); ok {
+		t.Error("expected nothing committable")
+	}
+	if _, ok := tracker.Done(msgs[2]); ok {
+		t.Error("expected nothing committable")
+	}
+	committable, ok := tracker.Done(msgs[1])
+	if !ok || committable.Offset != 2 {
+		t.Errorf("expected offset 2 committable, got %d %t", committable.Offset, ok)
+	}
+
+	// the already committed offset 0 never holds anything up
+	if _, ok := tracker.Done(msgs[0]); ok {
+		t.Error("expected nothing more committable")
+	}
+	if len(tracker.pending[0]) != 0 {
+		t.Errorf("expected nothing pending, got %d", len(tracker.pending[0]))
+	}
+}
+
+func TestConsumeOrderedKeepsKeyOrder(t *testing.T) {
+	const n = 60
+	msgs := make([]kafka.Message, n)
+	for i := range msgs {
+		msgs[i] = kafka.Message{
+			Topic:     "t",
+			Partition: i % 2,
+			Offset:    int64(i / 2),
+			Key:       []byte(fmt.Sprintf("account-%d", i%3)),
+		}
+	}
+	reader := &tu.MockKafkaReader{Messages: msgs}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	var (
+		mu      sync.Mutex
+		handled = map[string][]int64{}
+		count   int
+	)
+	ConsumeOrdered(ctx, reader, func(_ context.Context, msg kafka.Message) error {
+		time.Sleep(time.Duration(msg.Offset%3) * time.Millisecond)
+		mu.Lock()
+		defer mu.Unlock()
+		lane := fmt.Sprintf("%d/%s", msg.Partition, msg.Key)
+		handled[lane] = append(handled[lane], msg.Offset)
+		if count++; count == n {
+			cancel()
+		}
+		return nil
+	}, 4, AppLogger())
+
+	for lane, offsets := range handled {
+		for i := 1; i < len(offsets); i++ {
+			if offsets[i] < offsets[i-1] {
+				t.Errorf("expected %s handled in order, got %v", lane, offsets)
+				break
+			}
+		}
+	}
+
+	newest := map[int]int64{}
+	for _, m := range reader.Committed {
+		newest[m.Partition] = max(newest[m.Partition], m.Offset)
+	}
+	if newest[0] != n/2-1 || newest[1] != n/2-1 {
+		t.Errorf("expected both partitions committed to offset %d, got %v", n/2-1, newest)
+	}
+}
+
+// records commits so they can be checked while consuming
+type commitRecorder struct {
+	*tu.MockKafkaReader
+	mu      sync.Mutex
+	offsets []int64
+}
+
+func (r *commitRecorder) CommitMessages(ctx context.Context, msgs ...kafka.Message) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	for _, m := range msgs {
+		r.offsets = append(r.offsets, m.Offset)
+	}
+	return nil
+}
+
+func (r *commitRecorder) committed() []int64 {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return slices.Clone(r.offsets)
+}
+
+func TestConsumeOrderedCommitsInOffsetOrder(t *testing.T) {
+	const lanes = 8
+	slow := kafka.Message{Topic: "t", Offset: 0, Key: []byte("slow")}
+	fast := kafka.Message{Topic: "t", Offset: 1, Key: []byte("fast")}
+	for i := 0; laneFor(fast, lanes) == laneFor(slow, lanes); i++ {
+		fast.Key = []byte(fmt.Sprintf("fast-%d", i))
+	}
+	reader := &commitRecorder{MockKafkaReader: &tu.MockKafkaReader{Messages: []kafka.Message{slow, fast}}}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	fastDone := make(chan struct{})
+	ConsumeOrdered(ctx, reader, func(_ context.Context, msg kafka.Message) error {
+		if msg.Offset == 1 {
+			close(fastDone)
+			return nil
+		}
+
+		// the later key isn't held up by this one, but can't be committed before it
+		<-fastDone
+		time.Sleep(10 * time.Millisecond)
+		if c := reader.committed(); len(c) != 0 {
+			t.Errorf("expected nothing committed while offset 0 is in progress, got %v", c)
+		}
+		cancel()
+		return nil
+	}, lanes, AppLogger())
+
+	if c := reader.committed(); !slices.Equal(c, []int64{1}) {
+		t.Errorf("expected offset 1 committed once offset 0 finished, got %v", c)
+	}
+}
@@ -0,0 +1,72 @@
+package common
+
+import (
+	"fmt"
+	"log"
+	"os"
+	"strconv"
+	"time"
+)
+
+// Config is read from the environment with these helpers. An unset or empty variable means
+// the default, and a value that doesn't parse or is out of range is logged and the default used.
+
+// EnvOrDefault returns the variable, or the default if it's unset or empty
+func EnvOrDefault(key, defaultValue string) string {
+	if v := os.Getenv(key); v != "" {
+		return v
+	}
+	return defaultValue
+}
+
+// IntFromEnv parses an integer of at least minValue from the environment, falling back to the default
+func IntFromEnv(key string, defaultValue, minValue int, logger *log.Logger) int {
+	v := os.Getenv(key)
+	if v == "" {
+		return defaultValue
+	}
+	i, err := strconv.Atoi(v)
+	if err != nil {
+		err = fmt.Errorf("invalid %s %q", key, v)
+	} else if i < minValue {
+		err = fmt.Errorf("invalid %s %d, below %d", key, i, minValue)
+	}
+	if err != nil {
+		logger.Printf("%v, using %d", err, defaultValue)
+		return defaultValue
+	}
+	return i
+}
+
+// BoolFromEnv parses a bool e.g. "true" from the environment, falling back to the default
+func BoolFromEnv(key string, defaultValue bool, logger *log.Logger) bool {
+	v := os.Getenv(key)
+	if v == "" {
+		return defaultValue
+	}
+	b, err := strconv.ParseBool(v)
+	if err != nil {
+		logger.Printf("invalid %s %q, using %t", key, v, defaultValue)
+		return defaultValue
+	}
+	return b
+}
+
+// DurationFromEnv parses a positive duration e.g. "10m" from the environment, falling back to the default
+func DurationFromEnv(key string, defaultValue time.Duration, logger *log.Logger) time.Duration {
+	v := os.Getenv(key)
+	if v == "" {
+		return defaultValue
+	}
+	d, err := time.ParseDuration(v)
+	if err != nil {
+		err = fmt.Errorf("invalid %s %q", key, v)
+	} else if d <= 0 {
+		err = fmt.Errorf("invalid %s %s, not positive", key, d)
+	}
+	if err != nil {
+		logger.Printf("%v, using %s", err, defaultValue)
+		return defaultValue
+	}
+	return d
+}
@@ -0,0 +1,57 @@
+package common
+
+import (
+	"bytes"
+	"log"
+	"testing"
+	"time"
+
+	"github.com/bmizerany/assert"
+)
+
+func TestEnvOrDefault(t *testing.T) {
+	t.Setenv("TEST_VAR", "test_value")
+	assert.Equal(t, "test_value", EnvOrDefault("TEST_VAR", "default"))
+	assert.Equal(t, "default", EnvOrDefault("NONEXISTENT", "default"))
+}
+
+func TestIntFromEnv(t *testing.T) {
+	var buf bytes.Buffer
+	logger := log.New(&buf, "", 0)
+
+	t.Setenv("TEST_INT", "32")
+	assert.Equal(t, 32, IntFromEnv("TEST_INT", 8, 1, logger))
+
+	t.Setenv("TEST_INT", "0")
+	assert.Equal(t, 8, IntFromEnv("TEST_INT", 8, 1, logger))
+
+	t.Setenv("TEST_INT", "lots")
+	assert.Equal(t, 8, IntFromEnv("TEST_INT", 8, 1, logger))
+
+	assert.Equal(t, "invalid TEST_INT 0, below 1, using 8\ninvalid TEST_INT \"lots\", using 8\n", buf.String())
+}
+
+func TestBoolFromEnv(t *testing.T) {
+	logger := log.New(&bytes.Buffer{}, "", 0)
+
+	t.Setenv("TEST_BOOL", "true")
+	assert.Equal(t, true, BoolFromEnv("TEST_BOOL", false, logger))
+
+	t.Setenv("TEST_BOOL", "maybe")
+	assert.Equal(t, false, BoolFromEnv("TEST_BOOL", false, logger))
+}
+
+func TestDurationFromEnv(t *testing.T) {
+	logger := log.New(&bytes.Buffer{}, "", 0)
+
+	assert.Equal(t, time.Minute, DurationFromEnv("TEST_DURATION", time.Minute, logger))
+
+	t.Setenv("TEST_DURATION", "5s")
+	assert.Equal(t, 5*time.Second, DurationFromEnv("TEST_DURATION", time.Minute, logger))
+
+	t.Setenv("TEST_DURATION", "0s")
+	assert.Equal(t, time.Minute, DurationFromEnv("TEST_DURATION", time.Minute, logger))
+
+	t.Setenv("TEST_DURATION", "soon")
+	assert.Equal(t, time.Minute, DurationFromEnv("TEST_DURATION", time.Minute, logger))
+}
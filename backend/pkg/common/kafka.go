@@ -2,12 +2,16 @@ package common
 
 import (
 	"context"
+	"fmt"
 
 	"github.com/segmentio/kafka-go"
 )
 
+// KafkaReader fetches messages without committing them. consumers commit once a
+// message has been processed so a crash means redelivery rather than loss.
 type KafkaReader interface {
-	ReadMessage(ctx context.Context) (kafka.Message, error)
+	FetchMessage(ctx context.Context) (kafka.Message, error)
+	CommitMessages(ctx context.Context, msgs ...kafka.Message) error
 	Close() error
 }
 
@@ -15,3 +19,8 @@ type KafkaWriter interface {
 	WriteMessages(ctx context.Context, msgs ...kafka.Message) error
 	Close() error
 }
+
+// MessageID uniquely identifies a message within the cluster
+func MessageID(msg kafka.Message) string {
+	return fmt.Sprintf("%s:%d:%d", msg.Topic, msg.Partition, msg.Offset)
+}
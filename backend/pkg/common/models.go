@@ -1,8 +1,11 @@
 package common
 
 import (
+	"fmt"
+	"slices"
 	"time"
 
+	"github.com/google/uuid"
 	_ "github.com/lib/pq"
 )
 
@@ -11,6 +14,11 @@ type LoginRequest struct {
 	Password string `json:"password"`
 }
 
+const (
+	RoleAdmin    = "admin"
+	RoleCustomer = "customer"
+)
+
 type User struct {
 	ID       int32    `json:"id"`
 	Username string   `json:"username"`
@@ -21,9 +29,14 @@ func (u *User) Valid() bool {
 	return u != nil && u.Username != "" && len(u.Roles) > 0
 }
 
+func (u *User) HasRole(role string) bool {
+	return u != nil && slices.Contains(u.Roles, role)
+}
+
 type PaymentRequest struct {
 	AppID           string    `json:"appId"`
 	SystemID        string    `json:"systemId,omitempty"`
+	UserID          int32     `json:"userId"`
 	Amount          int64     `json:"amount"`
 	SourceAccountID int32     `json:"sourceAccountId"`
 	TargetAccountID int32     `json:"targetAccountId"`
@@ -31,9 +44,11 @@ type PaymentRequest struct {
 }
 
 func (pr *PaymentRequest) Valid() bool {
-	// checks all fields populated and imposes arbitrary timeout
-	return pr.AppID != "" &&
+	// checks all fields populated and imposes arbitrary timeout.
+	// AppID is stored with the payment as a uuid.
+	return uuid.Validate(pr.AppID) == nil &&
 		pr.SystemID != "" &&
+		pr.UserID > 0 &&
 		pr.Amount > 0 &&
 		pr.SourceAccountID > 0 &&
 		pr.TargetAccountID > 0 &&
@@ -47,6 +62,8 @@ type Transaction struct {
 	Amount       int64
 	AccountID    int32
 	KafkaID      string
+	// TxID of the leg this transaction reverses, if it's a compensation
+	Compensates string `json:",omitempty"`
 }
 
 func (t *Transaction) Valid() bool {
@@ -55,13 +72,147 @@ func (t *Transaction) Valid() bool {
 		t.AccountID != 0
 }
 
+type TransactionLeg string
+
+const (
+	LegDebit        TransactionLeg = "DEBIT"
+	LegCredit       TransactionLeg = "CREDIT"
+	LegCompensation TransactionLeg = "COMPENSATION"
+)
+
+// Leg is which side of its payment the transaction is. a payment has at most one of each per account.
+func (t *Transaction) Leg() TransactionLeg {
+	if t.Compensates != "" {
+		return LegCompensation
+	}
+	if t.Amount < 0 {
+		return LegDebit
+	}
+	return LegCredit
+}
+
+// IdempotentID is the producer's TxID, or if not set one derived from the payment,
+// account and leg, so every delivery of the same transaction gets the same ID
+func (t *Transaction) IdempotentID() string {
+	if t.TxID != "" {
+		return t.TxID
+	}
+	name := fmt.Sprintf("%s:%d:%s", t.PaymentSysID, t.AccountID, t.Leg())
+	return uuid.NewSHA1(uuid.NameSpaceOID, []byte(name)).String()
+}
+
+type TxFailureReason string
+
+const (
+	TxFailureInvalid         TxFailureReason = "INVALID_TRANSACTION"
+	TxFailureAccountNotFound TxFailureReason = "ACCOUNT_NOT_FOUND"
+	TxFailureConflict        TxFailureReason = "TX_ID_CONFLICT"
+	// the debit would take the account past its overdraft limit
+	TxFailureInsufficientFunds TxFailureReason = "INSUFFICIENT_FUNDS"
+	// the account's balance doesn't match its ledger
+	TxFailureLedgerMismatch TxFailureReason = "LEDGER_MISMATCH"
+)
+
+// TransactionEvent is the outcome of a transaction leg, published by transaction-service on
+// transaction-completed or transaction-failed. Balance is only set for completed transactions
+// and Reason and Error only for failed ones.
+type TransactionEvent struct {
+	TxID         string         `json:"txId"`
+	PaymentSysID string         `json:"paymentSysId"`
+	AccountID    int32          `json:"accountId"`
+	Leg          TransactionLeg `json:"leg"`
+	Amount       int64          `json:"amount"`
+	// account balance after the transaction
+	Balance int64 `json:"balance"`
+	// kafka message the transaction was applied from, see MessageID
+	KafkaID   string          `json:"kafkaId"`
+	Reason    TxFailureReason `json:"reason,omitempty"`
+	Error     string          `json:"error,omitempty"`
+	Timestamp time.Time       `json:"timestamp"`
+}
+
+type PaymentEventType string
+
+const (
+	PaymentFailed PaymentEventType = "paymentFailed"
+)
+
+// PaymentFailedEvent is published on payment-failed by account-service when a payment fails its
+// checks, and by payment-service when one times out. AccountID is the payment's source account.
+type PaymentFailedEvent struct {
+	Type      PaymentEventType `json:"type"`
+	Reason    string           `json:"reason"`
+	AppID     string           `json:"appId"`
+	SystemID  string           `json:"systemId"`
+	AccountID int32            `json:"accountId"`
+	Timestamp time.Time        `json:"timestamp"`
+}
+
+// FromReq populates the event from the failed payment's request
+func (e *PaymentFailedEvent) FromReq(req *PaymentRequest) *PaymentFailedEvent {
+	e.AccountID = req.SourceAccountID
+	e.AppID = req.AppID
+	e.SystemID = req.SystemID
+	e.Timestamp = time.Now()
+	return e
+}
+
+// what changed about an account, other than its balance
+type AccountChange string
+
+const (
+	AccountCreated          AccountChange = "CREATED"
+	AccountHoldPlaced       AccountChange = "HOLD_PLACED"
+	AccountHoldReleased     AccountChange = "HOLD_RELEASED"
+	AccountOverdraftChanged AccountChange = "OVERDRAFT_CHANGED"
+)
+
+// published by account-service whenever it changes an account, so cached views of it can be dropped.
+// balance changes are published by transaction-service as TransactionEvents.
+type AccountChangedEvent struct {
+	AccountID int32         `json:"accountId"`
+	UserID    int32         `json:"userId"`
+	Change    AccountChange `json:"change"`
+	Timestamp time.Time     `json:"timestamp"`
+}
+
+// ledger accounts owned by the bank, see scripts/postgres-init
+const (
+	// the kind bank funding opening balances
+	SystemAccountOpeningBalances int32 = -1
+	// funds between the debit and credit legs of a transfer
+	SystemAccountInFlight int32 = -2
+)
+
+// Transfer moves Amount from the source to the target account, applied by transaction-service
+// as a debit and a credit leg. The source may be a system account, e.g. for the opening balance
+// of a user's first account.
+type Transfer struct {
+	PaymentSysID    string `json:"paymentSysId"`
+	SourceAccountID int32  `json:"sourceAccountId"`
+	TargetAccountID int32  `json:"targetAccountId"`
+	Amount          int64  `json:"amount"`
+}
+
+func (t *Transfer) Valid() bool {
+	return t.PaymentSysID != "" &&
+		t.Amount > 0 &&
+		t.TargetAccountID > 0 &&
+		t.SourceAccountID != 0 &&
+		t.SourceAccountID != t.TargetAccountID
+}
+
 type Account struct {
 	AccountID int32  `json:"accountId"`
 	Name      string `json:"name"`
 	UserID    int32  `json:"userId"`
 	Balance   int64  `json:"balance"`
-	BankID    int32  `json:"bankId"`
-	BankName  string `json:"bankName"`
+	// ledger balance less active holds
+	AvailableBalance int64 `json:"availableBalance"`
+	// how far below zero the balance may go
+	OverdraftLimit int64  `json:"overdraftLimit,omitempty"`
+	BankID         int32  `json:"bankId"`
+	BankName       string `json:"bankName"`
 }
 
 type Bank struct {
@@ -0,0 +1,69 @@
+package common
+
+import (
+	"testing"
+
+	"github.com/bmizerany/assert"
+)
+
+func TestTransactionIdempotentID(t *testing.T) {
+	debit := Transaction{PaymentSysID: "pay-1", AccountID: 1, Amount: -100}
+	credit := Transaction{PaymentSysID: "pay-1", AccountID: 2, Amount: 100}
+
+	assert.Equal(t, LegDebit, debit.Leg())
+	assert.Equal(t, LegCredit, credit.Leg())
+
+	// stable across deliveries
+	redelivered := debit
+	redelivered.KafkaID = "other-offset"
+	assert.Equal(t, debit.IdempotentID(), redelivered.IdempotentID())
+
+	assert.NotEqual(t, debit.IdempotentID(), credit.IdempotentID())
+
+	// both legs on the same account are distinct
+	selfCredit := Transaction{PaymentSysID: "pay-1", AccountID: 1, Amount: 100}
+	assert.NotEqual(t, debit.IdempotentID(), selfCredit.IdempotentID())
+
+	withID := Transaction{TxID: "given", PaymentSysID: "pay-1", AccountID: 1, Amount: 100}
+	assert.Equal(t, "given", withID.IdempotentID())
+}
+
+func TestTransactionCompensationLeg(t *testing.T) {
+	debit := Transaction{PaymentSysID: "pay-1", AccountID: 1, Amount: -100}
+	refund := Transaction{PaymentSysID: "pay-1", AccountID: 1, Amount: 100, Compensates: debit.IdempotentID()}
+
+	assert.Equal(t, LegCompensation, refund.Leg())
+	assert.NotEqual(t, debit.IdempotentID(), refund.IdempotentID())
+}
+
+func TestTransferValid(t *testing.T) {
+	tests := []struct {
+		name     string
+		transfer Transfer
+		want     bool
+	}{
+		{"valid", Transfer{PaymentSysID: "p", SourceAccountID: 1, TargetAccountID: 2, Amount: 10}, true},
+		{"system source", Transfer{PaymentSysID: "p", SourceAccountID: SystemAccountOpeningBalances, TargetAccountID: 2, Amount: 10}, true},
+		{"no source", Transfer{PaymentSysID: "p", TargetAccountID: 2, Amount: 10}, false},
+		{"system target", Transfer{PaymentSysID: "p", SourceAccountID: 1, TargetAccountID: SystemAccountInFlight, Amount: 10}, false},
+		{"no payment", Transfer{SourceAccountID: 1, TargetAccountID: 2, Amount: 10}, false},
+		{"no target", Transfer{PaymentSysID: "p", SourceAccountID: 1, Amount: 10}, false},
+		{"same account", Transfer{PaymentSysID: "p", SourceAccountID: 2, TargetAccountID: 2, Amount: 10}, false},
+		{"negative amount", Transfer{PaymentSysID: "p", SourceAccountID: 1, TargetAccountID: 2, Amount: -10}, false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			assert.Equal(t, tt.want, tt.transfer.Valid())
+		})
+	}
+}
+
+func TestUserHasRole(t *testing.T) {
+	user := &User{ID: 1, Username: "u", Roles: []string{RoleCustomer}}
+	assert.Equal(t, true, user.HasRole(RoleCustomer))
+	assert.Equal(t, false, user.HasRole(RoleAdmin))
+
+	var missing *User
+	assert.Equal(t, false, missing.HasRole(RoleAdmin))
+}
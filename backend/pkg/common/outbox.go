@@ -0,0 +1,163 @@
+package common
+
+import (
+	"context"
+	"database/sql"
+	"log"
+	"time"
+
+	"github.com/lib/pq"
+	"github.com/segmentio/kafka-go"
+)
+
+// an outbox table, one per owning schema. see scripts/postgres-init
+type OutboxTable string
+
+const (
+	OutboxTablePayments OutboxTable = "payments.outbox"
+	OutboxTableAccounts OutboxTable = "accounts.outbox"
+)
+
+// WriteOutbox stages kafka messages in the outbox as part of the caller's transaction,
+// so they are only published if the business rows are committed.
+func WriteOutbox(tx *sql.Tx, table OutboxTable, msgs ...kafka.Message) error {
+	for _, msg := range msgs {
+		_, err := tx.Exec(`
+			INSERT INTO `+string(table)+` (topic, key, value) VALUES ($1, $2, $3)
+		`, msg.Topic, msg.Key, msg.Value)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// OutboxRelay publishes staged outbox messages to kafka and marks them sent.
+// delivery is at-least-once: a crash between publishing and marking means the batch is sent again.
+type OutboxRelay struct {
+	db        *sql.DB
+	table     OutboxTable
+	writer    KafkaWriter
+	logger    *log.Logger
+	interval  time.Duration
+	batchSize int
+	retention time.Duration
+}
+
+func NewOutboxRelay(db *sql.DB, table OutboxTable, writer KafkaWriter, logger *log.Logger) *OutboxRelay {
+	return &OutboxRelay{
+		db:        db,
+		table:     table,
+		writer:    writer,
+		logger:    logger,
+		interval:  250 * time.Millisecond,
+		batchSize: 100,
+		retention: 24 * time.Hour,
+	}
+}
+
+// Run polls the outbox until the context is cancelled
+func (r *OutboxRelay) Run(ctx context.Context) {
+	r.logger.Printf("Outbox relay started for %s", r.table)
+	ticker := time.NewTicker(r.interval)
+	defer ticker.Stop()
+
+	lastPurge := time.Now()
+	for {
+		select {
+		case <-ctx.Done():
+			r.logger.Printf("Outbox relay stopped for %s", r.table)
+			return
+		case <-ticker.C:
+		}
+
+		// keep going while there's a backlog
+		for {
+			n, err := r.publishBatch(ctx)
+			if err != nil {
+				r.logger.Printf("outbox relay %s: %v", r.table, err)
+				break
+			}
+			if n < r.batchSize {
+				break
+			}
+		}
+
+		if time.Since(lastPurge) > time.Hour {
+			if err := r.purgeSent(); err != nil {
+				r.logger.Printf("outbox purge %s: %v", r.table, err)
+			}
+			lastPurge = time.Now()
+		}
+	}
+}
+
+// publishes the oldest unsent messages, returning how many were sent.
+// rows stay locked until marked so concurrent relays don't double publish.
+func (r *OutboxRelay) publishBatch(ctx context.Context) (int, error) {
+	tx, err := r.db.BeginTx(ctx, nil)
+	if err != nil {
+		return 0, err
+	}
+	defer tx.Rollback()
+
+	rows, err := tx.Query(`
+		SELECT id, topic, key, value FROM `+string(r.table)+`
+		WHERE sent_at IS NULL
+		ORDER BY id
+		LIMIT $1
+		FOR UPDATE SKIP LOCKED
+	`, r.batchSize)
+	if err != nil {
+		return 0, err
+	}
+
+	var (
+		ids  []int64
+		msgs []kafka.Message
+	)
+	for rows.Next() {
+		var (
+			id  int64
+			msg kafka.Message
+		)
+		if err := rows.Scan(&id, &msg.Topic, &msg.Key, &msg.Value); err != nil {
+			rows.Close()
+			return 0, err
+		}
+		ids = append(ids, id)
+		msgs = append(msgs, msg)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return 0, err
+	}
+
+	if len(msgs) == 0 {
+		return 0, nil
+	}
+
+	if err := r.writer.WriteMessages(ctx, msgs...); err != nil {
+		return 0, err
+	}
+
+	_, err = tx.Exec(`
+		UPDATE `+string(r.table)+` SET sent_at = now() WHERE id = ANY($1)
+	`, pq.Array(ids))
+	if err != nil {
+		return 0, err
+	}
+
+	if err := tx.Commit(); err != nil {
+		return 0, err
+	}
+	return len(msgs), nil
+}
+
+// removes sent messages older than the retention period
+func (r *OutboxRelay) purgeSent() error {
+	_, err := r.db.Exec(`
+		DELETE FROM `+string(r.table)+` WHERE sent_at < now() - make_interval(secs => $1)
+	`, r.retention.Seconds())
+	return err
+}
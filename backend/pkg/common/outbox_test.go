@@ -0,0 +1,128 @@
+package common
+
+import (
+	"context"
+	"errors"
+	"testing"
+
+	"github.com/DATA-DOG/go-sqlmock"
+	"github.com/segmentio/kafka-go"
+	tu "github.com/timkins666/distributed-playground/backend/pkg/testutils"
+)
+
+func TestWriteOutbox(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatalf("failed to create mock: %v", err)
+	}
+	defer db.Close()
+
+	msgs := []kafka.Message{
+		{Topic: "t1", Key: []byte("k1"), Value: []byte("v1")},
+		{Topic: "t2", Key: []byte("k2"), Value: []byte("v2")},
+	}
+
+	mock.ExpectBegin()
+	for _, m := range msgs {
+		mock.ExpectExec("INSERT INTO payments.outbox").
+			WithArgs(m.Topic, m.Key, m.Value).
+			WillReturnResult(sqlmock.NewResult(1, 1))
+	}
+	mock.ExpectCommit()
+
+	tx, _ := db.Begin()
+	if err := WriteOutbox(tx, OutboxTablePayments, msgs...); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	_ = tx.Commit()
+
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("unmet expectations: %v", err)
+	}
+}
+
+func TestOutboxRelayPublishBatch(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatalf("failed to create mock: %v", err)
+	}
+	defer db.Close()
+
+	writer := &tu.MockKafkaWriter{}
+	relay := NewOutboxRelay(db, OutboxTableAccounts, writer, AppLogger())
+
+	mock.ExpectBegin()
+	mock.ExpectQuery("SELECT id, topic, key, value FROM accounts.outbox").
+		WithArgs(relay.batchSize).
+		WillReturnRows(sqlmock.NewRows([]string{"id", "topic", "key", "value"}).
+			AddRow(1, "t1", []byte("k1"), []byte("v1")).
+			AddRow(2, "t2", []byte("k2"), []byte("v2")))
+	mock.ExpectExec("UPDATE accounts.outbox SET sent_at").
+		WillReturnResult(sqlmock.NewResult(0, 2))
+	mock.ExpectCommit()
+
+	n, err := relay.publishBatch(context.Background())
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if n != 2 || len(writer.Messages) != 2 {
+		t.Errorf("expected 2 messages published, got %d/%d", n, len(writer.Messages))
+	}
+	if writer.Messages[1].Topic != "t2" || string(writer.Messages[1].Value) != "v2" {
+		t.Errorf("unexpected message %+v", writer.Messages[1])
+	}
+
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("unmet expectations: %v", err)
+	}
+}
+
+func TestOutboxRelayPublishBatchWriteError(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatalf("failed to create mock: %v", err)
+	}
+	defer db.Close()
+
+	writer := &tu.MockKafkaWriter{WriteErr: errors.New("kafka down")}
+	relay := NewOutboxRelay(db, OutboxTableAccounts, writer, AppLogger())
+
+	// messages stay unsent for the next attempt
+	mock.ExpectBegin()
+	mock.ExpectQuery("SELECT id, topic, key, value FROM accounts.outbox").
+		WillReturnRows(sqlmock.NewRows([]string{"id", "topic", "key", "value"}).
+			AddRow(1, "t1", []byte("k1"), []byte("v1")))
+	mock.ExpectRollback()
+
+	if _, err := relay.publishBatch(context.Background()); err == nil {
+		t.Error("expected error")
+	}
+
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("unmet expectations: %v", err)
+	}
+}
+
+func TestOutboxRelayPublishBatchEmpty(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatalf("failed to create mock: %v", err)
+	}
+	defer db.Close()
+
+	writer := &tu.MockKafkaWriter{}
+	relay := NewOutboxRelay(db, OutboxTablePayments, writer, AppLogger())
+
+	mock.ExpectBegin()
+	mock.ExpectQuery("SELECT id, topic, key, value FROM payments.outbox").
+		WillReturnRows(sqlmock.NewRows([]string{"id", "topic", "key", "value"}))
+	mock.ExpectRollback()
+
+	n, err := relay.publishBatch(context.Background())
+	if err != nil || n != 0 {
+		t.Errorf("expected nothing published, got %d %v", n, err)
+	}
+	if len(writer.Messages) != 0 {
+		t.Error("expected no kafka writes")
+	}
+}
@@ -2,7 +2,14 @@ package common
 
 import (
 	"context"
+	"crypto/tls"
 	"fmt"
+	"log"
+	"os"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
 
 	"github.com/redis/go-redis/v9"
 )
@@ -12,25 +19,231 @@ type RedisEntityKey string
 var (
 	RedisKeyUser         RedisEntityKey = "user"
 	RedisKeyUserAccounts RedisEntityKey = "userAccounts"
+	RedisKeyIdempotency  RedisEntityKey = "idempotency"
+	RedisKeyBanks        RedisEntityKey = "banks"
+	RedisKeyRevokedToken RedisEntityKey = "revokedToken"
 )
 
 func RedisKey(entityKey RedisEntityKey, id string) string {
 	return fmt.Sprintf("%s:%s", entityKey, id)
 }
 
-func NewRedisClient() (*redis.Client, error) {
-	addr := "redis:6379" // TODO: env/pass in
-	client := redis.NewClient(&redis.Options{
-		Addr: addr,
-		// Password: "",
-		// DB:       0, // TODO: ??
-	})
+// how redis is deployed
+type RedisMode string
 
-	var err error
-	for i := 0; i < 10; i++ {
-		if err = client.Ping(context.Background()).Err(); err == nil {
-			return client, nil
+const (
+	RedisSingle   RedisMode = "single"
+	RedisSentinel RedisMode = "sentinel"
+	RedisCluster  RedisMode = "cluster"
+)
+
+const (
+	redisBackoffMin  = 100 * time.Millisecond
+	redisBackoffMax  = 5 * time.Second
+	redisPingTimeout = 2 * time.Second
+)
+
+// RedisConfig says how to reach redis, see LoadRedisConfig
+type RedisConfig struct {
+	Mode RedisMode
+	// the server, the sentinels or some of the cluster's nodes, as host:port
+	Addrs []string
+	// master monitored by the sentinels
+	MasterName string
+	Password   string
+	// database index, not supported by cluster
+	DB  int
+	TLS bool
+	// connections per node, 0 for the go-redis default
+	PoolSize int
+	// pings at startup before carrying on without redis
+	ConnectAttempts int
+	// time between health checks once started
+	HealthInterval time.Duration
+}
+
+// LoadRedisConfig reads the config from REDIS_MODE (single, sentinel or cluster), REDIS_ADDRS
+// (comma separated), REDIS_MASTER_NAME, REDIS_PASSWORD, REDIS_DB, REDIS_TLS, REDIS_POOL_SIZE,
+// REDIS_CONNECT_ATTEMPTS and REDIS_HEALTH_INTERVAL
+func LoadRedisConfig() (RedisConfig, error) {
+	c := RedisConfig{
+		Mode:            RedisMode(EnvOrDefault("REDIS_MODE", string(RedisSingle))),
+		MasterName:      EnvOrDefault("REDIS_MASTER_NAME", "mymaster"),
+		Password:        os.Getenv("REDIS_PASSWORD"),
+		ConnectAttempts: 5,
+		HealthInterval:  5 * time.Second,
+	}
+	for _, addr := range strings.Split(EnvOrDefault("REDIS_ADDRS", "redis:6379"), ",") {
+		if addr = strings.TrimSpace(addr); addr != "" {
+			c.Addrs = append(c.Addrs, addr)
 		}
 	}
-	return nil, fmt.Errorf("failed to ping redis: %s", err.Error())
+
+	logger := AppLogger()
+	c.DB = IntFromEnv("REDIS_DB", 0, 0, logger)
+	c.PoolSize = IntFromEnv("REDIS_POOL_SIZE", 0, 0, logger)
+	c.ConnectAttempts = IntFromEnv("REDIS_CONNECT_ATTEMPTS", c.ConnectAttempts, 1, logger)
+	c.TLS = BoolFromEnv("REDIS_TLS", false, logger)
+	c.HealthInterval = DurationFromEnv("REDIS_HEALTH_INTERVAL", c.HealthInterval, logger)
+
+	return c, c.validate()
+}
+
+func (c RedisConfig) validate() error {
+	switch c.Mode {
+	case RedisSingle:
+		if len(c.Addrs) != 1 {
+			return fmt.Errorf("single redis needs exactly one address, got %d", len(c.Addrs))
+		}
+	case RedisSentinel:
+		if len(c.Addrs) == 0 || c.MasterName == "" {
+			return fmt.Errorf("sentinel redis needs sentinel addresses and a master name")
+		}
+	case RedisCluster:
+		if len(c.Addrs) == 0 {
+			return fmt.Errorf("cluster redis needs at least one node address")
+		}
+		if c.DB != 0 {
+			return fmt.Errorf("cluster redis only has database 0")
+		}
+	default:
+		return fmt.Errorf("unknown redis mode %q", c.Mode)
+	}
+	return nil
+}
+
+// a client for the configured mode, which connects lazily
+func (c RedisConfig) newClient() redis.UniversalClient {
+	opts := &redis.UniversalOptions{
+		Addrs:      c.Addrs,
+		MasterName: c.MasterName,
+		Password:   c.Password,
+		DB:         c.DB,
+		PoolSize:   c.PoolSize,
+	}
+	if c.TLS {
+		opts.TLSConfig = &tls.Config{MinVersion: tls.VersionTLS12}
+	}
+
+	switch c.Mode {
+	case RedisSentinel:
+		return redis.NewFailoverClient(opts.Failover())
+	case RedisCluster:
+		return redis.NewClusterClient(opts.Cluster())
+	default:
+		return redis.NewClient(opts.Simple())
+	}
+}
+
+// Redis is a redis client whose connection is watched in the background. Client is nil while
+// redis is unreachable, so callers carry on without it and pick it back up once it's reachable,
+// including when it was down at startup.
+type Redis struct {
+	client   redis.UniversalClient
+	healthy  atomic.Bool
+	logger   *log.Logger
+	interval time.Duration
+
+	stop     chan struct{}
+	stopOnce sync.Once
+}
+
+// ConnectRedis pings redis until it answers, backing off between attempts, then watches it until
+// ctx is done or it's closed. it returns even if redis never answered.
+func ConnectRedis(ctx context.Context, config RedisConfig, logger *log.Logger) *Redis {
+	r := newRedis(config.newClient(), config.HealthInterval, logger)
+	if err := r.connect(ctx, config.ConnectAttempts); err != nil {
+		logger.Printf("redis unreachable, continuing without until it is: %v", err)
+	}
+
+	go r.monitor(ctx)
+	return r
+}
+
+func newRedis(client redis.UniversalClient, interval time.Duration, logger *log.Logger) *Redis {
+	return &Redis{
+		client:   client,
+		logger:   logger,
+		interval: interval,
+		stop:     make(chan struct{}),
+	}
+}
+
+// pings until redis answers or the attempts run out
+func (r *Redis) connect(ctx context.Context, attempts int) error {
+	backoff := redisBackoffMin
+	for attempt := 1; ; attempt++ {
+		err := r.ping(ctx)
+		if err == nil {
+			r.healthy.Store(true)
+			return nil
+		}
+		if attempt == attempts {
+			return fmt.Errorf("no answer after %d attempts: %w", attempt, err)
+		}
+
+		r.logger.Printf("redis ping %d failed, retrying in %s: %v", attempt, backoff, err)
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(backoff):
+		}
+		backoff = min(backoff*2, redisBackoffMax)
+	}
+}
+
+// Client is the redis client, or nil while redis is unreachable
+func (r *Redis) Client() redis.UniversalClient {
+	if r == nil || !r.healthy.Load() {
+		return nil
+	}
+	return r.client
+}
+
+// Healthy is whether redis answered the last health check
+func (r *Redis) Healthy() bool {
+	return r != nil && r.healthy.Load()
+}
+
+// Close stops watching and closes the client
+func (r *Redis) Close() error {
+	if r == nil {
+		return nil
+	}
+	r.stopOnce.Do(func() { close(r.stop) })
+	return r.client.Close()
+}
+
+func (r *Redis) monitor(ctx context.Context) {
+	ticker := time.NewTicker(r.interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-r.stop:
+			return
+		case <-ticker.C:
+			r.check(ctx)
+		}
+	}
+}
+
+// pings redis, attaching or detaching it if it has come back or gone away
+func (r *Redis) check(ctx context.Context) {
+	err := r.ping(ctx)
+	was := r.healthy.Swap(err == nil)
+	switch {
+	case err == nil && !was:
+		r.logger.Println("redis reachable, attaching")
+	case err != nil && was:
+		r.logger.Printf("redis unreachable, detaching: %v", err)
+	}
+}
+
+func (r *Redis) ping(ctx context.Context) error {
+	ctx, cancel := context.WithTimeout(ctx, redisPingTimeout)
+	defer cancel()
+	return r.client.Ping(ctx).Err()
 }
@@ -0,0 +1,261 @@
+package common
+
+import (
+	"bufio"
+	"context"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/bmizerany/assert"
+	"github.com/redis/go-redis/v9"
+)
+
+func TestLoadRedisConfigDefaults(t *testing.T) {
+	c, err := LoadRedisConfig()
+	assert.Equal(t, nil, err)
+	assert.Equal(t, RedisSingle, c.Mode)
+	assert.Equal(t, []string{"redis:6379"}, c.Addrs)
+	assert.Equal(t, 0, c.DB)
+	assert.Equal(t, false, c.TLS)
+	assert.Equal(t, 5, c.ConnectAttempts)
+	assert.Equal(t, 5*time.Second, c.HealthInterval)
+}
+
+func TestLoadRedisConfig(t *testing.T) {
+	t.Setenv("REDIS_MODE", "sentinel")
+	t.Setenv("REDIS_ADDRS", "s1:26379, s2:26379,")
+	t.Setenv("REDIS_MASTER_NAME", "primary")
+	t.Setenv("REDIS_PASSWORD", "secret")
+	t.Setenv("REDIS_DB", "2")
+	t.Setenv("REDIS_TLS", "true")
+	t.Setenv("REDIS_POOL_SIZE", "20")
+	t.Setenv("REDIS_CONNECT_ATTEMPTS", "3")
+	t.Setenv("REDIS_HEALTH_INTERVAL", "1s")
+
+	c, err := LoadRedisConfig()
+	assert.Equal(t, nil, err)
+	assert.Equal(t, RedisConfig{
+		Mode:            RedisSentinel,
+		Addrs:           []string{"s1:26379", "s2:26379"},
+		MasterName:      "primary",
+		Password:        "secret",
+		DB:              2,
+		TLS:             true,
+		PoolSize:        20,
+		ConnectAttempts: 3,
+		HealthInterval:  time.Second,
+	}, c)
+}
+
+func TestLoadRedisConfigInvalid(t *testing.T) {
+	tests := []map[string]string{
+		{"REDIS_MODE": "memcached"},
+		{"REDIS_ADDRS": "a:6379,b:6379"},
+		{"REDIS_MODE": "cluster", "REDIS_DB": "1"},
+	}
+
+	for _, env := range tests {
+		t.Run(strings.Join(mapKeys(env), ","), func(t *testing.T) {
+			for k, v := range env {
+				t.Setenv(k, v)
+			}
+			if _, err := LoadRedisConfig(); err == nil {
+				t.Errorf("expected error for %v", env)
+			}
+		})
+	}
+}
+
+func TestLoadRedisConfigFallback(t *testing.T) {
+	t.Setenv("REDIS_DB", "one")
+	t.Setenv("REDIS_POOL_SIZE", "-1")
+	t.Setenv("REDIS_TLS", "maybe")
+	t.Setenv("REDIS_CONNECT_ATTEMPTS", "0")
+	t.Setenv("REDIS_HEALTH_INTERVAL", "often")
+
+	c, err := LoadRedisConfig()
+	assert.Equal(t, nil, err)
+	assert.Equal(t, 0, c.DB)
+	assert.Equal(t, 0, c.PoolSize)
+	assert.Equal(t, false, c.TLS)
+	assert.Equal(t, 5, c.ConnectAttempts)
+	assert.Equal(t, 5*time.Second, c.HealthInterval)
+}
+
+func mapKeys(m map[string]string) []string {
+	var keys []string
+	for k := range m {
+		keys = append(keys, k)
+	}
+	return keys
+}
+
+func TestRedisConfigNewClient(t *testing.T) {
+	single := RedisConfig{Mode: RedisSingle, Addrs: []string{"a:6379"}}.newClient()
+	defer single.Close()
+	if _, ok := single.(*redis.Client); !ok {
+		t.Errorf("expected a single client, got %T", single)
+	}
+
+	cluster := RedisConfig{Mode: RedisCluster, Addrs: []string{"a:6379", "b:6379"}}.newClient()
+	defer cluster.Close()
+	if _, ok := cluster.(*redis.ClusterClient); !ok {
+		t.Errorf("expected a cluster client, got %T", cluster)
+	}
+}
+
+// answers PING with PONG and anything else with an error, enough for health checks
+// answers PING, and SET and EXISTS on an in memory keyspace without expiry
+type pongServer struct {
+	ln     net.Listener
+	mu     sync.Mutex
+	conns  []net.Conn
+	values map[string]string
+}
+
+func startPongServer(t *testing.T, addr string) *pongServer {
+	ln, err := net.Listen("tcp", addr)
+	if err != nil {
+		t.Fatalf("failed to listen: %v", err)
+	}
+	s := &pongServer{ln: ln, values: map[string]string{}}
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			s.mu.Lock()
+			s.conns = append(s.conns, conn)
+			s.mu.Unlock()
+			go s.serve(conn)
+		}
+	}()
+	return s
+}
+
+func (s *pongServer) serve(conn net.Conn) {
+	r := bufio.NewReader(conn)
+	for {
+		args, err := readCommand(r)
+		if err != nil {
+			return
+		}
+		if _, err := conn.Write([]byte(s.reply(args))); err != nil {
+			return
+		}
+	}
+}
+
+func (s *pongServer) reply(args []string) string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	switch strings.ToLower(args[0]) {
+	case "ping":
+		return "+PONG\r\n"
+	case "set":
+		s.values[args[1]] = args[2]
+		return "+OK\r\n"
+	case "exists":
+		n := 0
+		for _, key := range args[1:] {
+			if _, ok := s.values[key]; ok {
+				n++
+			}
+		}
+		return ":" + strconv.Itoa(n) + "\r\n"
+	}
+	return "-ERR unknown command\r\n"
+}
+
+// reads a RESP array of bulk strings
+func readCommand(r *bufio.Reader) ([]string, error) {
+	line, err := r.ReadString('\n')
+	if err != nil {
+		return nil, err
+	}
+	n, _ := strconv.Atoi(strings.TrimSpace(line[1:]))
+	args := make([]string, 0, n)
+	for range n {
+		if _, err := r.ReadString('\n'); err != nil {
+			return nil, err
+		}
+		arg, err := r.ReadString('\n')
+		if err != nil {
+			return nil, err
+		}
+		args = append(args, strings.TrimSuffix(arg, "\r\n"))
+	}
+	return args, nil
+}
+
+func (s *pongServer) stop() {
+	s.ln.Close()
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, c := range s.conns {
+		c.Close()
+	}
+}
+
+func TestConnectRedisUnreachable(t *testing.T) {
+	config := RedisConfig{
+		Mode:            RedisSingle,
+		Addrs:           []string{"127.0.0.1:1"},
+		ConnectAttempts: 2,
+		HealthInterval:  time.Hour,
+	}
+
+	rds := ConnectRedis(context.Background(), config, AppLogger())
+	defer rds.Close()
+
+	assert.Equal(t, false, rds.Healthy())
+	if rds.Client() != nil {
+		t.Error("expected no client while redis is unreachable")
+	}
+}
+
+func TestRedisAttachesAndDetaches(t *testing.T) {
+	// reserve an address, then free it so redis starts off unreachable
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	addr := ln.Addr().String()
+	ln.Close()
+
+	rds := newRedis(redis.NewClient(&redis.Options{Addr: addr, MaxRetries: -1}), time.Hour, AppLogger())
+	defer rds.Close()
+	ctx := context.Background()
+
+	rds.check(ctx)
+	assert.Equal(t, false, rds.Healthy())
+
+	server := startPongServer(t, addr)
+	rds.check(ctx)
+	assert.Equal(t, true, rds.Healthy())
+	if rds.Client() == nil {
+		t.Error("expected the client once redis is reachable")
+	}
+
+	server.stop()
+	rds.check(ctx)
+	assert.Equal(t, false, rds.Healthy())
+	if rds.Client() != nil {
+		t.Error("expected no client once redis is unreachable again")
+	}
+}
+
+func TestNilRedis(t *testing.T) {
+	var rds *Redis
+	assert.Equal(t, false, rds.Healthy())
+	assert.Equal(t, nil, rds.Close())
+	if rds.Client() != nil {
+		t.Error("expected no client")
+	}
+}
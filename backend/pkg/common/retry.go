@@ -0,0 +1,229 @@
+package common
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"strconv"
+	"time"
+
+	"github.com/segmentio/kafka-go"
+)
+
+// headers added to retried and dead lettered messages
+const (
+	HeaderOriginalTopic     = "x-original-topic"
+	HeaderOriginalPartition = "x-original-partition"
+	HeaderOriginalOffset    = "x-original-offset"
+	HeaderRetryAttempt      = "x-retry-attempt"
+	HeaderRetryAfter        = "x-retry-after"
+	HeaderError             = "x-error"
+	HeaderFailedAt          = "x-failed-at"
+)
+
+var retryHeaders = []string{
+	HeaderOriginalTopic, HeaderOriginalPartition, HeaderOriginalOffset,
+	HeaderRetryAttempt, HeaderRetryAfter, HeaderError, HeaderFailedAt,
+}
+
+// RetryPolicy is the delay before each retry tier. a message which fails on the last
+// tier is dead lettered.
+type RetryPolicy []time.Duration
+
+var DefaultRetryPolicy = RetryPolicy{5 * time.Second, 30 * time.Second, 2 * time.Minute}
+
+// Topics returns the retry tier topics for topic, in tier order
+func (p RetryPolicy) Topics(topic Topic) []Topic {
+	topics := make([]Topic, len(p))
+	for i := range p {
+		topics[i] = topic.Retry(i + 1)
+	}
+	return topics
+}
+
+// Readers returns a reader for each retry tier of topic. tiers get their own consumer groups,
+// named after groupID, so a delayed retry doesn't hold up new messages.
+func (p RetryPolicy) Readers(broker, groupID string, topic Topic) []KafkaReader {
+	var readers []KafkaReader
+	for i, t := range p.Topics(topic) {
+		readers = append(readers, kafka.NewReader(kafka.ReaderConfig{
+			Brokers: []string{broker},
+			GroupID: fmt.Sprintf("%s-retry-%d", groupID, i+1),
+			Topic:   t.S(),
+		}))
+	}
+	return readers
+}
+
+// WithRetry wraps a handler so failed messages are moved aside instead of blocking the partition.
+// retryable failures go to the next retry tier and poison messages, or those out of retries,
+// go to the dead letter topic. with an empty policy retryable failures are returned to be
+// retried in place. messages from retry tiers aren't handled until their delay has passed.
+func WithRetry(handler MessageHandler, policy RetryPolicy, writer KafkaWriter, logger *log.Logger) MessageHandler {
+	return func(ctx context.Context, msg kafka.Message) error {
+		if err := waitUntilDue(ctx, msg); err != nil {
+			return err
+		}
+
+		err := handler(ctx, msg)
+		if err == nil {
+			return nil
+		}
+
+		attempt := retryAttempt(msg)
+		if !errors.Is(err, ErrUnprocessable) {
+			if len(policy) == 0 {
+				return err
+			}
+			if attempt < len(policy) {
+				return forward(ctx, msg, err, attempt+1, policy[attempt], writer, logger)
+			}
+		}
+		return deadLetter(ctx, msg, err, writer, logger)
+	}
+}
+
+// publishes msg to the retry tier for the given attempt
+func forward(ctx context.Context, msg kafka.Message, cause error, attempt int, delay time.Duration,
+	writer KafkaWriter, logger *log.Logger) error {
+
+	topic := OriginalTopic(msg).Retry(attempt)
+	out := failedCopy(msg, topic, cause)
+	out.Headers = setHeader(out.Headers, HeaderRetryAttempt, strconv.Itoa(attempt))
+	out.Headers = setHeader(out.Headers, HeaderRetryAfter, time.Now().Add(delay).UTC().Format(time.RFC3339Nano))
+
+	if err := writer.WriteMessages(ctx, out); err != nil {
+		// deliberately not wrapping cause, the message must be retried rather than dropped
+		return fmt.Errorf("failed to forward %s to %s: %v", MessageID(msg), topic, err)
+	}
+	logger.Printf("message %s failed, retrying on %s in %s: %v", MessageID(msg), topic, delay, cause)
+	return nil
+}
+
+// publishes msg to the dead letter topic for its original topic
+func deadLetter(ctx context.Context, msg kafka.Message, cause error, writer KafkaWriter, logger *log.Logger) error {
+	topic := OriginalTopic(msg).DLQ()
+	out := failedCopy(msg, topic, cause)
+
+	if err := writer.WriteMessages(ctx, out); err != nil {
+		return fmt.Errorf("failed to dead letter %s: %v", MessageID(msg), err)
+	}
+	logger.Printf("message %s dead lettered on %s: %v", MessageID(msg), topic, cause)
+	return nil
+}
+
+// copies msg for topic, keeping its original headers and recording where it came from and why it failed
+func failedCopy(msg kafka.Message, topic Topic, cause error) kafka.Message {
+	headers := append([]kafka.Header{}, msg.Headers...)
+
+	// the first failure is where the message originated
+	if header(msg, HeaderOriginalTopic) == "" {
+		headers = setHeader(headers, HeaderOriginalTopic, msg.Topic)
+		headers = setHeader(headers, HeaderOriginalPartition, strconv.Itoa(msg.Partition))
+		headers = setHeader(headers, HeaderOriginalOffset, strconv.FormatInt(msg.Offset, 10))
+	}
+	headers = setHeader(headers, HeaderError, cause.Error())
+	headers = setHeader(headers, HeaderFailedAt, time.Now().UTC().Format(time.RFC3339Nano))
+
+	return kafka.Message{
+		Topic:   topic.S(),
+		Key:     msg.Key,
+		Value:   msg.Value,
+		Headers: headers,
+	}
+}
+
+func waitUntilDue(ctx context.Context, msg kafka.Message) error {
+	due, err := time.Parse(time.RFC3339Nano, header(msg, HeaderRetryAfter))
+	if err != nil {
+		return nil
+	}
+
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-time.After(time.Until(due)):
+		return nil
+	}
+}
+
+// OriginalTopic is the topic msg was first published to, before any retries
+func OriginalTopic(msg kafka.Message) Topic {
+	if t := header(msg, HeaderOriginalTopic); t != "" {
+		return Topic(t)
+	}
+	return Topic(msg.Topic)
+}
+
+func retryAttempt(msg kafka.Message) int {
+	n, _ := strconv.Atoi(header(msg, HeaderRetryAttempt))
+	return n
+}
+
+// DeadLetter describes why a message ended up on a dead letter topic
+type DeadLetter struct {
+	Message       kafka.Message
+	OriginalTopic Topic
+	Partition     string
+	Offset        string
+	Attempts      int
+	Error         string
+	FailedAt      string
+}
+
+func ParseDeadLetter(msg kafka.Message) DeadLetter {
+	return DeadLetter{
+		Message:       msg,
+		OriginalTopic: OriginalTopic(msg),
+		Partition:     header(msg, HeaderOriginalPartition),
+		Offset:        header(msg, HeaderOriginalOffset),
+		Attempts:      retryAttempt(msg) + 1,
+		Error:         header(msg, HeaderError),
+		FailedAt:      header(msg, HeaderFailedAt),
+	}
+}
+
+// Replay returns the message as originally published, ready to send back to its source topic
+func (d DeadLetter) Replay() kafka.Message {
+	var headers []kafka.Header
+	for _, h := range d.Message.Headers {
+		if !isRetryHeader(h.Key) {
+			headers = append(headers, h)
+		}
+	}
+	return kafka.Message{
+		Topic:   d.OriginalTopic.S(),
+		Key:     d.Message.Key,
+		Value:   d.Message.Value,
+		Headers: headers,
+	}
+}
+
+func isRetryHeader(key string) bool {
+	for _, h := range retryHeaders {
+		if h == key {
+			return true
+		}
+	}
+	return false
+}
+
+func header(msg kafka.Message, key string) string {
+	for _, h := range msg.Headers {
+		if h.Key == key {
+			return string(h.Value)
+		}
+	}
+	return ""
+}
+
+func setHeader(headers []kafka.Header, key, value string) []kafka.Header {
+	for i, h := range headers {
+		if h.Key == key {
+			headers[i].Value = []byte(value)
+			return headers
+		}
+	}
+	return append(headers, kafka.Header{Key: key, Value: []byte(value)})
+}
@@ -0,0 +1,144 @@
+package common
+
+import (
+	"context"
+	"errors"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/bmizerany/assert"
+	"github.com/segmentio/kafka-go"
+	tu "github.com/timkins666/distributed-playground/backend/pkg/testutils"
+)
+
+func TestWithRetry(t *testing.T) {
+	policy := RetryPolicy{time.Second, time.Minute}
+	source := kafka.Message{
+		Topic:     "orders",
+		Partition: 2,
+		Offset:    7,
+		Value:     []byte("v"),
+		Headers:   []kafka.Header{{Key: "trace", Value: []byte("abc")}},
+	}
+
+	tests := []struct {
+		name      string
+		msg       kafka.Message
+		err       error
+		wantTopic string
+		wantErr   bool
+	}{
+		{name: "success", msg: source},
+		{name: "first failure", msg: source, err: errors.New("db down"), wantTopic: "orders.retry.1"},
+		{
+			name:      "failed retry",
+			msg:       retried(source, 1),
+			err:       errors.New("db down"),
+			wantTopic: "orders.retry.2",
+		},
+		{
+			name: "out of retries",
+			msg: kafka.Message{Topic: "orders.retry.2", Headers: []kafka.Header{
+				{Key: HeaderOriginalTopic, Value: []byte("orders")},
+				{Key: HeaderRetryAttempt, Value: []byte("2")},
+			}},
+			err:       errors.New("db down"),
+			wantTopic: "orders.dlq",
+		},
+		{name: "poison", msg: source, err: Unprocessable(errors.New("bad json")), wantTopic: "orders.dlq"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			writer := &tu.MockKafkaWriter{}
+			handler := WithRetry(func(context.Context, kafka.Message) error { return tt.err }, policy, writer, AppLogger())
+
+			err := handler(context.Background(), tt.msg)
+			assert.Equal(t, nil, err)
+
+			if tt.wantTopic == "" {
+				assert.Equal(t, 0, len(writer.Messages))
+				return
+			}
+			assert.Equal(t, 1, len(writer.Messages))
+			out := writer.Messages[0]
+			assert.Equal(t, tt.wantTopic, out.Topic)
+			assert.Equal(t, "orders", header(out, HeaderOriginalTopic))
+			assert.Equal(t, tt.err.Error(), header(out, HeaderError))
+		})
+	}
+}
+
+// source as it would be consumed from the given retry tier
+func retried(source kafka.Message, tier int) kafka.Message {
+	msg := failedCopy(source, Topic(source.Topic).Retry(tier), errors.New("db down"))
+	msg.Headers = setHeader(msg.Headers, HeaderRetryAttempt, strconv.Itoa(tier))
+	return msg
+}
+
+func TestWithRetryNoPolicyRetriesInPlace(t *testing.T) {
+	writer := &tu.MockKafkaWriter{}
+	handler := WithRetry(func(context.Context, kafka.Message) error {
+		return errors.New("db down")
+	}, nil, writer, AppLogger())
+
+	err := handler(context.Background(), kafka.Message{Topic: "orders"})
+	assert.NotEqual(t, nil, err)
+	assert.Equal(t, 0, len(writer.Messages))
+}
+
+func TestWithRetryForwardFailureIsRetryable(t *testing.T) {
+	writer := &tu.MockKafkaWriter{WriteErr: errors.New("kafka down")}
+	handler := WithRetry(func(context.Context, kafka.Message) error {
+		return Unprocessable(errors.New("bad json"))
+	}, DefaultRetryPolicy, writer, AppLogger())
+
+	// must not be committed as the dead letter wasn't written
+	err := handler(context.Background(), kafka.Message{Topic: "orders"})
+	assert.NotEqual(t, nil, err)
+	assert.Equal(t, false, errors.Is(err, ErrUnprocessable))
+}
+
+func TestWithRetryWaitsUntilDue(t *testing.T) {
+	msg := kafka.Message{Topic: "orders.retry.1", Headers: []kafka.Header{
+		{Key: HeaderRetryAfter, Value: []byte(time.Now().Add(time.Hour).Format(time.RFC3339Nano))},
+	}}
+
+	called := false
+	handler := WithRetry(func(context.Context, kafka.Message) error {
+		called = true
+		return nil
+	}, DefaultRetryPolicy, &tu.MockKafkaWriter{}, AppLogger())
+
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+	defer cancel()
+
+	err := handler(ctx, msg)
+	assert.Equal(t, context.DeadlineExceeded, err)
+	assert.Equal(t, false, called)
+}
+
+func TestDeadLetterReplay(t *testing.T) {
+	source := kafka.Message{
+		Topic:     "orders",
+		Partition: 1,
+		Offset:    42,
+		Key:       []byte("k"),
+		Value:     []byte("v"),
+		Headers:   []kafka.Header{{Key: "trace", Value: []byte("abc")}},
+	}
+	dlq := failedCopy(source, Topic("orders").DLQ(), errors.New("bad json"))
+
+	dl := ParseDeadLetter(dlq)
+	assert.Equal(t, Topic("orders"), dl.OriginalTopic)
+	assert.Equal(t, "1", dl.Partition)
+	assert.Equal(t, "42", dl.Offset)
+	assert.Equal(t, "bad json", dl.Error)
+
+	replay := dl.Replay()
+	assert.Equal(t, "orders", replay.Topic)
+	assert.Equal(t, source.Key, replay.Key)
+	assert.Equal(t, source.Value, replay.Value)
+	assert.Equal(t, source.Headers, replay.Headers)
+}
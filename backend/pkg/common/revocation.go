@@ -0,0 +1,73 @@
+package common
+
+import (
+	"context"
+	"errors"
+	"log"
+	"sync/atomic"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+)
+
+// RevocationList holds the ids of access tokens revoked before they expire, in redis so
+// every service sees them. entries expire with their tokens.
+type RevocationList struct {
+	redis  *Redis
+	logger *log.Logger
+	// unix nanos of the last time a failed check was logged
+	lastFailLog atomic.Int64
+}
+
+var errRevocationUnavailable = errors.New("revocation list unavailable, redis unreachable")
+
+// failed checks are logged at most this often, every request fails while redis is away
+const revocationFailLogInterval = 30 * time.Second
+
+func NewRevocationList(rds *Redis, logger *log.Logger) *RevocationList {
+	return &RevocationList{redis: rds, logger: logger}
+}
+
+// Revoke adds the tokens to the list. tokens that have already expired are skipped.
+func (l *RevocationList) Revoke(ctx context.Context, tokens ...AccessToken) error {
+	client := l.redis.Client()
+	if client == nil {
+		return errRevocationUnavailable
+	}
+
+	now := time.Now()
+	_, err := client.Pipelined(ctx, func(p redis.Pipeliner) error {
+		for _, t := range tokens {
+			if ttl := t.ExpiresAt.Sub(now); t.ID != "" && ttl > 0 {
+				p.Set(ctx, RedisKey(RedisKeyRevokedToken, t.ID), 1, ttl)
+			}
+		}
+		return nil
+	})
+	return err
+}
+
+// Revoked reports whether the token with the id has been revoked. a nil list has no
+// entries.
+func (l *RevocationList) Revoked(ctx context.Context, id string) (bool, error) {
+	if l == nil {
+		return false, nil
+	}
+	client := l.redis.Client()
+	if client == nil {
+		return false, errRevocationUnavailable
+	}
+
+	n, err := client.Exists(ctx, RedisKey(RedisKeyRevokedToken, id)).Result()
+	return n > 0, err
+}
+
+// logs a failed check unless one was logged within revocationFailLogInterval
+func (l *RevocationList) logUnavailable(err error) {
+	now := time.Now().UnixNano()
+	last := l.lastFailLog.Load()
+	if now-last < int64(revocationFailLogInterval) || !l.lastFailLog.CompareAndSwap(last, now) {
+		return
+	}
+	l.logger.Printf("Failed checking token revocation, accepting tokens unchecked: %v", err)
+}
@@ -0,0 +1,111 @@
+package common
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/bmizerany/assert"
+	"github.com/redis/go-redis/v9"
+)
+
+// a Redis attached to a pongServer
+func attachedRedis(t *testing.T) (*Redis, *pongServer) {
+	t.Helper()
+	server := startPongServer(t, "127.0.0.1:0")
+	t.Cleanup(server.stop)
+
+	rds := newRedis(redis.NewClient(&redis.Options{Addr: server.ln.Addr().String(), MaxRetries: -1}), time.Hour, AppLogger())
+	t.Cleanup(func() { rds.Close() })
+	rds.check(context.Background())
+	if !rds.Healthy() {
+		t.Fatal("redis not attached")
+	}
+	return rds, server
+}
+
+func TestRevocationList(t *testing.T) {
+	rds, server := attachedRedis(t)
+	l := NewRevocationList(rds, AppLogger())
+	ctx := context.Background()
+
+	live := NewAccessToken()
+	expired := AccessToken{ID: "expired", ExpiresAt: time.Now().Add(-time.Second)}
+	assert.Equal(t, nil, l.Revoke(ctx, live, expired))
+
+	revoked, err := l.Revoked(ctx, live.ID)
+	assert.Equal(t, nil, err)
+	assert.Equal(t, true, revoked)
+
+	revoked, err = l.Revoked(ctx, NewAccessToken().ID)
+	assert.Equal(t, nil, err)
+	assert.Equal(t, false, revoked)
+
+	if _, ok := server.values[RedisKey(RedisKeyRevokedToken, expired.ID)]; ok {
+		t.Error("expired token should not be stored")
+	}
+}
+
+func TestRevocationListUnavailable(t *testing.T) {
+	l := NewRevocationList(nil, AppLogger())
+	ctx := context.Background()
+
+	if err := l.Revoke(ctx, NewAccessToken()); !errors.Is(err, errRevocationUnavailable) {
+		t.Errorf("expected errRevocationUnavailable, got %v", err)
+	}
+	if _, err := l.Revoked(ctx, "id"); !errors.Is(err, errRevocationUnavailable) {
+		t.Errorf("expected errRevocationUnavailable, got %v", err)
+	}
+
+	var nilList *RevocationList
+	revoked, err := nilList.Revoked(ctx, "id")
+	assert.Equal(t, nil, err)
+	assert.Equal(t, false, revoked)
+}
+
+func TestSetUserIDMiddlewareRejectsRevoked(t *testing.T) {
+	rds, _ := attachedRedis(t)
+	l := NewRevocationList(rds, AppLogger())
+
+	access := NewAccessToken()
+	token, _ := access.Sign(&User{ID: 123})
+	request := func() int {
+		r := httptest.NewRequest(http.MethodGet, "/", nil)
+		r.Header.Add(authHeader, authHeaderPrefix+token)
+		rec := httptest.NewRecorder()
+		SetUserIDMiddleware(l)(func(w http.ResponseWriter, r *http.Request) {})(rec, r)
+		return rec.Code
+	}
+
+	assert.Equal(t, http.StatusOK, request())
+
+	assert.Equal(t, nil, l.Revoke(context.Background(), access))
+	assert.Equal(t, http.StatusUnauthorized, request())
+}
+
+func TestSetUserIDMiddlewareRevocationUnavailable(t *testing.T) {
+	var buf bytes.Buffer
+	l := NewRevocationList(nil, log.New(&buf, "", 0))
+
+	token, _ := CreateUserToken(&User{ID: 123})
+	request := func() int {
+		r := httptest.NewRequest(http.MethodGet, "/", nil)
+		r.Header.Add(authHeader, authHeaderPrefix+token)
+		rec := httptest.NewRecorder()
+		SetUserIDMiddleware(l)(func(w http.ResponseWriter, r *http.Request) {})(rec, r)
+		return rec.Code
+	}
+
+	// fails open, the token still expires
+	assert.Equal(t, http.StatusOK, request())
+	assert.Equal(t, http.StatusOK, request())
+
+	// logged once, not on every request
+	assert.Equal(t, 1, strings.Count(buf.String(), "\n"))
+}
@@ -1,5 +1,7 @@
 package common
 
+import "fmt"
+
 // defines grouped immutable topic constants, probably not very idiomatic
 
 type Topic string
@@ -19,8 +21,8 @@ func (t *topics) PaymentVerified() Topic {
 func (t *topics) PaymentFailed() Topic {
 	return "payment-failed"
 }
-func (t *topics) TransactionRequested() Topic {
-	return "transaction-requested"
+func (t *topics) TransferRequested() Topic {
+	return "transfer-requested"
 }
 func (t *topics) TransactionComplete() Topic {
 	return "transaction-completed"
@@ -28,5 +30,21 @@ func (t *topics) TransactionComplete() Topic {
 func (t *topics) TransactionFailed() Topic {
 	return "transaction-failed"
 }
+func (t *topics) AccountChanged() Topic {
+	return "account-changed"
+}
+func (t *topics) ReconciliationBreaks() Topic {
+	return "reconciliation-breaks"
+}
 
 var Topics = topics{}
+
+// Retry is the topic for the given retry tier of t, starting at 1
+func (t Topic) Retry(tier int) Topic {
+	return Topic(fmt.Sprintf("%s.retry.%d", t, tier))
+}
+
+// DLQ is the dead letter topic for t
+func (t Topic) DLQ() Topic {
+	return t + ".dlq"
+}
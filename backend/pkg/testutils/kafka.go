@@ -3,6 +3,7 @@ package testutils
 import (
 	"context"
 	"errors"
+	"sync"
 
 	"github.com/segmentio/kafka-go"
 )
@@ -32,21 +33,73 @@ func (m *MockKafkaWriter) Close() error {
 	return nil
 }
 
-// MockKafkaReader is a mock implementation of the Kafka reader for testing
+// MockKafkaReader is a mock implementation of the Kafka reader for testing.
+// Messages are fetched in order from a single partition, once they run out fetching
+// blocks until ctx is done. Restart simulates a consumer crash.
 type MockKafkaReader struct {
-	Messages []kafka.Message
-	Closed   bool
+	Messages  []kafka.Message
+	Committed []kafka.Message
+	FetchErr  error
+	CommitErr error
+	Closed    bool
+
+	mu   sync.Mutex
+	next int
 }
 
-func (m *MockKafkaReader) ReadMessage(ctx context.Context) (kafka.Message, error) {
+func (m *MockKafkaReader) FetchMessage(ctx context.Context) (kafka.Message, error) {
+	m.mu.Lock()
 	if m.Closed {
+		m.mu.Unlock()
 		return kafka.Message{}, errors.New("reader has been closed")
 	}
+	if m.FetchErr != nil {
+		m.mu.Unlock()
+		return kafka.Message{}, m.FetchErr
+	}
+	if m.next < len(m.Messages) {
+		msg := m.Messages[m.next]
+		m.next++
+		m.mu.Unlock()
+		return msg, nil
+	}
+	m.mu.Unlock()
+
+	<-ctx.Done()
+	return kafka.Message{}, ctx.Err()
+}
+
+func (m *MockKafkaReader) CommitMessages(ctx context.Context, msgs ...kafka.Message) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
 
-	return m.Messages[0], nil
+	if m.CommitErr != nil {
+		return m.CommitErr
+	}
+	m.Committed = append(m.Committed, msgs...)
+	return nil
+}
+
+// Restart rewinds to the message after the last commit, as a new consumer would
+func (m *MockKafkaReader) Restart() {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	m.next = 0
+	if len(m.Committed) == 0 {
+		return
+	}
+	last := m.Committed[len(m.Committed)-1]
+	for i, msg := range m.Messages {
+		if msg.Offset == last.Offset {
+			m.next = i + 1
+		}
+	}
 }
 
 func (m *MockKafkaReader) Close() error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
 	m.Closed = true
 	return nil
 }
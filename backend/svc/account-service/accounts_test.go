@@ -8,8 +8,10 @@ import (
 	"net/http"
 	"net/http/httptest"
 	"testing"
+	"time"
 
 	"github.com/bmizerany/assert"
+	"github.com/segmentio/kafka-go"
 	cmn "github.com/timkins666/distributed-playground/backend/pkg/common"
 	tu "github.com/timkins666/distributed-playground/backend/pkg/testutils"
 )
@@ -18,16 +20,22 @@ type MockAccDB struct {
 	users    map[int32]cmn.User
 	accounts map[int32]cmn.Account
 	payments []cmn.PaymentRequest
+	outbox   []kafka.Message
+	holds    map[string]cmn.Account // payment id -> held account id and amount
+	history  []HistoryEntry
+	// the last history query asked for
+	historyQuery *HistoryQuery
 }
 
 func NewMockAccDB() *MockAccDB {
 	return &MockAccDB{
 		users:    make(map[int32]cmn.User),
 		accounts: make(map[int32]cmn.Account),
+		holds:    make(map[string]cmn.Account),
 	}
 }
 
-func (m *MockAccDB) getUserByID(userID int32) (*cmn.User, error) {
+func (m *MockAccDB) getUserByID(_ context.Context, userID int32) (*cmn.User, error) {
 	user, ok := m.users[userID]
 	if !ok {
 		return nil, fmt.Errorf("user %d not set up", userID)
@@ -35,7 +43,15 @@ func (m *MockAccDB) getUserByID(userID int32) (*cmn.User, error) {
 	return &user, nil
 }
 
-func (m *MockAccDB) getUserAccounts(userID int32) ([]cmn.Account, error) {
+func (m *MockAccDB) getUserFromDB(ctx context.Context, userID int32) (*cmn.User, error) {
+	return m.getUserByID(ctx, userID)
+}
+
+func (m *MockAccDB) getBanks(_ context.Context) ([]*cmn.Bank, error) {
+	return []*cmn.Bank{{Name: "BankOfTim", ID: 1}}, nil
+}
+
+func (m *MockAccDB) getUserAccounts(_ context.Context, userID int32) ([]cmn.Account, error) {
 	var accounts []cmn.Account
 	for _, acc := range m.accounts {
 		if acc.UserID == userID {
@@ -45,7 +61,7 @@ func (m *MockAccDB) getUserAccounts(userID int32) ([]cmn.Account, error) {
 	return accounts, nil
 }
 
-func (m *MockAccDB) getAccountByID(accountID int32) (*cmn.Account, error) {
+func (m *MockAccDB) getAccountByID(_ context.Context, accountID int32) (*cmn.Account, error) {
 	acc, ok := m.accounts[accountID]
 	if !ok {
 		return nil, cmn.ErrAccountNotFound
@@ -53,13 +69,60 @@ func (m *MockAccDB) getAccountByID(accountID int32) (*cmn.Account, error) {
 	return &acc, nil
 }
 
-func (m *MockAccDB) createAccount(a cmn.Account) (int32, error) {
+func (m *MockAccDB) createAccount(_ context.Context, a cmn.Account, events accountEvents) (int32, error) {
 	id := int32(len(m.accounts) + 1)
+	msgs, err := events(id)
+	if err != nil {
+		return 0, err
+	}
 	a.AccountID = id
 	m.accounts[id] = a
+	m.outbox = append(m.outbox, msgs...)
 	return id, nil
 }
 
+func (m *MockAccDB) placeHold(_ context.Context, accountID, userID int32, paymentSysID string, amount int64, ttl time.Duration) (int64, error) {
+	acc, ok := m.accounts[accountID]
+	if !ok {
+		return 0, cmn.ErrAccountNotFound
+	}
+	if acc.UserID != userID {
+		return 0, errNotAccountOwner
+	}
+	available := acc.Balance + acc.OverdraftLimit
+	for id, h := range m.holds {
+		if h.AccountID == accountID && id != paymentSysID {
+			available -= h.Balance
+		}
+	}
+	if available < amount {
+		return available, errInsufficientFunds
+	}
+	m.holds[paymentSysID] = cmn.Account{AccountID: accountID, Balance: amount}
+	return available, nil
+}
+
+func (m *MockAccDB) releaseHold(_ context.Context, paymentSysID string) (bool, error) {
+	_, ok := m.holds[paymentSysID]
+	delete(m.holds, paymentSysID)
+	return ok, nil
+}
+
+func (m *MockAccDB) setOverdraftLimit(_ context.Context, accountID int32, limit int64) (*cmn.Account, error) {
+	acc, ok := m.accounts[accountID]
+	if !ok {
+		return nil, cmn.ErrAccountNotFound
+	}
+	acc.OverdraftLimit = limit
+	m.accounts[accountID] = acc
+	return &acc, nil
+}
+
+func (m *MockAccDB) getTransactionHistory(_ context.Context, q *HistoryQuery) (*HistoryPage, error) {
+	m.historyQuery = q
+	return &HistoryPage{Transactions: m.history}, nil
+}
+
 // getTestService creates a test app with mock dependencies
 func getTestService() Service {
 	mockDB := NewMockAccDB()
@@ -75,12 +138,13 @@ func getTestService() Service {
 
 	// Add test account
 	mockDB.accounts[1] = cmn.Account{
-		AccountID: 1,
-		Name:      "Test Account",
-		UserID:    1,
-		Balance:   1000,
-		BankID:    1,
-		BankName:  "BankOfTim",
+		AccountID:        1,
+		Name:             "Test Account",
+		UserID:           1,
+		Balance:          1000,
+		AvailableBalance: 1000,
+		BankID:           1,
+		BankName:         "BankOfTim",
 	}
 
 	return Service{
@@ -91,7 +155,6 @@ func getTestService() Service {
 			payReqReader: &mockReader,
 			writer:       &mockWriter,
 		},
-		banks: []*cmn.Bank{{Name: "BankOfTim", ID: 1}},
 	}
 }
 
@@ -218,7 +281,7 @@ func TestCreateUserAccountHandler(t *testing.T) {
 		userID         int32
 		request        CreateAccountRequest
 		expectedStatus int
-		checkResponse  func(t *testing.T, resp []byte, mockWriter *tu.MockKafkaWriter)
+		checkResponse  func(t *testing.T, resp []byte, outbox []kafka.Message)
 	}{
 		{
 			name:   "new user first account",
@@ -227,14 +290,22 @@ func TestCreateUserAccountHandler(t *testing.T) {
 				Name: "First Account",
 			},
 			expectedStatus: http.StatusCreated,
-			checkResponse: func(t *testing.T, resp []byte, mockWriter *tu.MockKafkaWriter) {
+			checkResponse: func(t *testing.T, resp []byte, outbox []kafka.Message) {
 				var accounts []cmn.Account
 				err := json.Unmarshal(resp, &accounts)
 				assert.Equal(t, nil, err)
 				assert.Equal(t, 1, len(accounts))
 				assert.Equal(t, "First Account", accounts[0].Name)
 				assert.Equal(t, int32(2), accounts[0].UserID)
-				assert.Equal(t, 1, len(mockWriter.Messages))
+				assert.Equal(t, 1, len(outbox))
+
+				// opening balance comes from the bank
+				assert.Equal(t, cmn.Topics.TransferRequested().S(), outbox[0].Topic)
+				transfer, err := cmn.FromBytes[cmn.Transfer](outbox[0].Value)
+				assert.Equal(t, nil, err)
+				assert.Equal(t, cmn.SystemAccountOpeningBalances, transfer.SourceAccountID)
+				assert.Equal(t, accounts[0].AccountID, transfer.TargetAccountID)
+				assert.Equal(t, accounts[0].Balance, transfer.Amount)
 			},
 		},
 		{
@@ -246,7 +317,7 @@ func TestCreateUserAccountHandler(t *testing.T) {
 				InitialBalance:       500,
 			},
 			expectedStatus: http.StatusCreated,
-			checkResponse: func(t *testing.T, resp []byte, mockWriter *tu.MockKafkaWriter) {
+			checkResponse: func(t *testing.T, resp []byte, outbox []kafka.Message) {
 				var accounts []cmn.Account
 				err := json.Unmarshal(resp, &accounts)
 				assert.Equal(t, nil, err)
@@ -270,8 +341,13 @@ func TestCreateUserAccountHandler(t *testing.T) {
 				// Check source account balance was reduced
 				assert.Equal(t, int64(500), sourceAcc.Balance) // 1000 - 500
 
-				// Check Kafka messages
-				assert.Equal(t, 2, len(mockWriter.Messages))
+				// both legs go in a single transfer
+				assert.Equal(t, 1, len(outbox))
+				transfer, err := cmn.FromBytes[cmn.Transfer](outbox[0].Value)
+				assert.Equal(t, nil, err)
+				assert.Equal(t, int32(1), transfer.SourceAccountID)
+				assert.Equal(t, newAcc.AccountID, transfer.TargetAccountID)
+				assert.Equal(t, int64(500), transfer.Amount)
 			},
 		},
 		{
@@ -283,7 +359,7 @@ func TestCreateUserAccountHandler(t *testing.T) {
 				InitialBalance:       2000, // More than the 1000 balance
 			},
 			expectedStatus: http.StatusBadRequest,
-			checkResponse: func(t *testing.T, resp []byte, mockWriter *tu.MockKafkaWriter) {
+			checkResponse: func(t *testing.T, resp []byte, outbox []kafka.Message) {
 				var errorResp map[string]string
 				err := json.Unmarshal(resp, &errorResp)
 				assert.Equal(t, nil, err)
@@ -299,7 +375,7 @@ func TestCreateUserAccountHandler(t *testing.T) {
 				InitialBalance:       100,
 			},
 			expectedStatus: http.StatusBadRequest,
-			checkResponse: func(t *testing.T, resp []byte, mockWriter *tu.MockKafkaWriter) {
+			checkResponse: func(t *testing.T, resp []byte, outbox []kafka.Message) {
 				var errorResp map[string]string
 				err := json.Unmarshal(resp, &errorResp)
 				assert.Equal(t, nil, err)
@@ -315,7 +391,7 @@ func TestCreateUserAccountHandler(t *testing.T) {
 				InitialBalance:       0, // No initial balance
 			},
 			expectedStatus: http.StatusBadRequest,
-			checkResponse: func(t *testing.T, resp []byte, mockWriter *tu.MockKafkaWriter) {
+			checkResponse: func(t *testing.T, resp []byte, outbox []kafka.Message) {
 				var errorResp map[string]string
 				err := json.Unmarshal(resp, &errorResp)
 				assert.Equal(t, nil, err)
@@ -326,13 +402,13 @@ func TestCreateUserAccountHandler(t *testing.T) {
 
 	for _, tt := range tests {
 		t.Run(tt.name, func(t *testing.T) {
-			// Reset the mock writer messages
-			writer, ok := service.appCtx.writer.(*tu.MockKafkaWriter)
+			// Reset the staged outbox messages
+			mockDB, ok := service.appCtx.db.(*MockAccDB)
 			if !ok {
-				t.Fatal("writer is not mock writer")
+				t.Fatal("db is not mock db")
 			}
 
-			writer.Messages = nil
+			mockDB.outbox = nil
 
 			// Create request body
 			reqBody, _ := json.Marshal(tt.request)
@@ -342,7 +418,7 @@ func TestCreateUserAccountHandler(t *testing.T) {
 			service.createUserAccountHandler(w, req)
 
 			assert.Equal(t, tt.expectedStatus, w.Code)
-			tt.checkResponse(t, w.Body.Bytes(), writer)
+			tt.checkResponse(t, w.Body.Bytes(), mockDB.outbox)
 		})
 	}
 }
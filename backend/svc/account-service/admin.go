@@ -0,0 +1,89 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+
+	cmn "github.com/timkins666/distributed-playground/backend/pkg/common"
+)
+
+// represents an admin request to change an account's overdraft limit
+type SetOverdraftRequest struct {
+	AccountID int32 `json:"accountId"`
+	// how far below zero the balance may go, 0 for no overdraft
+	Limit int64 `json:"limit"`
+}
+
+func (r *SetOverdraftRequest) Validate() error {
+	if r.AccountID <= 0 {
+		return fmt.Errorf("account ID is required")
+	}
+	if r.Limit < 0 {
+		return fmt.Errorf("overdraft limit cannot be negative")
+	}
+	return nil
+}
+
+// setOverdraftLimitHandler sets the overdraft limit of any account, admins only
+func (s *Service) setOverdraftLimitHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	appCtx, ok := r.Context().Value(cmn.AppCtx).(*accountsCtx)
+	if !ok {
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		return
+	}
+
+	userID, ok := r.Context().Value(cmn.UserIDKey).(int32)
+	if !ok || userID == 0 {
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+
+	// roles aren't in the token, and are read past the cache so a revoked role takes effect at once
+	user, err := appCtx.db.getUserFromDB(r.Context(), userID)
+	if err != nil {
+		appCtx.logger.Printf("Failed to load user %d: %v", userID, err)
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+	if !user.HasRole(cmn.RoleAdmin) {
+		appCtx.logger.Printf("User %d is not an admin, can't set overdraft limits", userID)
+		http.Error(w, "Forbidden", http.StatusForbidden)
+		return
+	}
+
+	var req SetOverdraftRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		appCtx.logger.Printf("Failed to decode request: %v", err)
+		http.Error(w, "Invalid request body", http.StatusBadRequest)
+		return
+	}
+
+	if err := req.Validate(); err != nil {
+		s.writeErrorResponse(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	acc, err := appCtx.db.setOverdraftLimit(r.Context(), req.AccountID, req.Limit)
+	if errors.Is(err, cmn.ErrAccountNotFound) {
+		s.writeErrorResponse(w, err.Error(), http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		appCtx.logger.Printf("Failed to set overdraft limit for account %d: %v", req.AccountID, err)
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		return
+	}
+
+	appCtx.logger.Printf("Admin %d set overdraft limit of account %d to %d", userID, acc.AccountID, acc.OverdraftLimit)
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(acc); err != nil {
+		appCtx.logger.Printf("Failed to encode response: %v", err)
+	}
+}
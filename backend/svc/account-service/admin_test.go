@@ -0,0 +1,122 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/bmizerany/assert"
+	cmn "github.com/timkins666/distributed-playground/backend/pkg/common"
+)
+
+func TestSetOverdraftLimitHandler(t *testing.T) {
+	service := getTestService()
+	mockDB := service.appCtx.db.(*MockAccDB)
+	mockDB.users[2] = cmn.User{ID: 2, Username: "admin", Roles: []string{cmn.RoleAdmin}}
+	// as created by the auth service's /register
+	mockDB.users[3] = cmn.User{ID: 3, Username: "registered", Roles: []string{cmn.RoleCustomer}}
+	mockDB.accounts[3] = cmn.Account{AccountID: 3, UserID: 3}
+
+	tests := []struct {
+		name           string
+		method         string
+		userID         int32
+		request        any
+		expectedStatus int
+	}{
+		{
+			name:           "admin sets limit",
+			method:         http.MethodPost,
+			userID:         2,
+			request:        SetOverdraftRequest{AccountID: 1, Limit: 500},
+			expectedStatus: http.StatusOK,
+		},
+		{
+			name:           "not an admin",
+			method:         http.MethodPost,
+			userID:         1,
+			request:        SetOverdraftRequest{AccountID: 1, Limit: 500},
+			expectedStatus: http.StatusForbidden,
+		},
+		{
+			name:           "registered customer on their own account",
+			method:         http.MethodPost,
+			userID:         3,
+			request:        SetOverdraftRequest{AccountID: 3, Limit: 1_000_000},
+			expectedStatus: http.StatusForbidden,
+		},
+		{
+			name:           "registered customer on another account",
+			method:         http.MethodPost,
+			userID:         3,
+			request:        SetOverdraftRequest{AccountID: 1, Limit: 1_000_000},
+			expectedStatus: http.StatusForbidden,
+		},
+		{
+			name:           "unknown user",
+			method:         http.MethodPost,
+			userID:         99,
+			request:        SetOverdraftRequest{AccountID: 1, Limit: 500},
+			expectedStatus: http.StatusUnauthorized,
+		},
+		{
+			name:           "negative limit",
+			method:         http.MethodPost,
+			userID:         2,
+			request:        SetOverdraftRequest{AccountID: 1, Limit: -1},
+			expectedStatus: http.StatusBadRequest,
+		},
+		{
+			name:           "bad body",
+			method:         http.MethodPost,
+			userID:         2,
+			request:        "nope",
+			expectedStatus: http.StatusBadRequest,
+		},
+		{
+			name:           "unknown account",
+			method:         http.MethodPost,
+			userID:         2,
+			request:        SetOverdraftRequest{AccountID: 42, Limit: 500},
+			expectedStatus: http.StatusNotFound,
+		},
+		{
+			name:           "wrong method",
+			method:         http.MethodGet,
+			userID:         2,
+			expectedStatus: http.StatusMethodNotAllowed,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			body, _ := json.Marshal(tt.request)
+			req := setupTestRequest(tt.method, "/admin/overdraft", body, *service.appCtx, tt.userID)
+			w := httptest.NewRecorder()
+
+			service.setOverdraftLimitHandler(w, req)
+
+			assert.Equal(t, tt.expectedStatus, w.Code)
+		})
+	}
+
+	assert.Equal(t, int64(500), mockDB.accounts[1].OverdraftLimit)
+	assert.Equal(t, int64(0), mockDB.accounts[3].OverdraftLimit)
+}
+
+func TestOverdraftLimitAllowsHold(t *testing.T) {
+	service := getTestService()
+	mockDB := service.appCtx.db.(*MockAccDB)
+
+	// balance is 1000
+	_, err := mockDB.placeHold(context.Background(), 1, 1, "pay1", 1200, 0)
+	assert.Equal(t, errInsufficientFunds, err)
+
+	_, err = mockDB.setOverdraftLimit(context.Background(), 1, 200)
+	assert.Equal(t, nil, err)
+
+	_, err = mockDB.placeHold(context.Background(), 1, 1, "pay1", 1200, 0)
+	assert.Equal(t, nil, err)
+}
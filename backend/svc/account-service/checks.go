@@ -0,0 +1,189 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"math/rand/v2"
+	"time"
+
+	cmn "github.com/timkins666/distributed-playground/backend/pkg/common"
+)
+
+// PaymentCheck is a single validation check run against every payment request
+type PaymentCheck interface {
+	Name() CheckName
+	// how long the check may run before it fails
+	Timeout() time.Duration
+	// returns nil if the payment passes, otherwise the reason it failed.
+	// must return promptly once ctx is done.
+	Run(ctx context.Context, req *cmn.PaymentRequest) error
+}
+
+// the checks the validator runs, in registration order
+type checkRegistry struct {
+	checks []PaymentCheck
+}
+
+func newCheckRegistry(checks ...PaymentCheck) *checkRegistry {
+	r := &checkRegistry{}
+	for _, c := range checks {
+		r.register(c)
+	}
+	return r
+}
+
+// adds a check to the registry. check names must be unique.
+func (r *checkRegistry) register(check PaymentCheck) {
+	for _, c := range r.checks {
+		if c.Name() == check.Name() {
+			panic(fmt.Sprintf("payment check %s already registered", check.Name()))
+		}
+	}
+	r.checks = append(r.checks, check)
+}
+
+func (r *checkRegistry) all() []PaymentCheck {
+	return r.checks
+}
+
+// the checks run for every payment. add new checks here.
+func defaultChecks(appCtx *accountsCtx) *checkRegistry {
+	return newCheckRegistry(
+		&balanceCheck{appCtx: appCtx, maxLatency: simulatedLatency},
+		&targetAccountCheck{appCtx: appCtx, maxLatency: simulatedLatency},
+		&sourceOwnershipCheck{appCtx: appCtx},
+	)
+}
+
+// runs the check within its timeout and records the outcome
+func runCheck(ctx context.Context, check PaymentCheck, req *cmn.PaymentRequest) CheckResult {
+	ctx, cancel := context.WithTimeout(ctx, check.Timeout())
+	defer cancel()
+
+	start := time.Now()
+	err := check.Run(ctx, req)
+
+	res := CheckResult{CheckName: check.Name(), Result: true, DurationMs: time.Since(start).Milliseconds()}
+	if err != nil {
+		res.Result = false
+		res.Error = err.Error()
+		if errors.Is(err, context.DeadlineExceeded) {
+			res.Error = fmt.Sprintf("timed out after %s", check.Timeout())
+		}
+	}
+	return res
+}
+
+// upper bound of the artificial delay added to checks to make things racey
+const simulatedLatency = 5 * time.Second
+
+// sleeps for a random time up to max, or until ctx is done
+func simulateLatency(ctx context.Context, name CheckName, max time.Duration, logger *log.Logger) error {
+	if max <= 0 {
+		return ctx.Err()
+	}
+	sleep := time.Duration(rand.N(max.Milliseconds())) * time.Millisecond
+	logger.Printf("%s sleeping for %s", name, sleep)
+
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-time.After(sleep):
+		return nil
+	}
+}
+
+// verifies that the source account has sufficient funds, holding them if so
+type balanceCheck struct {
+	appCtx     *accountsCtx
+	maxLatency time.Duration
+}
+
+func (c *balanceCheck) Name() CheckName        { return BalanceCheck }
+func (c *balanceCheck) Timeout() time.Duration { return 4 * time.Second }
+
+func (c *balanceCheck) Run(ctx context.Context, req *cmn.PaymentRequest) error {
+	if err := simulateLatency(ctx, c.Name(), c.maxLatency, c.appCtx.logger); err != nil {
+		return err
+	}
+
+	// passing the check reserves the funds until the debit is committed
+	available, err := c.appCtx.db.placeHold(ctx, req.SourceAccountID, req.UserID, req.SystemID, req.Amount, c.appCtx.holdTTL)
+	if err == errInsufficientFunds {
+		err = fmt.Errorf("insufficient funds: has %d, needs %d", available, req.Amount)
+		c.appCtx.logger.Printf("Balance check failed for account %d: %s", req.SourceAccountID, err)
+		return err
+	}
+	if err == errNotAccountOwner {
+		c.appCtx.logger.Printf("User %d attempted to hold funds on account %d they don't own", req.UserID, req.SourceAccountID)
+		return fmt.Errorf("source account %d is not owned by user %d", req.SourceAccountID, req.UserID)
+	}
+	if err == errHoldClosed {
+		c.appCtx.logger.Printf("Not placing hold for payment %s: %v", req.SystemID, err)
+		return err
+	}
+	if err != nil {
+		c.appCtx.logger.Printf("Failed to place hold on source account %d: %v", req.SourceAccountID, err)
+		if errors.Is(err, cmn.ErrAccountNotFound) {
+			return fmt.Errorf("account not found: %v", err)
+		}
+		return fmt.Errorf("failed to hold funds: %v", err)
+	}
+
+	c.appCtx.logger.Printf("Balance check passed for account %d, held %d of %d available",
+		req.SourceAccountID, req.Amount, available)
+	return nil
+}
+
+// verifies that the target account exists
+type targetAccountCheck struct {
+	appCtx     *accountsCtx
+	maxLatency time.Duration
+}
+
+func (c *targetAccountCheck) Name() CheckName        { return TargetAccountCheck }
+func (c *targetAccountCheck) Timeout() time.Duration { return 4 * time.Second }
+
+func (c *targetAccountCheck) Run(ctx context.Context, req *cmn.PaymentRequest) error {
+	if err := simulateLatency(ctx, c.Name(), c.maxLatency, c.appCtx.logger); err != nil {
+		return err
+	}
+
+	_, err := c.appCtx.db.getAccountByID(ctx, req.TargetAccountID)
+	if err != nil {
+		c.appCtx.logger.Printf("Target account %d not found: %v", req.TargetAccountID, err)
+		return fmt.Errorf("target account %d not found", req.TargetAccountID)
+	}
+
+	c.appCtx.logger.Printf("Target account %d validated successfully", req.TargetAccountID)
+	return nil
+}
+
+// verifies that the source account belongs to the user who requested the payment
+type sourceOwnershipCheck struct {
+	appCtx *accountsCtx
+}
+
+func (c *sourceOwnershipCheck) Name() CheckName        { return SourceOwnershipCheck }
+func (c *sourceOwnershipCheck) Timeout() time.Duration { return 2 * time.Second }
+
+func (c *sourceOwnershipCheck) Run(ctx context.Context, req *cmn.PaymentRequest) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+
+	acc, err := c.appCtx.db.getAccountByID(ctx, req.SourceAccountID)
+	if err != nil {
+		c.appCtx.logger.Printf("Source account %d not found: %v", req.SourceAccountID, err)
+		return fmt.Errorf("source account %d not found", req.SourceAccountID)
+	}
+
+	if acc.UserID != req.UserID {
+		c.appCtx.logger.Printf("User %d attempted payment from account %d owned by user %d",
+			req.UserID, req.SourceAccountID, acc.UserID)
+		return fmt.Errorf("source account %d is not owned by user %d", req.SourceAccountID, req.UserID)
+	}
+	return nil
+}
@@ -0,0 +1,149 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/bmizerany/assert"
+	cmn "github.com/timkins666/distributed-playground/backend/pkg/common"
+)
+
+// check which blocks until cancelled unless told to return
+type stubCheck struct {
+	name    CheckName
+	timeout time.Duration
+	err     error
+	block   bool
+}
+
+func (c *stubCheck) Name() CheckName        { return c.name }
+func (c *stubCheck) Timeout() time.Duration { return c.timeout }
+
+func (c *stubCheck) Run(ctx context.Context, req *cmn.PaymentRequest) error {
+	if c.block {
+		<-ctx.Done()
+		return ctx.Err()
+	}
+	return c.err
+}
+
+func TestCheckRegistry(t *testing.T) {
+	r := newCheckRegistry(&stubCheck{name: "chk1"}, &stubCheck{name: "chk2"})
+	assert.Equal(t, 2, len(r.all()))
+	assert.Equal(t, CheckName("chk1"), r.all()[0].Name())
+
+	defer func() {
+		assert.NotEqual(t, nil, recover())
+	}()
+	r.register(&stubCheck{name: "chk1"})
+}
+
+func TestRunCheck(t *testing.T) {
+	req := &cmn.PaymentRequest{SystemID: "pay1"}
+
+	tests := []struct {
+		name      string
+		check     *stubCheck
+		wantPass  bool
+		wantError string
+	}{
+		{
+			name:     "passed",
+			check:    &stubCheck{name: "chk", timeout: time.Second},
+			wantPass: true,
+		},
+		{
+			name:      "failed",
+			check:     &stubCheck{name: "chk", timeout: time.Second, err: errors.New("nope")},
+			wantError: "nope",
+		},
+		{
+			name:      "timed out",
+			check:     &stubCheck{name: "chk", timeout: 10 * time.Millisecond, block: true},
+			wantError: "timed out after 10ms",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			res := runCheck(context.Background(), tt.check, req)
+
+			assert.Equal(t, tt.check.name, res.CheckName)
+			assert.Equal(t, tt.wantPass, res.Result)
+			assert.Equal(t, tt.wantError, res.Error)
+		})
+	}
+}
+
+func TestChecksHonourCancellation(t *testing.T) {
+	appCtx := &accountsCtx{
+		db:     NewMockAccDB(),
+		logger: cmn.AppLogger(),
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	for _, check := range defaultChecks(appCtx).all() {
+		start := time.Now()
+		err := check.Run(ctx, &cmn.PaymentRequest{SystemID: "pay1"})
+
+		assert.Equal(t, context.Canceled, err)
+		assert.Equal(t, true, time.Since(start) < time.Second)
+	}
+}
+
+func TestSourceOwnershipCheck(t *testing.T) {
+	mockDB := NewMockAccDB()
+	mockDB.accounts[1] = cmn.Account{AccountID: 1, UserID: 10}
+
+	check := &sourceOwnershipCheck{appCtx: &accountsCtx{db: mockDB, logger: cmn.AppLogger()}}
+
+	tests := []struct {
+		name      string
+		req       *cmn.PaymentRequest
+		wantPass  bool
+		wantError string
+	}{
+		{
+			name:     "owner",
+			req:      &cmn.PaymentRequest{UserID: 10, SourceAccountID: 1},
+			wantPass: true,
+		},
+		{
+			name:      "not owner",
+			req:       &cmn.PaymentRequest{UserID: 11, SourceAccountID: 1},
+			wantError: "source account 1 is not owned by user 11",
+		},
+		{
+			name:      "unknown account",
+			req:       &cmn.PaymentRequest{UserID: 10, SourceAccountID: 2},
+			wantError: "source account 2 not found",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			res := runCheck(context.Background(), check, tt.req)
+
+			assert.Equal(t, SourceOwnershipCheck, res.CheckName)
+			assert.Equal(t, tt.wantPass, res.Result)
+			assert.Equal(t, tt.wantError, res.Error)
+		})
+	}
+}
+
+func TestBalanceCheckRefusesNonOwner(t *testing.T) {
+	mockDB := NewMockAccDB()
+	mockDB.accounts[1] = cmn.Account{AccountID: 1, UserID: 10, Balance: 1000}
+
+	check := &balanceCheck{appCtx: &accountsCtx{db: mockDB, logger: cmn.AppLogger()}}
+
+	res := runCheck(context.Background(), check, &cmn.PaymentRequest{UserID: 11, SourceAccountID: 1, SystemID: "pay1", Amount: 100})
+
+	assert.Equal(t, false, res.Result)
+	assert.Equal(t, "source account 1 is not owned by user 11", res.Error)
+	assert.Equal(t, 0, len(mockDB.holds))
+}
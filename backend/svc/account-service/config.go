@@ -7,13 +7,16 @@ import (
 	"time"
 
 	"github.com/segmentio/kafka-go"
+	cmn "github.com/timkins666/distributed-playground/backend/pkg/common"
 )
 
 // Config holds all configuration for the account service
 type Config struct {
-	Server ServerConfig
-	Kafka  KafkaConfig
-	DB     DatabaseConfig
+	Server   ServerConfig
+	Kafka    KafkaConfig
+	DB       DatabaseConfig
+	Redis    cmn.RedisConfig
+	Payments PaymentConfig
 }
 
 // ServerConfig holds HTTP server configuration
@@ -26,12 +29,22 @@ type ServerConfig struct {
 
 // KafkaConfig holds Kafka configuration
 type KafkaConfig struct {
-	Broker           string
-	PaymentTopic     string
-	TransactionTopic string
-	GroupID          string
-	RequiredAcks     kafka.RequiredAcks
-	MaxAttempts      int
+	Broker       string
+	PaymentTopic string
+	GroupID      string
+	HoldGroupID  string
+	RequiredAcks kafka.RequiredAcks
+	MaxAttempts  int
+	// payment requests validated concurrently
+	ValidatorWorkers int
+	// payment requests fetched but waiting for a worker
+	ValidatorQueueDepth int
+}
+
+// PaymentConfig holds payment validation configuration
+type PaymentConfig struct {
+	// how long funds are held for a validated payment before the hold lapses
+	HoldTTL time.Duration
 }
 
 // DatabaseConfig holds database configuration
@@ -41,23 +54,35 @@ type DatabaseConfig struct {
 
 // LoadConfig loads configuration from environment variables
 func LoadConfig() (*Config, error) {
+	logger := cmn.AppLogger()
 	config := &Config{
 		Server: ServerConfig{
-			Port:         getEnvOrDefault("SERVE_PORT", "8080"),
+			Port:         cmn.EnvOrDefault("SERVE_PORT", "8080"),
 			ReadTimeout:  30 * time.Second,
 			WriteTimeout: 30 * time.Second,
 			IdleTimeout:  120 * time.Second,
 		},
 		Kafka: KafkaConfig{
-			Broker:           os.Getenv("KAFKA_BROKER"),
-			PaymentTopic:     "payment-requested",
-			TransactionTopic: "transaction-requested",
-			GroupID:          "payment-validator",
-			RequiredAcks:     1,
-			MaxAttempts:      5,
+			Broker:              os.Getenv("KAFKA_BROKER"),
+			PaymentTopic:        "payment-requested",
+			GroupID:             "payment-validator",
+			HoldGroupID:         "hold-releaser",
+			RequiredAcks:        1,
+			MaxAttempts:         5,
+			ValidatorWorkers:    cmn.IntFromEnv("VALIDATOR_WORKERS", 16, 1, logger),
+			ValidatorQueueDepth: cmn.IntFromEnv("VALIDATOR_QUEUE_DEPTH", 64, 0, logger),
+		},
+		Payments: PaymentConfig{
+			HoldTTL: cmn.DurationFromEnv("HOLD_TTL", 5*time.Minute, logger),
 		},
 	}
 
+	redisConfig, err := cmn.LoadRedisConfig()
+	if err != nil {
+		return nil, fmt.Errorf("invalid configuration: %w", err)
+	}
+	config.Redis = redisConfig
+
 	if err := config.validate(); err != nil {
 		return nil, fmt.Errorf("invalid configuration: %w", err)
 	}
@@ -80,13 +105,17 @@ func (c *Config) validate() error {
 		return fmt.Errorf("invalid server port: %s", c.Server.Port)
 	}
 
-	return nil
-}
+	if c.Kafka.ValidatorWorkers < 1 {
+		return fmt.Errorf("validator workers must be at least 1")
+	}
+
+	if c.Kafka.ValidatorQueueDepth < 0 {
+		return fmt.Errorf("validator queue depth cannot be negative")
+	}
 
-// getEnvOrDefault returns environment variable value or default if not set
-func getEnvOrDefault(key, defaultValue string) string {
-	if value := os.Getenv(key); value != "" {
-		return value
+	if c.Payments.HoldTTL < 0 {
+		return fmt.Errorf("hold TTL cannot be negative")
 	}
-	return defaultValue
+
+	return nil
 }
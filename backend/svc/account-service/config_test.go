@@ -32,7 +32,7 @@ func TestConfigValidate(t *testing.T) {
 			name: "valid config",
 			config: Config{
 				Server: ServerConfig{Port: "8080"},
-				Kafka:  KafkaConfig{Broker: "localhost:9092"},
+				Kafka:  KafkaConfig{Broker: "localhost:9092", ValidatorWorkers: 1},
 			},
 			expectErr: false,
 		},
@@ -44,6 +44,22 @@ func TestConfigValidate(t *testing.T) {
 			},
 			expectErr: true,
 		},
+		{
+			name: "no validator workers",
+			config: Config{
+				Server: ServerConfig{Port: "8080"},
+				Kafka:  KafkaConfig{Broker: "localhost:9092"},
+			},
+			expectErr: true,
+		},
+		{
+			name: "negative validator queue depth",
+			config: Config{
+				Server: ServerConfig{Port: "8080"},
+				Kafka:  KafkaConfig{Broker: "localhost:9092", ValidatorWorkers: 1, ValidatorQueueDepth: -1},
+			},
+			expectErr: true,
+		},
 		{
 			name: "invalid port",
 			config: Config{
@@ -63,17 +79,3 @@ func TestConfigValidate(t *testing.T) {
 		})
 	}
 }
-
-func TestGetEnvOrDefault(t *testing.T) {
-	t.Setenv("TEST_VAR", "test_value")
-
-	result := getEnvOrDefault("TEST_VAR", "default")
-	if result != "test_value" {
-		t.Errorf("expected test_value, got %s", result)
-	}
-
-	result = getEnvOrDefault("NONEXISTENT", "default")
-	if result != "default" {
-		t.Errorf("expected default, got %s", result)
-	}
-}
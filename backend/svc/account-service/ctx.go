@@ -3,8 +3,8 @@ package main
 import (
 	"context"
 	"log"
+	"time"
 
-	"github.com/redis/go-redis/v9"
 	"github.com/segmentio/kafka-go"
 	cmn "github.com/timkins666/distributed-playground/backend/pkg/common"
 )
@@ -14,8 +14,17 @@ type accountsCtx struct {
 	db           accountsDB
 	logger       *log.Logger
 	payReqReader cmn.KafkaReader
-	writer       cmn.KafkaWriter
-	redisClient  *redis.Client
+	// one per retry tier of payment-requested
+	payReqRetryReaders []cmn.KafkaReader
+	retryPolicy        cmn.RetryPolicy
+	holdReader         cmn.KafkaReader
+	writer             cmn.KafkaWriter
+	redis              *cmn.Redis
+	// access tokens revoked before they expire, checked by the middleware
+	revocations *cmn.RevocationList
+	outbox      *cmn.OutboxRelay
+	holdTTL     time.Duration
+	checks      *checkRegistry
 }
 
 // Close releases all resources
@@ -28,14 +37,26 @@ func (a *accountsCtx) Close() error {
 		}
 	}
 
+	for _, r := range a.payReqRetryReaders {
+		if err := r.Close(); err != nil {
+			errs = append(errs, err)
+		}
+	}
+
+	if a.holdReader != nil {
+		if err := a.holdReader.Close(); err != nil {
+			errs = append(errs, err)
+		}
+	}
+
 	if a.writer != nil {
 		if err := a.writer.Close(); err != nil {
 			errs = append(errs, err)
 		}
 	}
 
-	if a.redisClient != nil {
-		if err := a.redisClient.Close(); err != nil {
+	if a.redis != nil {
+		if err := a.redis.Close(); err != nil {
 			errs = append(errs, err)
 		}
 	}
@@ -55,29 +76,46 @@ func newAppCtx(cancelCtx context.Context, config *Config) *accountsCtx {
 		GroupID: config.Kafka.GroupID,
 	})
 
+	// a hold is released when its payment fails, or its debit is rejected
+	holdReader := kafka.NewReader(kafka.ReaderConfig{
+		Brokers: []string{config.Kafka.Broker},
+		GroupTopics: []string{
+			cmn.Topics.PaymentFailed().S(),
+			cmn.Topics.TransactionFailed().S(),
+		},
+		GroupID: config.Kafka.HoldGroupID,
+	})
+
 	writer := &kafka.Writer{
 		Addr:         kafka.TCP(config.Kafka.Broker),
 		RequiredAcks: config.Kafka.RequiredAcks,
 		MaxAttempts:  config.Kafka.MaxAttempts,
 	}
 
-	redisClient, err := cmn.NewRedisClient() //TODO: env
-	if err != nil {
-		logger.Println("failed to initialise redis client, continuing without:", err.Error())
-		redisClient = nil // make sure
-	}
+	// caches in process until redis is reachable
+	rds := cmn.ConnectRedis(cancelCtx, config.Redis, logger)
 
-	db, err := initDB(redisClient)
+	db, err := initDB(rds)
 	if err != nil {
 		panic(err)
 	}
 
-	return &accountsCtx{
+	appCtx := &accountsCtx{
 		cancelCtx:    cancelCtx,
 		logger:       logger,
 		payReqReader: reader,
-		writer:       writer,
-		db:           db,
-		redisClient:  redisClient,
+		payReqRetryReaders: cmn.DefaultRetryPolicy.Readers(
+			config.Kafka.Broker, config.Kafka.GroupID, cmn.Topics.PaymentRequested()),
+		retryPolicy: cmn.DefaultRetryPolicy,
+		holdReader:  holdReader,
+		writer:      writer,
+		db:          db,
+		redis:       rds,
+		revocations: cmn.NewRevocationList(rds, logger),
+		outbox:      newOutboxRelay(db, writer, logger),
+		holdTTL:     config.Payments.HoldTTL,
 	}
+	appCtx.checks = defaultChecks(appCtx)
+
+	return appCtx
 }
@@ -4,12 +4,15 @@ import (
 	"context"
 	"testing"
 
+	cmn "github.com/timkins666/distributed-playground/backend/pkg/common"
 	tu "github.com/timkins666/distributed-playground/backend/pkg/testutils"
 )
 
 func TestNewAppCtx(t *testing.T) {
 	t.Setenv("KAFKA_BROKER", "foo")
 	t.Setenv("DB_TYPE", "_TEST_")
+	// no redis here, so don't wait for it
+	t.Setenv("REDIS_CONNECT_ATTEMPTS", "1")
 
 	config, err := LoadConfig()
 	if err != nil {
@@ -33,14 +36,19 @@ func TestNewAppCtx(t *testing.T) {
 	if ctx.payReqReader == nil {
 		t.Error("payReqReader should not be nil")
 	}
+	if len(ctx.payReqRetryReaders) != len(cmn.DefaultRetryPolicy) {
+		t.Errorf("expected a reader per retry tier, got %d", len(ctx.payReqRetryReaders))
+	}
 }
 
 func TestPaymentCtxClose(t *testing.T) {
 	mockWriter := &tu.MockKafkaWriter{}
+	mockRetryReader := &tu.MockKafkaReader{}
 
 	ctx := &accountsCtx{
-		cancelCtx: context.Background(),
-		writer:    mockWriter,
+		cancelCtx:          context.Background(),
+		payReqRetryReaders: []cmn.KafkaReader{mockRetryReader},
+		writer:             mockWriter,
 	}
 
 	err := ctx.Close()
@@ -51,4 +59,7 @@ func TestPaymentCtxClose(t *testing.T) {
 	if !mockWriter.Closed {
 		t.Error("writer should be closed")
 	}
+	if !mockRetryReader.Closed {
+		t.Error("retry reader should be closed")
+	}
 }
@@ -1,21 +1,34 @@
 package main
 
 import (
+	"context"
 	"fmt"
+	"log"
 	"os"
+	"time"
 
-	"github.com/redis/go-redis/v9"
+	"github.com/segmentio/kafka-go"
 	cmn "github.com/timkins666/distributed-playground/backend/pkg/common"
 )
 
+// builds the events to publish for a newly created account
+type accountEvents func(accountID int32) ([]kafka.Message, error)
+
 type accountsDB interface {
-	getUserAccounts(int32) ([]cmn.Account, error)
-	createAccount(cmn.Account) (int32, error)
-	getAccountByID(int32) (*cmn.Account, error)
-	getUserByID(int32) (*cmn.User, error)
+	getUserAccounts(context.Context, int32) ([]cmn.Account, error)
+	createAccount(context.Context, cmn.Account, accountEvents) (int32, error)
+	getAccountByID(context.Context, int32) (*cmn.Account, error)
+	getUserByID(context.Context, int32) (*cmn.User, error)
+	// always loads from the db, for authorization which mustn't see stale roles
+	getUserFromDB(context.Context, int32) (*cmn.User, error)
+	getBanks(context.Context) ([]*cmn.Bank, error)
+	placeHold(ctx context.Context, accountID, userID int32, paymentSysID string, amount int64, ttl time.Duration) (int64, error)
+	releaseHold(ctx context.Context, paymentSysID string) (bool, error)
+	setOverdraftLimit(ctx context.Context, accountID int32, limit int64) (*cmn.Account, error)
+	getTransactionHistory(context.Context, *HistoryQuery) (*HistoryPage, error)
 }
 
-func initDB(redisClient *redis.Client) (accountsDB, error) {
+func initDB(rds *cmn.Redis) (accountsDB, error) {
 	dbType, found := os.LookupEnv("DB_TYPE")
 
 	if dbType == "_TEST_" {
@@ -27,8 +40,17 @@ func initDB(redisClient *redis.Client) (accountsDB, error) {
 		if err != nil {
 			return nil, fmt.Errorf("failed to initialise database: %w", err)
 		}
-		return &dbPostgres{db, redisClient}, nil
+		return newDBPostgres(db, rds), nil
 	}
 
 	panic("cassandra not set up yet")
 }
+
+// relays events staged in the outbox alongside account rows
+func newOutboxRelay(db accountsDB, writer cmn.KafkaWriter, logger *log.Logger) *cmn.OutboxRelay {
+	pg, ok := db.(*dbPostgres)
+	if !ok || pg.db == nil {
+		return nil
+	}
+	return cmn.NewOutboxRelay(pg.db, cmn.OutboxTableAccounts, writer, logger)
+}
@@ -3,60 +3,76 @@ package main
 import (
 	"context"
 	"database/sql"
+	"fmt"
 	"log"
 	"strconv"
+	"strings"
 	"time"
 
 	"github.com/lib/pq"
-	"github.com/redis/go-redis/v9"
+	"github.com/segmentio/kafka-go"
 	cmn "github.com/timkins666/distributed-playground/backend/pkg/common"
 )
 
 type dbPostgres struct {
-	db          *sql.DB
-	redisClient *redis.Client
+	db *sql.DB
+	// nil caches load from the db every time
+	users        *cmn.Cache[cmn.User]
+	userAccounts *cmn.Cache[[]cmn.Account]
+	banks        *cmn.Cache[[]*cmn.Bank]
 }
 
+// caches in redis while it's reachable, otherwise in process
+func newDBPostgres(db *sql.DB, rds *cmn.Redis) *dbPostgres {
+	logger := cmn.AppLogger()
+	return &dbPostgres{
+		db:           db,
+		users:        cmn.NewCache[cmn.User](cmn.RedisKeyUser, rds, logger),
+		userAccounts: cmn.NewCache[[]cmn.Account](cmn.RedisKeyUserAccounts, rds, logger),
+		banks:        cmn.NewCache[[]*cmn.Bank](cmn.RedisKeyBanks, rds, logger),
+	}
+}
+
+// active holds reduce the available balance until consumed, released or expired
+const activeHoldsSQL = `
+	SELECT account_id, SUM(amount) AS held FROM accounts.hold
+	WHERE status = 'ACTIVE' AND expires_at > now()
+	GROUP BY account_id`
+
 // get single account matching id. always uses db for source of truth.
-func (db *dbPostgres) getAccountByID(accountID int32) (*cmn.Account, error) {
+func (db *dbPostgres) getAccountByID(ctx context.Context, accountID int32) (*cmn.Account, error) {
 	// TODO: squirrel / sqlx
 
 	acc := cmn.Account{}
 
-	err := db.db.QueryRow(`
-		SELECT id, user_id, balance from accounts.account WHERE id = $1
-	`, accountID).Scan(&acc.AccountID, &acc.UserID, &acc.Balance)
+	err := db.db.QueryRowContext(ctx, `
+		SELECT a.id, a.user_id, a.balance, a.balance - COALESCE(h.held, 0)
+		FROM accounts.account a
+		LEFT JOIN (`+activeHoldsSQL+`) h ON h.account_id = a.id
+		WHERE a.id = $1
+	`, accountID).Scan(&acc.AccountID, &acc.UserID, &acc.Balance, &acc.AvailableBalance)
 	if err != nil {
 		return nil, err
 	}
 	return &acc, nil
 }
 
-// get all accounts for the user from redis/db
-func (db *dbPostgres) getUserAccounts(userID int32) ([]cmn.Account, error) {
-	// TODO: squirrel / sqlx
-	// BIG TODO: put redis stuff somewhere else
-
-	var redisKey string
-	if db.redisClient != nil {
-		redisKey = cmn.RedisKey(cmn.RedisKeyUserAccounts, strconv.Itoa(int(userID)))
-		cached, err := db.redisClient.Get(context.Background(), redisKey).Result()
-
-		if err == nil {
-			log.Printf("found cached accounts for user %d", userID)
-			accs, err := cmn.FromBytes[[]cmn.Account]([]byte(cached))
-			return *accs, err
-		} else if err != redis.Nil {
-			log.Printf("Error getting user %d accounts from cache: %v", userID, err)
-		}
-
-		log.Printf("getUserAccounts cache miss for user %d", userID)
-	}
+// get all accounts for the user from the cache/db
+func (db *dbPostgres) getUserAccounts(ctx context.Context, userID int32) ([]cmn.Account, error) {
+	return db.userAccounts.Get(ctx, strconv.Itoa(int(userID)), func() ([]cmn.Account, error) {
+		return db.loadUserAccounts(ctx, userID)
+	})
+}
 
+func (db *dbPostgres) loadUserAccounts(ctx context.Context, userID int32) ([]cmn.Account, error) {
+	// TODO: squirrel / sqlx
 	var accounts []cmn.Account
 
-	rows, err := db.db.Query(`
-		SELECT id, name, balance FROM accounts.account WHERE user_id = $1
+	rows, err := db.db.QueryContext(ctx, `
+		SELECT a.id, a.name, a.balance, a.balance - COALESCE(h.held, 0)
+		FROM accounts.account a
+		LEFT JOIN (`+activeHoldsSQL+`) h ON h.account_id = a.id
+		WHERE a.user_id = $1
 	`, userID)
 	if err != nil {
 		return nil, err
@@ -65,7 +81,7 @@ func (db *dbPostgres) getUserAccounts(userID int32) ([]cmn.Account, error) {
 
 	for rows.Next() {
 		var acc cmn.Account
-		err := rows.Scan(&acc.AccountID, &acc.Name, &acc.Balance)
+		err := rows.Scan(&acc.AccountID, &acc.Name, &acc.Balance, &acc.AvailableBalance)
 		if err != nil {
 			return nil, err
 		}
@@ -77,39 +93,324 @@ func (db *dbPostgres) getUserAccounts(userID int32) ([]cmn.Account, error) {
 	}
 
 	log.Printf("user %d accounts\n%+v", userID, accounts)
+	return accounts, nil
+}
 
-	b, err := cmn.ToBytes(accounts)
+// creates the account and stages its events in the outbox in a single transaction
+func (db *dbPostgres) createAccount(ctx context.Context, a cmn.Account, events accountEvents) (int32, error) {
+	tx, err := db.db.BeginTx(ctx, nil)
 	if err != nil {
-		return nil, err
-	}
-
-	if db.redisClient != nil {
-		log.Printf("Setting redis key %s", redisKey)
-		db.redisClient.Set(context.Background(), redisKey, string(b), time.Minute)
+		return 0, err
 	}
-	return accounts, nil
-}
+	defer tx.Rollback()
 
-func (db *dbPostgres) createAccount(a cmn.Account) (int32, error) {
 	var newAccID int32
-	err := db.db.QueryRow(`
+	err = tx.QueryRowContext(ctx, `
 		INSERT INTO accounts.account (user_id, name)
 		VALUES ($1, $2)
 		RETURNING id
 		`, a.UserID, a.Name).Scan(&newAccID)
+	if err != nil {
+		return 0, err
+	}
+
+	msgs, err := events(newAccID)
+	if err != nil {
+		return 0, err
+	}
+	if err := cmn.WriteOutbox(tx, cmn.OutboxTableAccounts, msgs...); err != nil {
+		return 0, err
+	}
+	if err := writeAccountChanged(tx, newAccID, a.UserID, cmn.AccountCreated); err != nil {
+		return 0, err
+	}
 
-	if db.redisClient != nil {
-		// invalidate cache TODO: separate consumer invalidation service
-		db.redisClient.Del(context.Background(), cmn.RedisKey(cmn.RedisKeyUserAccounts, strconv.Itoa(int(a.UserID))))
+	if err := tx.Commit(); err != nil {
+		return 0, err
 	}
-	return newAccID, err
+	return newAccID, nil
 }
 
-func (db *dbPostgres) getUserByID(userID int32) (*cmn.User, error) {
+// get the user from the cache/db, cmn.ErrUserNotFound if there's no such user
+func (db *dbPostgres) getUserByID(ctx context.Context, userID int32) (*cmn.User, error) {
+	user, err := db.users.Get(ctx, strconv.Itoa(int(userID)), func() (cmn.User, error) {
+		return db.loadUser(ctx, userID)
+	})
+	if err != nil {
+		return nil, err
+	}
+	return &user, nil
+}
+
+// get the user from the db, bypassing the cache
+func (db *dbPostgres) getUserFromDB(ctx context.Context, userID int32) (*cmn.User, error) {
+	user, err := db.loadUser(ctx, userID)
+	if err != nil {
+		return nil, err
+	}
+	return &user, nil
+}
+
+func (db *dbPostgres) loadUser(ctx context.Context, userID int32) (cmn.User, error) {
 	log.Printf("Try load user id %d from db...", userID)
 	var user cmn.User
-	err := db.db.QueryRow(`
+	err := db.db.QueryRowContext(ctx, `
 		SELECT id, username, roles FROM accounts."user" WHERE id = $1
 	`, userID).Scan(&user.ID, &user.Username, pq.Array(&user.Roles))
-	return &user, err
+	if err == sql.ErrNoRows {
+		return user, cmn.ErrUserNotFound
+	}
+	return user, err
+}
+
+// get every bank from the cache/db
+func (db *dbPostgres) getBanks(ctx context.Context) ([]*cmn.Bank, error) {
+	return db.banks.Get(ctx, "all", func() ([]*cmn.Bank, error) {
+		rows, err := db.db.QueryContext(ctx, `SELECT id, name FROM accounts.bank ORDER BY id`)
+		if err != nil {
+			return nil, err
+		}
+		defer rows.Close()
+
+		var banks []*cmn.Bank
+		for rows.Next() {
+			var b cmn.Bank
+			if err := rows.Scan(&b.ID, &b.Name); err != nil {
+				return nil, err
+			}
+			banks = append(banks, &b)
+		}
+		return banks, rows.Err()
+	})
+}
+
+// reserves funds on the account for a payment if the available balance, including any overdraft,
+// covers it, returning the available balance before the hold. placing an active hold again renews
+// it, so a redriven payment whose hold has lapsed has its funds reserved again, but a hold that has
+// been released or consumed is never placed again. the account must belong to ownerID.
+func (db *dbPostgres) placeHold(ctx context.Context, accountID, ownerID int32, paymentSysID string, amount int64, ttl time.Duration) (int64, error) {
+	// the hold is rolled back rather than committed if ctx is done first
+	tx, err := db.db.BeginTx(ctx, nil)
+	if err != nil {
+		return 0, err
+	}
+	defer tx.Rollback()
+
+	var (
+		userID         int32
+		balance        int64
+		overdraftLimit int64
+	)
+	// lock the account so concurrent holds are serialised
+	err = tx.QueryRowContext(ctx, `
+		SELECT user_id, balance, overdraft_limit FROM accounts.account WHERE id = $1 FOR UPDATE
+	`, accountID).Scan(&userID, &balance, &overdraftLimit)
+	if err == sql.ErrNoRows {
+		return 0, cmn.ErrAccountNotFound
+	}
+	if err != nil {
+		return 0, err
+	}
+	// checked under the lock, the ownership check runs concurrently so can't be relied on here
+	if userID != ownerID {
+		return 0, errNotAccountOwner
+	}
+
+	var status string
+	err = tx.QueryRowContext(ctx, `
+		SELECT status FROM accounts.hold WHERE payment_sys_id = $1
+	`, paymentSysID).Scan(&status)
+	if err != nil && err != sql.ErrNoRows {
+		return 0, err
+	}
+	if err == nil && status != "ACTIVE" {
+		return 0, errHoldClosed
+	}
+
+	var held int64
+	err = tx.QueryRowContext(ctx, `
+		SELECT COALESCE(SUM(amount), 0) FROM accounts.hold
+		WHERE account_id = $1 AND payment_sys_id != $2 AND status = 'ACTIVE' AND expires_at > now()
+	`, accountID, paymentSysID).Scan(&held)
+	if err != nil {
+		return 0, err
+	}
+
+	// the debit is rejected by transaction-service if it goes past the overdraft limit
+	available := balance + overdraftLimit - held
+	if available < amount {
+		return available, errInsufficientFunds
+	}
+
+	res, err := tx.ExecContext(ctx, `
+		INSERT INTO accounts.hold (payment_sys_id, account_id, amount, status, expires_at)
+		VALUES ($1, $2, $3, 'ACTIVE', now() + make_interval(secs => $4))
+		ON CONFLICT (payment_sys_id) DO UPDATE
+			SET amount = EXCLUDED.amount, expires_at = EXCLUDED.expires_at, updated_at = now()
+			WHERE hold.status = 'ACTIVE'
+	`, paymentSysID, accountID, amount, ttl.Seconds())
+	if err != nil {
+		return 0, err
+	}
+	if placed, err := res.RowsAffected(); err != nil {
+		return 0, err
+	} else if placed > 0 {
+		if err := writeAccountChanged(tx, accountID, userID, cmn.AccountHoldPlaced); err != nil {
+			return 0, err
+		}
+	}
+
+	if err := tx.Commit(); err != nil {
+		return 0, err
+	}
+	return available, nil
+}
+
+// releases the active hold for a payment, returning whether there was one
+func (db *dbPostgres) releaseHold(ctx context.Context, paymentSysID string) (bool, error) {
+	tx, err := db.db.BeginTx(ctx, nil)
+	if err != nil {
+		return false, err
+	}
+	defer tx.Rollback()
+
+	var accountID, userID int32
+	err = tx.QueryRowContext(ctx, `
+		UPDATE accounts.hold h SET status = 'RELEASED', updated_at = now()
+		FROM accounts.account a
+		WHERE h.payment_sys_id = $1 AND h.status = 'ACTIVE' AND a.id = h.account_id
+		RETURNING a.id, a.user_id
+	`, paymentSysID).Scan(&accountID, &userID)
+	if err == sql.ErrNoRows {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+
+	if err := writeAccountChanged(tx, accountID, userID, cmn.AccountHoldReleased); err != nil {
+		return false, err
+	}
+	if err := tx.Commit(); err != nil {
+		return false, err
+	}
+	return true, nil
+}
+
+// sets how far below zero the account's balance may go
+func (db *dbPostgres) setOverdraftLimit(ctx context.Context, accountID int32, limit int64) (*cmn.Account, error) {
+	tx, err := db.db.BeginTx(ctx, nil)
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+
+	acc := cmn.Account{}
+	err = tx.QueryRowContext(ctx, `
+		UPDATE accounts.account SET overdraft_limit = $2 WHERE id = $1
+		RETURNING id, name, user_id, balance, overdraft_limit
+	`, accountID, limit).Scan(&acc.AccountID, &acc.Name, &acc.UserID, &acc.Balance, &acc.OverdraftLimit)
+	if err == sql.ErrNoRows {
+		return nil, cmn.ErrAccountNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	if err := writeAccountChanged(tx, acc.AccountID, acc.UserID, cmn.AccountOverdraftChanged); err != nil {
+		return nil, err
+	}
+	if err := tx.Commit(); err != nil {
+		return nil, err
+	}
+	return &acc, nil
+}
+
+// stages an account-changed event in the outbox, so cache-invalidator drops the user's cached
+// accounts once the change is committed
+func writeAccountChanged(tx *sql.Tx, accountID, userID int32, change cmn.AccountChange) error {
+	key, err := cmn.ToBytes(accountID)
+	if err != nil {
+		return err
+	}
+	val, err := cmn.ToBytes(cmn.AccountChangedEvent{
+		AccountID: accountID,
+		UserID:    userID,
+		Change:    change,
+		Timestamp: time.Now(),
+	})
+	if err != nil {
+		return err
+	}
+	return cmn.WriteOutbox(tx, cmn.OutboxTableAccounts, kafka.Message{
+		Topic: cmn.Topics.AccountChanged().S(),
+		Key:   key,
+		Value: val,
+	})
+}
+
+// gets a page of the account's ledger rows, newest first, matching the query's filters
+func (db *dbPostgres) getTransactionHistory(ctx context.Context, q *HistoryQuery) (*HistoryPage, error) {
+	where := []string{"account_id = $1"}
+	args := []any{q.AccountID}
+	arg := func(v any) string {
+		args = append(args, v)
+		return fmt.Sprintf("$%d", len(args))
+	}
+
+	if q.After != nil {
+		where = append(where, fmt.Sprintf("(created_at, id) < (%s, %s)", arg(q.After.CreatedAt), arg(q.After.TxID)))
+	}
+	if q.From != nil {
+		where = append(where, "created_at >= "+arg(*q.From))
+	}
+	if q.To != nil {
+		where = append(where, "created_at < "+arg(*q.To))
+	}
+	switch q.Direction {
+	case DirectionCredit:
+		where = append(where, "amount > 0")
+	case DirectionDebit:
+		where = append(where, "amount < 0")
+	}
+	if q.MinAmount != nil {
+		where = append(where, "abs(amount) >= "+arg(*q.MinAmount))
+	}
+	if q.MaxAmount != nil {
+		where = append(where, "abs(amount) <= "+arg(*q.MaxAmount))
+	}
+	if q.PaymentSysID != "" {
+		where = append(where, "payment_sys_id = "+arg(q.PaymentSysID))
+	}
+
+	// one extra row says whether there's another page
+	rows, err := db.db.QueryContext(ctx, `
+		SELECT id, payment_sys_id, leg, amount, balance_after, created_at
+		FROM transactions.transaction
+		WHERE `+strings.Join(where, " AND ")+`
+		ORDER BY created_at DESC, id DESC
+		LIMIT `+arg(q.Limit+1), args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	page := &HistoryPage{Transactions: []HistoryEntry{}}
+	for rows.Next() {
+		var e HistoryEntry
+		if err := rows.Scan(&e.TxID, &e.PaymentSysID, &e.Leg, &e.Amount, &e.BalanceAfter, &e.CreatedAt); err != nil {
+			return nil, err
+		}
+		page.Transactions = append(page.Transactions, e)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	if len(page.Transactions) > q.Limit {
+		page.Transactions = page.Transactions[:q.Limit]
+		last := page.Transactions[q.Limit-1]
+		page.NextCursor = historyCursor{CreatedAt: last.CreatedAt, TxID: last.TxID}.encode()
+	}
+	return page, nil
 }
@@ -1,10 +1,15 @@
 package main
 
 import (
+	"context"
+	"database/sql"
+	"database/sql/driver"
+	"errors"
 	"testing"
+	"time"
 
 	"github.com/DATA-DOG/go-sqlmock"
-	"github.com/redis/go-redis/v9"
+	"github.com/segmentio/kafka-go"
 	cmn "github.com/timkins666/distributed-playground/backend/pkg/common"
 )
 
@@ -15,24 +20,36 @@ func TestDBPostgresGetUserAccounts(t *testing.T) {
 	}
 	defer db.Close()
 
-	redisClient := redis.NewClient(&redis.Options{})
-	dbPg := &dbPostgres{db: db, redisClient: redisClient}
+	// never cached in process, cache-invalidator couldn't evict it
+	dbPg := newDBPostgres(db, nil)
 
-	rows := sqlmock.NewRows([]string{"id", "name", "balance"}).
-		AddRow(1, "Test Account", 1000).
-		AddRow(2, "Another Account", 2000)
+	for range 2 {
+		rows := sqlmock.NewRows([]string{"id", "name", "balance", "available"}).
+			AddRow(1, "Test Account", 1000, 900).
+			AddRow(2, "Another Account", 2000, 2000)
 
-	mock.ExpectQuery("SELECT id, name, balance FROM accounts.account WHERE user_id").
-		WithArgs(1).
-		WillReturnRows(rows)
+		mock.ExpectQuery("SELECT a.id, a.name, a.balance, (.+) FROM accounts.account a (.+) WHERE a.user_id").
+			WithArgs(1).
+			WillReturnRows(rows)
+	}
 
-	accounts, err := dbPg.getUserAccounts(1)
+	accounts, err := dbPg.getUserAccounts(context.Background(), 1)
 	if err != nil {
 		t.Errorf("unexpected error: %v", err)
 	}
 
 	if len(accounts) != 2 {
-		t.Errorf("expected 2 accounts, got %d", len(accounts))
+		t.Fatalf("expected 2 accounts, got %d", len(accounts))
+	}
+
+	if accounts[0].AvailableBalance != 900 {
+		t.Errorf("expected available balance 900, got %d", accounts[0].AvailableBalance)
+	}
+
+	// loaded again without redis
+	accounts, err = dbPg.getUserAccounts(context.Background(), 1)
+	if err != nil || len(accounts) != 2 {
+		t.Errorf("expected 2 accounts, got %v %v", accounts, err)
 	}
 
 	if err := mock.ExpectationsWereMet(); err != nil {
@@ -47,23 +64,38 @@ func TestDBPostgresCreateAccount(t *testing.T) {
 	}
 	defer db.Close()
 
-	redisClient := redis.NewClient(&redis.Options{})
-	dbPg := &dbPostgres{db: db, redisClient: redisClient}
+	dbPg := &dbPostgres{db: db}
 
 	account := cmn.Account{
 		UserID: 1,
 		Name:   "Test Account",
 	}
 
+	event := kafka.Message{Topic: "transfer-requested", Key: []byte("123"), Value: []byte("{}")}
+
+	mock.ExpectBegin()
 	mock.ExpectQuery("INSERT INTO accounts.account").
 		WithArgs(account.UserID, account.Name).
 		WillReturnRows(sqlmock.NewRows([]string{"id"}).AddRow(123))
+	mock.ExpectExec("INSERT INTO accounts.outbox").
+		WithArgs(event.Topic, event.Key, event.Value).
+		WillReturnResult(sqlmock.NewResult(1, 1))
+	expectAccountChanged(mock)
+	mock.ExpectCommit()
 
-	accountID, err := dbPg.createAccount(account)
+	var eventsAccID int32
+	accountID, err := dbPg.createAccount(context.Background(), account, func(accID int32) ([]kafka.Message, error) {
+		eventsAccID = accID
+		return []kafka.Message{event}, nil
+	})
 	if err != nil {
 		t.Errorf("unexpected error: %v", err)
 	}
 
+	if eventsAccID != 123 {
+		t.Errorf("expected events for account 123, got %d", eventsAccID)
+	}
+
 	if accountID != 123 {
 		t.Errorf("expected account ID 123, got %d", accountID)
 	}
@@ -80,15 +112,14 @@ func TestDBPostgresGetAccountByID(t *testing.T) {
 	}
 	defer db.Close()
 
-	redisClient := redis.NewClient(&redis.Options{})
-	dbPg := &dbPostgres{db: db, redisClient: redisClient}
+	dbPg := &dbPostgres{db: db}
 
-	mock.ExpectQuery("SELECT id, user_id, balance from accounts.account WHERE id").
+	mock.ExpectQuery("SELECT a.id, a.user_id, a.balance, (.+) FROM accounts.account a (.+) WHERE a.id").
 		WithArgs(123).
-		WillReturnRows(sqlmock.NewRows([]string{"id", "user_id", "balance"}).
-			AddRow(123, 1, 1000))
+		WillReturnRows(sqlmock.NewRows([]string{"id", "user_id", "balance", "available"}).
+			AddRow(123, 1, 1000, 1000))
 
-	account, err := dbPg.getAccountByID(123)
+	account, err := dbPg.getAccountByID(context.Background(), 123)
 	if err != nil {
 		t.Errorf("unexpected error: %v", err)
 	}
@@ -101,3 +132,416 @@ func TestDBPostgresGetAccountByID(t *testing.T) {
 		t.Errorf("unmet expectations: %v", err)
 	}
 }
+
+func TestDBPostgresCreateAccountEventsError(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatalf("failed to create mock: %v", err)
+	}
+	defer db.Close()
+
+	dbPg := &dbPostgres{db: db}
+
+	// the account isn't kept if its events can't be staged
+	mock.ExpectBegin()
+	mock.ExpectQuery("INSERT INTO accounts.account").
+		WillReturnRows(sqlmock.NewRows([]string{"id"}).AddRow(123))
+	mock.ExpectRollback()
+
+	_, err = dbPg.createAccount(context.Background(), cmn.Account{UserID: 1, Name: "x"}, func(int32) ([]kafka.Message, error) {
+		return nil, errors.New("oops")
+	})
+	if err == nil {
+		t.Error("expected error")
+	}
+
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("unmet expectations: %v", err)
+	}
+}
+
+func TestDBPostgresPlaceHold(t *testing.T) {
+	tests := []struct {
+		name      string
+		held      int64
+		overdraft int64
+		amount    int64
+		// hold already placed by an earlier delivery, which may have lapsed
+		duplicate bool
+		// status of the payment's existing hold
+		status string
+		// user the account belongs to
+		owner   int32
+		wantErr error
+	}{
+		{name: "funds available", held: 200, amount: 800},
+		{name: "hold already placed is renewed", held: 200, amount: 800, duplicate: true},
+		// a lapsed hold isn't counted as held, so the payment's funds are checked and held again
+		{name: "lapsed hold is renewed", amount: 800, duplicate: true},
+		{name: "funds already held", held: 300, amount: 800, wantErr: errInsufficientFunds},
+		{name: "covered by overdraft", held: 300, overdraft: 100, amount: 800},
+		{name: "hold already released", amount: 800, status: "RELEASED", wantErr: errHoldClosed},
+		{name: "hold already consumed", amount: 800, status: "CONSUMED", wantErr: errHoldClosed},
+		{name: "not the owner", amount: 800, owner: 2, wantErr: errNotAccountOwner},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			db, mock, err := sqlmock.New()
+			if err != nil {
+				t.Fatalf("failed to create mock: %v", err)
+			}
+			defer db.Close()
+
+			dbPg := &dbPostgres{db: db}
+			owner := tt.owner
+			if owner == 0 {
+				owner = 1
+			}
+
+			mock.ExpectBegin()
+			mock.ExpectQuery("SELECT user_id, balance, overdraft_limit FROM accounts.account WHERE id = (.+) FOR UPDATE").
+				WithArgs(1).
+				WillReturnRows(sqlmock.NewRows([]string{"user_id", "balance", "overdraft_limit"}).AddRow(owner, 1000, tt.overdraft))
+			if owner == 1 {
+				existing := sqlmock.NewRows([]string{"status"})
+				if tt.duplicate {
+					existing.AddRow("ACTIVE")
+				} else if tt.status != "" {
+					existing.AddRow(tt.status)
+				}
+				mock.ExpectQuery("SELECT status FROM accounts.hold WHERE payment_sys_id = (.+)").
+					WithArgs("pay1").
+					WillReturnRows(existing)
+			}
+			if owner == 1 && tt.status == "" {
+				mock.ExpectQuery("SELECT COALESCE(.+) FROM accounts.hold").
+					WithArgs(1, "pay1").
+					WillReturnRows(sqlmock.NewRows([]string{"held"}).AddRow(tt.held))
+			}
+			if tt.wantErr == nil {
+				mock.ExpectExec("INSERT INTO accounts.hold (.+) ON CONFLICT \\(payment_sys_id\\) DO UPDATE (.+) WHERE hold.status = 'ACTIVE'").
+					WithArgs("pay1", 1, tt.amount, float64(60)).
+					WillReturnResult(sqlmock.NewResult(1, 1))
+				expectAccountChanged(mock)
+				mock.ExpectCommit()
+			} else {
+				mock.ExpectRollback()
+			}
+
+			available, err := dbPg.placeHold(context.Background(), 1, 1, "pay1", tt.amount, time.Minute)
+			if err != tt.wantErr {
+				t.Errorf("expected error %v, got %v", tt.wantErr, err)
+			}
+			if want := 1000 + tt.overdraft - tt.held; tt.status == "" && tt.owner == 0 && available != want {
+				t.Errorf("expected available %d, got %d", want, available)
+			}
+
+			if err := mock.ExpectationsWereMet(); err != nil {
+				t.Errorf("unmet expectations: %v", err)
+			}
+		})
+	}
+}
+
+func TestDBPostgresPlaceHoldTimesOut(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatalf("failed to create mock: %v", err)
+	}
+	defer db.Close()
+
+	dbPg := &dbPostgres{db: db}
+
+	// the check gives up while waiting for the account lock
+	mock.ExpectBegin()
+	mock.ExpectQuery("SELECT user_id, balance, overdraft_limit FROM accounts.account WHERE id = (.+) FOR UPDATE").
+		WithArgs(1).
+		WillDelayFor(time.Second).
+		WillReturnRows(sqlmock.NewRows([]string{"user_id", "balance", "overdraft_limit"}).AddRow(1, 1000, 0))
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+
+	_, err = dbPg.placeHold(ctx, 1, 1, "pay1", 100, time.Minute)
+	if err == nil {
+		t.Error("expected error")
+	}
+
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("unmet expectations: %v", err)
+	}
+}
+
+func TestDBPostgresReleaseHold(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatalf("failed to create mock: %v", err)
+	}
+	defer db.Close()
+
+	dbPg := &dbPostgres{db: db}
+
+	mock.ExpectBegin()
+	mock.ExpectQuery("UPDATE accounts.hold h SET status = 'RELEASED'").
+		WithArgs("pay1").
+		WillReturnRows(sqlmock.NewRows([]string{"id", "user_id"}).AddRow(2, 1))
+	expectAccountChanged(mock)
+	mock.ExpectCommit()
+	mock.ExpectBegin()
+	mock.ExpectQuery("UPDATE accounts.hold h SET status = 'RELEASED'").
+		WithArgs("pay2").
+		WillReturnError(sql.ErrNoRows)
+	mock.ExpectRollback()
+
+	released, err := dbPg.releaseHold(context.Background(), "pay1")
+	if err != nil || !released {
+		t.Errorf("expected hold released, got %v %v", released, err)
+	}
+
+	released, err = dbPg.releaseHold(context.Background(), "pay2")
+	if err != nil || released {
+		t.Errorf("expected no hold to release, got %v %v", released, err)
+	}
+
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("unmet expectations: %v", err)
+	}
+}
+
+func TestDBPostgresSetOverdraftLimit(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatalf("failed to create mock: %v", err)
+	}
+	defer db.Close()
+
+	dbPg := &dbPostgres{db: db}
+
+	mock.ExpectBegin()
+	mock.ExpectQuery("UPDATE accounts.account SET overdraft_limit = (.+) RETURNING").
+		WithArgs(1, 500).
+		WillReturnRows(sqlmock.NewRows([]string{"id", "name", "user_id", "balance", "overdraft_limit"}).
+			AddRow(1, "acc", 3, 100, 500))
+	expectAccountChanged(mock)
+	mock.ExpectCommit()
+	mock.ExpectBegin()
+	mock.ExpectQuery("UPDATE accounts.account SET overdraft_limit").
+		WithArgs(2, 500).
+		WillReturnError(sql.ErrNoRows)
+	mock.ExpectRollback()
+
+	acc, err := dbPg.setOverdraftLimit(context.Background(), 1, 500)
+	if err != nil {
+		t.Errorf("unexpected error: %v", err)
+	}
+	if acc.OverdraftLimit != 500 || acc.UserID != 3 {
+		t.Errorf("unexpected account %+v", acc)
+	}
+
+	_, err = dbPg.setOverdraftLimit(context.Background(), 2, 500)
+	if err != cmn.ErrAccountNotFound {
+		t.Errorf("expected ErrAccountNotFound, got %v", err)
+	}
+
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("unmet expectations: %v", err)
+	}
+}
+
+func TestDBPostgresGetTransactionHistory(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatalf("failed to create mock: %v", err)
+	}
+	defer db.Close()
+
+	dbPg := &dbPostgres{db: db}
+	t1 := time.Date(2025, 1, 3, 0, 0, 0, 0, time.UTC)
+	t2 := time.Date(2025, 1, 2, 0, 0, 0, 0, time.UTC)
+	t3 := time.Date(2025, 1, 1, 0, 0, 0, 0, time.UTC)
+	tx1, tx2, tx3 := "0b1f6a52-6c1e-4d0e-9d55-1f3c0a8e0001", "0b1f6a52-6c1e-4d0e-9d55-1f3c0a8e0002", "0b1f6a52-6c1e-4d0e-9d55-1f3c0a8e0003"
+	cols := []string{"id", "payment_sys_id", "leg", "amount", "balance_after", "created_at"}
+
+	// first page of two, with a third row showing there's more
+	mock.ExpectQuery(`SELECT id, payment_sys_id, leg, amount, balance_after, created_at FROM transactions.transaction WHERE account_id = \$1 AND amount < 0 AND abs\(amount\) >= \$2 ORDER BY created_at DESC, id DESC LIMIT \$3`).
+		WithArgs(1, 100, 3).
+		WillReturnRows(sqlmock.NewRows(cols).
+			AddRow(tx1, "pay1", "DEBIT", -300, 700, t1).
+			AddRow(tx2, "pay2", "DEBIT", -200, 1000, t2).
+			AddRow(tx3, "pay3", "DEBIT", -100, 1200, t3))
+
+	min := int64(100)
+	page, err := dbPg.getTransactionHistory(context.Background(), &HistoryQuery{AccountID: 1, Limit: 2, Direction: DirectionDebit, MinAmount: &min})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if len(page.Transactions) != 2 || page.Transactions[1].TxID != tx2 || page.Transactions[1].BalanceAfter != 1000 {
+		t.Errorf("unexpected page %+v", page.Transactions)
+	}
+	if page.NextCursor == "" {
+		t.Fatal("expected a next cursor")
+	}
+
+	// the cursor continues after the last row returned
+	after, err := decodeHistoryCursor(page.NextCursor)
+	if err != nil {
+		t.Fatalf("failed to decode cursor: %v", err)
+	}
+	if !after.CreatedAt.Equal(t2) || after.TxID != tx2 {
+		t.Errorf("expected cursor at tx2, got %+v", after)
+	}
+
+	mock.ExpectQuery(`WHERE account_id = \$1 AND \(created_at, id\) < \(\$2, \$3\) AND created_at >= \$4 AND payment_sys_id = \$5 ORDER BY created_at DESC, id DESC LIMIT \$6`).
+		WithArgs(1, t2, after.TxID, t3, "pay3", 3).
+		WillReturnRows(sqlmock.NewRows(cols).AddRow(tx3, "pay3", "DEBIT", -100, 1200, t3))
+
+	page, err = dbPg.getTransactionHistory(context.Background(), &HistoryQuery{AccountID: 1, After: after, Limit: 2, From: &t3, PaymentSysID: "pay3"})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if len(page.Transactions) != 1 || page.NextCursor != "" {
+		t.Errorf("expected last page with one row, got %+v", page)
+	}
+
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("unmet expectations: %v", err)
+	}
+}
+
+// expects an account-changed event staged in the outbox
+func expectAccountChanged(mock sqlmock.Sqlmock) {
+	mock.ExpectExec("INSERT INTO accounts.outbox").
+		WithArgs(cmn.Topics.AccountChanged().S(), sqlmock.AnyArg(), sqlmock.AnyArg()).
+		WillReturnResult(sqlmock.NewResult(1, 1))
+}
+
+// matches a staged account-changed event
+type accountChangedArg struct {
+	want cmn.AccountChangedEvent
+}
+
+func (a accountChangedArg) Match(v driver.Value) bool {
+	b, ok := v.([]byte)
+	if !ok {
+		return false
+	}
+	got, err := cmn.FromBytes[cmn.AccountChangedEvent](b)
+	return err == nil && got.AccountID == a.want.AccountID && got.UserID == a.want.UserID &&
+		got.Change == a.want.Change && !got.Timestamp.IsZero()
+}
+
+func TestWriteAccountChanged(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatalf("failed to create mock: %v", err)
+	}
+	defer db.Close()
+
+	mock.ExpectBegin()
+	mock.ExpectExec("INSERT INTO accounts.outbox").
+		WithArgs(cmn.Topics.AccountChanged().S(), []byte("7"),
+			accountChangedArg{cmn.AccountChangedEvent{AccountID: 7, UserID: 3, Change: cmn.AccountHoldPlaced}}).
+		WillReturnResult(sqlmock.NewResult(1, 1))
+
+	tx, err := db.Begin()
+	if err != nil {
+		t.Fatalf("failed to begin: %v", err)
+	}
+	if err := writeAccountChanged(tx, 7, 3, cmn.AccountHoldPlaced); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("unmet expectations: %v", err)
+	}
+}
+
+func TestDBPostgresGetUserByID(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatalf("failed to create mock: %v", err)
+	}
+	defer db.Close()
+
+	dbPg := newDBPostgres(db, nil)
+
+	mock.ExpectQuery(`SELECT id, username, roles FROM accounts."user" WHERE id`).
+		WithArgs(1).
+		WillReturnRows(sqlmock.NewRows([]string{"id", "username", "roles"}).AddRow(1, "tim", "{admin}"))
+	mock.ExpectQuery(`SELECT id, username, roles FROM accounts."user" WHERE id`).
+		WithArgs(2).
+		WillReturnError(sql.ErrNoRows)
+
+	// each is only loaded once, including the user that doesn't exist
+	for range 2 {
+		user, err := dbPg.getUserByID(context.Background(), 1)
+		if err != nil || user.Username != "tim" || len(user.Roles) != 1 || user.Roles[0] != "admin" {
+			t.Errorf("unexpected user %+v %v", user, err)
+		}
+
+		_, err = dbPg.getUserByID(context.Background(), 2)
+		if err != cmn.ErrUserNotFound {
+			t.Errorf("expected ErrUserNotFound, got %v", err)
+		}
+	}
+
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("unmet expectations: %v", err)
+	}
+}
+
+func TestDBPostgresGetUserFromDB(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatalf("failed to create mock: %v", err)
+	}
+	defer db.Close()
+
+	dbPg := newDBPostgres(db, nil)
+
+	// loaded every time, roles can change at any moment
+	mock.ExpectQuery(`SELECT id, username, roles FROM accounts."user" WHERE id`).
+		WithArgs(1).
+		WillReturnRows(sqlmock.NewRows([]string{"id", "username", "roles"}).AddRow(1, "tim", "{admin}"))
+	mock.ExpectQuery(`SELECT id, username, roles FROM accounts."user" WHERE id`).
+		WithArgs(1).
+		WillReturnRows(sqlmock.NewRows([]string{"id", "username", "roles"}).AddRow(1, "tim", "{customer}"))
+
+	user, err := dbPg.getUserFromDB(context.Background(), 1)
+	if err != nil || !user.HasRole(cmn.RoleAdmin) {
+		t.Errorf("expected admin, got %+v %v", user, err)
+	}
+	user, err = dbPg.getUserFromDB(context.Background(), 1)
+	if err != nil || user.HasRole(cmn.RoleAdmin) {
+		t.Errorf("expected admin role revoked, got %+v %v", user, err)
+	}
+
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("unmet expectations: %v", err)
+	}
+}
+
+func TestDBPostgresGetBanks(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatalf("failed to create mock: %v", err)
+	}
+	defer db.Close()
+
+	dbPg := newDBPostgres(db, nil)
+
+	mock.ExpectQuery("SELECT id, name FROM accounts.bank").
+		WillReturnRows(sqlmock.NewRows([]string{"id", "name"}).AddRow(1, "BankOfTim").AddRow(2, "BankOfTom"))
+
+	for range 2 {
+		banks, err := dbPg.getBanks(context.Background())
+		if err != nil || len(banks) != 2 || banks[1].Name != "BankOfTom" {
+			t.Errorf("unexpected banks %v %v", banks, err)
+		}
+	}
+
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("unmet expectations: %v", err)
+	}
+}
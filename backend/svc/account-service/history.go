@@ -0,0 +1,204 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strconv"
+	"time"
+
+	"github.com/google/uuid"
+	cmn "github.com/timkins666/distributed-playground/backend/pkg/common"
+)
+
+const (
+	defaultHistoryLimit = 50
+	maxHistoryLimit     = 200
+)
+
+// the direction money moved on an account
+type Direction string
+
+const (
+	DirectionCredit Direction = "credit"
+	DirectionDebit  Direction = "debit"
+)
+
+// one transaction on an account, newest first in a history page
+type HistoryEntry struct {
+	TxID         string             `json:"txId"`
+	PaymentSysID string             `json:"paymentSysId"`
+	Leg          cmn.TransactionLeg `json:"leg"`
+	// negative for debits
+	Amount int64 `json:"amount"`
+	// account balance immediately after this transaction
+	BalanceAfter int64     `json:"balanceAfter"`
+	CreatedAt    time.Time `json:"createdAt"`
+}
+
+// a page of an account's transaction history
+type HistoryPage struct {
+	Transactions []HistoryEntry `json:"transactions"`
+	// pass as cursor to get the next page, empty on the last page
+	NextCursor string `json:"nextCursor,omitempty"`
+}
+
+// position in an account's history, the last entry of the previous page
+type historyCursor struct {
+	CreatedAt time.Time `json:"t"`
+	TxID      string    `json:"id"`
+}
+
+func (c historyCursor) encode() string {
+	b, _ := json.Marshal(c)
+	return base64.RawURLEncoding.EncodeToString(b)
+}
+
+func decodeHistoryCursor(s string) (*historyCursor, error) {
+	b, err := base64.RawURLEncoding.DecodeString(s)
+	if err != nil {
+		return nil, err
+	}
+	var c historyCursor
+	if err := json.Unmarshal(b, &c); err != nil {
+		return nil, err
+	}
+	if _, err := uuid.Parse(c.TxID); err != nil {
+		return nil, err
+	}
+	return &c, nil
+}
+
+// filters and page of a transaction history request. nil and empty filters match everything.
+type HistoryQuery struct {
+	AccountID int32
+	After     *historyCursor
+	Limit     int
+	// created at or after From and before To
+	From, To  *time.Time
+	Direction Direction
+	// inclusive bounds on the size of the amount, whichever direction it moved
+	MinAmount, MaxAmount *int64
+	PaymentSysID         string
+}
+
+// parseHistoryQuery reads the query string of a history request:
+// cursor, limit, from, to (RFC3339), direction (credit or debit), minAmount, maxAmount, paymentSysId
+func parseHistoryQuery(accountID int32, v url.Values) (*HistoryQuery, error) {
+	q := &HistoryQuery{AccountID: accountID, Limit: defaultHistoryLimit}
+
+	if s := v.Get("cursor"); s != "" {
+		c, err := decodeHistoryCursor(s)
+		if err != nil {
+			return nil, fmt.Errorf("invalid cursor")
+		}
+		q.After = c
+	}
+
+	if s := v.Get("limit"); s != "" {
+		n, err := strconv.Atoi(s)
+		if err != nil || n < 1 || n > maxHistoryLimit {
+			return nil, fmt.Errorf("limit must be between 1 and %d", maxHistoryLimit)
+		}
+		q.Limit = n
+	}
+
+	for key, dst := range map[string]**time.Time{"from": &q.From, "to": &q.To} {
+		if s := v.Get(key); s != "" {
+			t, err := time.Parse(time.RFC3339, s)
+			if err != nil {
+				return nil, fmt.Errorf("%s must be an RFC3339 time", key)
+			}
+			// stored without a zone, in UTC
+			t = t.UTC()
+			*dst = &t
+		}
+	}
+	if q.From != nil && q.To != nil && !q.From.Before(*q.To) {
+		return nil, fmt.Errorf("from must be before to")
+	}
+
+	switch d := Direction(v.Get("direction")); d {
+	case "", DirectionCredit, DirectionDebit:
+		q.Direction = d
+	default:
+		return nil, fmt.Errorf("direction must be %s or %s", DirectionCredit, DirectionDebit)
+	}
+
+	for key, dst := range map[string]**int64{"minAmount": &q.MinAmount, "maxAmount": &q.MaxAmount} {
+		if s := v.Get(key); s != "" {
+			n, err := strconv.ParseInt(s, 10, 64)
+			if err != nil || n < 0 {
+				return nil, fmt.Errorf("%s must be a non-negative integer", key)
+			}
+			*dst = &n
+		}
+	}
+	if q.MinAmount != nil && q.MaxAmount != nil && *q.MinAmount > *q.MaxAmount {
+		return nil, fmt.Errorf("minAmount can't be more than maxAmount")
+	}
+
+	if s := v.Get("paymentSysId"); s != "" {
+		if _, err := uuid.Parse(s); err != nil {
+			return nil, fmt.Errorf("invalid paymentSysId")
+		}
+		q.PaymentSysID = s
+	}
+
+	return q, nil
+}
+
+// getTransactionHistoryHandler returns a page of the transactions on one of the user's accounts
+func (s *Service) getTransactionHistoryHandler(w http.ResponseWriter, r *http.Request) {
+	appCtx, ok := r.Context().Value(cmn.AppCtx).(*accountsCtx)
+	if !ok {
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		return
+	}
+
+	userID, ok := r.Context().Value(cmn.UserIDKey).(int32)
+	if !ok || userID == 0 {
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+
+	accountID, err := strconv.ParseInt(r.PathValue("accountId"), 10, 32)
+	if err != nil || accountID <= 0 {
+		s.writeErrorResponse(w, "invalid account ID", http.StatusBadRequest)
+		return
+	}
+
+	// someone else's account is reported as not found so as not to reveal it exists
+	acc, err := appCtx.db.getAccountByID(r.Context(), int32(accountID))
+	if err != nil && !errors.Is(err, sql.ErrNoRows) && !errors.Is(err, cmn.ErrAccountNotFound) {
+		appCtx.logger.Printf("Failed to get account %d: %v", accountID, err)
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		return
+	}
+	if err != nil || acc.UserID != userID {
+		s.writeErrorResponse(w, cmn.ErrAccountNotFound.Error(), http.StatusNotFound)
+		return
+	}
+
+	query, err := parseHistoryQuery(int32(accountID), r.URL.Query())
+	if err != nil {
+		s.writeErrorResponse(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	page, err := appCtx.db.getTransactionHistory(r.Context(), query)
+	if err != nil {
+		appCtx.logger.Printf("Failed to get transaction history for account %d: %v", accountID, err)
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(page); err != nil {
+		appCtx.logger.Printf("Failed to encode transaction history response: %v", err)
+	}
+}
@@ -0,0 +1,125 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+	"time"
+
+	"github.com/bmizerany/assert"
+	cmn "github.com/timkins666/distributed-playground/backend/pkg/common"
+)
+
+func TestGetTransactionHistoryHandler(t *testing.T) {
+	created := time.Date(2025, 1, 2, 3, 4, 5, 0, time.UTC)
+	history := []HistoryEntry{
+		{
+			TxID:         "5b0c0b63-3f0e-4a39-9a2c-7b1e4b2a2c01",
+			PaymentSysID: "8d6d5a0e-2b39-4d4e-8c53-0c2d9d2f7e11",
+			Leg:          cmn.LegDebit,
+			Amount:       -250,
+			BalanceAfter: 750,
+			CreatedAt:    created,
+		},
+	}
+
+	tests := []struct {
+		name           string
+		userID         int32
+		accountID      string
+		query          string
+		expectedStatus int
+	}{
+		{name: "own account", userID: 1, accountID: "1", expectedStatus: http.StatusOK},
+		{name: "with filters", userID: 1, accountID: "1", query: "?direction=debit&limit=10", expectedStatus: http.StatusOK},
+		{name: "no user", userID: 0, accountID: "1", expectedStatus: http.StatusUnauthorized},
+		{name: "invalid account id", userID: 1, accountID: "abc", expectedStatus: http.StatusBadRequest},
+		{name: "unknown account", userID: 1, accountID: "99", expectedStatus: http.StatusNotFound},
+		{name: "someone else's account", userID: 2, accountID: "1", expectedStatus: http.StatusNotFound},
+		{name: "invalid filter", userID: 1, accountID: "1", query: "?direction=sideways", expectedStatus: http.StatusBadRequest},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			service := getTestService()
+			db := service.appCtx.db.(*MockAccDB)
+			db.history = history
+
+			req := setupTestRequest(http.MethodGet, "/"+tt.accountID+"/transactions"+tt.query, nil, *service.appCtx, tt.userID)
+			req.SetPathValue("accountId", tt.accountID)
+			w := httptest.NewRecorder()
+
+			service.getTransactionHistoryHandler(w, req)
+
+			assert.Equal(t, tt.expectedStatus, w.Code)
+			if tt.expectedStatus != http.StatusOK {
+				assert.Equal(t, (*HistoryQuery)(nil), db.historyQuery)
+				return
+			}
+
+			var page HistoryPage
+			if err := json.NewDecoder(w.Body).Decode(&page); err != nil {
+				t.Fatalf("failed to decode response: %v", err)
+			}
+			assert.Equal(t, history, page.Transactions)
+			assert.Equal(t, int32(1), db.historyQuery.AccountID)
+		})
+	}
+}
+
+func TestParseHistoryQuery(t *testing.T) {
+	from := time.Date(2025, 1, 1, 0, 0, 0, 0, time.UTC)
+	to := time.Date(2025, 2, 1, 0, 0, 0, 0, time.UTC)
+	cursor := historyCursor{CreatedAt: from, TxID: "5b0c0b63-3f0e-4a39-9a2c-7b1e4b2a2c01"}
+
+	q, err := parseHistoryQuery(3, url.Values{})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	assert.Equal(t, &HistoryQuery{AccountID: 3, Limit: defaultHistoryLimit}, q)
+
+	q, err = parseHistoryQuery(3, url.Values{
+		"cursor":       {cursor.encode()},
+		"limit":        {"20"},
+		"from":         {"2025-01-01T01:00:00+01:00"},
+		"to":           {"2025-02-01T00:00:00Z"},
+		"direction":    {"credit"},
+		"minAmount":    {"100"},
+		"maxAmount":    {"500"},
+		"paymentSysId": {"8d6d5a0e-2b39-4d4e-8c53-0c2d9d2f7e11"},
+	})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	min, max := int64(100), int64(500)
+	assert.Equal(t, &HistoryQuery{
+		AccountID:    3,
+		After:        &cursor,
+		Limit:        20,
+		From:         &from,
+		To:           &to,
+		Direction:    DirectionCredit,
+		MinAmount:    &min,
+		MaxAmount:    &max,
+		PaymentSysID: "8d6d5a0e-2b39-4d4e-8c53-0c2d9d2f7e11",
+	}, q)
+
+	invalid := []url.Values{
+		{"cursor": {"not-a-cursor"}},
+		{"limit": {"0"}},
+		{"limit": {"201"}},
+		{"from": {"yesterday"}},
+		{"from": {"2025-02-01T00:00:00Z"}, "to": {"2025-01-01T00:00:00Z"}},
+		{"direction": {"both"}},
+		{"minAmount": {"-1"}},
+		{"minAmount": {"500"}, "maxAmount": {"100"}},
+		{"paymentSysId": {"123"}},
+	}
+	for _, v := range invalid {
+		if _, err := parseHistoryQuery(3, v); err == nil {
+			t.Errorf("expected error for %v", v)
+		}
+	}
+}
@@ -0,0 +1,74 @@
+package main
+
+import (
+	"context"
+	"errors"
+
+	"github.com/segmentio/kafka-go"
+	cmn "github.com/timkins666/distributed-playground/backend/pkg/common"
+)
+
+// holds reserve funds between a successful balance check and the debit being committed by
+// the transaction service, so concurrent payments can't both spend the same balance.
+// a hold is consumed with the debit, released if the payment or its debit fails, or lapses after
+// the hold TTL.
+
+var (
+	errInsufficientFunds = errors.New("insufficient available funds")
+	// the payment's hold was already released or consumed, so a redelivered or redriven
+	// request can't reserve the funds again
+	errHoldClosed = errors.New("hold for payment already released or consumed")
+	// funds can only be held on an account by the user who owns it
+	errNotAccountOwner = errors.New("account not owned by user")
+)
+
+// releases holds for failed payments and rejected debits
+func holdReleaser(appCtx *accountsCtx) {
+	cmn.Consume(appCtx.cancelCtx, appCtx.holdReader, func(ctx context.Context, msg kafka.Message) error {
+		var err error
+		switch msg.Topic {
+		case cmn.Topics.TransactionFailed().S():
+			err = handleTransactionFailedMessage(ctx, msg, appCtx)
+		default:
+			err = handlePaymentFailedMessage(ctx, msg, appCtx)
+		}
+		if err != nil {
+			appCtx.logger.Printf("Failed to release hold: %v", err)
+		}
+		return err
+	}, appCtx.logger)
+	appCtx.logger.Println("Context cancelled, stopping hold releaser")
+}
+
+func handlePaymentFailedMessage(ctx context.Context, msg kafka.Message, appCtx *accountsCtx) error {
+	pm, err := cmn.FromBytes[cmn.PaymentFailedEvent](msg.Value)
+	if err != nil {
+		return cmn.Unprocessable(err)
+	}
+
+	return releaseHold(ctx, pm.SystemID, "failed payment", appCtx)
+}
+
+// a debit rejected by the transaction service, e.g. for insufficient funds, never consumes its
+// hold, so it's released rather than left to lapse
+func handleTransactionFailedMessage(ctx context.Context, msg kafka.Message, appCtx *accountsCtx) error {
+	event, err := cmn.FromBytes[cmn.TransactionEvent](msg.Value)
+	if err != nil {
+		return cmn.Unprocessable(err)
+	}
+	if event.Leg != cmn.LegDebit {
+		return nil
+	}
+	return releaseHold(ctx, event.PaymentSysID, "rejected debit of payment", appCtx)
+}
+
+func releaseHold(ctx context.Context, paymentSysID, why string, appCtx *accountsCtx) error {
+	released, err := appCtx.db.releaseHold(ctx, paymentSysID)
+	if err != nil {
+		return err
+	}
+	if released {
+		appCtx.logger.Printf("Released hold for %s %s", why, paymentSysID)
+	}
+	return nil
+}
@@ -0,0 +1,83 @@
+package main
+
+import (
+	"context"
+	"testing"
+
+	"github.com/bmizerany/assert"
+	"github.com/segmentio/kafka-go"
+	cmn "github.com/timkins666/distributed-playground/backend/pkg/common"
+)
+
+func TestCheckBalancePlacesHold(t *testing.T) {
+	mockDB := NewMockAccDB()
+	mockDB.accounts[1] = cmn.Account{AccountID: 1, Balance: 1000}
+
+	appCtx := &accountsCtx{
+		cancelCtx: context.Background(),
+		db:        mockDB,
+		logger:    cmn.AppLogger(),
+	}
+
+	check := &balanceCheck{appCtx: appCtx}
+
+	// first payment reserves most of the balance, the second can't be covered
+	first := runCheck(context.Background(), check, &cmn.PaymentRequest{SystemID: "pay1", SourceAccountID: 1, Amount: 800})
+	second := runCheck(context.Background(), check, &cmn.PaymentRequest{SystemID: "pay2", SourceAccountID: 1, Amount: 800})
+
+	assert.Equal(t, true, first.Result)
+	assert.Equal(t, false, second.Result)
+	assert.Equal(t, "insufficient funds: has 200, needs 800", second.Error)
+	assert.Equal(t, 1, len(mockDB.holds))
+}
+
+func TestHandlePaymentFailedMessage(t *testing.T) {
+	mockDB := NewMockAccDB()
+	mockDB.holds["pay1"] = cmn.Account{AccountID: 1, Balance: 800}
+
+	appCtx := &accountsCtx{
+		cancelCtx: context.Background(),
+		db:        mockDB,
+		logger:    cmn.AppLogger(),
+	}
+
+	val, _ := cmn.ToBytes(cmn.PaymentFailedEvent{Type: cmn.PaymentFailed, SystemID: "pay1", Reason: "nope"})
+	err := handlePaymentFailedMessage(context.Background(), kafka.Message{Value: val}, appCtx)
+
+	assert.Equal(t, nil, err)
+	assert.Equal(t, 0, len(mockDB.holds))
+}
+
+func TestHandleTransactionFailedMessage(t *testing.T) {
+	tests := []struct {
+		leg          cmn.TransactionLeg
+		wantReleased bool
+	}{
+		{leg: cmn.LegDebit, wantReleased: true},
+		{leg: cmn.LegCredit},
+		{leg: cmn.LegCompensation},
+	}
+
+	for _, tt := range tests {
+		t.Run(string(tt.leg), func(t *testing.T) {
+			mockDB := NewMockAccDB()
+			mockDB.holds["pay1"] = cmn.Account{AccountID: 1, Balance: 800}
+
+			appCtx := &accountsCtx{
+				cancelCtx: context.Background(),
+				db:        mockDB,
+				logger:    cmn.AppLogger(),
+			}
+
+			val, _ := cmn.ToBytes(cmn.TransactionEvent{
+				PaymentSysID: "pay1", AccountID: 1, Leg: tt.leg, Amount: -800, Reason: cmn.TxFailureInsufficientFunds,
+			})
+			msg := kafka.Message{Topic: cmn.Topics.TransactionFailed().S(), Value: val}
+			err := handleTransactionFailedMessage(context.Background(), msg, appCtx)
+
+			assert.Equal(t, nil, err)
+			_, held := mockDB.holds["pay1"]
+			assert.Equal(t, tt.wantReleased, !held)
+		})
+	}
+}
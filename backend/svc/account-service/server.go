@@ -2,6 +2,7 @@ package main
 
 import (
 	"context"
+	"encoding/json"
 	"fmt"
 	"net/http"
 	"os"
@@ -13,9 +14,10 @@ import (
 )
 
 type HTTPServer struct {
-	server  *http.Server
-	service *Service
-	config  *Config
+	server    *http.Server
+	service   *Service
+	config    *Config
+	validator *validatorPool
 }
 
 // creates a new HTTP server instance
@@ -37,6 +39,9 @@ func (h *HTTPServer) Start(ctx context.Context) error {
 		IdleTimeout:  h.config.Server.IdleTimeout,
 	}
 
+	h.validator = newValidatorPool(h.service.appCtx,
+		h.config.Kafka.ValidatorWorkers, h.config.Kafka.ValidatorQueueDepth)
+
 	stop := make(chan os.Signal, 1)
 	signal.Notify(stop, os.Interrupt, syscall.SIGTERM)
 
@@ -48,7 +53,18 @@ func (h *HTTPServer) Start(ctx context.Context) error {
 	}()
 
 	// Start payment validator
-	go paymentValidator(h.service.appCtx)
+	fetchCtx, stopFetching := context.WithCancel(ctx)
+	defer stopFetching()
+	go h.validator.Run(fetchCtx)
+	// retries are validated off the pool, each tier waits out its delay in order
+	for _, reader := range h.service.appCtx.payReqRetryReaders {
+		go cmn.Consume(ctx, reader, h.validator.handle, h.service.appCtx.logger)
+	}
+	go holdReleaser(h.service.appCtx)
+
+	if h.service.appCtx.outbox != nil {
+		go h.service.appCtx.outbox.Run(ctx)
+	}
 
 	// Wait for interrupt signal
 	<-stop
@@ -57,10 +73,17 @@ func (h *HTTPServer) Start(ctx context.Context) error {
 	shutdownCtx, cancel := context.WithTimeout(context.Background(), 60*time.Second)
 	defer cancel()
 
+	// stop taking new payment requests but let in-flight validations finish
+	stopFetching()
+
 	if err := h.server.Shutdown(shutdownCtx); err != nil {
 		return fmt.Errorf("server forced to shutdown: %w", err)
 	}
 
+	if err := h.validator.Wait(shutdownCtx); err != nil {
+		h.service.appCtx.logger.Printf("Validator did not drain before shutdown: %v", err)
+	}
+
 	h.service.appCtx.logger.Println("Server stopped :)")
 	return nil
 }
@@ -76,13 +99,17 @@ func (h *HTTPServer) setupRoutes() *http.ServeMux {
 	mux.HandleFunc("/banks", h.service.getAllBanksHandler)
 	mux.HandleFunc("/myaccounts", h.service.getUserAccountsHandler)
 	mux.HandleFunc("/new", h.service.createUserAccountHandler)
+	mux.HandleFunc("GET /{accountId}/transactions", h.service.getTransactionHistoryHandler)
+
+	// Admin endpoints
+	mux.HandleFunc("/admin/overdraft", h.service.setOverdraftLimitHandler)
 
 	return mux
 }
 
 // configures middleware chain
 func (h *HTTPServer) setupMiddleware(handler http.Handler) http.Handler {
-	return cmn.SetUserIDMiddlewareHandler(
+	return cmn.SetUserIDMiddlewareHandler(h.service.appCtx.revocations)(
 		cmn.SetContextValuesMiddleware(
 			map[cmn.ContextKey]any{cmn.AppCtx: h.service.appCtx})(handler))
 }
@@ -94,9 +121,21 @@ func (h *HTTPServer) healthCheckHandler(w http.ResponseWriter, r *http.Request)
 		return
 	}
 
+	resp := map[string]any{
+		"status":    "healthy",
+		"service":   "account-service",
+		"timestamp": time.Now().UTC().Format(time.RFC3339),
+	}
+	if h.validator != nil {
+		resp["validator"] = h.validator.stats()
+	}
+	if h.service != nil && h.service.appCtx != nil {
+		resp["redis"] = h.service.appCtx.redis.Healthy()
+	}
+
 	w.Header().Set("Content-Type", "application/json")
 	w.WriteHeader(http.StatusOK)
-	fmt.Fprintf(w, `{"status":"healthy","service":"account-service","timestamp":"%s"}`, time.Now().UTC().Format(time.RFC3339))
+	_ = json.NewEncoder(w).Encode(resp)
 }
 
 // gracefully stop the server
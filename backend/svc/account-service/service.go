@@ -1,8 +1,10 @@
 package main
 
 import (
+	"context"
 	"database/sql"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"math/rand/v2"
 	"net/http"
@@ -14,14 +16,12 @@ import (
 
 type Service struct {
 	appCtx *accountsCtx
-	banks  []*cmn.Bank
 }
 
 // sets up the service with all dependencies
 func initializeService(appCtx *accountsCtx) (*Service, error) {
 	return &Service{
 		appCtx: appCtx,
-		banks:  []*cmn.Bank{{Name: "BankOfTim", ID: 1}}, // TODO: load from database
 	}, nil
 }
 
@@ -39,7 +39,7 @@ func (s *Service) getAllBanksHandler(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	user, err := appCtx.db.getUserByID(userID)
+	user, err := appCtx.db.getUserByID(r.Context(), userID)
 	if err != nil || !user.Valid() {
 		var errStr string
 		if err != nil {
@@ -53,9 +53,16 @@ func (s *Service) getAllBanksHandler(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	banks, err := appCtx.db.getBanks(r.Context())
+	if err != nil {
+		appCtx.logger.Printf("Failed to get banks: %v", err)
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		return
+	}
+
 	appCtx.logger.Printf("User %s requested banks list", user.Username)
 	w.Header().Set("Content-Type", "application/json")
-	if err := json.NewEncoder(w).Encode(s.banks); err != nil {
+	if err := json.NewEncoder(w).Encode(banks); err != nil {
 		appCtx.logger.Printf("Failed to encode banks response: %v", err)
 		http.Error(w, "Internal server error", http.StatusInternalServerError)
 	}
@@ -75,7 +82,7 @@ func (s *Service) getUserAccountsHandler(w http.ResponseWriter, r *http.Request)
 		return
 	}
 
-	accs, err := appCtx.db.getUserAccounts(userID)
+	accs, err := appCtx.db.getUserAccounts(r.Context(), userID)
 	if err != nil && err != sql.ErrNoRows {
 		appCtx.logger.Printf("Failed to get accounts for user %d: %v", userID, err)
 		http.Error(w, "Internal server error", http.StatusInternalServerError)
@@ -127,7 +134,7 @@ func (s *Service) createUserAccountHandler(w http.ResponseWriter, r *http.Reques
 		return
 	}
 
-	accounts, err := s.createAccount(appCtx, userID, &req)
+	accounts, err := s.createAccount(r.Context(), appCtx, userID, &req)
 	if err != nil {
 		appCtx.logger.Printf("Failed to create account: %v", err)
 		s.writeErrorResponse(w, err.Error(), http.StatusBadRequest)
@@ -142,54 +149,74 @@ func (s *Service) createUserAccountHandler(w http.ResponseWriter, r *http.Reques
 }
 
 // createAccount handles the business logic for account creation
-func (s *Service) createAccount(appCtx *accountsCtx, userID int32, req *CreateAccountRequest) ([]cmn.Account, error) {
-	userAccounts, err := appCtx.db.getUserAccounts(userID)
+func (s *Service) createAccount(ctx context.Context, appCtx *accountsCtx, userID int32, req *CreateAccountRequest) ([]cmn.Account, error) {
+	userAccounts, err := appCtx.db.getUserAccounts(ctx, userID)
 	if err != nil && err != sql.ErrNoRows {
 		return nil, fmt.Errorf("failed to get user accounts: %w", err)
 	}
 
+	// every account is with the first bank for now
+	banks, err := appCtx.db.getBanks(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get banks: %w", err)
+	}
+	if len(banks) == 0 {
+		return nil, fmt.Errorf("no banks to create the account with")
+	}
+
 	var sourceAcc *cmn.Account
 	isFirstAccount := len(userAccounts) == 0
+	paymentSysID := uuid.NewString()
 
 	if !isFirstAccount {
 		if req.InitialBalance <= 0 {
 			return nil, cmn.ErrNoNewAccountBalance
 		}
 
-		sourceAcc, err = s.validateSourceAccount(appCtx, req.SourceFundsAccountID, userID, req.InitialBalance)
+		sourceAcc, err = s.validateSourceAccount(ctx, appCtx, req.SourceFundsAccountID, userID, req.InitialBalance)
 		if err != nil {
 			return nil, err
 		}
+
+		// the funds are held like a payment's until the transfer's debit consumes them
+		if err := s.holdSourceFunds(ctx, appCtx, req.SourceFundsAccountID, userID, paymentSysID, req.InitialBalance); err != nil {
+			return nil, err
+		}
 	} else {
 		// First account gets random balance
 		req.InitialBalance = rand.Int64N(10e5) + 1000 // Ensure minimum balance
 	}
 
 	newAccount := cmn.Account{
-		Name:     req.Name,
-		UserID:   userID,
-		Balance:  req.InitialBalance,
-		BankID:   s.banks[0].ID,
-		BankName: s.banks[0].Name,
+		Name:             req.Name,
+		UserID:           userID,
+		Balance:          req.InitialBalance,
+		AvailableBalance: req.InitialBalance,
+		BankID:           banks[0].ID,
+		BankName:         banks[0].Name,
 	}
 
-	accID, err := appCtx.db.createAccount(newAccount)
+	// the funding transactions are staged in the outbox with the account row
+	accID, err := appCtx.db.createAccount(ctx, newAccount, func(accID int32) ([]kafka.Message, error) {
+		newAccount.AccountID = accID
+		return s.createAccountTransactions(appCtx, &newAccount, sourceAcc, req.SourceFundsAccountID, paymentSysID)
+	})
 	if err != nil || accID <= 0 {
+		if sourceAcc != nil {
+			if _, relErr := appCtx.db.releaseHold(ctx, paymentSysID); relErr != nil {
+				appCtx.logger.Printf("Failed to release hold %s for account that wasn't created: %v", paymentSysID, relErr)
+			}
+		}
 		return nil, fmt.Errorf("failed to create account: %w", err)
 	}
 	newAccount.AccountID = accID
 
 	appCtx.logger.Printf("Created new account %d for user %d with balance %d", accID, userID, req.InitialBalance)
 
-	// Create transactions for the account creation
-	if err := s.createAccountTransactions(appCtx, &newAccount, sourceAcc, req.SourceFundsAccountID); err != nil {
-		appCtx.logger.Printf("Failed to create transactions: %v", err)
-		// TODO: Account is created, but transactions failed - rollback
-	}
-
 	respAccounts := []cmn.Account{newAccount}
 	if sourceAcc != nil {
 		sourceAcc.Balance -= req.InitialBalance
+		sourceAcc.AvailableBalance -= req.InitialBalance
 		respAccounts = append(respAccounts, *sourceAcc)
 	}
 
@@ -197,12 +224,12 @@ func (s *Service) createAccount(appCtx *accountsCtx, userID int32, req *CreateAc
 }
 
 // validateSourceAccount validates the source account for fund transfer
-func (s *Service) validateSourceAccount(appCtx *accountsCtx, sourceAccountID, userID int32, amount int64) (*cmn.Account, error) {
+func (s *Service) validateSourceAccount(ctx context.Context, appCtx *accountsCtx, sourceAccountID, userID int32, amount int64) (*cmn.Account, error) {
 	if sourceAccountID == 0 {
 		return nil, fmt.Errorf("source account ID is required for additional accounts")
 	}
 
-	sourceAcc, err := appCtx.db.getAccountByID(sourceAccountID)
+	sourceAcc, err := appCtx.db.getAccountByID(ctx, sourceAccountID)
 	if err != nil {
 		return nil, cmn.ErrAccountNotFound
 	}
@@ -211,69 +238,61 @@ func (s *Service) validateSourceAccount(appCtx *accountsCtx, sourceAccountID, us
 		return nil, fmt.Errorf("source account does not belong to user")
 	}
 
-	if sourceAcc.Balance < amount {
+	if sourceAcc.AvailableBalance < amount {
 		return nil, fmt.Errorf("source account doesn't have enough funds")
 	}
 
 	return sourceAcc, nil
 }
 
-// creates the necessary Kafka messages for initial account balance transfer
-func (s *Service) createAccountTransactions(appCtx *accountsCtx, newAccount *cmn.Account, sourceAcc *cmn.Account, sourceAccountID int32) error {
-	paymentID := uuid.NewString()
-
-	// Transaction for the new account (credit)
-	txCredit := cmn.Transaction{
-		TxID:         uuid.NewString(),
-		Amount:       newAccount.Balance,
-		AccountID:    newAccount.AccountID,
-		PaymentSysID: paymentID,
+// holdSourceFunds reserves the new account's funding on the source account, so it can't also
+// be spent by a payment before the transfer is committed
+func (s *Service) holdSourceFunds(ctx context.Context, appCtx *accountsCtx, sourceAccountID, userID int32, paymentSysID string, amount int64) error {
+	_, err := appCtx.db.placeHold(ctx, sourceAccountID, userID, paymentSysID, amount, appCtx.holdTTL)
+	switch {
+	case err == nil:
+		return nil
+	case err == errInsufficientFunds:
+		return fmt.Errorf("source account doesn't have enough funds")
+	case err == errNotAccountOwner:
+		return fmt.Errorf("source account does not belong to user")
+	case errors.Is(err, cmn.ErrAccountNotFound):
+		return cmn.ErrAccountNotFound
+	default:
+		return fmt.Errorf("failed to hold funds: %w", err)
 	}
+}
 
-	txKey, err := cmn.ToBytes(newAccount.AccountID)
-	if err != nil {
-		return fmt.Errorf("failed to serialize account ID: %w", err)
+// creates the transfer funding the new account. the first account's balance is a gift from
+// the bank's opening balances account.
+func (s *Service) createAccountTransactions(appCtx *accountsCtx, newAccount *cmn.Account, sourceAcc *cmn.Account, sourceAccountID int32, paymentSysID string) ([]kafka.Message, error) {
+	transfer := cmn.Transfer{
+		PaymentSysID:    paymentSysID,
+		SourceAccountID: cmn.SystemAccountOpeningBalances,
+		TargetAccountID: newAccount.AccountID,
+		Amount:          newAccount.Balance,
+	}
+	if sourceAcc != nil {
+		transfer.SourceAccountID = sourceAccountID
 	}
 
-	txMsg, err := cmn.ToBytes(txCredit)
+	// keyed by the source account like payment transfers, so its debits stay in order
+	key, err := cmn.ToBytes(transfer.SourceAccountID)
 	if err != nil {
-		return fmt.Errorf("failed to serialize transaction: %w", err)
+		return nil, fmt.Errorf("failed to serialize account ID: %w", err)
 	}
 
-	messages := []kafka.Message{{
-		Topic: cmn.Topics.TransactionRequested().S(),
-		Key:   txKey,
-		Value: txMsg,
-	}}
-
-	// If there's a source account, create debit transaction
-	if sourceAcc != nil {
-		txDebit := cmn.Transaction{
-			TxID:         uuid.NewString(),
-			Amount:       -newAccount.Balance,
-			AccountID:    sourceAccountID,
-			PaymentSysID: paymentID,
-		}
-
-		debitKey, err := cmn.ToBytes(sourceAccountID)
-		if err != nil {
-			return fmt.Errorf("failed to serialize source account ID: %w", err)
-		}
-
-		debitMsg, err := cmn.ToBytes(txDebit)
-		if err != nil {
-			return fmt.Errorf("failed to serialize debit transaction: %w", err)
-		}
-
-		messages = append(messages, kafka.Message{
-			Topic: cmn.Topics.TransactionRequested().S(),
-			Key:   debitKey,
-			Value: debitMsg,
-		})
+	val, err := cmn.ToBytes(transfer)
+	if err != nil {
+		return nil, fmt.Errorf("failed to serialize transfer: %w", err)
 	}
 
-	appCtx.logger.Printf("Created %d transactions for new account %d", len(messages), newAccount.AccountID)
-	return appCtx.writer.WriteMessages(appCtx.cancelCtx, messages...)
+	appCtx.logger.Printf("Created transfer %s funding new account %d", transfer.PaymentSysID, newAccount.AccountID)
+	return []kafka.Message{{
+		Topic: cmn.Topics.TransferRequested().S(),
+		Key:   key,
+		Value: val,
+	}}, nil
 }
 
 // writeErrorResponse writes a JSON error response
@@ -4,10 +4,13 @@ import (
 	"bytes"
 	"context"
 	"encoding/json"
+	"errors"
 	"net/http"
 	"net/http/httptest"
 	"testing"
+	"time"
 
+	"github.com/segmentio/kafka-go"
 	cmn "github.com/timkins666/distributed-playground/backend/pkg/common"
 	tu "github.com/timkins666/distributed-playground/backend/pkg/testutils"
 )
@@ -16,6 +19,9 @@ import (
 type mockDB struct {
 	users     map[int32]*cmn.User
 	accounts  map[int32]*cmn.Account
+	holds     map[string]int32
+	outbox    []kafka.Message
+	failWrite bool
 	nextAccID int32
 }
 
@@ -23,18 +29,27 @@ func NewMockDB() *mockDB {
 	return &mockDB{
 		users:     make(map[int32]*cmn.User),
 		accounts:  make(map[int32]*cmn.Account),
+		holds:     make(map[string]int32),
 		nextAccID: 1,
 	}
 }
 
-func (m *mockDB) getUserByID(id int32) (*cmn.User, error) {
+func (m *mockDB) getUserByID(_ context.Context, id int32) (*cmn.User, error) {
 	if user, exists := m.users[id]; exists {
 		return user, nil
 	}
 	return &cmn.User{}, cmn.ErrUserNotFound
 }
 
-func (m *mockDB) getUserAccounts(userID int32) ([]cmn.Account, error) {
+func (m *mockDB) getUserFromDB(ctx context.Context, id int32) (*cmn.User, error) {
+	return m.getUserByID(ctx, id)
+}
+
+func (m *mockDB) getBanks(_ context.Context) ([]*cmn.Bank, error) {
+	return []*cmn.Bank{{Name: "BankOfTim", ID: 1}}, nil
+}
+
+func (m *mockDB) getUserAccounts(_ context.Context, userID int32) ([]cmn.Account, error) {
 	var accounts []cmn.Account
 	for _, acc := range m.accounts {
 		if acc.UserID == userID {
@@ -44,21 +59,63 @@ func (m *mockDB) getUserAccounts(userID int32) ([]cmn.Account, error) {
 	return accounts, nil
 }
 
-func (m *mockDB) getAccountByID(id int32) (*cmn.Account, error) {
+func (m *mockDB) getAccountByID(_ context.Context, id int32) (*cmn.Account, error) {
 	if acc, exists := m.accounts[id]; exists {
 		return acc, nil
 	}
 	return nil, cmn.ErrAccountNotFound
 }
 
-func (m *mockDB) createAccount(acc cmn.Account) (int32, error) {
+func (m *mockDB) createAccount(_ context.Context, acc cmn.Account, events accountEvents) (int32, error) {
+	if m.failWrite {
+		return 0, errors.New("db down")
+	}
 	id := m.nextAccID
+	msgs, err := events(id)
+	if err != nil {
+		return 0, err
+	}
+	m.outbox = append(m.outbox, msgs...)
 	m.nextAccID++
 	acc.AccountID = id
 	m.accounts[id] = &acc
 	return id, nil
 }
 
+func (m *mockDB) placeHold(_ context.Context, accountID, userID int32, paymentSysID string, amount int64, ttl time.Duration) (int64, error) {
+	acc, exists := m.accounts[accountID]
+	if !exists {
+		return 0, cmn.ErrAccountNotFound
+	}
+	if acc.UserID != userID {
+		return 0, errNotAccountOwner
+	}
+	if acc.Balance < amount {
+		return acc.Balance, errInsufficientFunds
+	}
+	m.holds[paymentSysID] = accountID
+	return acc.Balance, nil
+}
+
+func (m *mockDB) releaseHold(_ context.Context, paymentSysID string) (bool, error) {
+	_, ok := m.holds[paymentSysID]
+	delete(m.holds, paymentSysID)
+	return ok, nil
+}
+
+func (m *mockDB) setOverdraftLimit(_ context.Context, accountID int32, limit int64) (*cmn.Account, error) {
+	acc, exists := m.accounts[accountID]
+	if !exists {
+		return nil, cmn.ErrAccountNotFound
+	}
+	acc.OverdraftLimit = limit
+	return acc, nil
+}
+
+func (m *mockDB) getTransactionHistory(_ context.Context, q *HistoryQuery) (*HistoryPage, error) {
+	return &HistoryPage{Transactions: []HistoryEntry{}}, nil
+}
+
 // Test helper to create a test service
 func createTestService(t *testing.T) *Service {
 	mockDB := NewMockDB()
@@ -388,7 +445,7 @@ func TestConfig_Validate(t *testing.T) {
 			name: "valid config",
 			config: Config{
 				Server: ServerConfig{Port: "8080"},
-				Kafka:  KafkaConfig{Broker: "localhost:9092"},
+				Kafka:  KafkaConfig{Broker: "localhost:9092", ValidatorWorkers: 1},
 			},
 			wantErr: false,
 		},
@@ -447,3 +504,63 @@ func BenchmarkPaymentValidationResult_IsValid(b *testing.B) {
 		_ = result.IsValid()
 	}
 }
+
+func TestServiceCreateAccountFunding(t *testing.T) {
+	newSetup := func() (*Service, *mockDB) {
+		srv := createTestService(t)
+		db := srv.appCtx.db.(*mockDB)
+		db.accounts[10] = &cmn.Account{AccountID: 10, UserID: 1, Balance: 500, AvailableBalance: 500}
+		db.nextAccID = 11
+		return srv, db
+	}
+
+	t.Run("funds are held and the transfer is keyed by the source account", func(t *testing.T) {
+		srv, db := newSetup()
+
+		_, err := srv.createAccount(context.Background(), srv.appCtx, 1, &CreateAccountRequest{Name: "new", SourceFundsAccountID: 10, InitialBalance: 200})
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		if len(db.outbox) != 1 {
+			t.Fatalf("expected one transfer, got %d", len(db.outbox))
+		}
+
+		var transfer cmn.Transfer
+		if err := json.Unmarshal(db.outbox[0].Value, &transfer); err != nil {
+			t.Fatalf("failed to decode transfer: %v", err)
+		}
+		if acc, ok := db.holds[transfer.PaymentSysID]; !ok || acc != 10 {
+			t.Errorf("expected a hold on account 10 for transfer %s, got %v", transfer.PaymentSysID, db.holds)
+		}
+
+		key, _ := cmn.ToBytes(int32(10))
+		if !bytes.Equal(db.outbox[0].Key, key) {
+			t.Errorf("expected transfer keyed by source account, got %s", db.outbox[0].Key)
+		}
+	})
+
+	t.Run("insufficient funds places no hold", func(t *testing.T) {
+		srv, db := newSetup()
+
+		_, err := srv.createAccount(context.Background(), srv.appCtx, 1, &CreateAccountRequest{Name: "new", SourceFundsAccountID: 10, InitialBalance: 900})
+		if err == nil {
+			t.Fatal("expected an error")
+		}
+		if len(db.holds) != 0 || len(db.outbox) != 0 {
+			t.Errorf("expected no hold or transfer, got %v %v", db.holds, db.outbox)
+		}
+	})
+
+	t.Run("hold is released if the account isn't created", func(t *testing.T) {
+		srv, db := newSetup()
+		db.failWrite = true
+
+		_, err := srv.createAccount(context.Background(), srv.appCtx, 1, &CreateAccountRequest{Name: "new", SourceFundsAccountID: 10, InitialBalance: 200})
+		if err == nil {
+			t.Fatal("expected an error")
+		}
+		if len(db.holds) != 0 {
+			t.Errorf("expected the hold to be released, got %v", db.holds)
+		}
+	})
+}
@@ -3,7 +3,6 @@ package main
 import (
 	"context"
 	"fmt"
-	"math/rand/v2"
 	"strings"
 	"time"
 
@@ -14,24 +13,23 @@ import (
 type CheckName string
 
 const (
-	BalanceCheck       CheckName = "balanceCheck"
-	TargetAccountCheck CheckName = "targetAccountCheck"
+	BalanceCheck         CheckName = "balanceCheck"
+	TargetAccountCheck   CheckName = "targetAccountCheck"
+	SourceOwnershipCheck CheckName = "sourceOwnershipCheck"
 )
 
-type PaymentMsgType string
-
-const (
-	PaymentFailed PaymentMsgType = "paymentFailed"
-)
+// overall deadline for all checks on a payment, checks also have their own timeouts
+const validationTimeout = 4500 * time.Millisecond
 
 // result of a validation check
 type CheckResult struct {
-	CheckName CheckName `json:"checkName"`
-	Result    bool      `json:"result"`
-	Error     string    `json:"error,omitempty"`
+	CheckName  CheckName `json:"checkName"`
+	Result     bool      `json:"result"`
+	Error      string    `json:"error,omitempty"`
+	DurationMs int64     `json:"durationMs"`
 }
 
-// aggregates all validation results
+// aggregates all validation results, published on payment-verified when all pass
 type PaymentValidationResult struct {
 	PaymentRequest *cmn.PaymentRequest `json:"paymentRequest"`
 	Results        []CheckResult       `json:"results"`
@@ -40,25 +38,6 @@ type PaymentValidationResult struct {
 	EndTime        time.Time           `json:"endTime"`
 }
 
-// a payment failure message
-type PaymentMsg struct {
-	Type      PaymentMsgType `json:"type"`
-	Reason    string         `json:"reason"`
-	AppID     string         `json:"appId"`
-	SystemID  string         `json:"systemId"`
-	AccountID int32          `json:"accountId"`
-	Timestamp time.Time      `json:"timestamp"`
-}
-
-// populates PaymentMsg from PaymentRequest
-func (pm *PaymentMsg) FromReq(req *cmn.PaymentRequest) *PaymentMsg {
-	pm.AccountID = req.SourceAccountID
-	pm.AppID = req.AppID
-	pm.SystemID = req.SystemID
-	pm.Timestamp = time.Now()
-	return pm
-}
-
 // checks if a result indicates success
 func (pvr *PaymentValidationResult) IsValid() bool {
 	if pvr.TimedOut {
@@ -90,36 +69,13 @@ func (pvr *PaymentValidationResult) GetFailureReasons() []string {
 	return reasons
 }
 
-// handles validation of requested payments
-func paymentValidator(appCtx *accountsCtx) {
-	max_errors := 10
-	for {
-		select {
-		case <-appCtx.cancelCtx.Done():
-			appCtx.logger.Println("Context cancelled")
-			return
-		default:
-			msg, err := appCtx.payReqReader.ReadMessage(context.Background())
-			if err != nil {
-				appCtx.logger.Println("READ MSG ERROR", err)
-				max_errors--
-				if max_errors == 0 {
-					appCtx.logger.Println("Max errors reached, something seems wrong...")
-					break
-				}
-				continue
-			}
-			go handlePaymentRequestedMessage(msg, appCtx)
-		}
-	}
-}
-
-// handlePaymentRequestedMessage processes a payment request message
-func handlePaymentRequestedMessage(message kafka.Message, appCtx *accountsCtx) {
+// handlePaymentRequestedMessage processes a payment request message. an error means
+// the outcome wasn't published and the message should be retried.
+func handlePaymentRequestedMessage(message kafka.Message, appCtx *accountsCtx) error {
 	req, err := cmn.FromBytes[cmn.PaymentRequest](message.Value)
 	if err != nil {
 		appCtx.logger.Printf("Failed to parse payment request message: %v", err)
-		return
+		return cmn.Unprocessable(err)
 	}
 
 	appCtx.logger.Printf("Processing payment request: %s (amount: %d, from: %d, to: %d)",
@@ -127,7 +83,7 @@ func handlePaymentRequestedMessage(message kafka.Message, appCtx *accountsCtx) {
 
 	if !req.Valid() {
 		appCtx.logger.Printf("Invalid payment request: %s", req.SystemID)
-		return
+		return cmn.Unprocessable(fmt.Errorf("invalid payment request %s", req.SystemID))
 	}
 
 	validationResult := &PaymentValidationResult{
@@ -135,77 +91,100 @@ func handlePaymentRequestedMessage(message kafka.Message, appCtx *accountsCtx) {
 		StartTime:      time.Now(),
 	}
 
-	const numChecks = 2
-	results := make(chan CheckResult, numChecks)
+	checks := appCtx.checks.all()
+	ctx, cancel := context.WithTimeout(appCtx.cancelCtx, validationTimeout)
+	defer cancel()
 
-	// Start validation checks concurrently
-	go checkBalance(req, results, appCtx)
-	go checkTargetAccount(req, results, appCtx)
+	// Start validation checks concurrently. buffered so abandoned checks don't block.
+	results := make(chan CheckResult, len(checks))
+	for _, check := range checks {
+		go func() {
+			results <- runCheck(ctx, check, req)
+		}()
+	}
 
 	// Collect results with timeout
-	timeout := 4500 * time.Millisecond
 	for {
 		select {
 		case res := <-results:
 			appCtx.logger.Printf("Check %s completed: %t", res.CheckName, res.Result)
 			validationResult.Results = append(validationResult.Results, res)
 
-			if len(validationResult.Results) == numChecks {
+			if len(validationResult.Results) == len(checks) {
 				validationResult.EndTime = time.Now()
 				appCtx.logger.Printf("All checks completed for request %s in %v",
 					req.SystemID, validationResult.EndTime.Sub(validationResult.StartTime))
-				go handleValidationResults(validationResult, appCtx)
-				return
+				return handleValidationResults(validationResult, appCtx)
 			}
 			appCtx.logger.Printf("Waiting for %d more checks for request %s",
-				numChecks-len(validationResult.Results), req.SystemID)
+				len(checks)-len(validationResult.Results), req.SystemID)
+
+		case <-ctx.Done():
+			if appCtx.cancelCtx.Err() != nil {
+				appCtx.logger.Printf("Context cancelled while processing request %s", req.SystemID)
+				return appCtx.cancelCtx.Err()
+			}
 
-		case <-time.After(timeout):
 			validationResult.TimedOut = true
 			validationResult.EndTime = time.Now()
 			appCtx.logger.Printf("Validation timed out for request %s after %v (completed %d/%d checks)",
-				req.SystemID, timeout, len(validationResult.Results), numChecks)
-			go handleValidationResults(validationResult, appCtx)
-			return
-
-		case <-appCtx.cancelCtx.Done():
-			appCtx.logger.Printf("Context cancelled while processing request %s", req.SystemID)
-			return
+				req.SystemID, validationTimeout, len(validationResult.Results), len(checks))
+			return handleValidationResults(validationResult, appCtx)
 		}
 	}
 }
 
 // processes the validation results
-func handleValidationResults(result *PaymentValidationResult, appCtx *accountsCtx) {
+func handleValidationResults(result *PaymentValidationResult, appCtx *accountsCtx) error {
 	if !result.IsValid() {
 		reasons := result.GetFailureReasons()
 		reason := strings.Join(reasons, ", ")
-		sendPaymentFailed(result.PaymentRequest, reason, appCtx)
-		return
+		return sendPaymentFailed(result.PaymentRequest, reason, appCtx)
 	}
 
 	appCtx.logger.Printf("Payment validation successful for request %s", result.PaymentRequest.SystemID)
-	// TODO: Implement fund locking to prevent race conditions before transaction
-	initiateTransaction(result.PaymentRequest, appCtx)
+	if err := sendPaymentVerified(result, appCtx); err != nil {
+		appCtx.logger.Printf("Failed to publish payment verified message: %v", err)
+		return sendPaymentFailed(result.PaymentRequest, "failed to publish verification", appCtx)
+	}
+	return initiateTransaction(result.PaymentRequest, appCtx)
+}
+
+// publishes the validation result so downstream services see verification before the transaction
+func sendPaymentVerified(result *PaymentValidationResult, appCtx *accountsCtx) error {
+	key, err := cmn.ToBytes(result.PaymentRequest.SourceAccountID)
+	if err != nil {
+		return err
+	}
+	val, err := cmn.ToBytes(result)
+	if err != nil {
+		return err
+	}
+
+	return appCtx.writer.WriteMessages(appCtx.cancelCtx, kafka.Message{
+		Topic: cmn.Topics.PaymentVerified().S(),
+		Key:   key,
+		Value: val,
+	})
 }
 
 // publishes a payment failure message to Kafka
-func sendPaymentFailed(req *cmn.PaymentRequest, reason string, appCtx *accountsCtx) {
+func sendPaymentFailed(req *cmn.PaymentRequest, reason string, appCtx *accountsCtx) error {
 	appCtx.logger.Printf("Payment failed - Amount: %d, From: %d, To: %d, Reason: %s",
 		req.Amount, req.SourceAccountID, req.TargetAccountID, reason)
 
-	msg := (&PaymentMsg{Type: PaymentFailed, Reason: reason}).FromReq(req)
+	msg := (&cmn.PaymentFailedEvent{Type: cmn.PaymentFailed, Reason: reason}).FromReq(req)
 
 	key, err := cmn.ToBytes(msg.AccountID)
 	if err != nil {
 		appCtx.logger.Printf("Failed to serialize account ID for payment failure: %v", err)
-		return
+		return err
 	}
 
 	val, err := cmn.ToBytes(msg)
 	if err != nil {
 		appCtx.logger.Printf("Failed to serialize payment failure message: %v", err)
-		return
+		return err
 	}
 
 	if err := appCtx.writer.WriteMessages(appCtx.cancelCtx, kafka.Message{
@@ -214,103 +193,34 @@ func sendPaymentFailed(req *cmn.PaymentRequest, reason string, appCtx *accountsC
 		Value: val,
 	}); err != nil {
 		appCtx.logger.Printf("Failed to publish payment failure message: %v", err)
+		return err
 	}
+	return nil
 }
 
-// send message(s) for transaction service
-func initiateTransaction(req *cmn.PaymentRequest, appCtx *accountsCtx) {
+// hands the transfer to the transaction service, which applies both legs as a saga
+func initiateTransaction(req *cmn.PaymentRequest, appCtx *accountsCtx) error {
 	appCtx.logger.Printf("Initiate transaction of £%d from account %d to account %d", req.Amount, req.SourceAccountID, req.TargetAccountID)
 
-	txOut := cmn.Transaction{
-		PaymentSysID: req.SystemID,
-		AccountID:    req.SourceAccountID,
-		Amount:       -req.Amount,
-	}
-	kOut, errkOut := cmn.ToBytes(txOut.AccountID)
-	vOut, errvOut := cmn.ToBytes(txOut)
-
-	txIn := cmn.Transaction{
-		PaymentSysID: req.SystemID,
-		AccountID:    req.TargetAccountID,
-		Amount:       req.Amount,
-	}
-	kIn, errkIn := cmn.ToBytes(txIn.AccountID)
-	vIn, errvIn := cmn.ToBytes(txIn)
-
-	if errvOut != nil || errkOut != nil || errvIn != nil || errkIn != nil {
-		sendPaymentFailed(req, "processing error", appCtx)
-		return
-	}
-
-	err := appCtx.writer.WriteMessages(appCtx.cancelCtx,
-		kafka.Message{
-			Topic: cmn.Topics.TransactionRequested().S(),
-			Key:   kOut,
-			Value: vOut,
-		},
-		kafka.Message{
-			Topic: cmn.Topics.TransactionRequested().S(),
-			Key:   kIn,
-			Value: vIn,
-		})
-
-	if err != nil {
-		// TODO: what if one message sent
-		sendPaymentFailed(req, "failed to initiate transaction", appCtx)
-	}
-
-}
-
-// verifies that the source account has sufficient funds
-func checkBalance(req *cmn.PaymentRequest, chn chan<- CheckResult, appCtx *accountsCtx) {
-	// artificial delay for simulation
-	sleep := rand.N(5000)
-	appCtx.logger.Printf("%s sleeping for %dms", BalanceCheck, sleep)
-	time.Sleep(time.Duration(sleep) * time.Millisecond)
-
-	res := CheckResult{CheckName: BalanceCheck}
-
-	srcAcc, err := appCtx.db.getAccountByID(req.SourceAccountID)
-	if err != nil {
-		appCtx.logger.Printf("Source account %d not found: %v", req.SourceAccountID, err)
-		res.Result = false
-		res.Error = fmt.Sprintf("account not found: %v", err)
-		chn <- res
-		return
+	transfer := cmn.Transfer{
+		PaymentSysID:    req.SystemID,
+		SourceAccountID: req.SourceAccountID,
+		TargetAccountID: req.TargetAccountID,
+		Amount:          req.Amount,
 	}
-
-	appCtx.logger.Printf("Balance check - Account: %d, Balance: %d, Required: %d",
-		srcAcc.AccountID, srcAcc.Balance, req.Amount)
-
-	if srcAcc.Balance >= req.Amount {
-		res.Result = true
-		appCtx.logger.Printf("Balance check passed for account %d", srcAcc.AccountID)
-	} else {
-		res.Result = false
-		res.Error = fmt.Sprintf("insufficient funds: has %d, needs %d", srcAcc.Balance, req.Amount)
-		appCtx.logger.Printf("Balance check failed for account %d: %s", srcAcc.AccountID, res.Error)
+	key, errKey := cmn.ToBytes(transfer.SourceAccountID)
+	val, errVal := cmn.ToBytes(transfer)
+	if errKey != nil || errVal != nil {
+		return sendPaymentFailed(req, "processing error", appCtx)
 	}
 
-	chn <- res
-}
-
-// verifies that the target account exists
-func checkTargetAccount(req *cmn.PaymentRequest, chn chan<- CheckResult, appCtx *accountsCtx) {
-	// artificial delay for simulation
-	sleep := rand.N(5000)
-	appCtx.logger.Printf("%s sleeping for %dms", TargetAccountCheck, sleep)
-	time.Sleep(time.Duration(sleep) * time.Millisecond)
-
-	res := CheckResult{CheckName: TargetAccountCheck}
-
-	_, err := appCtx.db.getAccountByID(req.TargetAccountID)
+	err := appCtx.writer.WriteMessages(appCtx.cancelCtx, kafka.Message{
+		Topic: cmn.Topics.TransferRequested().S(),
+		Key:   key,
+		Value: val,
+	})
 	if err != nil {
-		appCtx.logger.Printf("Target account %d not found: %v", req.TargetAccountID, err)
-		res.Result = false
-	} else {
-		res.Result = true
-		appCtx.logger.Printf("Target account %d validated successfully", req.TargetAccountID)
+		return sendPaymentFailed(req, "failed to initiate transaction", appCtx)
 	}
-
-	chn <- res
+	return nil
 }
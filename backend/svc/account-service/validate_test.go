@@ -91,7 +91,7 @@ func TestHandleResultsFailedChecks(t *testing.T) {
 			assert.Equal(t, len(writer.Messages), 1)
 			assert.Equal(t, writer.Messages[0].Topic, tt.wantTopic.S())
 
-			pm, err := cmn.FromBytes[PaymentMsg](writer.Messages[0].Value)
+			pm, err := cmn.FromBytes[cmn.PaymentFailedEvent](writer.Messages[0].Value)
 			if err != nil {
 				t.Fatal("error decoding message value")
 			}
@@ -149,18 +149,27 @@ func TestHandleResultsChecksPassed(t *testing.T) {
 			handleValidationResults(tt.res, &appCtx)
 
 			assert.Equal(t, len(writer.Messages), 2)
-			m1 := writer.Messages[0]
-			m2 := writer.Messages[1]
+			verified := writer.Messages[0]
+			m1 := writer.Messages[1]
 
-			assert.Equal(t, m1.Topic, cmn.Topics.TransactionRequested().S())
-			assert.Equal(t, m2.Topic, cmn.Topics.TransactionRequested().S())
+			assert.Equal(t, verified.Topic, cmn.Topics.PaymentVerified().S())
+			pvr, err := cmn.FromBytes[PaymentValidationResult](verified.Value)
+			if err != nil {
+				t.Fatal("error decoding verified message value")
+			}
+			assert.Equal(t, pr.SystemID, pvr.PaymentRequest.SystemID)
+			assert.Equal(t, 2, len(pvr.Results))
+
+			assert.Equal(t, m1.Topic, cmn.Topics.TransferRequested().S())
 
-			tx, err := cmn.FromBytes[cmn.Transaction](m1.Value)
+			transfer, err := cmn.FromBytes[cmn.Transfer](m1.Value)
 			if err != nil {
 				t.Fatal("error decoding message value")
 			}
-			assert.Equal(t, tx.AccountID, int32(pr.SourceAccountID))
-			assert.Equal(t, tx.PaymentSysID, pr.SystemID)
+			assert.Equal(t, pr.SourceAccountID, transfer.SourceAccountID)
+			assert.Equal(t, pr.TargetAccountID, transfer.TargetAccountID)
+			assert.Equal(t, pr.SystemID, transfer.PaymentSysID)
+			assert.Equal(t, pr.Amount, transfer.Amount)
 
 			key, err := cmn.FromBytes[int32](writer.Messages[0].Key)
 			if err != nil {
@@ -0,0 +1,171 @@
+package main
+
+import (
+	"context"
+	"sync"
+	"sync/atomic"
+
+	"github.com/segmentio/kafka-go"
+	cmn "github.com/timkins666/distributed-playground/backend/pkg/common"
+)
+
+// consecutive read errors before the validator gives up
+const maxReadErrors = 10
+
+// validates payment requests on a fixed number of workers. once every worker is busy
+// and the queue is full, fetching stops until a worker frees up. offsets are committed
+// in order once validation has been published, so nothing is lost if we crash.
+type validatorPool struct {
+	appCtx  *accountsCtx
+	workers int
+	queue   chan kafka.Message
+	handle  cmn.MessageHandler
+	done    chan struct{}
+
+	offsets  *cmn.OffsetTracker
+	commitMu sync.Mutex
+
+	busy      atomic.Int32
+	saturated atomic.Int64
+}
+
+// point in time view of the pool for health reporting
+type validatorStats struct {
+	Workers       int   `json:"workers"`
+	Busy          int32 `json:"busy"`
+	QueueDepth    int   `json:"queueDepth"`
+	QueueCapacity int   `json:"queueCapacity"`
+	Saturated     bool  `json:"saturated"`
+	// number of times fetching paused on a full queue
+	SaturatedCount int64 `json:"saturatedCount"`
+}
+
+func newValidatorPool(appCtx *accountsCtx, workers, queueDepth int) *validatorPool {
+	return &validatorPool{
+		appCtx:  appCtx,
+		workers: workers,
+		queue:   make(chan kafka.Message, queueDepth),
+		// failed requests move to the next retry tier so they don't hold up the pool, and are
+		// dead lettered once out of retries or if they can never succeed
+		handle: cmn.WithRetry(func(_ context.Context, msg kafka.Message) error {
+			return handlePaymentRequestedMessage(msg, appCtx)
+		}, appCtx.retryPolicy, appCtx.writer, appCtx.logger),
+		done:    make(chan struct{}),
+		offsets: cmn.NewOffsetTracker(),
+	}
+}
+
+// fetches and validates payment requests until ctx is cancelled, then
+// finishes everything already fetched before returning
+func (p *validatorPool) Run(ctx context.Context) {
+	var wg sync.WaitGroup
+	for range p.workers {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for msg := range p.queue {
+				p.busy.Add(1)
+				// validations run on the service context so they can finish while draining
+				if err := cmn.Process(p.appCtx.cancelCtx, msg, p.handle, p.appCtx.logger); err == nil {
+					p.commit(msg)
+				}
+				p.busy.Add(-1)
+			}
+		}()
+	}
+
+	p.fetch(ctx)
+
+	close(p.queue)
+	p.appCtx.logger.Printf("Validator stopped fetching, draining %d queued and %d in-flight requests",
+		len(p.queue), p.busy.Load())
+	wg.Wait()
+	close(p.done)
+	p.appCtx.logger.Println("Validator drained")
+}
+
+func (p *validatorPool) fetch(ctx context.Context) {
+	errCount := 0
+	pausedLogged := false
+
+	for {
+		msg, err := p.appCtx.payReqReader.FetchMessage(ctx)
+		if err != nil {
+			if ctx.Err() != nil {
+				return
+			}
+			errCount++
+			p.appCtx.logger.Println("READ MSG ERROR", err)
+			if errCount == maxReadErrors {
+				p.appCtx.logger.Println("Max errors reached, something seems wrong... stopping validator")
+				return
+			}
+			continue
+		}
+		errCount = 0
+		p.offsets.Track(msg)
+
+		select {
+		case p.queue <- msg:
+			if pausedLogged {
+				p.appCtx.logger.Println("Validator resumed fetching")
+				pausedLogged = false
+			}
+			continue
+		default:
+		}
+
+		// saturated, block until a worker takes something off the queue
+		p.saturated.Add(1)
+		if !pausedLogged {
+			p.appCtx.logger.Printf("Validator saturated (%d workers busy, queue %d/%d), pausing fetch",
+				p.busy.Load(), len(p.queue), cap(p.queue))
+			pausedLogged = true
+		}
+
+		select {
+		case p.queue <- msg:
+		case <-ctx.Done():
+			// the message has already been read, so validate it rather than drop it
+			p.queue <- msg
+			return
+		}
+	}
+}
+
+// commits everything up to msg once all earlier messages on its partition are done.
+// serialised so a slow commit can't overwrite a newer offset.
+func (p *validatorPool) commit(msg kafka.Message) {
+	p.commitMu.Lock()
+	defer p.commitMu.Unlock()
+
+	committable, ok := p.offsets.Done(msg)
+	if !ok {
+		return
+	}
+	if err := p.appCtx.payReqReader.CommitMessages(p.appCtx.cancelCtx, committable); err != nil {
+		p.appCtx.logger.Printf("Failed to commit %s, it will be redelivered: %v", cmn.MessageID(committable), err)
+	}
+}
+
+// blocks until the pool has drained or ctx is done
+func (p *validatorPool) Wait(ctx context.Context) error {
+	select {
+	case <-p.done:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+func (p *validatorPool) stats() validatorStats {
+	busy := p.busy.Load()
+	return validatorStats{
+		Workers:        p.workers,
+		Busy:           busy,
+		QueueDepth:     len(p.queue),
+		QueueCapacity:  cap(p.queue),
+		Saturated:      int(busy) == p.workers && len(p.queue) == cap(p.queue),
+		SaturatedCount: p.saturated.Load(),
+	}
+}
@@ -0,0 +1,143 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/bmizerany/assert"
+	"github.com/segmentio/kafka-go"
+	cmn "github.com/timkins666/distributed-playground/backend/pkg/common"
+)
+
+// reader which blocks until a message is sent or ctx is done
+type chanReader struct {
+	msgs      chan kafka.Message
+	mu        sync.Mutex
+	committed []kafka.Message
+}
+
+func (r *chanReader) FetchMessage(ctx context.Context) (kafka.Message, error) {
+	select {
+	case msg := <-r.msgs:
+		return msg, nil
+	case <-ctx.Done():
+		return kafka.Message{}, ctx.Err()
+	}
+}
+
+func (r *chanReader) CommitMessages(ctx context.Context, msgs ...kafka.Message) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.committed = append(r.committed, msgs...)
+	return nil
+}
+
+func (r *chanReader) Close() error { return nil }
+
+func TestValidatorPoolBackpressure(t *testing.T) {
+	reader := &chanReader{msgs: make(chan kafka.Message)}
+	appCtx := &accountsCtx{cancelCtx: context.Background(), payReqReader: reader, logger: cmn.AppLogger()}
+
+	release := make(chan struct{})
+	var mu sync.Mutex
+	var handled int
+
+	pool := newValidatorPool(appCtx, 2, 1)
+	pool.handle = func(context.Context, kafka.Message) error {
+		<-release
+		mu.Lock()
+		handled++
+		mu.Unlock()
+		return nil
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	go pool.Run(ctx)
+
+	// 2 workers busy, 1 queued, 1 held by the fetcher waiting for space
+	for i := range 4 {
+		reader.msgs <- kafka.Message{Offset: int64(i)}
+	}
+
+	// the fetcher is blocked so can't take another message
+	select {
+	case reader.msgs <- kafka.Message{Offset: 4}:
+		t.Fatal("expected fetching to pause while saturated")
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	stats := pool.stats()
+	assert.Equal(t, int32(2), stats.Busy)
+	assert.Equal(t, 1, stats.QueueDepth)
+	assert.Equal(t, true, stats.Saturated)
+	assert.Equal(t, true, stats.SaturatedCount > 0)
+
+	// shutdown drains everything already fetched
+	cancel()
+	close(release)
+
+	waitCtx, waitCancel := context.WithTimeout(context.Background(), time.Second)
+	defer waitCancel()
+	assert.Equal(t, nil, pool.Wait(waitCtx))
+	assert.Equal(t, 4, handled)
+
+	// committed in order, ending with the last message fetched
+	last := reader.committed[len(reader.committed)-1]
+	assert.Equal(t, int64(3), last.Offset)
+}
+
+func TestValidatorPoolDoesNotCommitPastFailure(t *testing.T) {
+	reader := &chanReader{msgs: make(chan kafka.Message)}
+	serviceCtx, crash := context.WithCancel(context.Background())
+	appCtx := &accountsCtx{cancelCtx: serviceCtx, payReqReader: reader, logger: cmn.AppLogger()}
+
+	pool := newValidatorPool(appCtx, 2, 0)
+	pool.handle = func(_ context.Context, msg kafka.Message) error {
+		if msg.Offset == 0 {
+			return errors.New("kafka unavailable")
+		}
+		return nil
+	}
+
+	fetchCtx, stopFetching := context.WithCancel(context.Background())
+	go pool.Run(fetchCtx)
+
+	reader.msgs <- kafka.Message{Offset: 0}
+	reader.msgs <- kafka.Message{Offset: 1}
+
+	// the second message finishing can't commit past the failing first one
+	time.Sleep(50 * time.Millisecond)
+	stopFetching()
+	crash()
+
+	waitCtx, waitCancel := context.WithTimeout(context.Background(), time.Second)
+	defer waitCancel()
+	assert.Equal(t, nil, pool.Wait(waitCtx))
+	assert.Equal(t, 0, len(reader.committed))
+}
+
+func TestValidatorPoolStopsAfterMaxReadErrors(t *testing.T) {
+	appCtx := &accountsCtx{payReqReader: &errReader{}, logger: cmn.AppLogger()}
+	pool := newValidatorPool(appCtx, 1, 0)
+
+	go pool.Run(context.Background())
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	assert.Equal(t, nil, pool.Wait(ctx))
+}
+
+type errReader struct{}
+
+func (r *errReader) FetchMessage(ctx context.Context) (kafka.Message, error) {
+	return kafka.Message{}, context.DeadlineExceeded
+}
+
+func (r *errReader) CommitMessages(ctx context.Context, msgs ...kafka.Message) error {
+	return nil
+}
+
+func (r *errReader) Close() error { return nil }
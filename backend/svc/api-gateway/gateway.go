@@ -15,11 +15,26 @@ var proxyHosts map[string]string = map[string]string{
 }
 
 func main() {
+	cancelCtx, stop := cmn.GetCancelContext()
+	defer stop()
+
+	redisConfig, err := cmn.LoadRedisConfig()
+	if err != nil {
+		log.Fatal(err)
+	}
+	// tokens revoked by the auth service are rejected before being proxied
+	rds := cmn.ConnectRedis(cancelCtx, redisConfig, cmn.AppLogger())
+	defer rds.Close()
+	authenticate := cmn.SetUserIDMiddleware(cmn.NewRevocationList(rds, cmn.AppLogger()))
+
 	mux := http.NewServeMux()
-	mux.HandleFunc("/login", loginHandler)
+	mux.HandleFunc("/login", authHandler("/login"))
+	mux.HandleFunc("/register", authHandler("/register"))
+	mux.HandleFunc("/refresh", authHandler("/refresh"))
+	mux.HandleFunc("/logout", authHandler("/logout"))
 
 	for srv := range proxyHosts {
-		mux.HandleFunc("/"+srv+"/", cmn.SetUserIDMiddleware(proxyToService))
+		mux.HandleFunc("/"+srv+"/", authenticate(proxyToService))
 	}
 
 	port := ":" + os.Getenv("SERVE_PORT")
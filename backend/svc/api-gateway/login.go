@@ -5,38 +5,65 @@ import (
 	"encoding/json"
 	"io"
 	"log"
+	"net"
 	"net/http"
 	"os"
-
-	cmn "github.com/timkins666/distributed-playground/backend/pkg/common"
 )
 
-func loginHandler(w http.ResponseWriter, r *http.Request) {
-	if r.Method != http.MethodPost {
-		http.Error(w, "Only POST allowed", http.StatusMethodNotAllowed)
-		return
-	}
-	var creds cmn.LoginRequest
-	if err := json.NewDecoder(r.Body).Decode(&creds); err != nil {
-		log.Println("ERROR:", err)
-		http.Error(w, "Invalid request", http.StatusBadRequest)
-		return
-	}
+// credentials and tokens are small
+const maxAuthBody = 64 << 10
+
+// forwards a json body, and any Authorization header, to path on the auth service,
+// relaying its response so clients see why e.g. a login failed
+func authHandler(path string) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			http.Error(w, "Only POST allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		body, err := io.ReadAll(io.LimitReader(r.Body, maxAuthBody))
+		if err != nil || !json.Valid(body) {
+			log.Println("ERROR: invalid auth request body", err)
+			http.Error(w, "Invalid request", http.StatusBadRequest)
+			return
+		}
 
-	jsonBody, _ := json.Marshal(creds)
-	resp, err := http.Post(
-		os.Getenv("AUTH_SERVICE_HOST")+"/login",
-		"application/json",
-		bytes.NewBuffer(jsonBody),
-	)
-	if err != nil || resp.StatusCode != http.StatusOK {
-		log.Println("ERROR:", err)
-		http.Error(w, "Login failed", http.StatusUnauthorized)
-		return
+		req, err := http.NewRequest(http.MethodPost, os.Getenv("AUTH_SERVICE_HOST")+path, bytes.NewReader(body))
+		if err != nil {
+			log.Println("ERROR:", err)
+			http.Error(w, "Failed to create request", http.StatusInternalServerError)
+			return
+		}
+		req.Header.Set("Content-Type", "application/json")
+		req.Header.Set("X-Forwarded-For", clientHost(r))
+		if auth := r.Header.Get("Authorization"); auth != "" {
+			req.Header.Set("Authorization", auth)
+		}
+
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			log.Println("ERROR:", err)
+			http.Error(w, "Failed to contact auth service", http.StatusServiceUnavailable)
+			return
+		}
+		defer resp.Body.Close()
+
+		for _, h := range []string{"Content-Type", "Retry-After"} {
+			if v := resp.Header.Get(h); v != "" {
+				w.Header().Set(h, v)
+			}
+		}
+		w.WriteHeader(resp.StatusCode)
+		io.Copy(w, resp.Body)
 	}
-	defer resp.Body.Close()
+}
 
-	// Forward the JWT response to the client
-	w.Header().Set("Content-Type", "application/json")
-	io.Copy(w, resp.Body)
+// the address the request came from. services rate limit on it, so any X-Forwarded-For
+// sent by the client is replaced rather than trusted.
+func clientHost(r *http.Request) string {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+	return host
 }
@@ -32,6 +32,7 @@ func proxyToService(w http.ResponseWriter, r *http.Request) {
 
 	// Copy headers (like Authorization) to the proxied request
 	req.Header = r.Header.Clone()
+	req.Header.Set("X-Forwarded-For", clientHost(r))
 
 	client := &http.Client{}
 	resp, err := client.Do(req)
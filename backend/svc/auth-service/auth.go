@@ -5,8 +5,12 @@ import (
 	"encoding/json"
 	"errors"
 	"log"
+	"math"
+	"net"
 	"net/http"
 	"os"
+	"strconv"
+	"strings"
 
 	cmn "github.com/timkins666/distributed-playground/backend/pkg/common"
 )
@@ -16,9 +20,16 @@ func main() {
 	defer stop()
 
 	app := newAppCtx(cancelCtx)
+	defer app.close()
+	if app.demoMode {
+		app.logger.Println("DEMO_MODE on, logging in as an unknown username creates it")
+	}
 
 	mux := http.NewServeMux()
-	mux.HandleFunc("/login", loginHandler)
+	mux.HandleFunc("POST /login", loginHandler)
+	mux.HandleFunc("POST /register", registerHandler)
+	mux.HandleFunc("POST /refresh", refreshHandler)
+	mux.HandleFunc("POST /logout", logoutHandler)
 
 	port := ":" + os.Getenv("SERVE_PORT")
 	log.Printf("Auth service running on %s", port)
@@ -41,47 +52,96 @@ func loginHandler(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	user, err := getOrCreateUser(req.Username, app)
+	ip := clientIP(r)
+	if wait := app.lockout.lockedFor(req.Username, ip); wait > 0 {
+		app.logger.Printf("Login for %q from %s locked out for %s", req.Username, ip, wait)
+		w.Header().Set("Retry-After", strconv.Itoa(int(math.Ceil(wait.Seconds()))))
+		http.Error(w, "too many failed logins, try again later", http.StatusTooManyRequests)
+		return
+	}
 
+	creds, err := app.db.getUserByName(req.Username)
+	if errors.Is(err, sql.ErrNoRows) {
+		if app.demoMode {
+			// held to the same rules as registering
+			username, err := validateRegistration(req.Username, req.Password)
+			if err != nil {
+				http.Error(w, err.Error(), http.StatusBadRequest)
+				return
+			}
+			log.Println("User not found, creating")
+			user, err := createUser(username, req.Password, app)
+			if err != nil {
+				app.logger.Println("Failed creating user:", err)
+				w.WriteHeader(http.StatusInternalServerError)
+				return
+			}
+			issueTokens(w, http.StatusOK, app, user)
+			return
+		}
+		// unknown usernames are checked against a dummy hash, so they can't be told
+		// apart from wrong passwords by how long they take
+		creds, err = &userCredentials{}, nil
+	}
 	if err != nil {
-		log.Println("Failed creating user :p")
+		app.logger.Println("Failed loading user:", err)
 		w.WriteHeader(http.StatusInternalServerError)
 		return
 	}
 
-	token, err := cmn.CreateUserToken(user)
-	if err != nil {
-		log.Println("Error creating token: ", err)
-		w.WriteHeader(http.StatusInternalServerError)
+	if !checkPassword(creds.passwordHash, req.Password) {
+		app.lockout.fail(req.Username, ip)
+		http.Error(w, "invalid username or password", http.StatusUnauthorized)
 		return
 	}
 
-	w.WriteHeader(http.StatusOK)
-	_ = json.NewEncoder(w).Encode(map[string]any{
-		"username": user.Username,
-		"roles":    user.Roles,
-		"token":    token,
-	})
+	app.lockout.succeed(req.Username)
+	issueTokens(w, http.StatusOK, app, &creds.user)
 }
 
-// don't care about passwords, that's not why we're here.
-func getOrCreateUser(username string, app *authCtx) (*cmn.User, error) {
-	user, err := app.db.getUserByName(username)
-	if err == nil {
-		return user, nil
+func registerHandler(w http.ResponseWriter, r *http.Request) {
+	app, ok := r.Context().Value(cmn.AppCtx).(*authCtx)
+	if !ok {
+		log.Println("Failed to get app context")
+		w.WriteHeader(http.StatusInternalServerError)
+		return
 	}
 
-	if err == sql.ErrNoRows {
-		log.Println("User not found, creating")
-		return createUser(username, app)
+	var req cmn.LoginRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "invalid request", http.StatusBadRequest)
+		return
+	}
+
+	username, err := validateRegistration(req.Username, req.Password)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	user, err := createUser(username, req.Password, app)
+	if errors.Is(err, errUsernameTaken) {
+		http.Error(w, "username taken", http.StatusConflict)
+		return
+	}
+	if err != nil {
+		app.logger.Println("Failed creating user:", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
 	}
 
-	return user, err
+	issueTokens(w, http.StatusCreated, app, user)
 }
 
-// create new user. all users are customers and admins for the time being.
-func createUser(username string, app *authCtx) (*cmn.User, error) {
-	roles := []string{"admin", "customer"}
+// create new user with the password. new users are only ever customers, admins are
+// provisioned in the db.
+func createUser(username, password string, app *authCtx) (*cmn.User, error) {
+	hash, err := hashPassword(password)
+	if err != nil {
+		return nil, err
+	}
+
+	roles := []string{cmn.RoleCustomer}
 
 	user := cmn.User{
 		Username: username,
@@ -89,7 +149,7 @@ func createUser(username string, app *authCtx) (*cmn.User, error) {
 	}
 
 	log.Printf("Creating user %+v", user)
-	newId, err := app.db.createUser(&user)
+	newId, err := app.db.createUser(&user, hash)
 
 	if err != nil {
 		return nil, err
@@ -102,3 +162,51 @@ func createUser(username string, app *authCtx) (*cmn.User, error) {
 	log.Printf("Created user with id %d", user.ID)
 	return &user, nil
 }
+
+// starts a refresh token family for the user, responding with it and an access token
+func issueTokens(w http.ResponseWriter, status int, app *authCtx, user *cmn.User) {
+	access := cmn.NewAccessToken()
+	refresh, stored, err := newRefreshToken(access, app.refreshTTL)
+	if err == nil {
+		err = app.db.createRefreshFamily(user.ID, stored)
+	}
+	if err != nil {
+		app.logger.Println("Error creating refresh token:", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	writeTokens(w, status, user, access, refresh)
+}
+
+// responds with the user, their signed access token and refresh token
+func writeTokens(w http.ResponseWriter, status int, user *cmn.User, access cmn.AccessToken, refresh string) {
+	token, err := access.Sign(user)
+	if err != nil {
+		log.Println("Error creating token: ", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	_ = json.NewEncoder(w).Encode(map[string]any{
+		"username":     user.Username,
+		"roles":        user.Roles,
+		"token":        token,
+		"refreshToken": refresh,
+	})
+}
+
+// the address of the client, as set by the gateway in X-Forwarded-For when proxied
+func clientIP(r *http.Request) string {
+	if fwd := r.Header.Get("X-Forwarded-For"); fwd != "" {
+		first, _, _ := strings.Cut(fwd, ",")
+		return strings.TrimSpace(first)
+	}
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+	return host
+}
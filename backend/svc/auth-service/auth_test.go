@@ -1 +1,369 @@
 package main
+
+import (
+	"bytes"
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	cmn "github.com/timkins666/distributed-playground/backend/pkg/common"
+	"golang.org/x/crypto/bcrypt"
+)
+
+func init() {
+	hashCost = bcrypt.MinCost
+}
+
+type mockAuthDB struct {
+	users  map[string]*userCredentials
+	nextID int32
+	err    error
+	// refresh tokens by hash, and whether each family is revoked
+	refreshTokens map[string]*mockRefreshToken
+	families      map[int]bool
+}
+
+type mockRefreshToken struct {
+	*refreshToken
+	userID int32
+	family int
+	used   bool
+}
+
+func newMockAuthDB() *mockAuthDB {
+	return &mockAuthDB{
+		users:         map[string]*userCredentials{},
+		nextID:        1,
+		refreshTokens: map[string]*mockRefreshToken{},
+		families:      map[int]bool{},
+	}
+}
+
+func (m *mockAuthDB) getUserByName(username string) (*userCredentials, error) {
+	if m.err != nil {
+		return nil, m.err
+	}
+	creds, ok := m.users[strings.ToLower(username)]
+	if !ok {
+		return &userCredentials{}, sql.ErrNoRows
+	}
+	return creds, nil
+}
+
+func (m *mockAuthDB) createUser(user *cmn.User, passwordHash []byte) (int32, error) {
+	if m.err != nil {
+		return 0, m.err
+	}
+	if _, ok := m.users[strings.ToLower(user.Username)]; ok {
+		return 0, errUsernameTaken
+	}
+	u := *user
+	u.ID = m.nextID
+	m.nextID++
+	m.users[strings.ToLower(user.Username)] = &userCredentials{user: u, passwordHash: passwordHash}
+	return u.ID, nil
+}
+
+func (m *mockAuthDB) createRefreshFamily(userID int32, token *refreshToken) error {
+	if m.err != nil {
+		return m.err
+	}
+	family := len(m.families)
+	m.families[family] = false
+	m.refreshTokens[string(token.hash)] = &mockRefreshToken{refreshToken: token, userID: userID, family: family}
+	return nil
+}
+
+func (m *mockAuthDB) rotateRefreshToken(hash []byte, next *refreshToken) (*cmn.User, error) {
+	if m.err != nil {
+		return nil, m.err
+	}
+	t, ok := m.refreshTokens[string(hash)]
+	switch {
+	case !ok || m.families[t.family] || !t.expiresAt.After(time.Now()):
+		return nil, errInvalidRefreshToken
+	case t.used:
+		return nil, errRefreshTokenReused
+	}
+	t.used = true
+	m.refreshTokens[string(next.hash)] = &mockRefreshToken{refreshToken: next, userID: t.userID, family: t.family}
+	for _, creds := range m.users {
+		if creds.user.ID == t.userID {
+			return &creds.user, nil
+		}
+	}
+	return nil, errors.New("no user")
+}
+
+func (m *mockAuthDB) revokeRefreshFamily(hash []byte) ([]cmn.AccessToken, error) {
+	if m.err != nil {
+		return nil, m.err
+	}
+	t, ok := m.refreshTokens[string(hash)]
+	if !ok || m.families[t.family] {
+		return nil, nil
+	}
+	m.families[t.family] = true
+	var tokens []cmn.AccessToken
+	for _, other := range m.refreshTokens {
+		if other.family == t.family {
+			tokens = append(tokens, other.access)
+		}
+	}
+	return tokens, nil
+}
+
+type mockRevoker struct {
+	revoked map[string]bool
+	err     error
+}
+
+func (m *mockRevoker) Revoke(_ context.Context, tokens ...cmn.AccessToken) error {
+	for _, t := range tokens {
+		m.revoked[t.ID] = true
+	}
+	return m.err
+}
+
+func newTestApp(db authDB) *authCtx {
+	return &authCtx{
+		cancelCtx:   context.Background(),
+		db:          db,
+		logger:      cmn.AppLogger(),
+		lockout:     newLockout(time.Minute, 3, 10),
+		refreshTTL:  time.Hour,
+		revocations: &mockRevoker{revoked: map[string]bool{}},
+	}
+}
+
+func addUser(t *testing.T, db *mockAuthDB, username, password string) {
+	t.Helper()
+	hash, err := hashPassword(password)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := db.createUser(&cmn.User{Username: username, Roles: []string{cmn.RoleCustomer}}, hash); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func post(app *authCtx, handler http.HandlerFunc, ip, username, password string) *httptest.ResponseRecorder {
+	body, _ := json.Marshal(cmn.LoginRequest{Username: username, Password: password})
+	req := httptest.NewRequest(http.MethodPost, "/", bytes.NewReader(body))
+	req = req.WithContext(context.WithValue(req.Context(), cmn.AppCtx, app))
+	req.Header.Set("X-Forwarded-For", ip)
+	rec := httptest.NewRecorder()
+	handler(rec, req)
+	return rec
+}
+
+func TestLogin(t *testing.T) {
+	db := newMockAuthDB()
+	addUser(t, db, "Tim", "correct horse")
+	app := newTestApp(db)
+
+	rec := post(app, loginHandler, "1.2.3.4", "tim", "correct horse")
+	if rec.Code != http.StatusOK {
+		t.Fatalf("expected 200, got %d: %s", rec.Code, rec.Body)
+	}
+	var resp map[string]any
+	if err := json.Unmarshal(rec.Body.Bytes(), &resp); err != nil {
+		t.Fatal(err)
+	}
+	if resp["username"] != "Tim" || resp["token"] == "" || resp["refreshToken"] == "" {
+		t.Errorf("unexpected response %v", resp)
+	}
+}
+
+func TestLoginWrongUsernameAndPasswordLookTheSame(t *testing.T) {
+	db := newMockAuthDB()
+	addUser(t, db, "tim", "correct horse")
+	app := newTestApp(db)
+
+	wrongPassword := post(app, loginHandler, "1.2.3.4", "tim", "battery staple")
+	unknownUser := post(app, loginHandler, "1.2.3.4", "nobody", "correct horse")
+
+	if wrongPassword.Code != http.StatusUnauthorized || unknownUser.Code != http.StatusUnauthorized {
+		t.Fatalf("expected 401s, got %d and %d", wrongPassword.Code, unknownUser.Code)
+	}
+	if wrongPassword.Body.String() != unknownUser.Body.String() {
+		t.Errorf("responses differ: %q and %q", wrongPassword.Body, unknownUser.Body)
+	}
+	if len(db.users) != 1 {
+		t.Error("unknown user should not be created outside demo mode")
+	}
+}
+
+func TestLoginUserWithoutPassword(t *testing.T) {
+	db := newMockAuthDB()
+	db.users["system"] = &userCredentials{user: cmn.User{ID: -1, Username: "system"}}
+
+	rec := post(newTestApp(db), loginHandler, "1.2.3.4", "system", "")
+	if rec.Code != http.StatusUnauthorized {
+		t.Errorf("expected 401, got %d", rec.Code)
+	}
+}
+
+func TestLoginDemoModeCreatesUser(t *testing.T) {
+	db := newMockAuthDB()
+	app := newTestApp(db)
+	app.demoMode = true
+
+	if rec := post(app, loginHandler, "1.2.3.4", "newbie", "demo-password"); rec.Code != http.StatusOK {
+		t.Fatalf("expected 200, got %d", rec.Code)
+	}
+	if roles := db.users["newbie"].user.Roles; len(roles) != 1 || roles[0] != cmn.RoleCustomer {
+		t.Errorf("expected a customer only, got roles %v", roles)
+	}
+	if rec := post(app, loginHandler, "1.2.3.4", "newbie", "demo-password"); rec.Code != http.StatusOK {
+		t.Errorf("expected created user to log in, got %d", rec.Code)
+	}
+	if rec := post(app, loginHandler, "1.2.3.4", "newbie", "other"); rec.Code != http.StatusUnauthorized {
+		t.Errorf("expected wrong password to fail in demo mode, got %d", rec.Code)
+	}
+}
+
+func TestLoginDemoModeValidatesNewUser(t *testing.T) {
+	tests := []struct {
+		name     string
+		username string
+		password string
+	}{
+		{name: "short password", username: "newbie", password: "test"},
+		{name: "blank username", username: "   ", password: "demo-password"},
+		{name: "long username", username: strings.Repeat("n", 100), password: "demo-password"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			db := newMockAuthDB()
+			app := newTestApp(db)
+			app.demoMode = true
+
+			if rec := post(app, loginHandler, "1.2.3.4", tt.username, tt.password); rec.Code != http.StatusBadRequest {
+				t.Errorf("expected 400, got %d", rec.Code)
+			}
+			if len(db.users) != 0 {
+				t.Errorf("expected no user created, got %d", len(db.users))
+			}
+		})
+	}
+}
+
+func TestLoginDBError(t *testing.T) {
+	db := newMockAuthDB()
+	db.err = errors.New("db down")
+
+	rec := post(newTestApp(db), loginHandler, "1.2.3.4", "tim", "correct horse")
+	if rec.Code != http.StatusInternalServerError {
+		t.Errorf("expected 500, got %d", rec.Code)
+	}
+}
+
+func TestLoginLocksOutUsername(t *testing.T) {
+	db := newMockAuthDB()
+	addUser(t, db, "tim", "correct horse")
+	app := newTestApp(db)
+
+	for i := range 3 {
+		post(app, loginHandler, "10.0.0."+string(rune('1'+i)), "tim", "guess")
+	}
+
+	rec := post(app, loginHandler, "1.2.3.4", "TIM", "correct horse")
+	if rec.Code != http.StatusTooManyRequests {
+		t.Fatalf("expected 429, got %d", rec.Code)
+	}
+	if rec.Header().Get("Retry-After") != "60" {
+		t.Errorf("expected Retry-After 60, got %q", rec.Header().Get("Retry-After"))
+	}
+}
+
+func TestLoginLocksOutIP(t *testing.T) {
+	db := newMockAuthDB()
+	addUser(t, db, "tim", "correct horse")
+	app := newTestApp(db)
+
+	for i := range 10 {
+		post(app, loginHandler, "1.2.3.4", "user"+string(rune('a'+i)), "guess")
+	}
+
+	if rec := post(app, loginHandler, "1.2.3.4", "tim", "correct horse"); rec.Code != http.StatusTooManyRequests {
+		t.Errorf("expected 429, got %d", rec.Code)
+	}
+	if rec := post(app, loginHandler, "5.6.7.8", "tim", "correct horse"); rec.Code != http.StatusOK {
+		t.Errorf("expected other IPs to log in, got %d", rec.Code)
+	}
+}
+
+func TestRegister(t *testing.T) {
+	db := newMockAuthDB()
+	app := newTestApp(db)
+
+	rec := post(app, registerHandler, "1.2.3.4", "  tim ", "correct horse")
+	if rec.Code != http.StatusCreated {
+		t.Fatalf("expected 201, got %d: %s", rec.Code, rec.Body)
+	}
+	creds := db.users["tim"]
+	if creds == nil || creds.user.Username != "tim" {
+		t.Fatalf("user not stored trimmed: %+v", db.users)
+	}
+	if bytes.Contains(creds.passwordHash, []byte("correct horse")) || !checkPassword(creds.passwordHash, "correct horse") {
+		t.Error("password not stored as a hash")
+	}
+	if len(creds.user.Roles) != 1 || creds.user.Roles[0] != cmn.RoleCustomer {
+		t.Errorf("expected a customer only, got roles %v", creds.user.Roles)
+	}
+
+	if rec := post(app, loginHandler, "1.2.3.4", "tim", "correct horse"); rec.Code != http.StatusOK {
+		t.Errorf("expected registered user to log in, got %d", rec.Code)
+	}
+}
+
+func TestRegisterErrors(t *testing.T) {
+	tests := []struct {
+		name     string
+		username string
+		password string
+		dbErr    error
+		expected int
+	}{
+		{"no username", " ", "correct horse", nil, http.StatusBadRequest},
+		{"long username", strings.Repeat("a", maxUsernameLength+1), "correct horse", nil, http.StatusBadRequest},
+		{"short password", "tim", "short", nil, http.StatusBadRequest},
+		{"long password", "tim", strings.Repeat("a", maxPasswordBytes+1), nil, http.StatusBadRequest},
+		{"taken", "Taken", "correct horse", nil, http.StatusConflict},
+		{"db error", "tim", "correct horse", errors.New("db down"), http.StatusInternalServerError},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			db := newMockAuthDB()
+			addUser(t, db, "taken", "correct horse")
+			db.err = tt.dbErr
+
+			rec := post(newTestApp(db), registerHandler, "1.2.3.4", tt.username, tt.password)
+			if rec.Code != tt.expected {
+				t.Errorf("expected %d, got %d", tt.expected, rec.Code)
+			}
+		})
+	}
+}
+
+func TestClientIP(t *testing.T) {
+	req := httptest.NewRequest(http.MethodPost, "/", nil)
+	req.RemoteAddr = "10.0.0.1:1234"
+	if ip := clientIP(req); ip != "10.0.0.1" {
+		t.Errorf("expected remote address, got %q", ip)
+	}
+
+	req.Header.Set("X-Forwarded-For", "1.2.3.4, 10.0.0.2")
+	if ip := clientIP(req); ip != "1.2.3.4" {
+		t.Errorf("expected forwarded address, got %q", ip)
+	}
+}
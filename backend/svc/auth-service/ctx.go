@@ -3,26 +3,64 @@ package main
 import (
 	"context"
 	"log"
+	"time"
 
 	cmn "github.com/timkins666/distributed-playground/backend/pkg/common"
 )
 
+const (
+	defaultLockoutWindow   = 15 * time.Minute
+	defaultMaxUserFailures = 5
+	defaultMaxIPFailures   = 20
+	defaultRefreshTTL      = 7 * 24 * time.Hour
+)
+
 // app context for the auth service
 type authCtx struct {
 	cancelCtx context.Context
 	db        authDB
 	logger    *log.Logger
+	// log in as unknown usernames creates them, for the playground
+	demoMode bool
+	lockout  *lockout
+	// how long a refresh token can be exchanged for
+	refreshTTL  time.Duration
+	redis       *cmn.Redis
+	revocations tokenRevoker
+}
+
+// close releases all resources
+func (a *authCtx) close() error {
+	return a.redis.Close()
 }
 
 func newAppCtx(cancelCtx context.Context) *authCtx {
+	logger := cmn.AppLogger()
+
 	db, err := initDB()
 	if err != nil {
 		panic(err)
 	}
 
+	redisConfig, err := cmn.LoadRedisConfig()
+	if err != nil {
+		logger.Fatal(err)
+	}
+	rds := cmn.ConnectRedis(cancelCtx, redisConfig, logger)
+	revocations := cmn.NewRevocationList(rds, logger)
+
 	return &authCtx{
 		cancelCtx: cancelCtx,
-		logger:    cmn.AppLogger(),
+		logger:    logger,
 		db:        db,
+		demoMode:  cmn.BoolFromEnv("DEMO_MODE", false, logger),
+		lockout: newLockout(
+			cmn.DurationFromEnv("LOCKOUT_WINDOW", defaultLockoutWindow, logger),
+			cmn.IntFromEnv("LOCKOUT_USER_FAILURES", defaultMaxUserFailures, 0, logger),
+			cmn.IntFromEnv("LOCKOUT_IP_FAILURES", defaultMaxIPFailures, 0, logger),
+		),
+		refreshTTL:  cmn.DurationFromEnv("REFRESH_TTL", defaultRefreshTTL, logger),
+		redis:       rds,
+		revocations: revocations,
 	}
 }
@@ -3,11 +3,13 @@ package main
 import (
 	"context"
 	"testing"
+	"time"
 )
 
 func TestNewAppCtx(t *testing.T) {
 	t.Setenv("KAFKA_BROKER", "foo")
 	t.Setenv("DB_TYPE", "_TEST_")
+	t.Setenv("REDIS_CONNECT_ATTEMPTS", "1")
 
 	ctx := newAppCtx(context.Background())
 	if ctx.cancelCtx == nil {
@@ -19,4 +21,36 @@ func TestNewAppCtx(t *testing.T) {
 	if ctx.logger == nil {
 		t.Error("logger should not be nil")
 	}
+	if ctx.demoMode {
+		t.Error("demo mode should be off by default")
+	}
+	if ctx.lockout == nil || ctx.lockout.maxUserFailures != defaultMaxUserFailures {
+		t.Errorf("unexpected lockout %+v", ctx.lockout)
+	}
+	if ctx.refreshTTL != defaultRefreshTTL || ctx.revocations == nil {
+		t.Error("refresh tokens not configured")
+	}
+	ctx.close()
+}
+
+func TestNewAppCtxFromEnv(t *testing.T) {
+	t.Setenv("DB_TYPE", "_TEST_")
+	t.Setenv("REDIS_CONNECT_ATTEMPTS", "1")
+	t.Setenv("DEMO_MODE", "true")
+	t.Setenv("LOCKOUT_WINDOW", "1m")
+	t.Setenv("LOCKOUT_USER_FAILURES", "3")
+	t.Setenv("LOCKOUT_IP_FAILURES", "nope")
+	t.Setenv("REFRESH_TTL", "24h")
+
+	ctx := newAppCtx(context.Background())
+	if !ctx.demoMode {
+		t.Error("expected demo mode on")
+	}
+	if ctx.lockout.window != time.Minute || ctx.lockout.maxUserFailures != 3 || ctx.lockout.maxIPFailures != defaultMaxIPFailures {
+		t.Errorf("unexpected lockout %+v", ctx.lockout)
+	}
+	if ctx.refreshTTL != 24*time.Hour {
+		t.Errorf("unexpected refresh TTL %s", ctx.refreshTTL)
+	}
+	ctx.close()
 }
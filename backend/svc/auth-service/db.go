@@ -1,6 +1,7 @@
 package main
 
 import (
+	"errors"
 	"fmt"
 	"os"
 
@@ -25,7 +26,21 @@ func initDB() (authDB, error) {
 	panic("cassandra not set up yet")
 }
 
+var errUsernameTaken = errors.New("username taken")
+
+// a user and the hash of their password, nil if they don't have one
+type userCredentials struct {
+	user         cmn.User
+	passwordHash []byte
+}
+
 type authDB interface {
-	getUserByName(string) (*cmn.User, error)
-	createUser(*cmn.User) (int32, error)
+	getUserByName(string) (*userCredentials, error)
+	createUser(*cmn.User, []byte) (int32, error)
+	// stores the first refresh token of a new family for the user
+	createRefreshFamily(int32, *refreshToken) error
+	// exchanges the refresh token with the hash for the next in its family
+	rotateRefreshToken([]byte, *refreshToken) (*cmn.User, error)
+	// revokes the family of the refresh token with the hash, returning its access tokens
+	revokeRefreshFamily([]byte) ([]cmn.AccessToken, error)
 }
@@ -2,8 +2,10 @@ package main
 
 import (
 	"database/sql"
+	"errors"
 	"log"
 
+	"github.com/google/uuid"
 	"github.com/lib/pq"
 	cmn "github.com/timkins666/distributed-playground/backend/pkg/common"
 )
@@ -13,23 +15,161 @@ type dbPostgres struct {
 }
 
 // load user by name from db. searches case insensitively, returns userame casing as in db.
-func (db *dbPostgres) getUserByName(username string) (*cmn.User, error) {
+func (db *dbPostgres) getUserByName(username string) (*userCredentials, error) {
 
 	log.Printf("Try load user %s from db...", username)
-	log.Printf("db is %+v", db)
-	log.Printf("db.db is %+v", db.db)
-	var user cmn.User
+	var creds userCredentials
 	err := db.db.QueryRow(`
-		SELECT id, username, roles FROM accounts."user" WHERE LOWER(username) = LOWER($1)
-	`, username).Scan(&user.ID, &user.Username, pq.Array(&user.Roles))
-	return &user, err
+		SELECT id, username, roles, password_hash FROM accounts."user" WHERE LOWER(username) = LOWER($1)
+	`, username).Scan(&creds.user.ID, &creds.user.Username, pq.Array(&creds.user.Roles), &creds.passwordHash)
+	return &creds, err
 }
 
-// creates the user in the db, returning the new user id
-func (db *dbPostgres) createUser(user *cmn.User) (int32, error) {
+// creates the user in the db with the hash of their password, returning the new user id.
+// returns errUsernameTaken if the username is already in use, in any casing.
+func (db *dbPostgres) createUser(user *cmn.User, passwordHash []byte) (int32, error) {
 	userID := int32(0)
 	err := db.db.QueryRow(`
-		INSERT INTO accounts."user" (username, roles) VALUES ($1, $2) RETURNING id
-	`, user.Username, pq.Array(user.Roles)).Scan(&userID)
+		INSERT INTO accounts."user" (username, roles, password_hash) VALUES ($1, $2, $3) RETURNING id
+	`, user.Username, pq.Array(user.Roles), passwordHash).Scan(&userID)
+
+	var pqErr *pq.Error
+	if errors.As(err, &pqErr) && pqErr.Code == "23505" {
+		return 0, errUsernameTaken
+	}
 	return userID, err
 }
+
+// stores the first refresh token of a new family for the user, e.g. on login
+func (db *dbPostgres) createRefreshFamily(userID int32, token *refreshToken) error {
+	tx, err := db.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	familyID := uuid.NewString()
+	if _, err := tx.Exec(`
+		INSERT INTO accounts.refresh_token_family (id, user_id) VALUES ($1, $2)
+	`, familyID, userID); err != nil {
+		return err
+	}
+	if err := insertRefreshToken(tx, familyID, token); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+// marks the refresh token with the hash used and stores next in its family, returning the
+// user it belongs to. the family row is locked so rotation can't race revocation.
+// returns errRefreshTokenReused if the token was already used, or errInvalidRefreshToken
+// if it's unknown, expired or revoked.
+func (db *dbPostgres) rotateRefreshToken(hash []byte, next *refreshToken) (*cmn.User, error) {
+	tx, err := db.db.Begin()
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+
+	var (
+		familyID      string
+		used, expired bool
+		revoked       bool
+		user          cmn.User
+	)
+	err = tx.QueryRow(`
+		SELECT t.family_id, t.used_at IS NOT NULL, t.expires_at <= now(), f.revoked_at IS NOT NULL,
+			u.id, u.username, u.roles
+		FROM accounts.refresh_token t
+		JOIN accounts.refresh_token_family f ON f.id = t.family_id
+		JOIN accounts."user" u ON u.id = f.user_id
+		WHERE t.token_hash = $1
+		FOR UPDATE OF f
+	`, hash).Scan(&familyID, &used, &expired, &revoked, &user.ID, &user.Username, pq.Array(&user.Roles))
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, errInvalidRefreshToken
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	switch {
+	case revoked:
+		return nil, errInvalidRefreshToken
+	case used:
+		return nil, errRefreshTokenReused
+	case expired:
+		return nil, errInvalidRefreshToken
+	}
+
+	if _, err := tx.Exec(`
+		UPDATE accounts.refresh_token SET used_at = now() WHERE token_hash = $1
+	`, hash); err != nil {
+		return nil, err
+	}
+	if err := insertRefreshToken(tx, familyID, next); err != nil {
+		return nil, err
+	}
+	if err := tx.Commit(); err != nil {
+		return nil, err
+	}
+	return &user, nil
+}
+
+// revokes the family of the refresh token with the hash, returning the access tokens issued
+// in it that haven't expired. returns none if the token is unknown or already revoked.
+func (db *dbPostgres) revokeRefreshFamily(hash []byte) ([]cmn.AccessToken, error) {
+	tx, err := db.db.Begin()
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+
+	var familyID string
+	err = tx.QueryRow(`
+		UPDATE accounts.refresh_token_family SET revoked_at = now()
+		WHERE id = (SELECT family_id FROM accounts.refresh_token WHERE token_hash = $1)
+			AND revoked_at IS NULL
+		RETURNING id
+	`, hash).Scan(&familyID)
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	rows, err := tx.Query(`
+		SELECT access_token_id, access_expires_at FROM accounts.refresh_token
+		WHERE family_id = $1 AND access_expires_at > now()
+	`, familyID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var tokens []cmn.AccessToken
+	for rows.Next() {
+		var t cmn.AccessToken
+		if err := rows.Scan(&t.ID, &t.ExpiresAt); err != nil {
+			return nil, err
+		}
+		tokens = append(tokens, t)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	if err := tx.Commit(); err != nil {
+		return nil, err
+	}
+	return tokens, nil
+}
+
+func insertRefreshToken(tx *sql.Tx, familyID string, token *refreshToken) error {
+	_, err := tx.Exec(`
+		INSERT INTO accounts.refresh_token (token_hash, family_id, expires_at, access_token_id, access_expires_at)
+		VALUES ($1, $2, $3, $4, $5)
+	`, token.hash, familyID, token.expiresAt, token.access.ID, token.access.ExpiresAt)
+	return err
+}
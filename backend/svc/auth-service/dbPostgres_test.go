@@ -0,0 +1,193 @@
+package main
+
+import (
+	"database/sql"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/DATA-DOG/go-sqlmock"
+	"github.com/lib/pq"
+	cmn "github.com/timkins666/distributed-playground/backend/pkg/common"
+)
+
+func TestDBPostgresGetUserByName(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatalf("failed to create mock: %v", err)
+	}
+	defer db.Close()
+
+	mock.ExpectQuery(`SELECT id, username, roles, password_hash FROM accounts."user"`).
+		WithArgs("TIM").
+		WillReturnRows(sqlmock.NewRows([]string{"id", "username", "roles", "password_hash"}).
+			AddRow(1, "tim", "{admin,customer}", []byte("hash")))
+
+	creds, err := (&dbPostgres{db: db}).getUserByName("TIM")
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if creds.user.ID != 1 || creds.user.Username != "tim" || len(creds.user.Roles) != 2 || string(creds.passwordHash) != "hash" {
+		t.Errorf("unexpected credentials %+v", creds)
+	}
+
+	mock.ExpectQuery(`FROM accounts."user"`).WithArgs("nobody").WillReturnError(sql.ErrNoRows)
+	if _, err := (&dbPostgres{db: db}).getUserByName("nobody"); !errors.Is(err, sql.ErrNoRows) {
+		t.Errorf("expected ErrNoRows, got %v", err)
+	}
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("unfulfilled expectations: %v", err)
+	}
+}
+
+func TestDBPostgresCreateUser(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatalf("failed to create mock: %v", err)
+	}
+	defer db.Close()
+
+	user := &cmn.User{Username: "tim", Roles: []string{cmn.RoleCustomer}}
+
+	mock.ExpectQuery(`INSERT INTO accounts."user" \(username, roles, password_hash\)`).
+		WithArgs("tim", sqlmock.AnyArg(), []byte("hash")).
+		WillReturnRows(sqlmock.NewRows([]string{"id"}).AddRow(7))
+
+	id, err := (&dbPostgres{db: db}).createUser(user, []byte("hash"))
+	if err != nil || id != 7 {
+		t.Errorf("expected id 7, got %d, %v", id, err)
+	}
+
+	mock.ExpectQuery(`INSERT INTO accounts."user"`).WillReturnError(&pq.Error{Code: "23505"})
+	if _, err := (&dbPostgres{db: db}).createUser(user, []byte("hash")); !errors.Is(err, errUsernameTaken) {
+		t.Errorf("expected errUsernameTaken, got %v", err)
+	}
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("unfulfilled expectations: %v", err)
+	}
+}
+
+func TestDBPostgresCreateRefreshFamily(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatalf("failed to create mock: %v", err)
+	}
+	defer db.Close()
+
+	token := &refreshToken{hash: []byte("hash"), expiresAt: time.Now(), access: cmn.NewAccessToken()}
+
+	mock.ExpectBegin()
+	mock.ExpectExec("INSERT INTO accounts.refresh_token_family").
+		WithArgs(sqlmock.AnyArg(), int32(3)).
+		WillReturnResult(sqlmock.NewResult(0, 1))
+	mock.ExpectExec("INSERT INTO accounts.refresh_token ").
+		WithArgs([]byte("hash"), sqlmock.AnyArg(), token.expiresAt, token.access.ID, token.access.ExpiresAt).
+		WillReturnResult(sqlmock.NewResult(0, 1))
+	mock.ExpectCommit()
+
+	if err := (&dbPostgres{db: db}).createRefreshFamily(3, token); err != nil {
+		t.Errorf("unexpected error: %v", err)
+	}
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("unfulfilled expectations: %v", err)
+	}
+}
+
+func TestDBPostgresRotateRefreshToken(t *testing.T) {
+	columns := []string{"family_id", "used", "expired", "revoked", "id", "username", "roles"}
+	next := &refreshToken{hash: []byte("next"), expiresAt: time.Now(), access: cmn.NewAccessToken()}
+
+	tests := []struct {
+		name                   string
+		used, expired, revoked bool
+		noRows                 bool
+		expectedErr            error
+	}{
+		{name: "rotates"},
+		{name: "unknown", noRows: true, expectedErr: errInvalidRefreshToken},
+		{name: "reused", used: true, expectedErr: errRefreshTokenReused},
+		{name: "expired", expired: true, expectedErr: errInvalidRefreshToken},
+		{name: "revoked", used: true, revoked: true, expectedErr: errInvalidRefreshToken},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			db, mock, err := sqlmock.New()
+			if err != nil {
+				t.Fatalf("failed to create mock: %v", err)
+			}
+			defer db.Close()
+
+			mock.ExpectBegin()
+			query := mock.ExpectQuery("FROM accounts.refresh_token t .* FOR UPDATE OF f").WithArgs([]byte("hash"))
+			if tt.noRows {
+				query.WillReturnError(sql.ErrNoRows)
+			} else {
+				query.WillReturnRows(sqlmock.NewRows(columns).
+					AddRow("family", tt.used, tt.expired, tt.revoked, 3, "tim", "{customer}"))
+			}
+			if tt.expectedErr == nil {
+				mock.ExpectExec("UPDATE accounts.refresh_token SET used_at = now()").
+					WithArgs([]byte("hash")).
+					WillReturnResult(sqlmock.NewResult(0, 1))
+				mock.ExpectExec("INSERT INTO accounts.refresh_token ").
+					WithArgs([]byte("next"), "family", next.expiresAt, next.access.ID, next.access.ExpiresAt).
+					WillReturnResult(sqlmock.NewResult(0, 1))
+				mock.ExpectCommit()
+			} else {
+				mock.ExpectRollback()
+			}
+
+			user, err := (&dbPostgres{db: db}).rotateRefreshToken([]byte("hash"), next)
+			if !errors.Is(err, tt.expectedErr) {
+				t.Fatalf("expected %v, got %v", tt.expectedErr, err)
+			}
+			if err == nil && (user.ID != 3 || user.Username != "tim") {
+				t.Errorf("unexpected user %+v", user)
+			}
+			if err := mock.ExpectationsWereMet(); err != nil {
+				t.Errorf("unfulfilled expectations: %v", err)
+			}
+		})
+	}
+}
+
+func TestDBPostgresRevokeRefreshFamily(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatalf("failed to create mock: %v", err)
+	}
+	defer db.Close()
+
+	expires := time.Now().Add(time.Minute)
+
+	mock.ExpectBegin()
+	mock.ExpectQuery("UPDATE accounts.refresh_token_family SET revoked_at = now()").
+		WithArgs([]byte("hash")).
+		WillReturnRows(sqlmock.NewRows([]string{"id"}).AddRow("family"))
+	mock.ExpectQuery("SELECT access_token_id, access_expires_at FROM accounts.refresh_token").
+		WithArgs("family").
+		WillReturnRows(sqlmock.NewRows([]string{"access_token_id", "access_expires_at"}).AddRow("jti", expires))
+	mock.ExpectCommit()
+
+	tokens, err := (&dbPostgres{db: db}).revokeRefreshFamily([]byte("hash"))
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if len(tokens) != 1 || tokens[0] != (cmn.AccessToken{ID: "jti", ExpiresAt: expires}) {
+		t.Errorf("unexpected tokens %+v", tokens)
+	}
+
+	// unknown or already revoked
+	mock.ExpectBegin()
+	mock.ExpectQuery("UPDATE accounts.refresh_token_family").WillReturnError(sql.ErrNoRows)
+	mock.ExpectRollback()
+
+	tokens, err = (&dbPostgres{db: db}).revokeRefreshFamily([]byte("hash"))
+	if err != nil || tokens != nil {
+		t.Errorf("expected nothing revoked, got %v, %v", tokens, err)
+	}
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("unfulfilled expectations: %v", err)
+	}
+}
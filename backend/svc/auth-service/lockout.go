@@ -0,0 +1,113 @@
+package main
+
+import (
+	"strings"
+	"sync"
+	"time"
+)
+
+// entries kept before expired ones are swept out
+const maxTrackedFailures = 10_000
+
+// failed logins for one username or IP
+type failures struct {
+	count int
+	// start of the window the failures are counted in
+	since       time.Time
+	lockedUntil time.Time
+}
+
+// locks out usernames and IPs after repeated failed logins. usernames are counted whether
+// they exist or not, so a lockout doesn't give away which do. state is per instance.
+type lockout struct {
+	mu sync.Mutex
+	// failures counted within, and how long a lockout lasts
+	window time.Duration
+	// failures allowed within the window, 0 for no limit
+	maxUserFailures int
+	maxIPFailures   int
+	users           map[string]*failures
+	ips             map[string]*failures
+	now             func() time.Time
+}
+
+func newLockout(window time.Duration, maxUserFailures, maxIPFailures int) *lockout {
+	return &lockout{
+		window:          window,
+		maxUserFailures: maxUserFailures,
+		maxIPFailures:   maxIPFailures,
+		users:           map[string]*failures{},
+		ips:             map[string]*failures{},
+		now:             time.Now,
+	}
+}
+
+// returns how much longer the username or IP is locked out for, or 0 if neither is
+func (l *lockout) lockedFor(username, ip string) time.Duration {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	now := l.now()
+	wait := time.Duration(0)
+	for _, f := range []*failures{l.users[userKey(username)], l.ips[ip]} {
+		if f != nil && f.lockedUntil.After(now) {
+			wait = max(wait, f.lockedUntil.Sub(now))
+		}
+	}
+	return wait
+}
+
+// records a failed login
+func (l *lockout) fail(username, ip string) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	now := l.now()
+	l.record(l.users, userKey(username), l.maxUserFailures, now)
+	l.record(l.ips, ip, l.maxIPFailures, now)
+}
+
+// clears the failures of a username after a successful login. the IP's are left alone so
+// logging in to one account doesn't reset guesses at others.
+func (l *lockout) succeed(username string) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	delete(l.users, userKey(username))
+}
+
+func (l *lockout) record(m map[string]*failures, key string, limit int, now time.Time) {
+	if limit <= 0 {
+		return
+	}
+
+	f, ok := m[key]
+	if !ok || now.Sub(f.since) >= l.window {
+		if len(m) >= maxTrackedFailures {
+			l.sweep(m, now)
+		}
+		f = &failures{since: now}
+		m[key] = f
+	}
+
+	f.count++
+	if f.count >= limit {
+		f.lockedUntil = now.Add(l.window)
+		f.count = 0
+		f.since = now
+	}
+}
+
+// drops entries that no longer count towards or hold a lockout
+func (l *lockout) sweep(m map[string]*failures, now time.Time) {
+	for key, f := range m {
+		if now.Sub(f.since) >= l.window && !f.lockedUntil.After(now) {
+			delete(m, key)
+		}
+	}
+}
+
+// usernames are case insensitive
+func userKey(username string) string {
+	return strings.ToLower(strings.TrimSpace(username))
+}
@@ -0,0 +1,89 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestLockout(t *testing.T) {
+	now := time.Now()
+	l := newLockout(time.Minute, 2, 3)
+	l.now = func() time.Time { return now }
+
+	l.fail("tim", "1.1.1.1")
+	if wait := l.lockedFor("tim", "1.1.1.1"); wait != 0 {
+		t.Fatalf("locked after one failure for %s", wait)
+	}
+
+	l.fail("Tim", "2.2.2.2")
+	if wait := l.lockedFor("tim", "3.3.3.3"); wait != time.Minute {
+		t.Errorf("expected username locked for a minute, got %s", wait)
+	}
+	if wait := l.lockedFor("other", "1.1.1.1"); wait != 0 {
+		t.Errorf("expected IP not locked, got %s", wait)
+	}
+
+	now = now.Add(time.Minute)
+	if wait := l.lockedFor("tim", "3.3.3.3"); wait != 0 {
+		t.Errorf("expected lockout to lapse, got %s", wait)
+	}
+}
+
+func TestLockoutIP(t *testing.T) {
+	now := time.Now()
+	l := newLockout(time.Minute, 2, 3)
+	l.now = func() time.Time { return now }
+
+	for _, user := range []string{"a", "b", "c"} {
+		l.fail(user, "1.1.1.1")
+	}
+	if wait := l.lockedFor("d", "1.1.1.1"); wait != time.Minute {
+		t.Errorf("expected IP locked for a minute, got %s", wait)
+	}
+}
+
+func TestLockoutFailuresExpire(t *testing.T) {
+	now := time.Now()
+	l := newLockout(time.Minute, 2, 0)
+	l.now = func() time.Time { return now }
+
+	l.fail("tim", "1.1.1.1")
+	now = now.Add(time.Minute)
+	l.fail("tim", "1.1.1.1")
+
+	if wait := l.lockedFor("tim", "1.1.1.1"); wait != 0 {
+		t.Errorf("failures in separate windows locked for %s", wait)
+	}
+	if len(l.ips) != 0 {
+		t.Error("IPs shouldn't be tracked without a limit")
+	}
+}
+
+func TestLockoutSucceedResetsUsername(t *testing.T) {
+	l := newLockout(time.Minute, 2, 2)
+
+	l.fail("tim", "1.1.1.1")
+	l.succeed("TIM")
+	l.fail("tim", "2.2.2.2")
+
+	if wait := l.lockedFor("tim", "3.3.3.3"); wait != 0 {
+		t.Errorf("expected success to reset username failures, locked for %s", wait)
+	}
+}
+
+func TestLockoutSweep(t *testing.T) {
+	now := time.Now()
+	l := newLockout(time.Minute, 1, 0)
+	l.now = func() time.Time { return now }
+
+	l.users["stale"] = &failures{count: 1, since: now.Add(-2 * time.Minute)}
+	l.users["locked"] = &failures{since: now, lockedUntil: now.Add(time.Minute)}
+	l.sweep(l.users, now)
+
+	if _, ok := l.users["stale"]; ok {
+		t.Error("expected stale entry swept")
+	}
+	if _, ok := l.users["locked"]; !ok {
+		t.Error("expected locked entry kept")
+	}
+}
@@ -0,0 +1,62 @@
+package main
+
+import (
+	"errors"
+	"strings"
+	"sync"
+	"unicode/utf8"
+
+	"golang.org/x/crypto/bcrypt"
+)
+
+const (
+	maxUsernameLength = 64
+	minPasswordLength = 8
+	// bcrypt only uses the first 72 bytes
+	maxPasswordBytes = 72
+)
+
+// bcrypt work factor, lowered by tests
+var hashCost = bcrypt.DefaultCost
+
+// compared against when there's no hash to check, so unknown usernames take as long
+// to reject as wrong passwords
+var dummyHash = sync.OnceValue(func() []byte {
+	hash, err := bcrypt.GenerateFromPassword([]byte("not a real password"), hashCost)
+	if err != nil {
+		panic(err)
+	}
+	return hash
+})
+
+func hashPassword(password string) ([]byte, error) {
+	return bcrypt.GenerateFromPassword([]byte(password), hashCost)
+}
+
+// reports whether the password matches the hash. a nil hash, for unknown users or users
+// without a password, never matches but costs the same as one that doesn't.
+func checkPassword(hash []byte, password string) bool {
+	if len(hash) == 0 {
+		_ = bcrypt.CompareHashAndPassword(dummyHash(), []byte(password))
+		return false
+	}
+	return bcrypt.CompareHashAndPassword(hash, []byte(password)) == nil
+}
+
+// checks the credentials of a new user, returning the username as it'll be stored
+func validateRegistration(username, password string) (string, error) {
+	username = strings.TrimSpace(username)
+	if username == "" {
+		return "", errors.New("username is required")
+	}
+	if utf8.RuneCountInString(username) > maxUsernameLength {
+		return "", errors.New("username is too long")
+	}
+	if utf8.RuneCountInString(password) < minPasswordLength {
+		return "", errors.New("password is too short")
+	}
+	if len(password) > maxPasswordBytes {
+		return "", errors.New("password is too long")
+	}
+	return username, nil
+}
@@ -0,0 +1,148 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"log"
+	"net/http"
+	"time"
+
+	cmn "github.com/timkins666/distributed-playground/backend/pkg/common"
+)
+
+var (
+	errInvalidRefreshToken = errors.New("invalid refresh token")
+	// a refresh token was used after being exchanged, so it may have been stolen
+	errRefreshTokenReused = errors.New("refresh token reused")
+)
+
+// a refresh token as stored, by hash, with the access token issued alongside it
+type refreshToken struct {
+	hash      []byte
+	expiresAt time.Time
+	access    cmn.AccessToken
+}
+
+// where access tokens are revoked, a *cmn.RevocationList outside tests
+type tokenRevoker interface {
+	Revoke(context.Context, ...cmn.AccessToken) error
+}
+
+type refreshRequest struct {
+	RefreshToken string `json:"refreshToken"`
+}
+
+// returns a new random refresh token for the client, and what's stored of it
+func newRefreshToken(access cmn.AccessToken, ttl time.Duration) (string, *refreshToken, error) {
+	b := make([]byte, 32)
+	if _, err := rand.Read(b); err != nil {
+		return "", nil, err
+	}
+	token := base64.RawURLEncoding.EncodeToString(b)
+	return token, &refreshToken{
+		hash:      hashRefreshToken(token),
+		expiresAt: time.Now().UTC().Add(ttl),
+		access:    access,
+	}, nil
+}
+
+// refresh tokens are random so don't need a slow hash like passwords
+func hashRefreshToken(token string) []byte {
+	h := sha256.Sum256([]byte(token))
+	return h[:]
+}
+
+// exchanges a refresh token for a new access and refresh token. presenting a refresh token
+// that has already been exchanged revokes its whole family, including access tokens.
+func refreshHandler(w http.ResponseWriter, r *http.Request) {
+	app, ok := r.Context().Value(cmn.AppCtx).(*authCtx)
+	if !ok {
+		log.Println("Failed to get app context")
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	var req refreshRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil || req.RefreshToken == "" {
+		http.Error(w, "invalid request", http.StatusBadRequest)
+		return
+	}
+
+	access := cmn.NewAccessToken()
+	value, next, err := newRefreshToken(access, app.refreshTTL)
+	if err != nil {
+		app.logger.Println("Failed creating refresh token:", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	hash := hashRefreshToken(req.RefreshToken)
+	user, err := app.db.rotateRefreshToken(hash, next)
+	if errors.Is(err, errRefreshTokenReused) {
+		app.logger.Println("Refresh token reused, revoking its family")
+		revokeFamily(r, app, hash)
+	}
+	if errors.Is(err, errRefreshTokenReused) || errors.Is(err, errInvalidRefreshToken) {
+		http.Error(w, "invalid refresh token", http.StatusUnauthorized)
+		return
+	}
+	if err != nil {
+		app.logger.Println("Failed rotating refresh token:", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	writeTokens(w, http.StatusOK, user, access, value)
+}
+
+// revokes the refresh token family of the token in the body, and the access token the
+// request is authorised with. either may be left out, and unknown tokens are ignored.
+func logoutHandler(w http.ResponseWriter, r *http.Request) {
+	app, ok := r.Context().Value(cmn.AppCtx).(*authCtx)
+	if !ok {
+		log.Println("Failed to get app context")
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	var req refreshRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "invalid request", http.StatusBadRequest)
+		return
+	}
+
+	if req.RefreshToken != "" {
+		if err := revokeFamily(r, app, hashRefreshToken(req.RefreshToken)); err != nil {
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+	}
+
+	if access, err := cmn.AccessTokenFromRequest(r); err == nil {
+		if err := app.revocations.Revoke(r.Context(), access); err != nil {
+			// it still expires within cmn.AccessTokenTTL
+			app.logger.Println("Failed revoking access token:", err)
+		}
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// revokes the family of the refresh token with the hash in the db, then the family's
+// access tokens that haven't expired
+func revokeFamily(r *http.Request, app *authCtx, hash []byte) error {
+	tokens, err := app.db.revokeRefreshFamily(hash)
+	if err != nil {
+		app.logger.Println("Failed revoking refresh token family:", err)
+		return err
+	}
+	if err := app.revocations.Revoke(r.Context(), tokens...); err != nil {
+		// the family can't be refreshed, and its access tokens expire within cmn.AccessTokenTTL
+		app.logger.Println("Failed revoking access tokens:", err)
+	}
+	return nil
+}
@@ -0,0 +1,170 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	cmn "github.com/timkins666/distributed-playground/backend/pkg/common"
+)
+
+type tokensResponse struct {
+	Username     string `json:"username"`
+	Token        string `json:"token"`
+	RefreshToken string `json:"refreshToken"`
+}
+
+func login(t *testing.T, app *authCtx) tokensResponse {
+	t.Helper()
+	rec := post(app, loginHandler, "1.2.3.4", "tim", "correct horse")
+	if rec.Code != http.StatusOK {
+		t.Fatalf("login failed with %d", rec.Code)
+	}
+	var resp tokensResponse
+	if err := json.Unmarshal(rec.Body.Bytes(), &resp); err != nil {
+		t.Fatal(err)
+	}
+	return resp
+}
+
+func postRefresh(app *authCtx, handler http.HandlerFunc, refreshToken, accessToken string) *httptest.ResponseRecorder {
+	body, _ := json.Marshal(refreshRequest{RefreshToken: refreshToken})
+	req := httptest.NewRequest(http.MethodPost, "/", bytes.NewReader(body))
+	req = req.WithContext(context.WithValue(req.Context(), cmn.AppCtx, app))
+	if accessToken != "" {
+		req.Header.Set("Authorization", "Bearer "+accessToken)
+	}
+	rec := httptest.NewRecorder()
+	handler(rec, req)
+	return rec
+}
+
+func newRefreshTestApp(t *testing.T) (*authCtx, *mockAuthDB, *mockRevoker) {
+	db := newMockAuthDB()
+	addUser(t, db, "tim", "correct horse")
+	app := newTestApp(db)
+	return app, db, app.revocations.(*mockRevoker)
+}
+
+func TestRefreshRotates(t *testing.T) {
+	app, _, _ := newRefreshTestApp(t)
+	first := login(t, app)
+
+	rec := postRefresh(app, refreshHandler, first.RefreshToken, "")
+	if rec.Code != http.StatusOK {
+		t.Fatalf("expected 200, got %d", rec.Code)
+	}
+	var second tokensResponse
+	if err := json.Unmarshal(rec.Body.Bytes(), &second); err != nil {
+		t.Fatal(err)
+	}
+	if second.Username != "tim" || second.Token == "" || second.RefreshToken == "" || second.RefreshToken == first.RefreshToken {
+		t.Errorf("unexpected response %+v", second)
+	}
+
+	if rec := postRefresh(app, refreshHandler, second.RefreshToken, ""); rec.Code != http.StatusOK {
+		t.Errorf("expected rotated token to refresh, got %d", rec.Code)
+	}
+}
+
+func TestRefreshReuseRevokesFamily(t *testing.T) {
+	app, db, revoker := newRefreshTestApp(t)
+	first := login(t, app)
+	other := login(t, app)
+
+	rec := postRefresh(app, refreshHandler, first.RefreshToken, "")
+	var second tokensResponse
+	_ = json.Unmarshal(rec.Body.Bytes(), &second)
+
+	if rec := postRefresh(app, refreshHandler, first.RefreshToken, ""); rec.Code != http.StatusUnauthorized {
+		t.Fatalf("expected reuse to be rejected, got %d", rec.Code)
+	}
+	if rec := postRefresh(app, refreshHandler, second.RefreshToken, ""); rec.Code != http.StatusUnauthorized {
+		t.Errorf("expected the rest of the family revoked, got %d", rec.Code)
+	}
+	if len(revoker.revoked) != 2 {
+		t.Errorf("expected both access tokens in the family revoked, got %v", revoker.revoked)
+	}
+	if rec := postRefresh(app, refreshHandler, other.RefreshToken, ""); rec.Code != http.StatusOK {
+		t.Errorf("expected other families unaffected, got %d", rec.Code)
+	}
+	if len(db.families) != 2 {
+		t.Errorf("expected two families, got %d", len(db.families))
+	}
+}
+
+func TestRefreshInvalid(t *testing.T) {
+	app, db, _ := newRefreshTestApp(t)
+
+	if rec := postRefresh(app, refreshHandler, "", ""); rec.Code != http.StatusBadRequest {
+		t.Errorf("expected 400 without a token, got %d", rec.Code)
+	}
+	if rec := postRefresh(app, refreshHandler, "unknown", ""); rec.Code != http.StatusUnauthorized {
+		t.Errorf("expected 401 for an unknown token, got %d", rec.Code)
+	}
+
+	resp := login(t, app)
+	for _, rt := range db.refreshTokens {
+		rt.expiresAt = time.Now().Add(-time.Second)
+	}
+	if rec := postRefresh(app, refreshHandler, resp.RefreshToken, ""); rec.Code != http.StatusUnauthorized {
+		t.Errorf("expected 401 for an expired token, got %d", rec.Code)
+	}
+
+	db.err = errors.New("db down")
+	if rec := postRefresh(app, refreshHandler, resp.RefreshToken, ""); rec.Code != http.StatusInternalServerError {
+		t.Errorf("expected 500, got %d", rec.Code)
+	}
+}
+
+func TestLogout(t *testing.T) {
+	app, _, revoker := newRefreshTestApp(t)
+	resp := login(t, app)
+
+	if rec := postRefresh(app, logoutHandler, resp.RefreshToken, resp.Token); rec.Code != http.StatusNoContent {
+		t.Fatalf("expected 204, got %d", rec.Code)
+	}
+	if len(revoker.revoked) != 1 {
+		t.Errorf("expected the access token revoked, got %v", revoker.revoked)
+	}
+	if rec := postRefresh(app, refreshHandler, resp.RefreshToken, ""); rec.Code != http.StatusUnauthorized {
+		t.Errorf("expected refresh after logout to fail, got %d", rec.Code)
+	}
+
+	// logging out again is harmless
+	if rec := postRefresh(app, logoutHandler, resp.RefreshToken, ""); rec.Code != http.StatusNoContent {
+		t.Errorf("expected 204, got %d", rec.Code)
+	}
+}
+
+func TestLogoutRevocationUnavailable(t *testing.T) {
+	app, _, revoker := newRefreshTestApp(t)
+	revoker.err = errors.New("redis down")
+	resp := login(t, app)
+
+	// the refresh token is still revoked in the db
+	if rec := postRefresh(app, logoutHandler, resp.RefreshToken, resp.Token); rec.Code != http.StatusNoContent {
+		t.Fatalf("expected 204, got %d", rec.Code)
+	}
+	if rec := postRefresh(app, refreshHandler, resp.RefreshToken, ""); rec.Code != http.StatusUnauthorized {
+		t.Errorf("expected refresh after logout to fail, got %d", rec.Code)
+	}
+}
+
+func TestHashRefreshToken(t *testing.T) {
+	value, stored, err := newRefreshToken(cmn.NewAccessToken(), time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(stored.hash, hashRefreshToken(value)) || bytes.Contains(stored.hash, []byte(value)) {
+		t.Error("expected the token stored as its hash")
+	}
+	if other, _, _ := newRefreshToken(cmn.NewAccessToken(), time.Hour); other == value {
+		t.Error("expected random tokens")
+	}
+}
@@ -0,0 +1,40 @@
+package main
+
+import (
+	"context"
+	"errors"
+
+	cmn "github.com/timkins666/distributed-playground/backend/pkg/common"
+)
+
+var errRedisUnavailable = errors.New("redis unavailable")
+
+// the cache holding the views being invalidated
+type cacheStore interface {
+	// removes the key, returning whether it was cached
+	evict(ctx context.Context, key string) (bool, error)
+	// whether the cache can be reached
+	healthy() bool
+	close() error
+}
+
+type redisStore struct {
+	redis *cmn.Redis
+}
+
+func (r *redisStore) evict(ctx context.Context, key string) (bool, error) {
+	client := r.redis.Client()
+	if client == nil {
+		return false, errRedisUnavailable
+	}
+	n, err := client.Del(ctx, key).Result()
+	return n > 0, err
+}
+
+func (r *redisStore) healthy() bool {
+	return r.redis.Healthy()
+}
+
+func (r *redisStore) close() error {
+	return r.redis.Close()
+}
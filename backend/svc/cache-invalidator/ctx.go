@@ -0,0 +1,78 @@
+package main
+
+import (
+	"context"
+	"log"
+
+	"github.com/segmentio/kafka-go"
+	cmn "github.com/timkins666/distributed-playground/backend/pkg/common"
+)
+
+// app context for the cache invalidator
+type invalidatorCtx struct {
+	cancelCtx context.Context
+	db        invalidatorDB
+	cache     cacheStore
+	// account and transaction change events
+	reader  cmn.KafkaReader
+	logger  *log.Logger
+	metrics *invalidatorMetrics
+	// account id -> owning user id. only used by the consumer.
+	owners map[int32]int32
+}
+
+// close releases all resources
+func (a *invalidatorCtx) close() error {
+	var errs []error
+
+	if a.reader != nil {
+		if err := a.reader.Close(); err != nil {
+			errs = append(errs, err)
+		}
+	}
+
+	if a.cache != nil {
+		if err := a.cache.close(); err != nil {
+			errs = append(errs, err)
+		}
+	}
+
+	if len(errs) > 0 {
+		return errs[0]
+	}
+	return nil
+}
+
+func newAppCtx(cancelCtx context.Context) *invalidatorCtx {
+	logger := cmn.AppLogger()
+
+	db, err := initDB()
+	if err != nil {
+		logger.Fatal(err)
+	}
+
+	redisConfig, err := cmn.LoadRedisConfig()
+	if err != nil {
+		logger.Fatal(err)
+	}
+
+	reader := kafka.NewReader(kafka.ReaderConfig{
+		Brokers: []string{cmn.KafkaBroker()},
+		GroupID: "cache-invalidator",
+		GroupTopics: []string{
+			cmn.Topics.AccountChanged().S(),
+			cmn.Topics.TransactionComplete().S(),
+		},
+	})
+
+	return &invalidatorCtx{
+		cancelCtx: cancelCtx,
+		db:        db,
+		// events are retried until redis is reachable
+		cache:   &redisStore{cmn.ConnectRedis(cancelCtx, redisConfig, logger)},
+		reader:  reader,
+		logger:  logger,
+		metrics: newInvalidatorMetrics(),
+		owners:  make(map[int32]int32),
+	}
+}
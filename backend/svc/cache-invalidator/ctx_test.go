@@ -0,0 +1,20 @@
+package main
+
+import (
+	"testing"
+
+	tu "github.com/timkins666/distributed-playground/backend/pkg/testutils"
+)
+
+func TestInvalidatorCtxClose(t *testing.T) {
+	reader := &tu.MockKafkaReader{}
+	cache := &mockCache{}
+	ctx := &invalidatorCtx{reader: reader, cache: cache}
+
+	if err := ctx.close(); err != nil {
+		t.Errorf("unexpected error: %v", err)
+	}
+	if !reader.Closed || !cache.closed {
+		t.Error("reader and cache should be closed")
+	}
+}
@@ -0,0 +1,31 @@
+package main
+
+import (
+	"fmt"
+	"os"
+
+	cmn "github.com/timkins666/distributed-playground/backend/pkg/common"
+)
+
+func initDB() (invalidatorDB, error) {
+	dbType, found := os.LookupEnv("DB_TYPE")
+
+	if dbType == "_TEST_" {
+		return &dbPostgres{}, nil
+	}
+
+	if dbType == "POSTGRES" || !found {
+		db, err := cmn.InitPostgres(cmn.DefaultConfig)
+		if err != nil {
+			return nil, fmt.Errorf("failed to initialize database: %w", err)
+		}
+		return &dbPostgres{db}, nil
+	}
+
+	panic("cassandra not set up yet")
+}
+
+type invalidatorDB interface {
+	// the user owning the account, cmn.ErrAccountNotFound if there's no such account
+	getAccountOwner(accountID int32) (int32, error)
+}
@@ -0,0 +1,22 @@
+package main
+
+import (
+	"database/sql"
+
+	cmn "github.com/timkins666/distributed-playground/backend/pkg/common"
+)
+
+type dbPostgres struct {
+	db *sql.DB
+}
+
+func (db *dbPostgres) getAccountOwner(accountID int32) (int32, error) {
+	var userID int32
+	err := db.db.QueryRow(`
+		SELECT user_id FROM accounts.account WHERE id = $1
+	`, accountID).Scan(&userID)
+	if err == sql.ErrNoRows {
+		return 0, cmn.ErrAccountNotFound
+	}
+	return userID, err
+}
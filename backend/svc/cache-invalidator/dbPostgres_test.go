@@ -0,0 +1,40 @@
+package main
+
+import (
+	"database/sql"
+	"testing"
+
+	"github.com/DATA-DOG/go-sqlmock"
+	cmn "github.com/timkins666/distributed-playground/backend/pkg/common"
+)
+
+func TestDBPostgresGetAccountOwner(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatalf("failed to create mock: %v", err)
+	}
+	defer db.Close()
+
+	dbPg := &dbPostgres{db: db}
+
+	mock.ExpectQuery("SELECT user_id FROM accounts.account WHERE id").
+		WithArgs(7).
+		WillReturnRows(sqlmock.NewRows([]string{"user_id"}).AddRow(3))
+	mock.ExpectQuery("SELECT user_id FROM accounts.account WHERE id").
+		WithArgs(8).
+		WillReturnError(sql.ErrNoRows)
+
+	userID, err := dbPg.getAccountOwner(7)
+	if err != nil || userID != 3 {
+		t.Errorf("expected owner 3, got %d %v", userID, err)
+	}
+
+	_, err = dbPg.getAccountOwner(8)
+	if err != cmn.ErrAccountNotFound {
+		t.Errorf("expected ErrAccountNotFound, got %v", err)
+	}
+
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("unmet expectations: %v", err)
+	}
+}
@@ -0,0 +1,96 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strconv"
+	"time"
+
+	"github.com/segmentio/kafka-go"
+	cmn "github.com/timkins666/distributed-playground/backend/pkg/common"
+)
+
+// accounts never change owner, so owners are remembered up to this many accounts
+const maxOwners = 100_000
+
+// a change to an account, from either source topic
+type change struct {
+	accountID int32
+	// 0 if the event doesn't say, it's looked up from the account
+	userID    int32
+	changedAt time.Time
+}
+
+// handleMessage evicts the cached accounts of the user owning the changed account
+func handleMessage(ctx context.Context, msg kafka.Message, appCtx *invalidatorCtx) error {
+	c, err := parseChange(msg)
+	if err != nil {
+		appCtx.metrics.recordDropped()
+		return cmn.Unprocessable(err)
+	}
+
+	userID := c.userID
+	if userID == 0 {
+		userID, err = appCtx.accountOwner(c.accountID)
+		if errors.Is(err, cmn.ErrAccountNotFound) {
+			appCtx.metrics.recordDropped()
+			return cmn.Unprocessable(fmt.Errorf("account %d: %w", c.accountID, err))
+		}
+		if err != nil {
+			appCtx.metrics.recordError()
+			return err
+		}
+	}
+
+	key := cmn.RedisKey(cmn.RedisKeyUserAccounts, strconv.Itoa(int(userID)))
+	evicted, err := appCtx.cache.evict(ctx, key)
+	if err != nil {
+		appCtx.metrics.recordError()
+		return fmt.Errorf("failed to evict %s: %w", key, err)
+	}
+
+	appCtx.metrics.recordInvalidation(msg.Topic, evicted, time.Since(c.changedAt))
+	if evicted {
+		appCtx.logger.Printf("Evicted %s after change to account %d", key, c.accountID)
+	}
+	return nil
+}
+
+func parseChange(msg kafka.Message) (*change, error) {
+	switch msg.Topic {
+	case cmn.Topics.AccountChanged().S():
+		e, err := cmn.FromBytes[cmn.AccountChangedEvent](msg.Value)
+		if err != nil {
+			return nil, err
+		}
+		return &change{accountID: e.AccountID, userID: e.UserID, changedAt: e.Timestamp}, nil
+
+	case cmn.Topics.TransactionComplete().S():
+		e, err := cmn.FromBytes[cmn.TransactionEvent](msg.Value)
+		if err != nil {
+			return nil, err
+		}
+		return &change{accountID: e.AccountID, changedAt: e.Timestamp}, nil
+	}
+
+	return nil, fmt.Errorf("unexpected topic %s", msg.Topic)
+}
+
+// accountOwner looks up the user owning the account, remembering the answer
+func (a *invalidatorCtx) accountOwner(accountID int32) (int32, error) {
+	if userID, ok := a.owners[accountID]; ok {
+		return userID, nil
+	}
+
+	userID, err := a.db.getAccountOwner(accountID)
+	if err != nil {
+		return 0, err
+	}
+
+	if len(a.owners) >= maxOwners {
+		clear(a.owners)
+	}
+	a.owners[accountID] = userID
+	return userID, nil
+}
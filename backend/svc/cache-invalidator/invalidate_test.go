@@ -0,0 +1,212 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/segmentio/kafka-go"
+	cmn "github.com/timkins666/distributed-playground/backend/pkg/common"
+)
+
+type mockDB struct {
+	owners map[int32]int32
+	err    error
+	// number of owner lookups
+	lookups int
+}
+
+func (m *mockDB) getAccountOwner(accountID int32) (int32, error) {
+	m.lookups++
+	if m.err != nil {
+		return 0, m.err
+	}
+	userID, ok := m.owners[accountID]
+	if !ok {
+		return 0, cmn.ErrAccountNotFound
+	}
+	return userID, nil
+}
+
+type mockCache struct {
+	keys    map[string]bool
+	evicted []string
+	err     error
+	closed  bool
+}
+
+func (m *mockCache) evict(_ context.Context, key string) (bool, error) {
+	if m.err != nil {
+		return false, m.err
+	}
+	m.evicted = append(m.evicted, key)
+	cached := m.keys[key]
+	delete(m.keys, key)
+	return cached, nil
+}
+
+func (m *mockCache) healthy() bool {
+	return m.err == nil
+}
+
+func (m *mockCache) close() error {
+	m.closed = true
+	return nil
+}
+
+func testAppCtx(db *mockDB, cache *mockCache) *invalidatorCtx {
+	return &invalidatorCtx{
+		cancelCtx: context.Background(),
+		db:        db,
+		cache:     cache,
+		logger:    cmn.AppLogger(),
+		metrics:   newInvalidatorMetrics(),
+		owners:    make(map[int32]int32),
+	}
+}
+
+func accountChangedMsg(t *testing.T, e cmn.AccountChangedEvent) kafka.Message {
+	b, err := cmn.ToBytes(e)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return kafka.Message{Topic: cmn.Topics.AccountChanged().S(), Value: b}
+}
+
+func txCompletedMsg(t *testing.T, e cmn.TransactionEvent) kafka.Message {
+	b, err := cmn.ToBytes(e)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return kafka.Message{Topic: cmn.Topics.TransactionComplete().S(), Value: b}
+}
+
+func TestHandleAccountChanged(t *testing.T) {
+	db := &mockDB{}
+	cache := &mockCache{keys: map[string]bool{"userAccounts:3": true}}
+	appCtx := testAppCtx(db, cache)
+
+	msg := accountChangedMsg(t, cmn.AccountChangedEvent{
+		AccountID: 7, UserID: 3, Change: cmn.AccountHoldPlaced, Timestamp: time.Now().Add(-50 * time.Millisecond),
+	})
+	if err := handleMessage(context.Background(), msg, appCtx); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	if len(cache.evicted) != 1 || cache.evicted[0] != "userAccounts:3" {
+		t.Errorf("expected userAccounts:3 evicted, got %v", cache.evicted)
+	}
+	// the event names the user so there's nothing to look up
+	if db.lookups != 0 {
+		t.Errorf("expected no owner lookups, got %d", db.lookups)
+	}
+
+	m := appCtx.metrics.snapshot()
+	if m.Events[cmn.Topics.AccountChanged().S()] != 1 || m.Evicted != 1 {
+		t.Errorf("unexpected metrics %+v", m)
+	}
+	if m.StaleWindow.Count != 1 || m.StaleWindow.LastMs < 50 {
+		t.Errorf("expected a stale window of at least 50ms, got %+v", m.StaleWindow)
+	}
+}
+
+func TestHandleTransactionCompleted(t *testing.T) {
+	db := &mockDB{owners: map[int32]int32{7: 3}}
+	cache := &mockCache{keys: map[string]bool{"userAccounts:3": true}}
+	appCtx := testAppCtx(db, cache)
+
+	for range 2 {
+		msg := txCompletedMsg(t, cmn.TransactionEvent{AccountID: 7, Amount: 100, Timestamp: time.Now()})
+		if err := handleMessage(context.Background(), msg, appCtx); err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+	}
+
+	if len(cache.evicted) != 2 || cache.evicted[1] != "userAccounts:3" {
+		t.Errorf("expected userAccounts:3 evicted twice, got %v", cache.evicted)
+	}
+	// the owner is remembered
+	if db.lookups != 1 {
+		t.Errorf("expected 1 owner lookup, got %d", db.lookups)
+	}
+
+	m := appCtx.metrics.snapshot()
+	if m.Events[cmn.Topics.TransactionComplete().S()] != 2 || m.Evicted != 1 || m.NotCached != 1 {
+		t.Errorf("unexpected metrics %+v", m)
+	}
+}
+
+func TestHandleMessageFailures(t *testing.T) {
+	tests := []struct {
+		name              string
+		msg               func(t *testing.T) kafka.Message
+		dbErr             error
+		cacheErr          error
+		wantUnprocessable bool
+	}{
+		{
+			name: "unparseable",
+			msg: func(*testing.T) kafka.Message {
+				return kafka.Message{Topic: cmn.Topics.AccountChanged().S(), Value: []byte("nope")}
+			},
+			wantUnprocessable: true,
+		},
+		{
+			name: "unknown account",
+			msg: func(t *testing.T) kafka.Message {
+				return txCompletedMsg(t, cmn.TransactionEvent{AccountID: 99})
+			},
+			wantUnprocessable: true,
+		},
+		{
+			name: "owner lookup fails",
+			msg: func(t *testing.T) kafka.Message {
+				return txCompletedMsg(t, cmn.TransactionEvent{AccountID: 7})
+			},
+			dbErr: errors.New("db down"),
+		},
+		{
+			name: "evict fails",
+			msg: func(t *testing.T) kafka.Message {
+				return accountChangedMsg(t, cmn.AccountChangedEvent{AccountID: 7, UserID: 3})
+			},
+			cacheErr: errors.New("redis down"),
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			appCtx := testAppCtx(&mockDB{owners: map[int32]int32{7: 3}, err: tt.dbErr}, &mockCache{err: tt.cacheErr})
+
+			err := handleMessage(context.Background(), tt.msg(t), appCtx)
+			if err == nil {
+				t.Fatal("expected error")
+			}
+			if got := errors.Is(err, cmn.ErrUnprocessable); got != tt.wantUnprocessable {
+				t.Errorf("expected unprocessable %v, got %v", tt.wantUnprocessable, err)
+			}
+
+			m := appCtx.metrics.snapshot()
+			if tt.wantUnprocessable && m.Dropped != 1 || !tt.wantUnprocessable && m.Errors != 1 {
+				t.Errorf("unexpected metrics %+v", m)
+			}
+		})
+	}
+}
+
+func TestAccountOwnerForgetsWhenFull(t *testing.T) {
+	db := &mockDB{owners: map[int32]int32{1: 10, 2: 20}}
+	appCtx := testAppCtx(db, &mockCache{})
+	for i := range int32(maxOwners) {
+		appCtx.owners[-i-100] = 1
+	}
+
+	userID, err := appCtx.accountOwner(2)
+	if err != nil || userID != 20 {
+		t.Fatalf("expected owner 20, got %d %v", userID, err)
+	}
+	if len(appCtx.owners) != 1 {
+		t.Errorf("expected owners reset before remembering, got %d", len(appCtx.owners))
+	}
+}
@@ -0,0 +1,76 @@
+// cache-invalidator evicts users' cached accounts from redis when account-service changes an
+// account or transaction-service changes its balance, keeping invalidation off the write paths.
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"log"
+	"net/http"
+	"os"
+	"time"
+
+	"github.com/segmentio/kafka-go"
+	cmn "github.com/timkins666/distributed-playground/backend/pkg/common"
+)
+
+func main() {
+	cancelCtx, stop := cmn.GetCancelContext()
+	defer stop()
+
+	appCtx := newAppCtx(cancelCtx)
+	defer appCtx.close()
+
+	// evicting is idempotent so redelivered events are harmless
+	go cmn.Consume(cancelCtx, appCtx.reader, func(ctx context.Context, msg kafka.Message) error {
+		return handleMessage(ctx, msg, appCtx)
+	}, appCtx.logger)
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("GET /health", handleHealth)
+	mux.HandleFunc("GET /metrics", handleMetrics)
+
+	port := ":" + os.Getenv("SERVE_PORT")
+	log.Printf("Cache invalidator running on %s", port)
+	log.Fatal(http.ListenAndServe(port,
+		cmn.SetContextValuesMiddleware(
+			map[cmn.ContextKey]any{cmn.AppCtx: appCtx})(mux)))
+}
+
+func handleHealth(w http.ResponseWriter, r *http.Request) {
+	appCtx, ok := r.Context().Value(cmn.AppCtx).(*invalidatorCtx)
+	if !ok {
+		log.Println("invalid appCtx")
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	// nothing can be evicted without redis
+	status, code := "healthy", http.StatusOK
+	if !appCtx.cache.healthy() {
+		status, code = "redis unavailable", http.StatusServiceUnavailable
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(code)
+	_ = json.NewEncoder(w).Encode(map[string]any{
+		"status":    status,
+		"service":   "cache-invalidator",
+		"timestamp": time.Now().UTC().Format(time.RFC3339),
+	})
+}
+
+// responds with invalidation counts and stale read windows
+func handleMetrics(w http.ResponseWriter, r *http.Request) {
+	appCtx, ok := r.Context().Value(cmn.AppCtx).(*invalidatorCtx)
+	if !ok {
+		log.Println("invalid appCtx")
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(appCtx.metrics.snapshot()); err != nil {
+		appCtx.logger.Printf("Failed to encode response: %v", err)
+	}
+}
@@ -0,0 +1,47 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	cmn "github.com/timkins666/distributed-playground/backend/pkg/common"
+)
+
+func TestHandleHealth(t *testing.T) {
+	tests := []struct {
+		name       string
+		cacheErr   error
+		wantStatus int
+	}{
+		{name: "redis reachable", wantStatus: http.StatusOK},
+		{name: "redis unavailable", cacheErr: errRedisUnavailable, wantStatus: http.StatusServiceUnavailable},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			appCtx := testAppCtx(&mockDB{}, &mockCache{err: tt.cacheErr})
+			req := httptest.NewRequest(http.MethodGet, "/health", nil)
+			req = req.WithContext(context.WithValue(req.Context(), cmn.AppCtx, appCtx))
+			w := httptest.NewRecorder()
+
+			handleHealth(w, req)
+
+			if w.Code != tt.wantStatus {
+				t.Errorf("expected status %d, got %d", tt.wantStatus, w.Code)
+			}
+		})
+	}
+}
+
+func TestRedisStoreUnavailable(t *testing.T) {
+	store := &redisStore{}
+	if store.healthy() {
+		t.Error("expected unhealthy without redis")
+	}
+	if _, err := store.evict(context.Background(), "userAccounts:1"); !errors.Is(err, errRedisUnavailable) {
+		t.Errorf("expected errRedisUnavailable, got %v", err)
+	}
+}
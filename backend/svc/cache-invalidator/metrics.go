@@ -0,0 +1,136 @@
+package main
+
+import (
+	"sync"
+	"time"
+)
+
+// upper bounds of the stale read window histogram, anything longer is counted in the last bucket
+var staleBuckets = []time.Duration{
+	10 * time.Millisecond,
+	100 * time.Millisecond,
+	time.Second,
+	10 * time.Second,
+}
+
+// counts invalidations and how long cached views were stale before being evicted
+type invalidatorMetrics struct {
+	mu sync.Mutex
+	// events handled per source topic
+	events map[string]int64
+	// evictions of keys that were cached
+	evicted int64
+	// events for keys that weren't cached, nothing to evict
+	notCached int64
+	// failed attempts at looking up an owner or evicting, retried
+	errors int64
+	// events dropped as unparseable or for unknown accounts
+	dropped int64
+
+	stale      staleWindows
+	staleCount []int64
+}
+
+// time from an account changing to its user's cached accounts being evicted, during which
+// account-service may serve the old view
+type staleWindows struct {
+	Count  int64   `json:"count"`
+	MeanMs float64 `json:"meanMs"`
+	MaxMs  float64 `json:"maxMs"`
+	LastMs float64 `json:"lastMs"`
+	// count of windows below each bound
+	Buckets []staleBucket `json:"buckets"`
+}
+
+type staleBucket struct {
+	// empty for the overflow bucket
+	Below string `json:"below,omitempty"`
+	Count int64  `json:"count"`
+}
+
+// point in time view of the metrics
+type metricsSnapshot struct {
+	Events      map[string]int64 `json:"events"`
+	Evicted     int64            `json:"evicted"`
+	NotCached   int64            `json:"notCached"`
+	Errors      int64            `json:"errors"`
+	Dropped     int64            `json:"dropped"`
+	StaleWindow staleWindows     `json:"staleWindow"`
+}
+
+func newInvalidatorMetrics() *invalidatorMetrics {
+	return &invalidatorMetrics{
+		events:     make(map[string]int64),
+		staleCount: make([]int64, len(staleBuckets)+1),
+	}
+}
+
+// records a handled event. staleFor is only recorded when a cached view was evicted.
+func (m *invalidatorMetrics) recordInvalidation(source string, evicted bool, staleFor time.Duration) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	m.events[source]++
+	if !evicted {
+		m.notCached++
+		return
+	}
+	m.evicted++
+
+	// clocks can disagree between hosts
+	staleFor = max(staleFor, 0)
+	ms := float64(staleFor) / float64(time.Millisecond)
+	m.stale.Count++
+	m.stale.MeanMs += (ms - m.stale.MeanMs) / float64(m.stale.Count)
+	m.stale.MaxMs = max(m.stale.MaxMs, ms)
+	m.stale.LastMs = ms
+
+	bucket := len(staleBuckets)
+	for i, bound := range staleBuckets {
+		if staleFor < bound {
+			bucket = i
+			break
+		}
+	}
+	m.staleCount[bucket]++
+}
+
+func (m *invalidatorMetrics) recordError() {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.errors++
+}
+
+func (m *invalidatorMetrics) recordDropped() {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.dropped++
+}
+
+func (m *invalidatorMetrics) snapshot() metricsSnapshot {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	events := make(map[string]int64, len(m.events))
+	for k, v := range m.events {
+		events[k] = v
+	}
+
+	stale := m.stale
+	stale.Buckets = make([]staleBucket, len(m.staleCount))
+	for i, n := range m.staleCount {
+		stale.Buckets[i].Count = n
+		if i < len(staleBuckets) {
+			stale.Buckets[i].Below = staleBuckets[i].String()
+		}
+	}
+
+	return metricsSnapshot{
+		Events:      events,
+		Evicted:     m.evicted,
+		NotCached:   m.notCached,
+		Errors:      m.errors,
+		Dropped:     m.dropped,
+		StaleWindow: stale,
+	}
+}
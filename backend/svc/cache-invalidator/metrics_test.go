@@ -0,0 +1,45 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestInvalidatorMetricsStaleWindows(t *testing.T) {
+	m := newInvalidatorMetrics()
+
+	m.recordInvalidation("a", true, 5*time.Millisecond)
+	m.recordInvalidation("a", true, 15*time.Millisecond)
+	m.recordInvalidation("b", true, 20*time.Second)
+	// clock skew shouldn't give a negative window
+	m.recordInvalidation("b", true, -time.Second)
+	m.recordInvalidation("b", false, time.Hour)
+	m.recordError()
+	m.recordDropped()
+
+	s := m.snapshot()
+	if s.Events["a"] != 2 || s.Events["b"] != 3 {
+		t.Errorf("unexpected events %v", s.Events)
+	}
+	if s.Evicted != 4 || s.NotCached != 1 || s.Errors != 1 || s.Dropped != 1 {
+		t.Errorf("unexpected counts %+v", s)
+	}
+
+	w := s.StaleWindow
+	if w.Count != 4 || w.MaxMs != 20000 || w.LastMs != 0 {
+		t.Errorf("unexpected stale windows %+v", w)
+	}
+	if want := (5.0 + 15 + 20000) / 4; w.MeanMs != want {
+		t.Errorf("expected mean %f, got %f", want, w.MeanMs)
+	}
+
+	wantBuckets := []staleBucket{{"10ms", 2}, {"100ms", 1}, {"1s", 0}, {"10s", 0}, {"", 1}}
+	if len(w.Buckets) != len(wantBuckets) {
+		t.Fatalf("expected %d buckets, got %+v", len(wantBuckets), w.Buckets)
+	}
+	for i, b := range wantBuckets {
+		if w.Buckets[i] != b {
+			t.Errorf("bucket %d: expected %+v, got %+v", i, b, w.Buckets[i])
+		}
+	}
+}
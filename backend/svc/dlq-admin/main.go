@@ -0,0 +1,168 @@
+// dlq-admin inspects dead letter topics and replays their messages to the original topic.
+//
+//	dlq-admin list <topic>.dlq [-limit n]
+//	dlq-admin replay <topic>.dlq (-all | -partition p -offset o)
+package main
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"os"
+	"strings"
+
+	"github.com/segmentio/kafka-go"
+	cmn "github.com/timkins666/distributed-playground/backend/pkg/common"
+)
+
+const usage = `usage:
+  dlq-admin list <topic>.dlq [-limit n]
+  dlq-admin replay <topic>.dlq (-all | -partition p -offset o)`
+
+func main() {
+	if len(os.Args) < 3 || !strings.HasSuffix(os.Args[2], ".dlq") {
+		fmt.Fprintln(os.Stderr, usage)
+		os.Exit(2)
+	}
+
+	ctx, stop := cmn.GetCancelContext()
+	defer stop()
+
+	cmd, topic, args := os.Args[1], os.Args[2], os.Args[3:]
+	broker := cmn.KafkaBroker()
+
+	var err error
+	switch cmd {
+	case "list":
+		err = list(ctx, broker, topic, args)
+	case "replay":
+		err = replay(ctx, broker, topic, args)
+	default:
+		fmt.Fprintln(os.Stderr, usage)
+		os.Exit(2)
+	}
+
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+}
+
+func list(ctx context.Context, broker, topic string, args []string) error {
+	flags := flag.NewFlagSet("list", flag.ExitOnError)
+	limit := flags.Int("limit", 50, "maximum messages to show")
+	flags.Parse(args)
+
+	shown := 0
+	err := readTopic(ctx, broker, topic, func(msg kafka.Message) bool {
+		dl := cmn.ParseDeadLetter(msg)
+		fmt.Printf("%d:%d from %s:%s:%s attempts=%d failed=%s\n  error: %s\n  key: %s\n  value: %s\n",
+			msg.Partition, msg.Offset, dl.OriginalTopic, dl.Partition, dl.Offset, dl.Attempts, dl.FailedAt,
+			dl.Error, msg.Key, truncate(msg.Value, 200))
+		shown++
+		return shown < *limit
+	})
+	fmt.Printf("%d messages\n", shown)
+	return err
+}
+
+// replays dead letters to their original topic. the dead letters themselves are left in place.
+func replay(ctx context.Context, broker, topic string, args []string) error {
+	flags := flag.NewFlagSet("replay", flag.ExitOnError)
+	all := flags.Bool("all", false, "replay every message")
+	partition := flags.Int("partition", 0, "partition of the message to replay")
+	offset := flags.Int64("offset", -1, "offset of the message to replay")
+	flags.Parse(args)
+
+	if !*all && *offset < 0 {
+		return errors.New("one of -all or -offset is required\n" + usage)
+	}
+
+	writer := &kafka.Writer{Addr: kafka.TCP(broker), RequiredAcks: kafka.RequireAll}
+	defer writer.Close()
+
+	replayed := 0
+	var writeErr error
+	err := readTopic(ctx, broker, topic, func(msg kafka.Message) bool {
+		if !*all && (msg.Partition != *partition || msg.Offset != *offset) {
+			return true
+		}
+
+		out := cmn.ParseDeadLetter(msg).Replay()
+		if writeErr = writer.WriteMessages(ctx, out); writeErr != nil {
+			return false
+		}
+		fmt.Printf("replayed %d:%d to %s\n", msg.Partition, msg.Offset, out.Topic)
+		replayed++
+		return *all
+	})
+	fmt.Printf("%d messages replayed\n", replayed)
+	return errors.Join(err, writeErr)
+}
+
+// calls fn with every message currently on topic until it returns false
+func readTopic(ctx context.Context, broker, topic string, fn func(kafka.Message) bool) error {
+	conn, err := kafka.DialContext(ctx, "tcp", broker)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+
+	partitions, err := conn.ReadPartitions(topic)
+	if err != nil {
+		return err
+	}
+
+	for _, p := range partitions {
+		more, err := readPartition(ctx, broker, topic, p.ID, fn)
+		if err != nil || !more {
+			return err
+		}
+	}
+	return nil
+}
+
+func readPartition(ctx context.Context, broker, topic string, partition int, fn func(kafka.Message) bool) (bool, error) {
+	leader, err := kafka.DialLeader(ctx, "tcp", broker, topic, partition)
+	if err != nil {
+		return false, err
+	}
+	first, last, err := leader.ReadOffsets()
+	leader.Close()
+	if err != nil || first == last {
+		return err == nil, err
+	}
+
+	// no group, so reading doesn't move any consumer's offsets
+	reader := kafka.NewReader(kafka.ReaderConfig{
+		Brokers:   []string{broker},
+		Topic:     topic,
+		Partition: partition,
+	})
+	defer reader.Close()
+
+	if err := reader.SetOffset(first); err != nil {
+		return false, err
+	}
+
+	for {
+		msg, err := reader.ReadMessage(ctx)
+		if err != nil {
+			return false, err
+		}
+		if !fn(msg) {
+			return false, nil
+		}
+		if msg.Offset >= last-1 {
+			return true, nil
+		}
+	}
+}
+
+func truncate(b []byte, n int) string {
+	if len(b) <= n {
+		return string(b)
+	}
+	return string(b[:n]) + "..."
+}
@@ -3,28 +3,48 @@ package main
 import (
 	"context"
 	"log"
+	"time"
 
 	"github.com/segmentio/kafka-go"
 	cmn "github.com/timkins666/distributed-playground/backend/pkg/common"
 )
 
 type paymentCtx struct {
-	cancelCtx context.Context
-	db        transactionDB
-	logger    *log.Logger
-	writer    cmn.KafkaWriter
+	cancelCtx    context.Context
+	db           transactionDB
+	logger       *log.Logger
+	writer       cmn.KafkaWriter
+	statusReader cmn.KafkaReader
+	redis        *cmn.Redis
+	// access tokens revoked before they expire, checked by the middleware
+	revocations    *cmn.RevocationList
+	outbox         *cmn.OutboxRelay
+	idempotencyTTL time.Duration
+	sweeper        sweeperConfig
 }
 
 // Close releases all resources
 func (a *paymentCtx) Close() error {
 	var errs []error
 
+	if a.statusReader != nil {
+		if err := a.statusReader.Close(); err != nil {
+			errs = append(errs, err)
+		}
+	}
+
 	if a.writer != nil {
 		if err := a.writer.Close(); err != nil {
 			errs = append(errs, err)
 		}
 	}
 
+	if a.redis != nil {
+		if err := a.redis.Close(); err != nil {
+			errs = append(errs, err)
+		}
+	}
+
 	if len(errs) > 0 {
 		return errs[0]
 	}
@@ -32,20 +52,46 @@ func (a *paymentCtx) Close() error {
 }
 
 func newAppCtx(cancelCtx context.Context) paymentCtx {
+	logger := cmn.AppLogger()
+
 	writer := &kafka.Writer{
 		Addr:         kafka.TCP(cmn.KafkaBroker()),
 		RequiredAcks: 1,
 	}
 
-	db, err := initDB()
+	statusReader := kafka.NewReader(kafka.ReaderConfig{
+		Brokers: []string{cmn.KafkaBroker()},
+		GroupID: "payment-status",
+		GroupTopics: []string{
+			cmn.Topics.PaymentVerified().S(),
+			cmn.Topics.PaymentFailed().S(),
+			cmn.Topics.TransactionComplete().S(),
+			cmn.Topics.TransactionFailed().S(),
+		},
+	})
+
+	redisConfig, err := cmn.LoadRedisConfig()
+	if err != nil {
+		log.Fatal(err)
+	}
+	// idempotency keys are only checked in postgres until redis is reachable
+	rds := cmn.ConnectRedis(cancelCtx, redisConfig, logger)
+
+	db, err := initDB(rds)
 	if err != nil {
 		log.Fatal(err)
 	}
 
 	return paymentCtx{
-		cancelCtx: cancelCtx,
-		db:        db,
-		writer:    writer,
-		logger:    cmn.AppLogger(),
+		cancelCtx:      cancelCtx,
+		db:             db,
+		writer:         writer,
+		statusReader:   statusReader,
+		redis:          rds,
+		revocations:    cmn.NewRevocationList(rds, logger),
+		outbox:         newOutboxRelay(db, writer, logger),
+		idempotencyTTL: idempotencyWindow(),
+		sweeper:        loadSweeperConfig(),
+		logger:         logger,
 	}
 }
@@ -10,6 +10,8 @@ import (
 func TestNewAppCtx(t *testing.T) {
 	t.Setenv("KAFKA_BROKER", "foo")
 	t.Setenv("DB_TYPE", "_TEST_")
+	// no redis here, so don't wait for it
+	t.Setenv("REDIS_CONNECT_ATTEMPTS", "1")
 
 	ctx := newAppCtx(context.Background())
 	if ctx.cancelCtx == nil {
@@ -24,14 +26,19 @@ func TestNewAppCtx(t *testing.T) {
 	if ctx.writer == nil {
 		t.Error("writer should not be nil")
 	}
+	if ctx.statusReader == nil {
+		t.Error("statusReader should not be nil")
+	}
 }
 
 func TestPaymentCtxClose(t *testing.T) {
 	mockWriter := &tu.MockKafkaWriter{}
+	mockReader := &tu.MockKafkaReader{}
 
 	ctx := &paymentCtx{
-		cancelCtx: context.Background(),
-		writer:    mockWriter,
+		cancelCtx:    context.Background(),
+		writer:       mockWriter,
+		statusReader: mockReader,
 	}
 
 	err := ctx.Close()
@@ -42,4 +49,7 @@ func TestPaymentCtxClose(t *testing.T) {
 	if !mockWriter.Closed {
 		t.Error("writer should be closed")
 	}
+	if !mockReader.Closed {
+		t.Error("statusReader should be closed")
+	}
 }
@@ -2,16 +2,23 @@ package main
 
 import (
 	"fmt"
+	"log"
 	"os"
+	"time"
 
+	"github.com/segmentio/kafka-go"
 	cmn "github.com/timkins666/distributed-playground/backend/pkg/common"
 )
 
 type transactionDB interface {
-	createPayment(*cmn.PaymentRequest) error
+	createPayment(pr *cmn.PaymentRequest, key idempotencyKey, ttl time.Duration, events ...kafka.Message) (*idempotencyKey, error)
+	getPayment(systemID string) (*paymentRecord, error)
+	transitionPayment(systemID string, to paymentStatus, reason string) error
+	completeLeg(systemID string, credit bool) (bool, error)
+	sweepPayments(status paymentStatus, stuckFor time.Duration, limit int, decide sweepDecider) (int, error)
 }
 
-func initDB() (transactionDB, error) {
+func initDB(rds *cmn.Redis) (transactionDB, error) {
 	dbType, found := os.LookupEnv("DB_TYPE")
 
 	if dbType == "_TEST_" {
@@ -23,8 +30,17 @@ func initDB() (transactionDB, error) {
 		if err != nil {
 			return nil, fmt.Errorf("failed to initialize database: %w", err)
 		}
-		return &dbPostgres{db}, nil
+		return &dbPostgres{db, rds}, nil
 	}
 
 	panic("cassandra not set up yet")
 }
+
+// relays events staged in the outbox alongside payment rows
+func newOutboxRelay(db transactionDB, writer cmn.KafkaWriter, logger *log.Logger) *cmn.OutboxRelay {
+	pg, ok := db.(*dbPostgres)
+	if !ok || pg.db == nil {
+		return nil
+	}
+	return cmn.NewOutboxRelay(pg.db, cmn.OutboxTablePayments, writer, logger)
+}
@@ -1,28 +1,297 @@
 package main
 
 import (
+	"context"
 	"database/sql"
+	"fmt"
+	"log"
+	"time"
 
+	"github.com/redis/go-redis/v9"
+	"github.com/segmentio/kafka-go"
 	cmn "github.com/timkins666/distributed-playground/backend/pkg/common"
 )
 
 type dbPostgres struct {
-	db *sql.DB
+	db    *sql.DB
+	redis *cmn.Redis
 }
 
-func (db *dbPostgres) createPayment(pr *cmn.PaymentRequest) error {
+// claims the user's AppID, creates the payment and stages its events in the outbox in a single
+// transaction. if the AppID is already held by an unexpired claim nothing is created and the
+// existing claim is returned instead. redis is used as a fast path, postgres is the source of truth.
+func (db *dbPostgres) createPayment(pr *cmn.PaymentRequest, key idempotencyKey, ttl time.Duration, events ...kafka.Message) (*idempotencyKey, error) {
+	redisKey := idempotencyRedisKey(pr.UserID, pr.AppID)
+
+	if client := db.redis.Client(); client != nil {
+		cached, err := client.Get(context.Background(), redisKey).Result()
+		if err == nil {
+			existing, err := cmn.FromBytes[idempotencyKey]([]byte(cached))
+			if err == nil {
+				return existing, nil
+			}
+		} else if err != redis.Nil {
+			log.Printf("Error getting idempotency key %s from cache: %v", redisKey, err)
+		}
+	}
+
+	tx, err := db.db.Begin()
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+
+	// expired keys are taken over by the new request. a concurrent claim of the same
+	// key blocks here until the other transaction commits or rolls back.
+	var claimedID string
+	err = tx.QueryRow(`
+		INSERT INTO payments.idempotency_key (user_id, app_id, request_hash, system_id, expires_at)
+		VALUES ($1, $2, $3, $4, now() + make_interval(secs => $5))
+		ON CONFLICT (user_id, app_id) DO UPDATE
+		SET request_hash = EXCLUDED.request_hash,
+			system_id = EXCLUDED.system_id,
+			created_at = now(),
+			expires_at = EXCLUDED.expires_at
+		WHERE payments.idempotency_key.expires_at < now()
+		RETURNING system_id
+	`, pr.UserID, pr.AppID, key.RequestHash, key.SystemID, ttl.Seconds()).Scan(&claimedID)
+
+	if err == sql.ErrNoRows {
+		var (
+			existing  idempotencyKey
+			expiresAt time.Time
+		)
+		err = tx.QueryRow(`
+			SELECT request_hash, system_id, expires_at FROM payments.idempotency_key
+			WHERE user_id = $1 AND app_id = $2
+		`, pr.UserID, pr.AppID).Scan(&existing.RequestHash, &existing.SystemID, &expiresAt)
+		if err != nil {
+			return nil, err
+		}
+
+		db.cacheIdempotencyKey(redisKey, existing, time.Until(expiresAt))
+		return &existing, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
 	// TODO: check affected row count == 1
-	_, err := db.db.Exec(`
+	_, err = tx.Exec(`
 	INSERT INTO payments.transfer (
 		system_id,
 		app_id,
+		user_id,
 		source_account_id,
 		target_account_id,
 		amount,
 		status
 		)
-		VALUES ($1, $2, $3, $4, $5, 'PENDING')
-		`, pr.SystemID, pr.AppID, pr.SourceAccountID, pr.TargetAccountID, pr.Amount)
+		VALUES ($1, $2, $3, $4, $5, $6, 'PENDING')
+		`, pr.SystemID, pr.AppID, pr.UserID, pr.SourceAccountID, pr.TargetAccountID, pr.Amount)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := cmn.WriteOutbox(tx, cmn.OutboxTablePayments, events...); err != nil {
+		return nil, err
+	}
+
+	if err := tx.Commit(); err != nil {
+		return nil, err
+	}
+
+	// only cached once committed, a rolled back claim must not block retries
+	db.cacheIdempotencyKey(redisKey, key, ttl)
+	return nil, nil
+}
+
+func (db *dbPostgres) getPayment(systemID string) (*paymentRecord, error) {
+	var (
+		p                     paymentRecord
+		reason                sql.NullString
+		debitedAt, creditedAt sql.NullTime
+	)
+
+	err := db.db.QueryRow(`
+		SELECT system_id, app_id, user_id, source_account_id, target_account_id, amount,
+			status, failure_reason, created_at, updated_at, debited_at, credited_at, redrive_count
+		FROM payments.transfer WHERE system_id = $1
+	`, systemID).Scan(&p.SystemID, &p.AppID, &p.UserID, &p.SourceAccountID, &p.TargetAccountID, &p.Amount,
+		&p.Status, &reason, &p.CreatedAt, &p.UpdatedAt, &debitedAt, &creditedAt, &p.RedriveCount)
+	if err == sql.ErrNoRows {
+		return nil, errPaymentNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	p.FailureReason = reason.String
+	if debitedAt.Valid {
+		p.DebitedAt = &debitedAt.Time
+	}
+	if creditedAt.Valid {
+		p.CreditedAt = &creditedAt.Time
+	}
+	return &p, nil
+}
+
+// moves the payment to a new status if the transition is legal.
+// transitioning to the current status is a no-op so redelivered events are harmless.
+func (db *dbPostgres) transitionPayment(systemID string, to paymentStatus, reason string) error {
+	tx, err := db.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	var from paymentStatus
+	err = tx.QueryRow(`
+		SELECT status FROM payments.transfer WHERE system_id = $1 FOR UPDATE
+	`, systemID).Scan(&from)
+	if err == sql.ErrNoRows {
+		return errPaymentNotFound
+	}
+	if err != nil {
+		return err
+	}
+
+	if from == to {
+		return nil
+	}
+	if !from.canTransitionTo(to) {
+		return fmt.Errorf("%w: %s -> %s for payment %s", errIllegalTransition, from, to, systemID)
+	}
+
+	_, err = tx.Exec(`
+		UPDATE payments.transfer
+		SET status = $1, failure_reason = NULLIF($2, ''), updated_at = now()
+		WHERE system_id = $3
+	`, string(to), reason, systemID)
+	if err != nil {
+		return err
+	}
+
+	return tx.Commit()
+}
+
+// records completion of the debit or credit leg, returning whether both legs are now complete
+func (db *dbPostgres) completeLeg(systemID string, credit bool) (bool, error) {
+	col := "debited_at"
+	if credit {
+		col = "credited_at"
+	}
+
+	var debited, credited bool
+	err := db.db.QueryRow(`
+		UPDATE payments.transfer
+		SET `+col+` = COALESCE(`+col+`, now()), updated_at = now()
+		WHERE system_id = $1
+		RETURNING debited_at IS NOT NULL, credited_at IS NOT NULL
+	`, systemID).Scan(&debited, &credited)
+	if err == sql.ErrNoRows {
+		return false, errPaymentNotFound
+	}
+	if err != nil {
+		return false, err
+	}
+	return debited && credited, nil
+}
+
+func (db *dbPostgres) cacheIdempotencyKey(redisKey string, key idempotencyKey, ttl time.Duration) {
+	client := db.redis.Client()
+	if client == nil || ttl <= 0 {
+		return
+	}
+	b, err := cmn.ToBytes(key)
+	if err != nil {
+		return
+	}
+	client.Set(context.Background(), redisKey, string(b), ttl)
+}
+
+// sweepPayments claims up to limit payments that have been in the given status for longer than
+// stuckFor with no leg applied, and applies decide to each, all in one transaction. claimed rows
+// are locked so concurrent sweepers skip them. returns the number of payments swept. each payment
+// is loaded with whether account-service is holding its funds or transaction-service has started
+// its transfer.
+func (db *dbPostgres) sweepPayments(status paymentStatus, stuckFor time.Duration, limit int, decide sweepDecider) (int, error) {
+	tx, err := db.db.Begin()
+	if err != nil {
+		return 0, err
+	}
+	defer tx.Rollback()
+
+	rows, err := tx.Query(`
+		SELECT system_id, app_id, user_id, source_account_id, target_account_id, amount,
+			status, redrive_count, created_at, updated_at,
+			EXISTS (SELECT 1 FROM transactions.saga s WHERE s.payment_sys_id = t.system_id)
+				OR EXISTS (
+					SELECT 1 FROM accounts.hold h WHERE h.payment_sys_id = t.system_id
+						AND (h.status = 'CONSUMED' OR (h.status = 'ACTIVE' AND h.expires_at > now()))
+				)
+		FROM payments.transfer t
+		WHERE status = $1 AND updated_at < now() - make_interval(secs => $2)
+			AND debited_at IS NULL AND credited_at IS NULL
+		ORDER BY updated_at
+		LIMIT $3
+		FOR UPDATE SKIP LOCKED
+	`, string(status), stuckFor.Seconds(), limit)
+	if err != nil {
+		return 0, err
+	}
+
+	var stuck []*paymentRecord
+	for rows.Next() {
+		var p paymentRecord
+		err := rows.Scan(&p.SystemID, &p.AppID, &p.UserID, &p.SourceAccountID, &p.TargetAccountID, &p.Amount,
+			&p.Status, &p.RedriveCount, &p.CreatedAt, &p.UpdatedAt, &p.HandedOn)
+		if err != nil {
+			rows.Close()
+			return 0, err
+		}
+		stuck = append(stuck, &p)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return 0, err
+	}
+
+	for _, p := range stuck {
+		action, events, err := decide(p)
+		if err != nil {
+			return 0, fmt.Errorf("payment %s: %w", p.SystemID, err)
+		}
+
+		switch action {
+		case sweepRedrive:
+			_, err = tx.Exec(`
+				UPDATE payments.transfer
+				SET redrive_count = redrive_count + 1, updated_at = now()
+				WHERE system_id = $1
+			`, p.SystemID)
+		case sweepFail:
+			if !p.Status.canTransitionTo(statusFailed) {
+				return 0, fmt.Errorf("%w: %s -> %s for payment %s", errIllegalTransition, p.Status, statusFailed, p.SystemID)
+			}
+			_, err = tx.Exec(`
+				UPDATE payments.transfer
+				SET status = $1, failure_reason = $2, updated_at = now()
+				WHERE system_id = $3
+			`, string(statusFailed), timeoutReason, p.SystemID)
+		case sweepWait:
+			_, err = tx.Exec(`
+				UPDATE payments.transfer SET updated_at = now() WHERE system_id = $1
+			`, p.SystemID)
+		}
+		if err != nil {
+			return 0, err
+		}
+
+		if err := cmn.WriteOutbox(tx, cmn.OutboxTablePayments, events...); err != nil {
+			return 0, err
+		}
+	}
 
-	return err
+	return len(stuck), tx.Commit()
 }
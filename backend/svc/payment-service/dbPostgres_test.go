@@ -2,9 +2,12 @@ package main
 
 import (
 	"database/sql"
+	"errors"
 	"testing"
+	"time"
 
 	"github.com/DATA-DOG/go-sqlmock"
+	"github.com/segmentio/kafka-go"
 	cmn "github.com/timkins666/distributed-playground/backend/pkg/common"
 )
 
@@ -20,19 +23,34 @@ func TestDBPostgresCreatePayment(t *testing.T) {
 	req := &cmn.PaymentRequest{
 		SystemID:        "test-id",
 		AppID:           "app-id",
+		UserID:          7,
 		SourceAccountID: 123,
 		TargetAccountID: 456,
 		Amount:          10050,
 	}
 
+	event := kafka.Message{Topic: "payment-requested", Key: []byte("123"), Value: []byte("{}")}
+	key := idempotencyKey{RequestHash: "hash", SystemID: req.SystemID}
+
+	mock.ExpectBegin()
+	mock.ExpectQuery("INSERT INTO payments.idempotency_key").
+		WithArgs(req.UserID, req.AppID, key.RequestHash, key.SystemID, float64(60)).
+		WillReturnRows(sqlmock.NewRows([]string{"system_id"}).AddRow(req.SystemID))
 	mock.ExpectExec("INSERT INTO payments.transfer").
-		WithArgs(req.SystemID, req.AppID, req.SourceAccountID, req.TargetAccountID, req.Amount).
+		WithArgs(req.SystemID, req.AppID, req.UserID, req.SourceAccountID, req.TargetAccountID, req.Amount).
+		WillReturnResult(sqlmock.NewResult(1, 1))
+	mock.ExpectExec("INSERT INTO payments.outbox").
+		WithArgs(event.Topic, event.Key, event.Value).
 		WillReturnResult(sqlmock.NewResult(1, 1))
+	mock.ExpectCommit()
 
-	err = dbPg.createPayment(req)
+	existing, err := dbPg.createPayment(req, key, time.Minute, event)
 	if err != nil {
 		t.Errorf("unexpected error: %v", err)
 	}
+	if existing != nil {
+		t.Errorf("expected key to be claimed, got %+v", existing)
+	}
 
 	if err := mock.ExpectationsWereMet(); err != nil {
 		t.Errorf("unmet expectations: %v", err)
@@ -51,16 +69,24 @@ func TestDBPostgresCreatePaymentError(t *testing.T) {
 	req := &cmn.PaymentRequest{
 		SystemID:        "test-id",
 		AppID:           "app-id", 
+		UserID:          7,
 		SourceAccountID: 123,
 		TargetAccountID: 456,
 		Amount:          10050,
 	}
+	key := idempotencyKey{RequestHash: "hash", SystemID: req.SystemID}
 
+	// the claim is rolled back with the payment
+	mock.ExpectBegin()
+	mock.ExpectQuery("INSERT INTO payments.idempotency_key").
+		WithArgs(req.UserID, req.AppID, key.RequestHash, key.SystemID, float64(60)).
+		WillReturnRows(sqlmock.NewRows([]string{"system_id"}).AddRow(req.SystemID))
 	mock.ExpectExec("INSERT INTO payments.transfer").
-		WithArgs(req.SystemID, req.AppID, req.SourceAccountID, req.TargetAccountID, req.Amount).
+		WithArgs(req.SystemID, req.AppID, req.UserID, req.SourceAccountID, req.TargetAccountID, req.Amount).
 		WillReturnError(sql.ErrConnDone)
+	mock.ExpectRollback()
 
-	err = dbPg.createPayment(req)
+	_, err = dbPg.createPayment(req, key, time.Minute)
 	if err == nil {
 		t.Error("expected error but got nil")
 	}
@@ -68,4 +94,246 @@ func TestDBPostgresCreatePaymentError(t *testing.T) {
 	if err := mock.ExpectationsWereMet(); err != nil {
 		t.Errorf("unmet expectations: %v", err)
 	}
-}
\ No newline at end of file
+}
+
+func TestDBPostgresTransitionPayment(t *testing.T) {
+	tests := []struct {
+		name    string
+		from    paymentStatus
+		to      paymentStatus
+		update  bool
+		wantErr error
+	}{
+		{name: "legal", from: statusPending, to: statusVerified, update: true},
+		{name: "same status", from: statusVerified, to: statusVerified},
+		{name: "illegal", from: statusFailed, to: statusCompleted, wantErr: errIllegalTransition},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			db, mock, err := sqlmock.New()
+			if err != nil {
+				t.Fatalf("failed to create mock: %v", err)
+			}
+			defer db.Close()
+
+			dbPg := &dbPostgres{db: db}
+
+			mock.ExpectBegin()
+			mock.ExpectQuery("SELECT status FROM payments.transfer").
+				WithArgs("sys1").
+				WillReturnRows(sqlmock.NewRows([]string{"status"}).AddRow(string(tt.from)))
+			if tt.update {
+				mock.ExpectExec("UPDATE payments.transfer").
+					WithArgs(string(tt.to), "", "sys1").
+					WillReturnResult(sqlmock.NewResult(0, 1))
+				mock.ExpectCommit()
+			} else {
+				mock.ExpectRollback()
+			}
+
+			err = dbPg.transitionPayment("sys1", tt.to, "")
+			if !errors.Is(err, tt.wantErr) {
+				t.Errorf("expected error %v, got %v", tt.wantErr, err)
+			}
+
+			if err := mock.ExpectationsWereMet(); err != nil {
+				t.Errorf("unmet expectations: %v", err)
+			}
+		})
+	}
+}
+
+func TestDBPostgresTransitionPaymentNotFound(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatalf("failed to create mock: %v", err)
+	}
+	defer db.Close()
+
+	dbPg := &dbPostgres{db: db}
+
+	mock.ExpectBegin()
+	mock.ExpectQuery("SELECT status FROM payments.transfer").
+		WithArgs("sys1").
+		WillReturnError(sql.ErrNoRows)
+	mock.ExpectRollback()
+
+	err = dbPg.transitionPayment("sys1", statusFailed, "reason")
+	if err != errPaymentNotFound {
+		t.Errorf("expected errPaymentNotFound, got %v", err)
+	}
+}
+
+func TestDBPostgresCompleteLeg(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatalf("failed to create mock: %v", err)
+	}
+	defer db.Close()
+
+	dbPg := &dbPostgres{db: db}
+
+	mock.ExpectQuery("UPDATE payments.transfer SET credited_at").
+		WithArgs("sys1").
+		WillReturnRows(sqlmock.NewRows([]string{"debited", "credited"}).AddRow(true, true))
+
+	both, err := dbPg.completeLeg("sys1", true)
+	if err != nil {
+		t.Errorf("unexpected error: %v", err)
+	}
+	if !both {
+		t.Error("expected both legs complete")
+	}
+
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("unmet expectations: %v", err)
+	}
+}
+
+func TestDBPostgresGetPayment(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatalf("failed to create mock: %v", err)
+	}
+	defer db.Close()
+
+	dbPg := &dbPostgres{db: db}
+	now := time.Now()
+
+	mock.ExpectQuery("SELECT (.+) FROM payments.transfer WHERE system_id").
+		WithArgs("sys1").
+		WillReturnRows(sqlmock.NewRows([]string{
+			"system_id", "app_id", "user_id", "source_account_id", "target_account_id", "amount",
+			"status", "failure_reason", "created_at", "updated_at", "debited_at", "credited_at", "redrive_count",
+		}).AddRow("sys1", "app1", 7, 1, 2, 100, "VERIFIED", nil, now, now, now, nil, 1))
+
+	p, err := dbPg.getPayment("sys1")
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if p.Status != statusVerified || p.DebitedAt == nil || p.CreditedAt != nil || p.RedriveCount != 1 {
+		t.Errorf("unexpected payment %+v", p)
+	}
+
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("unmet expectations: %v", err)
+	}
+}
+
+func TestDBPostgresCreatePaymentExistingKey(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatalf("failed to create mock: %v", err)
+	}
+	defer db.Close()
+
+	dbPg := &dbPostgres{db: db}
+	req := &cmn.PaymentRequest{SystemID: "sys2", AppID: "app1", UserID: 1}
+	key := idempotencyKey{RequestHash: "hash", SystemID: "sys2"}
+
+	mock.ExpectBegin()
+	mock.ExpectQuery("INSERT INTO payments.idempotency_key").
+		WithArgs(1, "app1", key.RequestHash, key.SystemID, float64(60)).
+		WillReturnError(sql.ErrNoRows)
+	mock.ExpectQuery("SELECT request_hash, system_id, expires_at FROM payments.idempotency_key").
+		WithArgs(1, "app1").
+		WillReturnRows(sqlmock.NewRows([]string{"request_hash", "system_id", "expires_at"}).
+			AddRow("hash", "sys1", time.Now().Add(time.Minute)))
+	mock.ExpectRollback()
+
+	existing, err := dbPg.createPayment(req, key, time.Minute)
+	if err != nil {
+		t.Errorf("unexpected error: %v", err)
+	}
+	if existing == nil || existing.SystemID != "sys1" {
+		t.Errorf("expected existing key for sys1, got %+v", existing)
+	}
+
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("unmet expectations: %v", err)
+	}
+}
+
+func TestDBPostgresSweepPayments(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatalf("failed to create mock: %v", err)
+	}
+	defer db.Close()
+
+	dbPg := &dbPostgres{db: db}
+	now := time.Now()
+
+	mock.ExpectBegin()
+	mock.ExpectQuery("SELECT (.+) FROM transactions.saga (.+) FROM accounts.hold (.+) FROM payments.transfer t WHERE status = (.+) FOR UPDATE SKIP LOCKED").
+		WithArgs("PENDING", 30.0, 10).
+		WillReturnRows(sqlmock.NewRows([]string{
+			"system_id", "app_id", "user_id", "source_account_id", "target_account_id", "amount",
+			"status", "redrive_count", "created_at", "updated_at", "handed_on",
+		}).
+			AddRow("sys1", "app1", 7, 1, 2, 100, "PENDING", 0, now, now, false).
+			AddRow("sys2", "app2", 7, 1, 2, 100, "PENDING", 3, now, now, false).
+			AddRow("sys3", "app3", 7, 1, 2, 100, "PENDING", 3, now, now, true))
+	mock.ExpectExec("UPDATE payments.transfer SET redrive_count = redrive_count \\+ 1").
+		WithArgs("sys1").
+		WillReturnResult(sqlmock.NewResult(0, 1))
+	mock.ExpectExec("INSERT INTO payments.outbox").
+		WithArgs(cmn.Topics.PaymentRequested().S(), sqlmock.AnyArg(), sqlmock.AnyArg()).
+		WillReturnResult(sqlmock.NewResult(1, 1))
+	mock.ExpectExec("UPDATE payments.transfer SET status = (.+), failure_reason").
+		WithArgs("FAILED", timeoutReason, "sys2").
+		WillReturnResult(sqlmock.NewResult(0, 1))
+	mock.ExpectExec("INSERT INTO payments.outbox").
+		WithArgs(cmn.Topics.PaymentFailed().S(), sqlmock.AnyArg(), sqlmock.AnyArg()).
+		WillReturnResult(sqlmock.NewResult(2, 1))
+	// its funds are held, so it's left to finish rather than failed
+	mock.ExpectExec("UPDATE payments.transfer SET updated_at = now\\(\\) WHERE system_id").
+		WithArgs("sys3").
+		WillReturnResult(sqlmock.NewResult(0, 1))
+	mock.ExpectCommit()
+
+	n, err := dbPg.sweepPayments(statusPending, 30*time.Second, 10, func(p *paymentRecord) (sweepAction, []kafka.Message, error) {
+		return decidePending(p, 3)
+	})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if n != 3 {
+		t.Errorf("expected 3 swept, got %d", n)
+	}
+
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("unmet expectations: %v", err)
+	}
+}
+
+func TestDBPostgresSweepPaymentsDecideError(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatalf("failed to create mock: %v", err)
+	}
+	defer db.Close()
+
+	dbPg := &dbPostgres{db: db}
+	now := time.Now()
+
+	mock.ExpectBegin()
+	mock.ExpectQuery("SELECT (.+) FROM payments.transfer").
+		WillReturnRows(sqlmock.NewRows([]string{
+			"system_id", "app_id", "user_id", "source_account_id", "target_account_id", "amount",
+			"status", "redrive_count", "created_at", "updated_at", "handed_on",
+		}).AddRow("sys1", "app1", 7, 1, 2, 100, "VERIFIED", 0, now, now, false))
+	mock.ExpectRollback()
+
+	_, err = dbPg.sweepPayments(statusVerified, time.Minute, 10, func(p *paymentRecord) (sweepAction, []kafka.Message, error) {
+		return 0, nil, errors.New("nope")
+	})
+	if err == nil {
+		t.Error("expected error")
+	}
+
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("unmet expectations: %v", err)
+	}
+}
@@ -20,13 +20,14 @@ func TestCreateDBPayment(t *testing.T) {
 		SystemID:        "test-id",
 	}
 
-	err := createDBPayment(req, appCtx)
-	if err != nil {
-		t.Errorf("unexpected error: %v", err)
+	existing, err := createDBPayment(req, idempotencyKey{SystemID: req.SystemID}, appCtx)
+	if err != nil || existing != nil {
+		t.Errorf("unexpected result: %+v, %v", existing, err)
 	}
 
 	mockDB.createPaymentErr = errors.New("db error")
-	err = createDBPayment(req, appCtx)
+	req.AppID = "other-app-id"
+	_, err = createDBPayment(req, idempotencyKey{SystemID: req.SystemID}, appCtx)
 	if err == nil {
 		t.Error("expected error but got nil")
 	}
@@ -36,7 +37,7 @@ func TestInitDB(t *testing.T) {
 	t.Setenv("DB_TYPE", "POSTGRES")
 	t.Setenv("POSTGRES_HOST", "localhost")
 	
-	_, err := initDB()
+	_, err := initDB(nil)
 	if err == nil {
 		t.Error("expected connection error in test environment")
 	}
@@ -0,0 +1,38 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"strconv"
+	"time"
+
+	cmn "github.com/timkins666/distributed-playground/backend/pkg/common"
+)
+
+const defaultIdempotencyWindow = 24 * time.Hour
+
+var errIdempotencyConflict = errors.New("idempotency key reused with a different request")
+
+// a client AppID claimed by a payment. AppIDs are scoped to the user.
+type idempotencyKey struct {
+	RequestHash string `json:"requestHash"`
+	SystemID    string `json:"systemId"`
+}
+
+// hashes the client supplied parts of the request, so retries of the same
+// request match regardless of server assigned fields
+func requestHash(req *cmn.PaymentRequest) string {
+	h := sha256.Sum256(fmt.Appendf(nil, "%d:%d:%d", req.SourceAccountID, req.TargetAccountID, req.Amount))
+	return hex.EncodeToString(h[:])
+}
+
+func idempotencyRedisKey(userID int32, appID string) string {
+	return cmn.RedisKey(cmn.RedisKeyIdempotency, strconv.Itoa(int(userID))+":"+appID)
+}
+
+// how long an AppID is remembered, from IDEMPOTENCY_WINDOW e.g. "24h"
+func idempotencyWindow() time.Duration {
+	return cmn.DurationFromEnv("IDEMPOTENCY_WINDOW", defaultIdempotencyWindow, cmn.AppLogger())
+}
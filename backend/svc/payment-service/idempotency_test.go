@@ -0,0 +1,41 @@
+package main
+
+import (
+	"testing"
+	"time"
+
+	cmn "github.com/timkins666/distributed-playground/backend/pkg/common"
+)
+
+func TestRequestHash(t *testing.T) {
+	pr := cmn.PaymentRequest{AppID: "a", SourceAccountID: 1, TargetAccountID: 2, Amount: 100}
+
+	retry := pr
+	retry.SystemID = "different"
+	retry.Timestamp = time.Now()
+	if requestHash(&pr) != requestHash(&retry) {
+		t.Error("expected server assigned fields to be ignored")
+	}
+
+	changed := pr
+	changed.TargetAccountID = 3
+	if requestHash(&pr) == requestHash(&changed) {
+		t.Error("expected different hash for different request")
+	}
+}
+
+func TestIdempotencyWindow(t *testing.T) {
+	if idempotencyWindow() != defaultIdempotencyWindow {
+		t.Error("expected default window")
+	}
+
+	t.Setenv("IDEMPOTENCY_WINDOW", "90m")
+	if idempotencyWindow() != 90*time.Minute {
+		t.Error("expected configured window")
+	}
+
+	t.Setenv("IDEMPOTENCY_WINDOW", "soon")
+	if idempotencyWindow() != defaultIdempotencyWindow {
+		t.Error("expected default window for invalid value")
+	}
+}
@@ -1,7 +1,6 @@
 package main
 
 import (
-	"context"
 	"encoding/json"
 	"log"
 	"net/http"
@@ -22,11 +21,18 @@ func main() {
 
 	mux := http.NewServeMux()
 	mux.HandleFunc("/transfer", handlePaymentRequest)
+	mux.HandleFunc("GET /payment/{systemId}", handleGetPayment)
+
+	go paymentStatusConsumer(&appCtx)
+	go runSweeper(&appCtx)
+	if appCtx.outbox != nil {
+		go appCtx.outbox.Run(cancelCtx)
+	}
 
 	port := ":" + os.Getenv("SERVE_PORT")
 	log.Printf("Payment service running on %s", port)
 	log.Fatal(http.ListenAndServe(port,
-		cmn.SetUserIDMiddlewareHandler(
+		cmn.SetUserIDMiddlewareHandler(appCtx.revocations)(
 			cmn.SetContextValuesMiddleware(
 				map[cmn.ContextKey]any{cmn.AppCtx: &appCtx})(mux))))
 }
@@ -40,6 +46,12 @@ func handlePaymentRequest(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	userID, ok := r.Context().Value(cmn.UserIDKey).(int32)
+	if !ok || userID == 0 {
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+
 	var req cmn.PaymentRequest
 	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
 		http.Error(w, "invalid request", http.StatusBadRequest)
@@ -48,6 +60,8 @@ func handlePaymentRequest(w http.ResponseWriter, r *http.Request) {
 
 	req.Timestamp = time.Now().UTC()
 	req.SystemID = uuid.NewString()
+	// never trust a client supplied user, ownership is checked against this
+	req.UserID = userID
 
 	if !req.Valid() {
 		http.Error(w, "invalid request", http.StatusBadRequest)
@@ -65,41 +79,96 @@ func handlePaymentRequest(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	// create payment in system for tracking and analytics/reconciliation
-	if err = createDBPayment(req, appCtx); err != nil {
-		appCtx.logger.Println(err)
-		w.WriteHeader(http.StatusInternalServerError)
-		return
-	}
-
-	err = appCtx.writer.WriteMessages(context.Background(), kafka.Message{
+	// AppID is the client's idempotency key, retries get the original payment.
+	// create payment in system for tracking and analytics/reconciliation.
+	// the payment-requested message is published by the outbox relay once committed.
+	existing, err := createDBPayment(req, idempotencyKey{RequestHash: requestHash(&req), SystemID: req.SystemID}, appCtx, kafka.Message{
 		Topic: cmn.Topics.PaymentRequested().S(),
 		Key:   key,
 		Value: msg,
 	})
 	if err != nil {
-		appCtx.logger.Println("WRITE ERR:", err)
+		appCtx.logger.Println(err)
 		w.WriteHeader(http.StatusInternalServerError)
 		return
 	}
+	if existing != nil {
+		replayPaymentRequest(w, &req, existing, appCtx)
+		return
+	}
+
+	appCtx.logger.Printf("Staged payment-requested message: %s", msg)
+	writePaymentAccepted(w, req.SystemID, statusPending)
+}
+
+// responds to a retried request with the payment created by the original
+func replayPaymentRequest(w http.ResponseWriter, req *cmn.PaymentRequest, existing *idempotencyKey, appCtx *paymentCtx) {
+	if existing.RequestHash != requestHash(req) {
+		appCtx.logger.Printf("AppID %s reused for a different request", req.AppID)
+		http.Error(w, errIdempotencyConflict.Error(), http.StatusConflict)
+		return
+	}
 
-	appCtx.logger.Printf("Sent payment-requested message: %s", msg)
+	// the original request may still be in flight
+	status := statusPending
+	if payment, err := appCtx.db.getPayment(existing.SystemID); err == nil {
+		status = payment.Status
+	}
+
+	appCtx.logger.Printf("Replaying payment %s for AppID %s", existing.SystemID, req.AppID)
+	w.Header().Set("Idempotent-Replayed", "true")
+	writePaymentAccepted(w, existing.SystemID, status)
+}
+
+func writePaymentAccepted(w http.ResponseWriter, systemID string, status paymentStatus) {
+	w.Header().Set("Content-Type", "application/json")
 	w.WriteHeader(http.StatusAccepted)
+	_ = json.NewEncoder(w).Encode(map[string]any{
+		"systemId": systemID,
+		"status":   status,
+	})
 }
 
-func createDBPayment(req cmn.PaymentRequest, appCtx *paymentCtx) error {
+func createDBPayment(req cmn.PaymentRequest, key idempotencyKey, appCtx *paymentCtx, events ...kafka.Message) (*idempotencyKey, error) {
 	log.Printf("saving payment to db: %+v", req)
-	return appCtx.db.createPayment(&req)
+	return appCtx.db.createPayment(&req, key, appCtx.idempotencyTTL, events...)
 }
 
-// TODO: on tx complete. + use types for status
-// func (db *DB) UpdatePaymentStatus(sysId, status string) error {
-// 	// TODO: check affected row count == 1
-// 	_, err := db.db.Exec(`
-// 		UPDATE payments.transfer
-// 		SET status = $1
-// 		WHERE system_id = $2
-// 	`, status, sysId)
-
-// 	return err
-// }
+// returns the current status of one of the user's payments
+func handleGetPayment(w http.ResponseWriter, r *http.Request) {
+	appCtx, ok := r.Context().Value(cmn.AppCtx).(*paymentCtx)
+	if !ok {
+		log.Println("invalid appCtx")
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	userID, ok := r.Context().Value(cmn.UserIDKey).(int32)
+	if !ok || userID == 0 {
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+
+	systemID := r.PathValue("systemId")
+	if _, err := uuid.Parse(systemID); err != nil {
+		http.Error(w, "invalid payment id", http.StatusBadRequest)
+		return
+	}
+
+	payment, err := appCtx.db.getPayment(systemID)
+	// other users' payments are reported as not found, so their ids can't be probed
+	if err == errPaymentNotFound || (err == nil && payment.UserID != userID) {
+		http.Error(w, "payment not found", http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		appCtx.logger.Println(err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(payment); err != nil {
+		appCtx.logger.Printf("Failed to encode payment response: %v", err)
+	}
+}
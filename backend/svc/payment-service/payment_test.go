@@ -8,18 +8,108 @@ import (
 	"net/http"
 	"net/http/httptest"
 	"testing"
+	"time"
 
-
+	"github.com/segmentio/kafka-go"
 	cmn "github.com/timkins666/distributed-playground/backend/pkg/common"
 	tu "github.com/timkins666/distributed-playground/backend/pkg/testutils"
 )
 
 type mockDB struct {
 	createPaymentErr error
+	outbox           []kafka.Message
+	payments         map[string]*paymentRecord
+	idempotencyKeys  map[string]idempotencyKey
+}
+
+func (m *mockDB) createPayment(pr *cmn.PaymentRequest, key idempotencyKey, _ time.Duration, events ...kafka.Message) (*idempotencyKey, error) {
+	k := idempotencyRedisKey(pr.UserID, pr.AppID)
+	if existing, ok := m.idempotencyKeys[k]; ok {
+		return &existing, nil
+	}
+	// the key is only claimed if the payment commits
+	if m.createPaymentErr != nil {
+		return nil, m.createPaymentErr
+	}
+	if m.idempotencyKeys == nil {
+		m.idempotencyKeys = make(map[string]idempotencyKey)
+	}
+	m.idempotencyKeys[k] = key
+	m.outbox = append(m.outbox, events...)
+	return nil, nil
+}
+
+func (m *mockDB) getPayment(systemID string) (*paymentRecord, error) {
+	p, ok := m.payments[systemID]
+	if !ok {
+		return nil, errPaymentNotFound
+	}
+	return p, nil
+}
+
+func (m *mockDB) transitionPayment(systemID string, to paymentStatus, reason string) error {
+	p, ok := m.payments[systemID]
+	if !ok {
+		return errPaymentNotFound
+	}
+	if p.Status == to {
+		return nil
+	}
+	if !p.Status.canTransitionTo(to) {
+		return errIllegalTransition
+	}
+	p.Status = to
+	p.FailureReason = reason
+	return nil
 }
 
-func (m *mockDB) createPayment(*cmn.PaymentRequest) error {
-	return m.createPaymentErr
+func (m *mockDB) completeLeg(systemID string, credit bool) (bool, error) {
+	p, ok := m.payments[systemID]
+	if !ok {
+		return false, errPaymentNotFound
+	}
+	now := time.Now()
+	if credit {
+		p.CreditedAt = &now
+	} else {
+		p.DebitedAt = &now
+	}
+	return p.DebitedAt != nil && p.CreditedAt != nil, nil
+}
+
+func (m *mockDB) sweepPayments(status paymentStatus, stuckFor time.Duration, limit int, decide sweepDecider) (int, error) {
+	swept := 0
+	for _, p := range m.payments {
+		if swept == limit {
+			break
+		}
+		if p.Status != status || time.Since(p.UpdatedAt) < stuckFor || p.DebitedAt != nil || p.CreditedAt != nil {
+			continue
+		}
+
+		action, events, err := decide(p)
+		if err != nil {
+			return swept, err
+		}
+		switch action {
+		case sweepRedrive:
+			p.RedriveCount++
+		case sweepFail:
+			p.Status = statusFailed
+			p.FailureReason = timeoutReason
+		}
+		p.UpdatedAt = time.Now()
+		m.outbox = append(m.outbox, events...)
+		swept++
+	}
+	return swept, nil
+}
+
+// adds the app context and authenticated user to the request
+func withPaymentCtx(req *http.Request, appCtx *paymentCtx, userID int32) *http.Request {
+	ctx := context.WithValue(req.Context(), cmn.AppCtx, appCtx)
+	ctx = context.WithValue(ctx, cmn.UserIDKey, userID)
+	return req.WithContext(ctx)
 }
 
 func TestHandlePaymentRequest(t *testing.T) {
@@ -36,7 +126,7 @@ func TestHandlePaymentRequest(t *testing.T) {
 				SourceAccountID: 123,
 				TargetAccountID: 789,
 				Amount:          10050,
-				AppID:           "aID",
+				AppID:           "6f1c2b9d-0b7e-4d8e-9a62-3f1c2b9d4e11",
 				SystemID:        "sID",
 			},
 			expectedStatus: http.StatusAccepted,
@@ -46,34 +136,56 @@ func TestHandlePaymentRequest(t *testing.T) {
 			request: cmn.PaymentRequest{
 				TargetAccountID: 789,
 				Amount:          10050,
-				AppID:           "aID",
+				AppID:           "6f1c2b9d-0b7e-4d8e-9a62-3f1c2b9d4e11",
 				SystemID:        "sID",
 			},
 			expectedStatus: http.StatusBadRequest,
 		},
 		{
-			name: "database error",
+			name: "invalid request - app id not a uuid",
 			request: cmn.PaymentRequest{
 				SourceAccountID: 123,
 				TargetAccountID: 789,
 				Amount:          10050,
 				AppID:           "aID",
+			},
+			expectedStatus: http.StatusBadRequest,
+		},
+		{
+			name: "database error",
+			request: cmn.PaymentRequest{
+				SourceAccountID: 123,
+				TargetAccountID: 789,
+				Amount:          10050,
+				AppID:           "6f1c2b9d-0b7e-4d8e-9a62-3f1c2b9d4e11",
 				SystemID:        "sID",
 			},
 			dbErr:          errors.New("oh no"),
 			expectedStatus: http.StatusInternalServerError,
 		},
 		{
-			name: "kafka write error",
+			name: "client supplied user ignored",
 			request: cmn.PaymentRequest{
+				UserID:          42,
 				SourceAccountID: 123,
 				TargetAccountID: 789,
 				Amount:          10050,
-				AppID:           "aID",
+				AppID:           "6f1c2b9d-0b7e-4d8e-9a62-3f1c2b9d4e11",
+			},
+			expectedStatus: http.StatusAccepted,
+		},
+		{
+			// published later by the outbox relay
+			name: "kafka unavailable",
+			request: cmn.PaymentRequest{
+				SourceAccountID: 123,
+				TargetAccountID: 789,
+				Amount:          10050,
+				AppID:           "6f1c2b9d-0b7e-4d8e-9a62-3f1c2b9d4e11",
 				SystemID:        "sID",
 			},
 			writerErr:      errors.New("oh shucks"),
-			expectedStatus: http.StatusInternalServerError,
+			expectedStatus: http.StatusAccepted,
 		},
 	}
 
@@ -91,7 +203,7 @@ func TestHandlePaymentRequest(t *testing.T) {
 
 			body, _ := json.Marshal(tt.request)
 			req := httptest.NewRequest("POST", "/transfer", bytes.NewReader(body))
-			req = req.WithContext(context.WithValue(req.Context(), cmn.AppCtx, appCtx))
+			req = withPaymentCtx(req, appCtx, 1)
 
 			w := httptest.NewRecorder()
 			handlePaymentRequest(w, req)
@@ -100,8 +212,20 @@ func TestHandlePaymentRequest(t *testing.T) {
 				t.Errorf("expected status %d, got %d", tt.expectedStatus, w.Code)
 			}
 
-			if tt.expectedStatus == http.StatusAccepted && len(mockWriter.Messages) != 1 {
-				t.Errorf("expected 1 kafka message, got %d", len(mockWriter.Messages))
+			if tt.expectedStatus == http.StatusAccepted {
+				if len(mockDB.outbox) != 1 || mockDB.outbox[0].Topic != cmn.Topics.PaymentRequested().S() {
+					t.Errorf("expected 1 payment-requested outbox message, got %+v", mockDB.outbox)
+				} else if pr, err := cmn.FromBytes[cmn.PaymentRequest](mockDB.outbox[0].Value); err != nil || pr.UserID != 1 {
+					t.Errorf("expected payment stamped with user 1, got %+v", pr)
+				}
+				if len(mockWriter.Messages) != 0 {
+					t.Errorf("expected no direct kafka writes, got %d", len(mockWriter.Messages))
+				}
+			}
+
+			// failed requests can be retried with the same AppID
+			if tt.expectedStatus == http.StatusInternalServerError && len(mockDB.idempotencyKeys) != 0 {
+				t.Error("expected idempotency key not to be claimed")
 			}
 		})
 	}
@@ -116,7 +240,7 @@ func TestHandlePaymentRequestInvalidJSON(t *testing.T) {
 	}
 
 	req := httptest.NewRequest("POST", "/transfer", bytes.NewReader([]byte("invalid json")))
-	req = req.WithContext(context.WithValue(req.Context(), cmn.AppCtx, appCtx))
+	req = withPaymentCtx(req, appCtx, 1)
 
 	w := httptest.NewRecorder()
 	handlePaymentRequest(w, req)
@@ -135,3 +259,128 @@ func TestHandlePaymentRequestMissingContext(t *testing.T) {
 		t.Errorf("expected status %d, got %d", http.StatusInternalServerError, w.Code)
 	}
 }
+
+
+func TestHandlePaymentRequestUnauthorized(t *testing.T) {
+	appCtx := &paymentCtx{db: &mockDB{}, logger: cmn.AppLogger()}
+
+	req := httptest.NewRequest("POST", "/transfer", nil)
+	req = req.WithContext(context.WithValue(req.Context(), cmn.AppCtx, appCtx))
+
+	w := httptest.NewRecorder()
+	handlePaymentRequest(w, req)
+
+	if w.Code != http.StatusUnauthorized {
+		t.Errorf("expected status %d, got %d", http.StatusUnauthorized, w.Code)
+	}
+}
+
+func TestHandlePaymentRequestIdempotent(t *testing.T) {
+	mockDB := &mockDB{payments: map[string]*paymentRecord{}}
+	mockWriter := &tu.MockKafkaWriter{}
+	appCtx := &paymentCtx{
+		cancelCtx: context.Background(),
+		db:        mockDB,
+		writer:    mockWriter,
+		logger:    cmn.AppLogger(),
+	}
+
+	send := func(pr cmn.PaymentRequest, userID int32) (*httptest.ResponseRecorder, map[string]string) {
+		body, _ := json.Marshal(pr)
+		req := withPaymentCtx(httptest.NewRequest("POST", "/transfer", bytes.NewReader(body)), appCtx, userID)
+		w := httptest.NewRecorder()
+		handlePaymentRequest(w, req)
+
+		var resp map[string]string
+		_ = json.Unmarshal(w.Body.Bytes(), &resp)
+		return w, resp
+	}
+
+	pr := cmn.PaymentRequest{AppID: "6f1c2b9d-0b7e-4d8e-9a62-3f1c2b9d4e11", SourceAccountID: 1, TargetAccountID: 2, Amount: 100}
+
+	w, first := send(pr, 1)
+	if w.Code != http.StatusAccepted {
+		t.Fatalf("expected status %d, got %d", http.StatusAccepted, w.Code)
+	}
+	mockDB.payments[first["systemId"]] = &paymentRecord{SystemID: first["systemId"], Status: statusVerified}
+
+	w, retry := send(pr, 1)
+	if w.Code != http.StatusAccepted {
+		t.Fatalf("expected status %d, got %d", http.StatusAccepted, w.Code)
+	}
+	if retry["systemId"] != first["systemId"] {
+		t.Errorf("expected original system id %s, got %s", first["systemId"], retry["systemId"])
+	}
+	if retry["status"] != string(statusVerified) {
+		t.Errorf("expected status %s, got %s", statusVerified, retry["status"])
+	}
+	if w.Header().Get("Idempotent-Replayed") != "true" {
+		t.Error("expected replayed header")
+	}
+	if len(mockDB.outbox) != 1 {
+		t.Errorf("expected 1 outbox message, got %d", len(mockDB.outbox))
+	}
+
+	// same key, different body
+	changed := pr
+	changed.Amount = 200
+	if w, _ = send(changed, 1); w.Code != http.StatusConflict {
+		t.Errorf("expected status %d, got %d", http.StatusConflict, w.Code)
+	}
+
+	// keys are scoped to the user
+	w, other := send(pr, 2)
+	if w.Code != http.StatusAccepted || other["systemId"] == first["systemId"] {
+		t.Errorf("expected new payment for another user, got %d %+v", w.Code, other)
+	}
+}
+
+func TestHandleGetPayment(t *testing.T) {
+	sysID := "0b0e8a57-4bd5-4a6c-a4a6-5f7b1f2f6c11"
+	mockDB := &mockDB{payments: map[string]*paymentRecord{
+		sysID: {SystemID: sysID, UserID: 1, Status: statusFailed, FailureReason: "balanceCheck failed"},
+	}}
+	appCtx := &paymentCtx{db: mockDB, logger: cmn.AppLogger()}
+
+	tests := []struct {
+		name           string
+		systemID       string
+		userID         int32
+		expectedStatus int
+	}{
+		{name: "found", systemID: sysID, userID: 1, expectedStatus: http.StatusOK},
+		{name: "another user's", systemID: sysID, userID: 2, expectedStatus: http.StatusNotFound},
+		{name: "not found", systemID: "6f1d7c0e-7a53-4ad2-9a43-0c8d2b1e9f00", userID: 1, expectedStatus: http.StatusNotFound},
+		{name: "invalid id", systemID: "nope", userID: 1, expectedStatus: http.StatusBadRequest},
+		{name: "no user", systemID: sysID, expectedStatus: http.StatusUnauthorized},
+	}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("GET /payment/{systemId}", handleGetPayment)
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req := httptest.NewRequest("GET", "/payment/"+tt.systemID, nil)
+			ctx := context.WithValue(req.Context(), cmn.AppCtx, appCtx)
+			req = req.WithContext(context.WithValue(ctx, cmn.UserIDKey, tt.userID))
+			w := httptest.NewRecorder()
+
+			mux.ServeHTTP(w, req)
+
+			if w.Code != tt.expectedStatus {
+				t.Fatalf("expected status %d, got %d", tt.expectedStatus, w.Code)
+			}
+			if tt.expectedStatus != http.StatusOK {
+				return
+			}
+
+			var got paymentRecord
+			if err := json.Unmarshal(w.Body.Bytes(), &got); err != nil {
+				t.Fatal(err)
+			}
+			if got.Status != statusFailed || got.FailureReason != "balanceCheck failed" {
+				t.Errorf("unexpected payment %+v", got)
+			}
+		})
+	}
+}
\ No newline at end of file
@@ -0,0 +1,161 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"slices"
+	"time"
+
+	"github.com/segmentio/kafka-go"
+	cmn "github.com/timkins666/distributed-playground/backend/pkg/common"
+)
+
+type paymentStatus string
+
+const (
+	statusPending   paymentStatus = "PENDING"
+	statusVerified  paymentStatus = "VERIFIED"
+	statusCompleted paymentStatus = "COMPLETED"
+	statusFailed    paymentStatus = "FAILED"
+)
+
+// legal status transitions. COMPLETED and FAILED are terminal.
+var statusTransitions = map[paymentStatus][]paymentStatus{
+	statusPending:  {statusVerified, statusFailed},
+	statusVerified: {statusCompleted, statusFailed},
+}
+
+func (s paymentStatus) canTransitionTo(next paymentStatus) bool {
+	return slices.Contains(statusTransitions[s], next)
+}
+
+var (
+	errPaymentNotFound   = errors.New("payment not found")
+	errIllegalTransition = errors.New("illegal payment status transition")
+)
+
+// current state of a payment as stored in payments.transfer
+type paymentRecord struct {
+	SystemID        string        `json:"systemId"`
+	AppID           string        `json:"appId"`
+	UserID          int32         `json:"userId"`
+	SourceAccountID int32         `json:"sourceAccountId"`
+	TargetAccountID int32         `json:"targetAccountId"`
+	Amount          int64         `json:"amount"`
+	Status          paymentStatus `json:"status"`
+	FailureReason   string        `json:"failureReason,omitempty"`
+	CreatedAt       time.Time     `json:"createdAt"`
+	UpdatedAt       time.Time     `json:"updatedAt"`
+	DebitedAt       *time.Time    `json:"debitedAt,omitempty"`
+	CreditedAt      *time.Time    `json:"creditedAt,omitempty"`
+	RedriveCount    int           `json:"redriveCount,omitempty"`
+	// account-service holds the payment's funds or transaction-service has started its transfer,
+	// so it may still complete however long it's been pending. only loaded by the sweeper.
+	HandedOn bool `json:"-"`
+}
+
+// fields of interest from account-service's validation result, which owns the full message shape
+type paymentVerifiedMsg struct {
+	PaymentRequest struct {
+		SystemID string `json:"systemId"`
+	} `json:"paymentRequest"`
+}
+
+// consumes payment and transaction events and moves payments through their lifecycle
+func paymentStatusConsumer(appCtx *paymentCtx) {
+	cmn.Consume(appCtx.cancelCtx, appCtx.statusReader, func(_ context.Context, msg kafka.Message) error {
+		err := handleStatusMessage(msg, appCtx)
+		if err != nil {
+			appCtx.logger.Printf("error handling %s message: %s", msg.Topic, err)
+		}
+		// retrying won't make these legal
+		if errors.Is(err, errIllegalTransition) || errors.Is(err, errPaymentNotFound) {
+			return cmn.Unprocessable(err)
+		}
+		return err
+	}, appCtx.logger)
+	appCtx.logger.Println("Context cancelled, stopping status consumer")
+}
+
+func handleStatusMessage(msg kafka.Message, appCtx *paymentCtx) error {
+	switch msg.Topic {
+	case cmn.Topics.PaymentVerified().S():
+		m, err := cmn.FromBytes[paymentVerifiedMsg](msg.Value)
+		if err != nil {
+			return cmn.Unprocessable(err)
+		}
+		return onPaymentVerified(m.PaymentRequest.SystemID, appCtx)
+
+	case cmn.Topics.PaymentFailed().S():
+		m, err := cmn.FromBytes[cmn.PaymentFailedEvent](msg.Value)
+		if err != nil {
+			return cmn.Unprocessable(err)
+		}
+		return appCtx.db.transitionPayment(m.SystemID, statusFailed, m.Reason)
+
+	case cmn.Topics.TransactionComplete().S():
+		m, err := cmn.FromBytes[cmn.TransactionEvent](msg.Value)
+		if err != nil {
+			return cmn.Unprocessable(err)
+		}
+		return onTransactionCompleted(m, appCtx)
+
+	case cmn.Topics.TransactionFailed().S():
+		m, err := cmn.FromBytes[cmn.TransactionEvent](msg.Value)
+		if err != nil {
+			return cmn.Unprocessable(err)
+		}
+		err = appCtx.db.transitionPayment(m.PaymentSysID, statusFailed, string(m.Reason))
+		return ignoreUnknownPayment(err)
+	}
+
+	appCtx.logger.Printf("ignoring message from unexpected topic %s", msg.Topic)
+	return nil
+}
+
+func onPaymentVerified(systemID string, appCtx *paymentCtx) error {
+	if err := appCtx.db.transitionPayment(systemID, statusVerified, ""); err != nil {
+		return err
+	}
+
+	// transaction legs may have been consumed before verification
+	payment, err := appCtx.db.getPayment(systemID)
+	if err != nil {
+		return err
+	}
+	if payment.DebitedAt != nil && payment.CreditedAt != nil {
+		return appCtx.db.transitionPayment(systemID, statusCompleted, "")
+	}
+	return nil
+}
+
+func onTransactionCompleted(m *cmn.TransactionEvent, appCtx *paymentCtx) error {
+	// a compensation follows a failed credit, which has already failed the payment
+	if m.Leg == cmn.LegCompensation {
+		return nil
+	}
+
+	bothLegs, err := appCtx.db.completeLeg(m.PaymentSysID, m.Leg == cmn.LegCredit)
+	if err != nil {
+		return ignoreUnknownPayment(err)
+	}
+	if !bothLegs {
+		return nil
+	}
+
+	err = appCtx.db.transitionPayment(m.PaymentSysID, statusCompleted, "")
+	if errors.Is(err, errIllegalTransition) {
+		// not verified yet, completed when verification is consumed
+		appCtx.logger.Printf("payment %s legs complete before verification", m.PaymentSysID)
+		return nil
+	}
+	return err
+}
+
+// transactions are also issued for things that aren't payments, e.g. account creation
+func ignoreUnknownPayment(err error) error {
+	if errors.Is(err, errPaymentNotFound) {
+		return nil
+	}
+	return err
+}
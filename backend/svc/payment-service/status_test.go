@@ -0,0 +1,179 @@
+package main
+
+import (
+	"context"
+	"testing"
+
+	"github.com/segmentio/kafka-go"
+	cmn "github.com/timkins666/distributed-playground/backend/pkg/common"
+)
+
+func TestCanTransitionTo(t *testing.T) {
+	tests := []struct {
+		from, to paymentStatus
+		want     bool
+	}{
+		{statusPending, statusVerified, true},
+		{statusPending, statusFailed, true},
+		{statusPending, statusCompleted, false},
+		{statusVerified, statusCompleted, true},
+		{statusVerified, statusFailed, true},
+		{statusVerified, statusPending, false},
+		{statusCompleted, statusFailed, false},
+		{statusFailed, statusCompleted, false},
+		{statusFailed, statusVerified, false},
+	}
+
+	for _, tt := range tests {
+		t.Run(string(tt.from)+"->"+string(tt.to), func(t *testing.T) {
+			if got := tt.from.canTransitionTo(tt.to); got != tt.want {
+				t.Errorf("expected %v, got %v", tt.want, got)
+			}
+		})
+	}
+}
+
+func statusMsg(t *testing.T, topic cmn.Topic, v any) kafka.Message {
+	b, err := cmn.ToBytes(v)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return kafka.Message{Topic: topic.S(), Value: b}
+}
+
+func TestHandleStatusMessage(t *testing.T) {
+	verified := paymentVerifiedMsg{}
+	verified.PaymentRequest.SystemID = "sys1"
+
+	debit := cmn.TransactionEvent{PaymentSysID: "sys1", AccountID: 1, Leg: cmn.LegDebit, Amount: -100}
+	credit := cmn.TransactionEvent{PaymentSysID: "sys1", AccountID: 2, Leg: cmn.LegCredit, Amount: 100}
+	refund := cmn.TransactionEvent{PaymentSysID: "sys1", AccountID: 1, Leg: cmn.LegCompensation, Amount: 100}
+	creditFailed := cmn.TransactionEvent{PaymentSysID: "sys1", AccountID: 2, Leg: cmn.LegCredit, Reason: cmn.TxFailureAccountNotFound}
+
+	tests := []struct {
+		name       string
+		msgs       []kafka.Message
+		wantStatus paymentStatus
+		wantReason string
+	}{
+		{
+			name:       "verified",
+			msgs:       []kafka.Message{statusMsg(t, cmn.Topics.PaymentVerified(), verified)},
+			wantStatus: statusVerified,
+		},
+		{
+			name: "validation failed",
+			msgs: []kafka.Message{
+				statusMsg(t, cmn.Topics.PaymentFailed(), cmn.PaymentFailedEvent{SystemID: "sys1", Reason: "nope"}),
+			},
+			wantStatus: statusFailed,
+			wantReason: "nope",
+		},
+		{
+			name: "both legs completed",
+			msgs: []kafka.Message{
+				statusMsg(t, cmn.Topics.PaymentVerified(), verified),
+				statusMsg(t, cmn.Topics.TransactionComplete(), debit),
+				statusMsg(t, cmn.Topics.TransactionComplete(), credit),
+			},
+			wantStatus: statusCompleted,
+		},
+		{
+			name: "one leg completed",
+			msgs: []kafka.Message{
+				statusMsg(t, cmn.Topics.PaymentVerified(), verified),
+				statusMsg(t, cmn.Topics.TransactionComplete(), debit),
+			},
+			wantStatus: statusVerified,
+		},
+		{
+			name: "legs completed before verification",
+			msgs: []kafka.Message{
+				statusMsg(t, cmn.Topics.TransactionComplete(), debit),
+				statusMsg(t, cmn.Topics.TransactionComplete(), credit),
+				statusMsg(t, cmn.Topics.PaymentVerified(), verified),
+			},
+			wantStatus: statusCompleted,
+		},
+		{
+			name: "transaction failed",
+			msgs: []kafka.Message{
+				statusMsg(t, cmn.Topics.PaymentVerified(), verified),
+				statusMsg(t, cmn.Topics.TransactionFailed(), cmn.TransactionEvent{PaymentSysID: "sys1", Reason: cmn.TxFailureInvalid}),
+			},
+			wantStatus: statusFailed,
+			wantReason: string(cmn.TxFailureInvalid),
+		},
+		{
+			name: "credit failed and debit compensated",
+			msgs: []kafka.Message{
+				statusMsg(t, cmn.Topics.PaymentVerified(), verified),
+				statusMsg(t, cmn.Topics.TransactionComplete(), debit),
+				statusMsg(t, cmn.Topics.TransactionFailed(), creditFailed),
+				statusMsg(t, cmn.Topics.TransactionComplete(), refund),
+			},
+			wantStatus: statusFailed,
+			wantReason: string(cmn.TxFailureAccountNotFound),
+		},
+		{
+			name: "redelivered verification",
+			msgs: []kafka.Message{
+				statusMsg(t, cmn.Topics.PaymentVerified(), verified),
+				statusMsg(t, cmn.Topics.PaymentVerified(), verified),
+			},
+			wantStatus: statusVerified,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			mockDB := &mockDB{payments: map[string]*paymentRecord{
+				"sys1": {SystemID: "sys1", Status: statusPending},
+			}}
+			appCtx := &paymentCtx{
+				cancelCtx: context.Background(),
+				db:        mockDB,
+				logger:    cmn.AppLogger(),
+			}
+
+			for _, msg := range tt.msgs {
+				if err := handleStatusMessage(msg, appCtx); err != nil {
+					t.Fatalf("unexpected error: %v", err)
+				}
+			}
+
+			p := mockDB.payments["sys1"]
+			if p.Status != tt.wantStatus {
+				t.Errorf("expected status %s, got %s", tt.wantStatus, p.Status)
+			}
+			if p.FailureReason != tt.wantReason {
+				t.Errorf("expected reason %q, got %q", tt.wantReason, p.FailureReason)
+			}
+		})
+	}
+}
+
+func TestHandleStatusMessageIllegalTransition(t *testing.T) {
+	mockDB := &mockDB{payments: map[string]*paymentRecord{
+		"sys1": {SystemID: "sys1", Status: statusFailed},
+	}}
+	appCtx := &paymentCtx{db: mockDB, logger: cmn.AppLogger()}
+
+	verified := paymentVerifiedMsg{}
+	verified.PaymentRequest.SystemID = "sys1"
+
+	err := handleStatusMessage(statusMsg(t, cmn.Topics.PaymentVerified(), verified), appCtx)
+	if err != errIllegalTransition {
+		t.Errorf("expected errIllegalTransition, got %v", err)
+	}
+}
+
+func TestHandleStatusMessageUnknownPayment(t *testing.T) {
+	appCtx := &paymentCtx{db: &mockDB{}, logger: cmn.AppLogger()}
+
+	// account creation transactions have no payment record
+	msg := statusMsg(t, cmn.Topics.TransactionComplete(), cmn.TransactionEvent{PaymentSysID: "acc", Leg: cmn.LegCredit, Amount: 5})
+	if err := handleStatusMessage(msg, appCtx); err != nil {
+		t.Errorf("unexpected error: %v", err)
+	}
+}
@@ -0,0 +1,168 @@
+package main
+
+import (
+	"time"
+
+	"github.com/segmentio/kafka-go"
+	cmn "github.com/timkins666/distributed-playground/backend/pkg/common"
+)
+
+const (
+	defaultSweepInterval   = 10 * time.Second
+	defaultPendingTimeout  = 30 * time.Second
+	defaultVerifiedTimeout = time.Minute
+	defaultMaxRedrives     = 3
+	sweepBatchSize         = 100
+
+	// payment requests are only validated within 10s of their timestamp, and validation takes
+	// at most 4.5s. a pending payment older than this can't be verified by any copy already
+	// published, so it's safe to fail.
+	minPendingTimeout = 15 * time.Second
+
+	timeoutReason = "timeout"
+)
+
+// deadlines for each stage of a payment, from the environment
+type sweeperConfig struct {
+	interval time.Duration
+	// time a payment may wait for validation before it's re-driven, then failed
+	pendingTimeout time.Duration
+	// time a verified payment may wait for its first leg before the transfer is re-driven
+	verifiedTimeout time.Duration
+	// times a pending payment is republished before it's failed
+	maxRedrives int
+}
+
+func loadSweeperConfig() sweeperConfig {
+	logger := cmn.AppLogger()
+	conf := sweeperConfig{
+		interval:        cmn.DurationFromEnv("SWEEP_INTERVAL", defaultSweepInterval, logger),
+		pendingTimeout:  cmn.DurationFromEnv("PENDING_TIMEOUT", defaultPendingTimeout, logger),
+		verifiedTimeout: cmn.DurationFromEnv("VERIFIED_TIMEOUT", defaultVerifiedTimeout, logger),
+		maxRedrives:     cmn.IntFromEnv("MAX_REDRIVES", defaultMaxRedrives, 0, logger),
+	}
+	if conf.pendingTimeout < minPendingTimeout {
+		logger.Printf("PENDING_TIMEOUT %s is too short, using %s", conf.pendingTimeout, minPendingTimeout)
+		conf.pendingTimeout = minPendingTimeout
+	}
+	return conf
+}
+
+// what the sweeper does with a stuck payment
+type sweepAction int
+
+const (
+	// republish the payment and restart its deadline
+	sweepRedrive sweepAction = iota
+	// fail the payment with the timeout reason
+	sweepFail
+	// leave the payment to finish, restarting its deadline
+	sweepWait
+)
+
+// decides what to do with a stuck payment and the events to stage in the outbox for it
+type sweepDecider func(p *paymentRecord) (sweepAction, []kafka.Message, error)
+
+// runSweeper periodically re-drives or fails payments stuck before their first leg. payments
+// are claimed with row locks that other replicas skip, so any number can run it.
+func runSweeper(appCtx *paymentCtx) {
+	conf := appCtx.sweeper
+	appCtx.logger.Printf("Payment sweeper started, pending timeout %s, verified timeout %s", conf.pendingTimeout, conf.verifiedTimeout)
+
+	ticker := time.NewTicker(conf.interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-appCtx.cancelCtx.Done():
+			appCtx.logger.Println("Context cancelled, stopping payment sweeper")
+			return
+		case <-ticker.C:
+			sweep(appCtx)
+		}
+	}
+}
+
+func sweep(appCtx *paymentCtx) {
+	conf := appCtx.sweeper
+
+	n, err := appCtx.db.sweepPayments(statusPending, conf.pendingTimeout, sweepBatchSize,
+		func(p *paymentRecord) (sweepAction, []kafka.Message, error) {
+			return decidePending(p, conf.maxRedrives)
+		})
+	if err != nil {
+		appCtx.logger.Printf("failed to sweep pending payments: %s", err)
+	} else if n > 0 {
+		appCtx.logger.Printf("Swept %d pending payments", n)
+	}
+
+	n, err = appCtx.db.sweepPayments(statusVerified, conf.verifiedTimeout, sweepBatchSize, decideVerified)
+	if err != nil {
+		appCtx.logger.Printf("failed to sweep verified payments: %s", err)
+	} else if n > 0 {
+		appCtx.logger.Printf("Swept %d verified payments", n)
+	}
+}
+
+// a pending payment's request was lost or dropped by the validator. it's republished with a
+// fresh timestamp so it can be validated again, then failed once out of attempts. it isn't
+// failed while its funds are held or its transfer has started, as it may have been verified
+// with payment-verified still waiting to be consumed, and failing it wouldn't stop the transfer.
+func decidePending(p *paymentRecord, maxRedrives int) (sweepAction, []kafka.Message, error) {
+	key, err := cmn.ToBytes(p.SourceAccountID)
+	if err != nil {
+		return 0, nil, err
+	}
+
+	if p.RedriveCount >= maxRedrives && p.HandedOn {
+		return sweepWait, nil, nil
+	}
+	if p.RedriveCount >= maxRedrives {
+		val, err := cmn.ToBytes(cmn.PaymentFailedEvent{
+			Type:      cmn.PaymentFailed,
+			Reason:    timeoutReason,
+			AppID:     p.AppID,
+			SystemID:  p.SystemID,
+			AccountID: p.SourceAccountID,
+			Timestamp: time.Now().UTC(),
+		})
+		if err != nil {
+			return 0, nil, err
+		}
+		return sweepFail, []kafka.Message{{Topic: cmn.Topics.PaymentFailed().S(), Key: key, Value: val}}, nil
+	}
+
+	val, err := cmn.ToBytes(cmn.PaymentRequest{
+		AppID:           p.AppID,
+		SystemID:        p.SystemID,
+		UserID:          p.UserID,
+		Amount:          p.Amount,
+		SourceAccountID: p.SourceAccountID,
+		TargetAccountID: p.TargetAccountID,
+		Timestamp:       time.Now().UTC(),
+	})
+	if err != nil {
+		return 0, nil, err
+	}
+	return sweepRedrive, []kafka.Message{{Topic: cmn.Topics.PaymentRequested().S(), Key: key, Value: val}}, nil
+}
+
+// a verified payment has been handed to transaction-service as a transfer. it's never failed
+// here as the transfer may still be applied, but republishing it is safe as the saga is
+// idempotent on the payment.
+func decideVerified(p *paymentRecord) (sweepAction, []kafka.Message, error) {
+	key, err := cmn.ToBytes(p.SourceAccountID)
+	if err != nil {
+		return 0, nil, err
+	}
+	val, err := cmn.ToBytes(cmn.Transfer{
+		PaymentSysID:    p.SystemID,
+		SourceAccountID: p.SourceAccountID,
+		TargetAccountID: p.TargetAccountID,
+		Amount:          p.Amount,
+	})
+	if err != nil {
+		return 0, nil, err
+	}
+	return sweepRedrive, []kafka.Message{{Topic: cmn.Topics.TransferRequested().S(), Key: key, Value: val}}, nil
+}
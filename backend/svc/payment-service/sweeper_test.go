@@ -0,0 +1,122 @@
+package main
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	cmn "github.com/timkins666/distributed-playground/backend/pkg/common"
+)
+
+func TestLoadSweeperConfig(t *testing.T) {
+	conf := loadSweeperConfig()
+	if conf.pendingTimeout != defaultPendingTimeout || conf.verifiedTimeout != defaultVerifiedTimeout ||
+		conf.maxRedrives != defaultMaxRedrives || conf.interval != defaultSweepInterval {
+		t.Errorf("expected defaults, got %+v", conf)
+	}
+
+	t.Setenv("PENDING_TIMEOUT", "1s")
+	t.Setenv("VERIFIED_TIMEOUT", "5m")
+	t.Setenv("MAX_REDRIVES", "0")
+	conf = loadSweeperConfig()
+	if conf.pendingTimeout != minPendingTimeout {
+		t.Errorf("expected pending timeout raised to %s, got %s", minPendingTimeout, conf.pendingTimeout)
+	}
+	if conf.verifiedTimeout != 5*time.Minute || conf.maxRedrives != 0 {
+		t.Errorf("expected configured values, got %+v", conf)
+	}
+}
+
+func sweeperCtx(db *mockDB) *paymentCtx {
+	return &paymentCtx{
+		cancelCtx: context.Background(),
+		db:        db,
+		logger:    cmn.AppLogger(),
+		sweeper: sweeperConfig{
+			pendingTimeout:  30 * time.Second,
+			verifiedTimeout: time.Minute,
+			maxRedrives:     2,
+		},
+	}
+}
+
+func TestSweepPending(t *testing.T) {
+	stale := time.Now().Add(-time.Hour)
+	db := &mockDB{payments: map[string]*paymentRecord{
+		"redrive": {SystemID: "redrive", AppID: "00000000-0000-0000-0000-000000000001", UserID: 7, SourceAccountID: 1, TargetAccountID: 2,
+			Amount: 100, Status: statusPending, UpdatedAt: stale, RedriveCount: 1},
+		"fail": {SystemID: "fail", AppID: "00000000-0000-0000-0000-000000000002", UserID: 7, SourceAccountID: 1, TargetAccountID: 2,
+			Amount: 100, Status: statusPending, UpdatedAt: stale, RedriveCount: 2},
+		"recent": {SystemID: "recent", Status: statusPending, UpdatedAt: time.Now()},
+		// verified with its funds held, but payment-verified hasn't been consumed yet
+		"handed-on": {SystemID: "handed-on", AppID: "00000000-0000-0000-0000-000000000003", UserID: 7, SourceAccountID: 1, TargetAccountID: 2,
+			Amount: 100, Status: statusPending, UpdatedAt: stale, RedriveCount: 2, HandedOn: true},
+	}}
+
+	sweep(sweeperCtx(db))
+
+	if p := db.payments["redrive"]; p.Status != statusPending || p.RedriveCount != 2 {
+		t.Errorf("expected payment re-driven, got %+v", p)
+	}
+	if p := db.payments["fail"]; p.Status != statusFailed || p.FailureReason != timeoutReason {
+		t.Errorf("expected payment failed with timeout, got %+v", p)
+	}
+	if p := db.payments["recent"]; p.Status != statusPending || p.RedriveCount != 0 {
+		t.Errorf("expected recent payment untouched, got %+v", p)
+	}
+	if p := db.payments["handed-on"]; p.Status != statusPending || p.RedriveCount != 2 || time.Since(p.UpdatedAt) > time.Minute {
+		t.Errorf("expected handed on payment left pending with its deadline restarted, got %+v", p)
+	}
+
+	if len(db.outbox) != 2 {
+		t.Fatalf("expected 2 events, got %d", len(db.outbox))
+	}
+	for _, msg := range db.outbox {
+		switch msg.Topic {
+		case cmn.Topics.PaymentRequested().S():
+			req, err := cmn.FromBytes[cmn.PaymentRequest](msg.Value)
+			if err != nil || req.SystemID != "redrive" || req.UserID != 7 {
+				t.Errorf("unexpected re-driven request %+v", req)
+			}
+			// must pass the validator's freshness check again
+			if !req.Valid() {
+				t.Errorf("expected re-driven request to be valid, got %+v", req)
+			}
+		case cmn.Topics.PaymentFailed().S():
+			m, err := cmn.FromBytes[cmn.PaymentFailedEvent](msg.Value)
+			if err != nil || m.SystemID != "fail" || m.Reason != timeoutReason {
+				t.Errorf("unexpected payment failed message %+v", m)
+			}
+		default:
+			t.Errorf("unexpected topic %s", msg.Topic)
+		}
+	}
+}
+
+func TestSweepVerified(t *testing.T) {
+	stale := time.Now().Add(-time.Hour)
+	debited := stale
+	db := &mockDB{payments: map[string]*paymentRecord{
+		"stuck": {SystemID: "stuck", SourceAccountID: 1, TargetAccountID: 2, Amount: 100,
+			Status: statusVerified, UpdatedAt: stale, RedriveCount: 10},
+		"in-progress": {SystemID: "in-progress", Status: statusVerified, UpdatedAt: stale, DebitedAt: &debited},
+	}}
+
+	sweep(sweeperCtx(db))
+
+	// verified payments are never failed by the sweeper, however many attempts
+	if p := db.payments["stuck"]; p.Status != statusVerified || p.RedriveCount != 11 {
+		t.Errorf("expected transfer re-driven, got %+v", p)
+	}
+	if p := db.payments["in-progress"]; p.RedriveCount != 0 {
+		t.Errorf("expected payment with a leg applied to be left to the saga, got %+v", p)
+	}
+
+	if len(db.outbox) != 1 || db.outbox[0].Topic != cmn.Topics.TransferRequested().S() {
+		t.Fatalf("expected 1 transfer-requested event, got %+v", db.outbox)
+	}
+	transfer, err := cmn.FromBytes[cmn.Transfer](db.outbox[0].Value)
+	if err != nil || !transfer.Valid() || transfer.PaymentSysID != "stuck" {
+		t.Errorf("unexpected transfer %+v", transfer)
+	}
+}
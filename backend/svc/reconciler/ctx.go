@@ -0,0 +1,70 @@
+package main
+
+import (
+	"context"
+	"log"
+	"sync"
+	"time"
+
+	"github.com/segmentio/kafka-go"
+	cmn "github.com/timkins666/distributed-playground/backend/pkg/common"
+)
+
+const (
+	defaultInterval   = 5 * time.Minute
+	defaultPendingSLA = 10 * time.Minute
+)
+
+// app context for the reconciler
+type reconcilerCtx struct {
+	cancelCtx context.Context
+	db        reconcilerDB
+	logger    *log.Logger
+	writer    cmn.KafkaWriter
+	// tokens revoked on logout, checked for on demand runs
+	revocations *cmn.RevocationList
+	// time between scheduled runs
+	interval time.Duration
+	// how long a payment may stay PENDING before it's a break
+	pendingSLA time.Duration
+	// scheduled and on demand runs take turns
+	runMu sync.Mutex
+}
+
+// close releases all resources
+func (a *reconcilerCtx) close() error {
+	if a.writer != nil {
+		return a.writer.Close()
+	}
+	return nil
+}
+
+func newAppCtx(cancelCtx context.Context) *reconcilerCtx {
+	logger := cmn.AppLogger()
+
+	db, err := initDB()
+	if err != nil {
+		logger.Fatal(err)
+	}
+
+	writer := &kafka.Writer{
+		Addr:         kafka.TCP(cmn.KafkaBroker()),
+		RequiredAcks: 1,
+	}
+
+	redisConfig, err := cmn.LoadRedisConfig()
+	if err != nil {
+		logger.Fatal(err)
+	}
+	rds := cmn.ConnectRedis(cancelCtx, redisConfig, logger)
+
+	return &reconcilerCtx{
+		cancelCtx:   cancelCtx,
+		db:          db,
+		logger:      logger,
+		writer:      writer,
+		revocations: cmn.NewRevocationList(rds, logger),
+		interval:    cmn.DurationFromEnv("RECONCILE_INTERVAL", defaultInterval, logger),
+		pendingSLA:  cmn.DurationFromEnv("PENDING_SLA", defaultPendingSLA, logger),
+	}
+}
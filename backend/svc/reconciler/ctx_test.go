@@ -0,0 +1,41 @@
+package main
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	tu "github.com/timkins666/distributed-playground/backend/pkg/testutils"
+)
+
+func TestNewAppCtx(t *testing.T) {
+	t.Setenv("KAFKA_BROKER", "foo")
+	t.Setenv("DB_TYPE", "_TEST_")
+	t.Setenv("RECONCILE_INTERVAL", "30s")
+	t.Setenv("PENDING_SLA", "nonsense")
+	// no redis here, so don't wait for it
+	t.Setenv("REDIS_CONNECT_ATTEMPTS", "1")
+
+	ctx := newAppCtx(context.Background())
+	if ctx.db == nil || ctx.writer == nil || ctx.logger == nil || ctx.revocations == nil {
+		t.Errorf("expected db, writer, logger and revocations, got %+v", ctx)
+	}
+	if ctx.interval != 30*time.Second {
+		t.Errorf("expected interval 30s, got %s", ctx.interval)
+	}
+	if ctx.pendingSLA != defaultPendingSLA {
+		t.Errorf("expected default pending SLA, got %s", ctx.pendingSLA)
+	}
+}
+
+func TestReconcilerCtxClose(t *testing.T) {
+	writer := &tu.MockKafkaWriter{}
+	ctx := &reconcilerCtx{writer: writer}
+
+	if err := ctx.close(); err != nil {
+		t.Errorf("unexpected error: %v", err)
+	}
+	if !writer.Closed {
+		t.Error("writer should be closed")
+	}
+}
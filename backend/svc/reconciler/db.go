@@ -0,0 +1,41 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"time"
+
+	cmn "github.com/timkins666/distributed-playground/backend/pkg/common"
+)
+
+func initDB() (reconcilerDB, error) {
+	dbType, found := os.LookupEnv("DB_TYPE")
+
+	if dbType == "_TEST_" {
+		return &dbPostgres{}, nil
+	}
+
+	if dbType == "POSTGRES" || !found {
+		db, err := cmn.InitPostgres(cmn.DefaultConfig)
+		if err != nil {
+			return nil, fmt.Errorf("failed to initialize database: %w", err)
+		}
+		return &dbPostgres{db}, nil
+	}
+
+	panic("cassandra not set up yet")
+}
+
+// reads across the accounts, transactions and payments schemas. never writes.
+type reconcilerDB interface {
+	// accounts whose balance differs from the sum of their transactions
+	getBalanceBreaks() ([]balanceBreak, error)
+	// accounts whose balance differs from the balance after their latest journal line
+	getJournalBreaks() ([]journalBreak, error)
+	// completed payments without exactly one debit and one credit leg
+	getLegBreaks() ([]legBreak, error)
+	// payments still pending that were created before the given time
+	getStalePayments(createdBefore time.Time) ([]stalePayment, error)
+	// the user with their roles, read on every request so a revoked role takes effect at once
+	getUser(id int32) (*cmn.User, error)
+}
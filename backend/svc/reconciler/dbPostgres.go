@@ -0,0 +1,134 @@
+package main
+
+import (
+	"database/sql"
+	"time"
+
+	"github.com/lib/pq"
+	cmn "github.com/timkins666/distributed-playground/backend/pkg/common"
+)
+
+type dbPostgres struct {
+	db *sql.DB
+}
+
+func (db *dbPostgres) getBalanceBreaks() ([]balanceBreak, error) {
+	rows, err := db.db.Query(`
+		SELECT a.id, a.balance, COALESCE(SUM(t.amount), 0)
+		FROM accounts.account a
+		LEFT JOIN transactions.transaction t ON t.account_id = a.id
+		GROUP BY a.id, a.balance
+		HAVING a.balance <> COALESCE(SUM(t.amount), 0)
+		ORDER BY a.id
+	`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var breaks []balanceBreak
+	for rows.Next() {
+		var b balanceBreak
+		if err := rows.Scan(&b.AccountID, &b.Balance, &b.TransactionTotal); err != nil {
+			return nil, err
+		}
+		breaks = append(breaks, b)
+	}
+	return breaks, rows.Err()
+}
+
+func (db *dbPostgres) getJournalBreaks() ([]journalBreak, error) {
+	// the in-flight account keeps no running balance, so has no line with one
+	rows, err := db.db.Query(`
+		SELECT a.id, a.balance, l.balance_after
+		FROM accounts.account a
+		JOIN LATERAL (
+			SELECT balance_after FROM transactions.journal_line
+			WHERE account_id = a.id AND balance_after IS NOT NULL
+			ORDER BY id DESC
+			LIMIT 1
+		) l ON true
+		WHERE a.balance <> l.balance_after
+		ORDER BY a.id
+	`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var breaks []journalBreak
+	for rows.Next() {
+		var b journalBreak
+		if err := rows.Scan(&b.AccountID, &b.Balance, &b.BalanceAfter); err != nil {
+			return nil, err
+		}
+		breaks = append(breaks, b)
+	}
+	return breaks, rows.Err()
+}
+
+func (db *dbPostgres) getLegBreaks() ([]legBreak, error) {
+	rows, err := db.db.Query(`
+		SELECT p.system_id,
+			COUNT(t.id) FILTER (WHERE t.leg = 'DEBIT'),
+			COUNT(t.id) FILTER (WHERE t.leg = 'CREDIT')
+		FROM payments.transfer p
+		LEFT JOIN transactions.transaction t ON t.payment_sys_id = p.system_id
+		WHERE p.status = 'COMPLETED'
+		GROUP BY p.system_id
+		HAVING COUNT(t.id) FILTER (WHERE t.leg = 'DEBIT') <> 1
+			OR COUNT(t.id) FILTER (WHERE t.leg = 'CREDIT') <> 1
+		ORDER BY p.system_id
+	`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var breaks []legBreak
+	for rows.Next() {
+		var b legBreak
+		if err := rows.Scan(&b.PaymentSysID, &b.Debits, &b.Credits); err != nil {
+			return nil, err
+		}
+		breaks = append(breaks, b)
+	}
+	return breaks, rows.Err()
+}
+
+func (db *dbPostgres) getStalePayments(createdBefore time.Time) ([]stalePayment, error) {
+	rows, err := db.db.Query(`
+		SELECT system_id, created_at
+		FROM payments.transfer
+		WHERE status = 'PENDING' AND created_at < $1
+		ORDER BY created_at
+	`, createdBefore)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var stale []stalePayment
+	for rows.Next() {
+		var p stalePayment
+		if err := rows.Scan(&p.PaymentSysID, &p.CreatedAt); err != nil {
+			return nil, err
+		}
+		stale = append(stale, p)
+	}
+	return stale, rows.Err()
+}
+
+func (db *dbPostgres) getUser(id int32) (*cmn.User, error) {
+	var user cmn.User
+	err := db.db.QueryRow(`
+		SELECT id, username, roles FROM accounts."user" WHERE id = $1
+	`, id).Scan(&user.ID, &user.Username, pq.Array(&user.Roles))
+	if err == sql.ErrNoRows {
+		return nil, cmn.ErrUserNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &user, nil
+}
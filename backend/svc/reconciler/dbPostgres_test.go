@@ -0,0 +1,148 @@
+package main
+
+import (
+	"database/sql"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/DATA-DOG/go-sqlmock"
+	cmn "github.com/timkins666/distributed-playground/backend/pkg/common"
+)
+
+func TestDBPostgresGetBalanceBreaks(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatalf("failed to create mock: %v", err)
+	}
+	defer db.Close()
+
+	mock.ExpectQuery("SELECT a.id, a.balance, COALESCE\\(SUM\\(t.amount\\), 0\\)").
+		WillReturnRows(sqlmock.NewRows([]string{"id", "balance", "sum"}).
+			AddRow(1, 100, 90).
+			AddRow(2, 0, 50))
+
+	breaks, err := (&dbPostgres{db: db}).getBalanceBreaks()
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if len(breaks) != 2 || breaks[0] != (balanceBreak{1, 100, 90}) || breaks[1] != (balanceBreak{2, 0, 50}) {
+		t.Errorf("unexpected breaks %+v", breaks)
+	}
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("unfulfilled expectations: %v", err)
+	}
+}
+
+func TestDBPostgresGetJournalBreaks(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatalf("failed to create mock: %v", err)
+	}
+	defer db.Close()
+
+	mock.ExpectQuery("SELECT a.id, a.balance, l.balance_after FROM accounts.account a JOIN LATERAL").
+		WillReturnRows(sqlmock.NewRows([]string{"id", "balance", "balance_after"}).AddRow(1, 100, 90))
+
+	breaks, err := (&dbPostgres{db: db}).getJournalBreaks()
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if len(breaks) != 1 || breaks[0] != (journalBreak{1, 100, 90}) {
+		t.Errorf("unexpected breaks %+v", breaks)
+	}
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("unfulfilled expectations: %v", err)
+	}
+}
+
+func TestDBPostgresGetLegBreaks(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatalf("failed to create mock: %v", err)
+	}
+	defer db.Close()
+
+	mock.ExpectQuery("FROM payments.transfer p").
+		WillReturnRows(sqlmock.NewRows([]string{"system_id", "debits", "credits"}).AddRow("p1", 1, 0))
+
+	breaks, err := (&dbPostgres{db: db}).getLegBreaks()
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if len(breaks) != 1 || breaks[0] != (legBreak{"p1", 1, 0}) {
+		t.Errorf("unexpected breaks %+v", breaks)
+	}
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("unfulfilled expectations: %v", err)
+	}
+}
+
+func TestDBPostgresGetStalePayments(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatalf("failed to create mock: %v", err)
+	}
+	defer db.Close()
+
+	cutoff := time.Date(2025, 1, 1, 12, 0, 0, 0, time.UTC)
+	created := cutoff.Add(-time.Hour)
+	mock.ExpectQuery("SELECT system_id, created_at FROM payments.transfer").
+		WithArgs(cutoff).
+		WillReturnRows(sqlmock.NewRows([]string{"system_id", "created_at"}).AddRow("p1", created))
+
+	stale, err := (&dbPostgres{db: db}).getStalePayments(cutoff)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if len(stale) != 1 || stale[0].PaymentSysID != "p1" || !stale[0].CreatedAt.Equal(created) {
+		t.Errorf("unexpected stale payments %+v", stale)
+	}
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("unfulfilled expectations: %v", err)
+	}
+}
+
+func TestDBPostgresGetUser(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatalf("failed to create mock: %v", err)
+	}
+	defer db.Close()
+
+	mock.ExpectQuery(`SELECT id, username, roles FROM accounts."user"`).
+		WithArgs(1).
+		WillReturnRows(sqlmock.NewRows([]string{"id", "username", "roles"}).AddRow(1, "admin", "{admin}"))
+	mock.ExpectQuery(`SELECT id, username, roles FROM accounts."user"`).
+		WithArgs(2).
+		WillReturnError(sql.ErrNoRows)
+
+	user, err := (&dbPostgres{db: db}).getUser(1)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if user.Username != "admin" || len(user.Roles) != 1 || user.Roles[0] != cmn.RoleAdmin {
+		t.Errorf("unexpected user %+v", user)
+	}
+
+	if _, err := (&dbPostgres{db: db}).getUser(2); err != cmn.ErrUserNotFound {
+		t.Errorf("expected user not found, got %v", err)
+	}
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("unfulfilled expectations: %v", err)
+	}
+}
+
+func TestDBPostgresQueryError(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatalf("failed to create mock: %v", err)
+	}
+	defer db.Close()
+
+	mock.ExpectQuery("SELECT").WillReturnError(errors.New("db down"))
+
+	if _, err := (&dbPostgres{db: db}).getBalanceBreaks(); err == nil {
+		t.Error("expected error")
+	}
+}
@@ -0,0 +1,106 @@
+package main
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/segmentio/kafka-go"
+	cmn "github.com/timkins666/distributed-playground/backend/pkg/common"
+)
+
+// an account whose balance isn't the sum of its transactions
+type balanceBreak struct {
+	AccountID        int32 `json:"accountId"`
+	Balance          int64 `json:"balance"`
+	TransactionTotal int64 `json:"transactionTotal"`
+}
+
+// an account whose balance isn't the balance after its latest journal line
+type journalBreak struct {
+	AccountID    int32 `json:"accountId"`
+	Balance      int64 `json:"balance"`
+	BalanceAfter int64 `json:"balanceAfter"`
+}
+
+// a completed payment that wasn't applied as exactly one debit and one credit
+type legBreak struct {
+	PaymentSysID string `json:"paymentSysId"`
+	Debits       int    `json:"debits"`
+	Credits      int    `json:"credits"`
+}
+
+// a payment that has been PENDING for longer than the SLA
+type stalePayment struct {
+	PaymentSysID string    `json:"paymentSysId"`
+	CreatedAt    time.Time `json:"createdAt"`
+}
+
+// report is the result of one reconciliation run, published to reconciliation-breaks
+// when anything doesn't add up
+type report struct {
+	RunID      string    `json:"runId"`
+	StartedAt  time.Time `json:"startedAt"`
+	FinishedAt time.Time `json:"finishedAt"`
+	// payments created before this and still pending are stale
+	PendingCutoff time.Time      `json:"pendingCutoff"`
+	BalanceBreaks []balanceBreak `json:"balanceBreaks"`
+	JournalBreaks []journalBreak `json:"journalBreaks"`
+	LegBreaks     []legBreak     `json:"legBreaks"`
+	StalePayments []stalePayment `json:"stalePayments"`
+}
+
+func (r *report) breaks() int {
+	return len(r.BalanceBreaks) + len(r.JournalBreaks) + len(r.LegBreaks) + len(r.StalePayments)
+}
+
+// reconcile runs every check and publishes the report if there are any breaks
+func reconcile(appCtx *reconcilerCtx) (*report, error) {
+	appCtx.runMu.Lock()
+	defer appCtx.runMu.Unlock()
+
+	// payments.transfer timestamps are UTC without a zone
+	now := time.Now().UTC()
+	r := &report{
+		RunID:         uuid.NewString(),
+		StartedAt:     now,
+		PendingCutoff: now.Add(-appCtx.pendingSLA),
+	}
+
+	var err error
+	if r.BalanceBreaks, err = appCtx.db.getBalanceBreaks(); err != nil {
+		return nil, fmt.Errorf("balance check: %w", err)
+	}
+	if r.JournalBreaks, err = appCtx.db.getJournalBreaks(); err != nil {
+		return nil, fmt.Errorf("journal check: %w", err)
+	}
+	if r.LegBreaks, err = appCtx.db.getLegBreaks(); err != nil {
+		return nil, fmt.Errorf("leg check: %w", err)
+	}
+	if r.StalePayments, err = appCtx.db.getStalePayments(r.PendingCutoff); err != nil {
+		return nil, fmt.Errorf("pending check: %w", err)
+	}
+	r.FinishedAt = time.Now().UTC()
+
+	if r.breaks() == 0 {
+		appCtx.logger.Printf("Reconciliation %s found no breaks", r.RunID)
+		return r, nil
+	}
+
+	appCtx.logger.Printf("Reconciliation %s found %d balance, %d journal, %d leg and %d pending breaks",
+		r.RunID, len(r.BalanceBreaks), len(r.JournalBreaks), len(r.LegBreaks), len(r.StalePayments))
+
+	msg, err := cmn.ToBytes(r)
+	if err != nil {
+		return nil, err
+	}
+	err = appCtx.writer.WriteMessages(appCtx.cancelCtx, kafka.Message{
+		Topic: cmn.Topics.ReconciliationBreaks().S(),
+		Key:   []byte(r.RunID),
+		Value: msg,
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to publish report %s: %w", r.RunID, err)
+	}
+	return r, nil
+}
@@ -0,0 +1,182 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	cmn "github.com/timkins666/distributed-playground/backend/pkg/common"
+	tu "github.com/timkins666/distributed-playground/backend/pkg/testutils"
+)
+
+type mockDB struct {
+	balanceBreaks []balanceBreak
+	journalBreaks []journalBreak
+	legBreaks     []legBreak
+	stale         []stalePayment
+	users         map[int32]*cmn.User
+	err           error
+	cutoff        time.Time
+}
+
+func (m *mockDB) getBalanceBreaks() ([]balanceBreak, error) {
+	return m.balanceBreaks, m.err
+}
+
+func (m *mockDB) getJournalBreaks() ([]journalBreak, error) {
+	return m.journalBreaks, m.err
+}
+
+func (m *mockDB) getLegBreaks() ([]legBreak, error) {
+	return m.legBreaks, m.err
+}
+
+func (m *mockDB) getStalePayments(createdBefore time.Time) ([]stalePayment, error) {
+	m.cutoff = createdBefore
+	return m.stale, m.err
+}
+
+func (m *mockDB) getUser(id int32) (*cmn.User, error) {
+	if user, ok := m.users[id]; ok {
+		return user, nil
+	}
+	return nil, cmn.ErrUserNotFound
+}
+
+func testCtx(db *mockDB) (*reconcilerCtx, *tu.MockKafkaWriter) {
+	writer := &tu.MockKafkaWriter{}
+	return &reconcilerCtx{
+		cancelCtx:  context.Background(),
+		db:         db,
+		logger:     cmn.AppLogger(),
+		writer:     writer,
+		interval:   time.Minute,
+		pendingSLA: 10 * time.Minute,
+	}, writer
+}
+
+func TestReconcileNoBreaks(t *testing.T) {
+	db := &mockDB{}
+	appCtx, writer := testCtx(db)
+
+	r, err := reconcile(appCtx)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if r.breaks() != 0 {
+		t.Errorf("expected no breaks, got %+v", r)
+	}
+	if len(writer.Messages) != 0 {
+		t.Errorf("expected nothing published, got %d messages", len(writer.Messages))
+	}
+	if !db.cutoff.Equal(r.PendingCutoff) || r.StartedAt.Sub(r.PendingCutoff) != 10*time.Minute {
+		t.Errorf("expected pending cutoff 10m before start, got %s and %s", r.StartedAt, db.cutoff)
+	}
+}
+
+func TestReconcilePublishesBreaks(t *testing.T) {
+	db := &mockDB{
+		balanceBreaks: []balanceBreak{{AccountID: 1, Balance: 100, TransactionTotal: 90}},
+		journalBreaks: []journalBreak{{AccountID: 1, Balance: 100, BalanceAfter: 90}},
+		legBreaks:     []legBreak{{PaymentSysID: "p1", Debits: 1, Credits: 0}},
+		stale:         []stalePayment{{PaymentSysID: "p2", CreatedAt: time.Now().Add(-time.Hour)}},
+	}
+	appCtx, writer := testCtx(db)
+
+	r, err := reconcile(appCtx)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if r.breaks() != 4 {
+		t.Errorf("expected 4 breaks, got %d", r.breaks())
+	}
+
+	if len(writer.Messages) != 1 {
+		t.Fatalf("expected 1 message, got %d", len(writer.Messages))
+	}
+	msg := writer.Messages[0]
+	if msg.Topic != cmn.Topics.ReconciliationBreaks().S() {
+		t.Errorf("expected topic %s, got %s", cmn.Topics.ReconciliationBreaks(), msg.Topic)
+	}
+	published, err := cmn.FromBytes[report](msg.Value)
+	if err != nil {
+		t.Fatalf("failed to parse report: %v", err)
+	}
+	if published.RunID != r.RunID || published.breaks() != 4 || published.JournalBreaks[0].BalanceAfter != 90 {
+		t.Errorf("unexpected published report %+v", published)
+	}
+}
+
+func TestReconcileErrors(t *testing.T) {
+	t.Run("db", func(t *testing.T) {
+		appCtx, writer := testCtx(&mockDB{err: errors.New("db down")})
+		if _, err := reconcile(appCtx); err == nil {
+			t.Error("expected error")
+		}
+		if len(writer.Messages) != 0 {
+			t.Error("expected nothing published")
+		}
+	})
+
+	t.Run("publish", func(t *testing.T) {
+		appCtx, writer := testCtx(&mockDB{legBreaks: []legBreak{{PaymentSysID: "p1"}}})
+		writer.WriteErr = errors.New("kafka down")
+		if _, err := reconcile(appCtx); err == nil {
+			t.Error("expected error")
+		}
+	})
+}
+
+func TestHandleReconcile(t *testing.T) {
+	users := map[int32]*cmn.User{
+		1: {ID: 1, Username: "admin", Roles: []string{cmn.RoleAdmin}},
+		2: {ID: 2, Username: "tim", Roles: []string{cmn.RoleCustomer}},
+	}
+
+	tests := []struct {
+		name           string
+		db             *mockDB
+		userID         int32
+		expectedStatus int
+	}{
+		{"clean", &mockDB{users: users}, 1, http.StatusOK},
+		{"breaks", &mockDB{users: users, stale: []stalePayment{{PaymentSysID: "p1"}}}, 1, http.StatusOK},
+		{"error", &mockDB{users: users, err: errors.New("db down")}, 1, http.StatusInternalServerError},
+		{"no user", &mockDB{users: users}, 0, http.StatusUnauthorized},
+		{"unknown user", &mockDB{users: users}, 3, http.StatusUnauthorized},
+		{"not an admin", &mockDB{users: users}, 2, http.StatusForbidden},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			appCtx, writer := testCtx(tt.db)
+			req := httptest.NewRequest("POST", "/reconcile", nil)
+			ctx := context.WithValue(req.Context(), cmn.AppCtx, appCtx)
+			if tt.userID != 0 {
+				ctx = context.WithValue(ctx, cmn.UserIDKey, tt.userID)
+			}
+			req = req.WithContext(ctx)
+
+			w := httptest.NewRecorder()
+			handleReconcile(w, req)
+
+			if w.Code != tt.expectedStatus {
+				t.Errorf("expected status %d, got %d", tt.expectedStatus, w.Code)
+			}
+			if tt.expectedStatus == http.StatusOK {
+				r, err := cmn.FromBytes[report](w.Body.Bytes())
+				if err != nil || r.RunID == "" {
+					t.Errorf("expected report in response, got %s", w.Body.String())
+				}
+			}
+			if tt.expectedStatus == http.StatusUnauthorized || tt.expectedStatus == http.StatusForbidden {
+				if len(writer.Messages) != 0 {
+					t.Errorf("expected no reconciliation, got %d messages", len(writer.Messages))
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,88 @@
+// reconciler checks the accounts, transactions and payments schemas agree with each other,
+// on a schedule and on demand, and publishes any breaks to reconciliation-breaks.
+package main
+
+import (
+	"encoding/json"
+	"log"
+	"net/http"
+	"os"
+	"time"
+
+	cmn "github.com/timkins666/distributed-playground/backend/pkg/common"
+)
+
+func main() {
+	cancelCtx, stop := cmn.GetCancelContext()
+	defer stop()
+
+	appCtx := newAppCtx(cancelCtx)
+	defer appCtx.close()
+
+	go runScheduled(appCtx)
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("POST /reconcile", cmn.SetUserIDMiddleware(appCtx.revocations)(handleReconcile))
+
+	port := ":" + os.Getenv("SERVE_PORT")
+	log.Printf("Reconciler running on %s, every %s", port, appCtx.interval)
+	log.Fatal(http.ListenAndServe(port,
+		cmn.SetContextValuesMiddleware(
+			map[cmn.ContextKey]any{cmn.AppCtx: appCtx})(mux)))
+}
+
+// runScheduled reconciles every interval until cancelled
+func runScheduled(appCtx *reconcilerCtx) {
+	ticker := time.NewTicker(appCtx.interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-appCtx.cancelCtx.Done():
+			return
+		case <-ticker.C:
+			if _, err := reconcile(appCtx); err != nil {
+				appCtx.logger.Printf("scheduled reconciliation failed: %s", err)
+			}
+		}
+	}
+}
+
+// runs a reconciliation now and responds with the report, admins only
+func handleReconcile(w http.ResponseWriter, r *http.Request) {
+	appCtx, ok := r.Context().Value(cmn.AppCtx).(*reconcilerCtx)
+	if !ok {
+		log.Println("invalid appCtx")
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	userID, ok := r.Context().Value(cmn.UserIDKey).(int32)
+	if !ok || userID == 0 {
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+	user, err := appCtx.db.getUser(userID)
+	if err != nil {
+		appCtx.logger.Printf("Failed to load user %d: %v", userID, err)
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+	if !user.HasRole(cmn.RoleAdmin) {
+		appCtx.logger.Printf("User %d is not an admin, can't run a reconciliation", userID)
+		http.Error(w, "Forbidden", http.StatusForbidden)
+		return
+	}
+
+	report, err := reconcile(appCtx)
+	if err != nil {
+		appCtx.logger.Printf("on demand reconciliation failed: %s", err)
+		http.Error(w, "reconciliation failed", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(report); err != nil {
+		appCtx.logger.Printf("Failed to encode response: %v", err)
+	}
+}
@@ -0,0 +1,90 @@
+package main
+
+import (
+	"context"
+	"log"
+	"time"
+
+	cmn "github.com/timkins666/distributed-playground/backend/pkg/common"
+)
+
+// txBatcher groups transactions handled at the same time into one database transaction, to
+// save a commit per message. a batch is flushed once it has size transactions or linger has
+// passed since the first. callers wait for their own result, so each consumer lane still
+// handles its messages one after another.
+type txBatcher struct {
+	db       transactionDB
+	logger   *log.Logger
+	size     int
+	linger   time.Duration
+	requests chan batchRequest
+}
+
+type batchRequest struct {
+	tx     *cmn.Transaction
+	result chan txResult
+}
+
+func newTxBatcher(db transactionDB, size int, linger time.Duration, logger *log.Logger) *txBatcher {
+	return &txBatcher{
+		db:       db,
+		logger:   logger,
+		size:     size,
+		linger:   linger,
+		requests: make(chan batchRequest),
+	}
+}
+
+// commit queues the transaction for the next batch and waits for its result
+func (b *txBatcher) commit(ctx context.Context, tx *cmn.Transaction) (*txOutcome, error) {
+	req := batchRequest{tx: tx, result: make(chan txResult, 1)}
+	select {
+	case b.requests <- req:
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+
+	// a batch in progress always finishes, so there's no need to give up waiting
+	res := <-req.result
+	return res.Outcome, res.Err
+}
+
+// run collects and commits batches until ctx is done
+func (b *txBatcher) run(ctx context.Context) {
+	b.logger.Printf("Batching transactions, up to %d or %s", b.size, b.linger)
+	for {
+		var first batchRequest
+		select {
+		case <-ctx.Done():
+			return
+		case first = <-b.requests:
+		}
+
+		batch := []batchRequest{first}
+		linger := time.NewTimer(b.linger)
+	collect:
+		for len(batch) < b.size {
+			select {
+			case req := <-b.requests:
+				batch = append(batch, req)
+			case <-linger.C:
+				break collect
+			}
+		}
+		linger.Stop()
+
+		b.flush(batch)
+	}
+}
+
+func (b *txBatcher) flush(batch []batchRequest) {
+	txs := make([]*cmn.Transaction, len(batch))
+	for i, req := range batch {
+		txs[i] = req.tx
+	}
+
+	results := b.db.commitTransactions(txs)
+	for i, req := range batch {
+		req.result <- results[i]
+	}
+}
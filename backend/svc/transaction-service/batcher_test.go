@@ -0,0 +1,95 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"testing"
+	"time"
+
+	cmn "github.com/timkins666/distributed-playground/backend/pkg/common"
+	tu "github.com/timkins666/distributed-playground/backend/pkg/testutils"
+)
+
+func TestTxBatcherFlushesOnSize(t *testing.T) {
+	db := &mockTransactionDB{missingAccounts: map[int32]bool{3: true}}
+	// a long linger so only a full batch is flushed
+	batcher := newTxBatcher(db, 3, time.Hour, cmn.AppLogger())
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go batcher.run(ctx)
+
+	var (
+		wg   sync.WaitGroup
+		errs = make([]error, 3)
+	)
+	for i := range 3 {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			tx := &cmn.Transaction{TxID: string(rune('a' + i)), AccountID: int32(i + 1), Amount: 10}
+			_, errs[i] = batcher.commit(ctx, tx)
+		}()
+	}
+	wg.Wait()
+
+	if len(db.batches) != 1 || db.batches[0] != 3 {
+		t.Errorf("expected a single batch of 3, got %v", db.batches)
+	}
+	// the failed item doesn't affect the others
+	if errs[0] != nil || errs[1] != nil || !errors.Is(errs[2], errAccountNotExist) {
+		t.Errorf("expected only account 3 to fail, got %v", errs)
+	}
+}
+
+func TestTxBatcherFlushesOnLinger(t *testing.T) {
+	db := &mockTransactionDB{}
+	batcher := newTxBatcher(db, 100, time.Millisecond, cmn.AppLogger())
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go batcher.run(ctx)
+
+	outcome, err := batcher.commit(ctx, &cmn.Transaction{TxID: "a", AccountID: 1, Amount: 10})
+	if err != nil || outcome.TxID != "a" {
+		t.Fatalf("expected outcome for a, got %+v %v", outcome, err)
+	}
+	if len(db.batches) != 1 || db.batches[0] != 1 {
+		t.Errorf("expected a batch of 1 after lingering, got %v", db.batches)
+	}
+}
+
+func TestTxBatcherCommitCancelled(t *testing.T) {
+	// nothing running to take the request
+	batcher := newTxBatcher(&mockTransactionDB{}, 10, time.Millisecond, cmn.AppLogger())
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if _, err := batcher.commit(ctx, &cmn.Transaction{}); !errors.Is(err, context.Canceled) {
+		t.Errorf("expected context cancelled, got %v", err)
+	}
+}
+
+func TestApplyTransactionBatched(t *testing.T) {
+	db := &mockTransactionDB{accounts: map[int32]*cmn.Account{1: {AccountID: 1, Balance: 100}}}
+	appCtx := &transactionCtx{
+		cancelCtx: context.Background(),
+		db:        db,
+		logger:    cmn.AppLogger(),
+		writer:    &tu.MockKafkaWriter{},
+		batcher:   newTxBatcher(db, 10, time.Millisecond, cmn.AppLogger()),
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go appCtx.batcher.run(ctx)
+
+	outcome, err := applyTransaction(&cmn.Transaction{PaymentSysID: "p1", AccountID: 1, Amount: -40}, "t:0:1", appCtx)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if outcome.Balance != 60 || len(db.batches) != 1 {
+		t.Errorf("expected balance 60 committed in a batch, got %+v and batches %v", outcome, db.batches)
+	}
+}
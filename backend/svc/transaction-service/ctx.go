@@ -3,39 +3,51 @@ package main
 import (
 	"context"
 	"log"
+	"time"
 
-	"github.com/redis/go-redis/v9"
 	"github.com/segmentio/kafka-go"
 	cmn "github.com/timkins666/distributed-playground/backend/pkg/common"
 )
 
+const (
+	defaultConcurrency = 8
+	defaultBatchLinger = 5 * time.Millisecond
+)
+
 type transactionCtx struct {
-	cancelCtx   context.Context
-	db          transactionDB
-	logger      *log.Logger
-	writer      cmn.KafkaWriter
-	txReqReader cmn.KafkaReader
-	redisClient *redis.Client
+	cancelCtx context.Context
+	db        transactionDB
+	logger    *log.Logger
+	writer    cmn.KafkaWriter
+	// transfers coordinated as sagas over their legs
+	transferReader cmn.KafkaReader
+	// one per retry tier of transfer-requested
+	retryReaders []cmn.KafkaReader
+	retryPolicy  cmn.RetryPolicy
+	// messages handled at once per reader, ordered per account
+	concurrency int
+	// nil unless transactions are committed in batches
+	batcher *txBatcher
 }
 
 // close releases all resources
 func (a *transactionCtx) close() error {
 	var errs []error
 
-	if a.txReqReader != nil {
-		if err := a.txReqReader.Close(); err != nil {
+	if a.transferReader != nil {
+		if err := a.transferReader.Close(); err != nil {
 			errs = append(errs, err)
 		}
 	}
 
-	if a.writer != nil {
-		if err := a.writer.Close(); err != nil {
+	for _, r := range a.retryReaders {
+		if err := r.Close(); err != nil {
 			errs = append(errs, err)
 		}
 	}
 
-	if a.redisClient != nil {
-		if err := a.redisClient.Close(); err != nil {
+	if a.writer != nil {
+		if err := a.writer.Close(); err != nil {
 			errs = append(errs, err)
 		}
 	}
@@ -49,12 +61,14 @@ func (a *transactionCtx) close() error {
 func newAppCtx(cancelCtx context.Context) transactionCtx {
 	logger := cmn.AppLogger()
 
-	txReqReader := kafka.NewReader(kafka.ReaderConfig{
+	transferReader := kafka.NewReader(kafka.ReaderConfig{
 		Brokers: []string{cmn.KafkaBroker()},
-		GroupID: "process-transaction",
-		Topic:   cmn.Topics.TransactionRequested().S(),
+		GroupID: "transfer-saga",
+		Topic:   cmn.Topics.TransferRequested().S(),
 	})
 
+	retryPolicy := cmn.DefaultRetryPolicy
+
 	writer := &kafka.Writer{
 		Addr:         kafka.TCP(cmn.KafkaBroker()),
 		RequiredAcks: 1,
@@ -65,18 +79,21 @@ func newAppCtx(cancelCtx context.Context) transactionCtx {
 		logger.Fatal(err)
 	}
 
-	redisClient, err := cmn.NewRedisClient()
-	if err != nil {
-		logger.Println("Failed to start redis client, continuing without :(")
-		redisClient = nil // make sure it is
+	// off unless a batch size above 1 is set
+	var batcher *txBatcher
+	if size := cmn.IntFromEnv("TX_BATCH_SIZE", 0, 0, logger); size > 1 {
+		batcher = newTxBatcher(db, size, cmn.DurationFromEnv("TX_BATCH_LINGER", defaultBatchLinger, logger), logger)
 	}
 
 	return transactionCtx{
-		cancelCtx:   cancelCtx,
-		db:          db,
-		writer:      writer,
-		txReqReader: txReqReader,
-		redisClient: redisClient,
-		logger:      logger,
+		cancelCtx:      cancelCtx,
+		db:             db,
+		writer:         writer,
+		transferReader: transferReader,
+		retryReaders:   retryPolicy.Readers(cmn.KafkaBroker(), "transfer-saga", cmn.Topics.TransferRequested()),
+		retryPolicy:    retryPolicy,
+		concurrency:    cmn.IntFromEnv("TX_CONCURRENCY", defaultConcurrency, 1, logger),
+		batcher:        batcher,
+		logger:         logger,
 	}
 }
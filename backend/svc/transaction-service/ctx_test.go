@@ -3,7 +3,9 @@ package main
 import (
 	"context"
 	"testing"
+	"time"
 
+	cmn "github.com/timkins666/distributed-playground/backend/pkg/common"
 	tu "github.com/timkins666/distributed-playground/backend/pkg/testutils"
 )
 
@@ -24,20 +26,43 @@ func TestNewAppCtx(t *testing.T) {
 	if ctx.writer == nil {
 		t.Error("writer should not be nil")
 	}
-	if ctx.txReqReader == nil {
-		t.Error("txReqReader should not be nil")
+	if ctx.transferReader == nil {
+		t.Error("transferReader should not be nil")
+	}
+	if len(ctx.retryReaders) != len(cmn.DefaultRetryPolicy) {
+		t.Errorf("expected a reader per retry tier, got %d", len(ctx.retryReaders))
+	}
+	if ctx.concurrency != defaultConcurrency {
+		t.Errorf("expected default concurrency, got %d", ctx.concurrency)
+	}
+}
+
+func TestNewAppCtxBatching(t *testing.T) {
+	t.Setenv("KAFKA_BROKER", "foo")
+	t.Setenv("DB_TYPE", "_TEST_")
+
+	if ctx := newAppCtx(context.Background()); ctx.batcher != nil {
+		t.Error("expected batching off by default")
+	}
+
+	t.Setenv("TX_BATCH_SIZE", "50")
+	t.Setenv("TX_BATCH_LINGER", "2ms")
+	ctx := newAppCtx(context.Background())
+	if ctx.batcher == nil || ctx.batcher.size != 50 || ctx.batcher.linger != 2*time.Millisecond {
+		t.Errorf("expected batches of 50 lingering 2ms, got %+v", ctx.batcher)
 	}
 }
 
 func TestTransactionCtxClose(t *testing.T) {
-	mockReader := &tu.MockKafkaReader{}
+	mockTransferReader := &tu.MockKafkaReader{}
+	mockRetryReader := &tu.MockKafkaReader{}
 	mockWriter := &tu.MockKafkaWriter{}
 
 	ctx := &transactionCtx{
-		cancelCtx:   context.Background(),
-		txReqReader: mockReader,
-		writer:      mockWriter,
-		redisClient: nil,
+		cancelCtx:      context.Background(),
+		transferReader: mockTransferReader,
+		retryReaders:   []cmn.KafkaReader{mockRetryReader},
+		writer:         mockWriter,
 	}
 
 	err := ctx.close()
@@ -45,8 +70,11 @@ func TestTransactionCtxClose(t *testing.T) {
 		t.Errorf("unexpected error: %v", err)
 	}
 
-	if !mockReader.Closed {
-		t.Error("reader should be closed")
+	if !mockTransferReader.Closed {
+		t.Error("transfer reader should be closed")
+	}
+	if !mockRetryReader.Closed {
+		t.Error("retry reader should be closed")
 	}
 	if !mockWriter.Closed {
 		t.Error("writer should be closed")
@@ -8,8 +8,31 @@ import (
 )
 
 type transactionDB interface {
-	commitTransaction(transaction *cmn.Transaction) error
-	getAccountByID(int32) (*cmn.Account, error)
+	commitTransaction(transaction *cmn.Transaction) (*txOutcome, error)
+	// applies each transaction in one database transaction, see txBatcher
+	commitTransactions(transactions []*cmn.Transaction) []txResult
+	// records a new saga for the transfer, or returns the existing one
+	startSaga(transfer *cmn.Transfer, kafkaID string) (*transferSaga, error)
+	// moves the saga on from the expected state, errSagaMoved if it's no longer in it
+	updateSaga(paymentSysID string, from, to sagaState, reason string) error
+	getUnfinishedSagas() ([]*transferSaga, error)
+}
+
+// the recorded result of applying a transaction
+type txOutcome struct {
+	TxID string
+	// message the transaction was applied from
+	KafkaID string
+	// account balance immediately after the transaction was applied
+	Balance int64
+	// the transaction was applied by an earlier delivery, nothing was changed this time
+	Duplicate bool
+}
+
+// the outcome of one transaction in a batch, or why it wasn't applied
+type txResult struct {
+	Outcome *txOutcome
+	Err     error
 }
 
 func initDB() (transactionDB, error) {
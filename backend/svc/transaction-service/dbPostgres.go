@@ -1,8 +1,12 @@
 package main
 
 import (
+	"cmp"
 	"database/sql"
+	"errors"
+	"fmt"
 	"log"
+	"slices"
 
 	cmn "github.com/timkins666/distributed-playground/backend/pkg/common"
 )
@@ -11,68 +15,286 @@ type dbPostgres struct {
 	db *sql.DB
 }
 
-func (db *dbPostgres) commitTransaction(transaction *cmn.Transaction) error {
+// applies the transaction to its account and posts it to the ledger. transactions are identified
+// by payment, account and leg, so applying one again is a no-op which returns the original outcome.
+func (db *dbPostgres) commitTransaction(transaction *cmn.Transaction) (*txOutcome, error) {
 	tx, err := db.db.Begin()
 	if err != nil {
-		return err
+		return nil, err
 	}
 	defer tx.Rollback()
 
-	// TODO: redis
-	var exists bool
-	err = tx.QueryRow(`
-        SELECT EXISTS (
-            SELECT 1 FROM transactions.transaction WHERE id = $1
-        )`, transaction.TxID).Scan(&exists)
+	outcome, err := applyInTx(tx, transaction)
+	if err == errAlreadyApplied {
+		tx.Rollback()
+		return getOutcome(db.db, transaction)
+	}
 	if err != nil {
-		return err
+		return nil, err
 	}
-	if exists {
-		log.Println("Transaction already processed:", transaction.TxID)
-		return errTxProcessed
+
+	if err := tx.Commit(); err != nil {
+		return nil, err
 	}
+	return outcome, nil
+}
 
-	var balance int64
-	// FOR UPDATE = pessimistic lock
-	err = tx.QueryRow(`
-        SELECT balance FROM accounts.account WHERE id = $1 FOR UPDATE
-    `, transaction.AccountID).Scan(&balance)
+// commitTransactions applies a batch of transactions in one database transaction, each checked
+// individually. an item that fails is rolled back to its savepoint without affecting the rest,
+// and its error returned in its result. results are in the same order as transactions.
+func (db *dbPostgres) commitTransactions(transactions []*cmn.Transaction) []txResult {
+	results := make([]txResult, len(transactions))
+	failAll := func(err error) []txResult {
+		for i := range results {
+			results[i] = txResult{Err: err}
+		}
+		return results
+	}
+
+	tx, err := db.db.Begin()
 	if err != nil {
-		log.Printf("account not found for transaction %+v\n%s", transaction, err)
-		return errAccountNotExist
+		return failAll(err)
+	}
+	defer tx.Rollback()
+
+	// accounts are locked in id order, so concurrent batches can't deadlock. the sort is
+	// stable so each account's transactions keep their order.
+	order := make([]int, len(transactions))
+	for i := range order {
+		order[i] = i
+	}
+	slices.SortStableFunc(order, func(a, b int) int {
+		return cmp.Compare(transactions[a].AccountID, transactions[b].AccountID)
+	})
+
+	for _, i := range order {
+		transaction := transactions[i]
+		if _, err := tx.Exec(`SAVEPOINT batch_item`); err != nil {
+			return failAll(err)
+		}
+
+		outcome, err := applyInTx(tx, transaction)
+		if err != nil {
+			// an error aborts the whole transaction in postgres unless rolled back to here
+			if _, rbErr := tx.Exec(`ROLLBACK TO SAVEPOINT batch_item`); rbErr != nil {
+				return failAll(rbErr)
+			}
+			if err == errAlreadyApplied {
+				outcome, err = getOutcome(tx, transaction)
+			}
+			results[i] = txResult{Outcome: outcome, Err: err}
+			continue
+		}
+
+		if _, err := tx.Exec(`RELEASE SAVEPOINT batch_item`); err != nil {
+			return failAll(err)
+		}
+		results[i] = txResult{Outcome: outcome}
+	}
+
+	if err := tx.Commit(); err != nil {
+		return failAll(err)
+	}
+	return results
+}
+
+// the transaction was applied before, nothing was changed
+var errAlreadyApplied = errors.New("transaction already applied")
+
+// applies the transaction within tx, returning errAlreadyApplied if it's a duplicate
+func applyInTx(tx *sql.Tx, transaction *cmn.Transaction) (*txOutcome, error) {
+	var (
+		balance, overdraftLimit int64
+		system                  bool
+	)
+	// FOR UPDATE = pessimistic lock, also serialises redeliveries of the same transaction
+	err := tx.QueryRow(`
+        SELECT balance, overdraft_limit, system FROM accounts.account WHERE id = $1 FOR UPDATE
+    `, transaction.AccountID).Scan(&balance, &overdraftLimit, &system)
+	if errors.Is(err, sql.ErrNoRows) {
+		log.Printf("account not found for transaction %+v", transaction)
+		return nil, errAccountNotExist
+	}
+	if err != nil {
+		// anything else is transient, so the leg is retried rather than rejected
+		return nil, fmt.Errorf("failed to lock account %d: %w", transaction.AccountID, err)
 	}
 
 	newBalance := balance + transaction.Amount
+
+	res, err := tx.Exec(`
+        INSERT INTO transactions.transaction (id, payment_sys_id, account_id, leg, kafka_id, amount, balance_after)
+        VALUES ($1, $2, $3, $4, $5, $6, $7)
+        ON CONFLICT DO NOTHING
+    `, transaction.TxID, transaction.PaymentSysID, transaction.AccountID, string(transaction.Leg()),
+		transaction.KafkaID, transaction.Amount, newBalance)
+	if err != nil {
+		log.Println("err insert into")
+		return nil, err
+	}
+	if n, err := res.RowsAffected(); err != nil {
+		return nil, err
+	} else if n == 0 {
+		log.Println("Transaction already processed:", transaction.TxID)
+		return nil, errAlreadyApplied
+	}
+
+	// the cached balance is only trusted while it agrees with the ledger. each line carries the
+	// account's running total, so only the latest is read rather than summing the whole history.
+	// the account lock means no line can be posted for it in the meantime.
+	var ledgerBalance int64
+	err = tx.QueryRow(`
+		SELECT balance_after FROM transactions.journal_line
+		WHERE account_id = $1 ORDER BY id DESC LIMIT 1
+	`, transaction.AccountID).Scan(&ledgerBalance)
+	if err != nil && err != sql.ErrNoRows {
+		return nil, err
+	}
+	if ledgerBalance != balance {
+		log.Printf("account %d balance %d doesn't match ledger %d", transaction.AccountID, balance, ledgerBalance)
+		return nil, errLedgerMismatch
+	}
+
+	// checked after the insert so a redelivered debit returns its outcome rather than failing
+	if transaction.Amount < 0 && !system && newBalance < -overdraftLimit {
+		log.Printf("debit %s would take account %d to %d, limit is -%d",
+			transaction.TxID, transaction.AccountID, newBalance, overdraftLimit)
+		return nil, errInsufficientFunds
+	}
+
 	_, err = tx.Exec(`
         UPDATE accounts.account SET balance = $1 WHERE id = $2
 		`, newBalance, transaction.AccountID)
 	if err != nil {
 		log.Println("err update")
-		return err
+		return nil, err
 	}
 
-	_, err = tx.Exec(`
-        INSERT INTO transactions.transaction (id, account_id, kafka_id, amount) VALUES ($1, $2, $3, $4)
-    `, transaction.TxID, transaction.AccountID, transaction.KafkaID, transaction.Amount)
+	if err := postToLedger(tx, transaction, newBalance); err != nil {
+		log.Println("err post to ledger")
+		return nil, err
+	}
+
+	// the funds held for the payment at validation are now spent
+	if transaction.Amount < 0 {
+		_, err = tx.Exec(`
+			UPDATE accounts.hold SET status = 'CONSUMED', updated_at = now()
+			WHERE payment_sys_id = $1 AND account_id = $2 AND status = 'ACTIVE'
+		`, transaction.PaymentSysID, transaction.AccountID)
+		if err != nil {
+			log.Println("err consume hold")
+			return nil, err
+		}
+	}
+
+	return &txOutcome{TxID: transaction.TxID, KafkaID: transaction.KafkaID, Balance: newBalance}, nil
+}
+
+// adds the transaction to its payment's journal entry, balanced against the in-flight account.
+// a debit moves funds into flight, a credit or compensation takes them out. the account's line
+// records its balance after the transaction, the in-flight account's running total isn't kept.
+func postToLedger(tx *sql.Tx, transaction *cmn.Transaction, balanceAfter int64) error {
+	_, err := tx.Exec(`
+		INSERT INTO transactions.journal_entry (payment_sys_id) VALUES ($1)
+		ON CONFLICT DO NOTHING
+	`, transaction.PaymentSysID)
 	if err != nil {
-		log.Println("err insert into")
 		return err
 	}
 
-	return tx.Commit()
+	_, err = tx.Exec(`
+		INSERT INTO transactions.journal_line (payment_sys_id, tx_id, account_id, amount, balance_after)
+		VALUES ($1, $2, $3, $4, $5), ($1, $2, $6, $7, NULL)
+	`, transaction.PaymentSysID, transaction.TxID,
+		transaction.AccountID, transaction.Amount, balanceAfter,
+		cmn.SystemAccountInFlight, -transaction.Amount)
+	return err
 }
 
-// get single account matching id. always uses db for source of truth.
-func (db *dbPostgres) getAccountByID(accountID int32) (*cmn.Account, error) {
-	// TODO: squirrel / sqlx
+// a *sql.DB or *sql.Tx
+type queryRower interface {
+	QueryRow(query string, args ...any) *sql.Row
+}
 
-	acc := cmn.Account{}
+// the outcome of a transaction which has already been applied
+func getOutcome(q queryRower, transaction *cmn.Transaction) (*txOutcome, error) {
+	outcome := txOutcome{Duplicate: true}
+	err := q.QueryRow(`
+		SELECT id, kafka_id, balance_after FROM transactions.transaction
+		WHERE payment_sys_id = $1 AND account_id = $2 AND leg = $3
+	`, transaction.PaymentSysID, transaction.AccountID, string(transaction.Leg())).Scan(&outcome.TxID, &outcome.KafkaID, &outcome.Balance)
+	if err == sql.ErrNoRows {
+		// the conflict was on the TxID alone
+		return nil, errTxConflict
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &outcome, nil
+}
 
-	err := db.db.QueryRow(`
-		SELECT id, user_id, balance from accounts.account WHERE id = $1
-	`, accountID).Scan(&acc.AccountID, &acc.UserID, &acc.Balance)
+func (db *dbPostgres) startSaga(transfer *cmn.Transfer, kafkaID string) (*transferSaga, error) {
+	_, err := db.db.Exec(`
+		INSERT INTO transactions.saga (payment_sys_id, source_account_id, target_account_id, amount, kafka_id)
+		VALUES ($1, $2, $3, $4, $5)
+		ON CONFLICT (payment_sys_id) DO NOTHING
+	`, transfer.PaymentSysID, transfer.SourceAccountID, transfer.TargetAccountID, transfer.Amount, kafkaID)
 	if err != nil {
 		return nil, err
 	}
-	return &acc, nil
+
+	saga := transferSaga{}
+	err = db.db.QueryRow(`
+		SELECT `+sagaColumns+` FROM transactions.saga WHERE payment_sys_id = $1
+	`, transfer.PaymentSysID).Scan(sagaFields(&saga)...)
+	if err != nil {
+		return nil, err
+	}
+	return &saga, nil
+}
+
+func (db *dbPostgres) updateSaga(paymentSysID string, from, to sagaState, reason string) error {
+	res, err := db.db.Exec(`
+		UPDATE transactions.saga SET state = $3, failure_reason = NULLIF($4, ''), updated_at = now()
+		WHERE payment_sys_id = $1 AND state = $2
+	`, paymentSysID, string(from), string(to), reason)
+	if err != nil {
+		return err
+	}
+	updated, err := res.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if updated == 0 {
+		return fmt.Errorf("%w: transfer %s is no longer %s", errSagaMoved, paymentSysID, from)
+	}
+	return nil
+}
+
+func (db *dbPostgres) getUnfinishedSagas() ([]*transferSaga, error) {
+	rows, err := db.db.Query(`
+		SELECT `+sagaColumns+` FROM transactions.saga
+		WHERE state NOT IN ($1, $2, $3)
+		ORDER BY created_at
+	`, string(sagaCompleted), string(sagaCompensated), string(sagaFailed))
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var sagas []*transferSaga
+	for rows.Next() {
+		saga := transferSaga{}
+		if err := rows.Scan(sagaFields(&saga)...); err != nil {
+			return nil, err
+		}
+		sagas = append(sagas, &saga)
+	}
+	return sagas, rows.Err()
+}
+
+const sagaColumns = `payment_sys_id, source_account_id, target_account_id, amount, kafka_id, state, COALESCE(failure_reason, '')`
+
+func sagaFields(s *transferSaga) []any {
+	return []any{&s.PaymentSysID, &s.SourceAccountID, &s.TargetAccountID, &s.Amount, &s.KafkaID, &s.State, &s.FailureReason}
 }
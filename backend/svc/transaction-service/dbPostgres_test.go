@@ -1,12 +1,58 @@
 package main
 
 import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"os"
 	"testing"
+	"time"
 
 	"github.com/DATA-DOG/go-sqlmock"
+	"github.com/google/uuid"
 	cmn "github.com/timkins666/distributed-playground/backend/pkg/common"
 )
 
+func accountRow(balance, overdraftLimit int64, system bool) *sqlmock.Rows {
+	return sqlmock.NewRows([]string{"balance", "overdraft_limit", "system"}).AddRow(balance, overdraftLimit, system)
+}
+
+// the running total on the account's latest journal line
+func expectLedgerBalance(mock sqlmock.Sqlmock, accountID int32, balance int64) {
+	mock.ExpectQuery("SELECT balance_after FROM transactions.journal_line (.+) ORDER BY id DESC LIMIT 1").
+		WithArgs(accountID).
+		WillReturnRows(sqlmock.NewRows([]string{"balance_after"}).AddRow(balance))
+}
+
+// the transaction's line and the opposite line for the in-flight account
+func expectPostToLedger(mock sqlmock.Sqlmock, tx *cmn.Transaction, balanceAfter int64) {
+	mock.ExpectExec("INSERT INTO transactions.journal_entry").
+		WithArgs(tx.PaymentSysID).
+		WillReturnResult(sqlmock.NewResult(0, 1))
+	mock.ExpectExec("INSERT INTO transactions.journal_line").
+		WithArgs(tx.PaymentSysID, tx.TxID, tx.AccountID, tx.Amount, balanceAfter, cmn.SystemAccountInFlight, -tx.Amount).
+		WillReturnResult(sqlmock.NewResult(0, 2))
+}
+
+// a credit applied to an account whose balance agrees with the ledger
+func expectApplyCredit(mock sqlmock.Sqlmock, tx *cmn.Transaction, balance int64) {
+	mock.ExpectQuery("SELECT balance, overdraft_limit, system FROM accounts.account").
+		WithArgs(tx.AccountID).
+		WillReturnRows(accountRow(balance, 0, false))
+	mock.ExpectExec("INSERT INTO transactions.transaction").
+		WithArgs(tx.TxID, tx.PaymentSysID, tx.AccountID, "CREDIT", tx.KafkaID, tx.Amount, balance+tx.Amount).
+		WillReturnResult(sqlmock.NewResult(1, 1))
+	expectLedgerBalance(mock, tx.AccountID, balance)
+	mock.ExpectExec("UPDATE accounts.account SET balance").
+		WithArgs(balance+tx.Amount, tx.AccountID).
+		WillReturnResult(sqlmock.NewResult(1, 1))
+	mock.ExpectExec("INSERT INTO transactions.journal_entry").
+		WithArgs(tx.PaymentSysID).
+		WillReturnResult(sqlmock.NewResult(0, 1))
+	mock.ExpectExec("INSERT INTO transactions.journal_line").
+		WillReturnResult(sqlmock.NewResult(0, 2))
+}
+
 func TestDBPostgresCommitTransaction(t *testing.T) {
 	db, mock, err := sqlmock.New()
 	if err != nil {
@@ -17,28 +63,75 @@ func TestDBPostgresCommitTransaction(t *testing.T) {
 	dbPg := &dbPostgres{db: db}
 
 	tx := &cmn.Transaction{
-		TxID:      "test-tx-id",
-		AccountID: 123,
-		KafkaID:   "test-kafka-id",
-		Amount:    1000,
+		TxID:         "test-tx-id",
+		PaymentSysID: "pay-id",
+		AccountID:    123,
+		KafkaID:      "test-kafka-id",
+		Amount:       1000,
 	}
 
 	mock.ExpectBegin()
-	mock.ExpectQuery("SELECT EXISTS").
-		WithArgs(tx.TxID).
-		WillReturnRows(sqlmock.NewRows([]string{"exists"}).AddRow(false))
-	mock.ExpectQuery("SELECT balance FROM accounts.account").
+	mock.ExpectQuery("SELECT balance, overdraft_limit, system FROM accounts.account").
 		WithArgs(tx.AccountID).
-		WillReturnRows(sqlmock.NewRows([]string{"balance"}).AddRow(5000))
+		WillReturnRows(accountRow(5000, 0, false))
+	mock.ExpectExec("INSERT INTO transactions.transaction .* ON CONFLICT DO NOTHING").
+		WithArgs(tx.TxID, tx.PaymentSysID, tx.AccountID, "CREDIT", tx.KafkaID, tx.Amount, 6000).
+		WillReturnResult(sqlmock.NewResult(1, 1))
+	expectLedgerBalance(mock, tx.AccountID, 5000)
 	mock.ExpectExec("UPDATE accounts.account SET balance").
 		WithArgs(6000, tx.AccountID).
 		WillReturnResult(sqlmock.NewResult(1, 1))
+	expectPostToLedger(mock, tx, 6000)
+	mock.ExpectCommit()
+
+	outcome, err := dbPg.commitTransaction(tx)
+	if err != nil {
+		t.Errorf("unexpected error: %v", err)
+	}
+	if outcome.Duplicate || outcome.Balance != 6000 || outcome.TxID != tx.TxID {
+		t.Errorf("unexpected outcome %+v", outcome)
+	}
+
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("unmet expectations: %v", err)
+	}
+}
+
+func TestDBPostgresCommitTransactionDebitConsumesHold(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatalf("failed to create mock: %v", err)
+	}
+	defer db.Close()
+
+	dbPg := &dbPostgres{db: db}
+
+	tx := &cmn.Transaction{
+		TxID:         "test-tx-id",
+		PaymentSysID: "pay-id",
+		AccountID:    123,
+		KafkaID:      "test-kafka-id",
+		Amount:       -1000,
+	}
+
+	mock.ExpectBegin()
+	mock.ExpectQuery("SELECT balance, overdraft_limit, system FROM accounts.account").
+		WithArgs(tx.AccountID).
+		WillReturnRows(accountRow(5000, 0, false))
 	mock.ExpectExec("INSERT INTO transactions.transaction").
-		WithArgs(tx.TxID, tx.AccountID, tx.KafkaID, tx.Amount).
+		WithArgs(tx.TxID, tx.PaymentSysID, tx.AccountID, "DEBIT", tx.KafkaID, tx.Amount, 4000).
+		WillReturnResult(sqlmock.NewResult(1, 1))
+	expectLedgerBalance(mock, tx.AccountID, 5000)
+	mock.ExpectExec("UPDATE accounts.account SET balance").
+		WithArgs(4000, tx.AccountID).
 		WillReturnResult(sqlmock.NewResult(1, 1))
+	expectPostToLedger(mock, tx, 4000)
+	mock.ExpectExec("UPDATE accounts.hold SET status = 'CONSUMED'").
+		WithArgs(tx.PaymentSysID, tx.AccountID).
+		WillReturnResult(sqlmock.NewResult(0, 1))
 	mock.ExpectCommit()
 
-	err = dbPg.commitTransaction(tx)
+	_, err = dbPg.commitTransaction(tx)
 	if err != nil {
 		t.Errorf("unexpected error: %v", err)
 	}
@@ -48,6 +141,137 @@ func TestDBPostgresCommitTransaction(t *testing.T) {
 	}
 }
 
+func TestDBPostgresCommitTransactionOverdraft(t *testing.T) {
+	tests := []struct {
+		name    string
+		balance int64
+		limit   int64
+		amount  int64
+		system  bool
+		wantErr error
+	}{
+		{name: "within balance", balance: 500, amount: -500},
+		{name: "within overdraft", balance: 500, limit: 300, amount: -800},
+		{name: "past overdraft", balance: 500, limit: 300, amount: -801, wantErr: errInsufficientFunds},
+		{name: "no overdraft", balance: 500, amount: -501, wantErr: errInsufficientFunds},
+		{name: "credit while overdrawn", balance: -200, amount: 100},
+		{name: "system account", balance: -5000, amount: -100, system: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			db, mock, err := sqlmock.New()
+			if err != nil {
+				t.Fatalf("failed to create mock: %v", err)
+			}
+			defer db.Close()
+
+			dbPg := &dbPostgres{db: db}
+			tx := &cmn.Transaction{TxID: "tx", PaymentSysID: "pay-id", AccountID: 123, Amount: tt.amount}
+
+			mock.ExpectBegin()
+			mock.ExpectQuery("SELECT balance, overdraft_limit, system FROM accounts.account").
+				WithArgs(tx.AccountID).
+				WillReturnRows(accountRow(tt.balance, tt.limit, tt.system))
+			mock.ExpectExec("INSERT INTO transactions.transaction").
+				WillReturnResult(sqlmock.NewResult(1, 1))
+			expectLedgerBalance(mock, tx.AccountID, tt.balance)
+			if tt.wantErr != nil {
+				mock.ExpectRollback()
+			} else {
+				mock.ExpectExec("UPDATE accounts.account SET balance").
+					WithArgs(tt.balance+tt.amount, tx.AccountID).
+					WillReturnResult(sqlmock.NewResult(1, 1))
+				expectPostToLedger(mock, tx, tt.balance+tt.amount)
+				if tt.amount < 0 {
+					mock.ExpectExec("UPDATE accounts.hold").WillReturnResult(sqlmock.NewResult(0, 1))
+				}
+				mock.ExpectCommit()
+			}
+
+			_, err = dbPg.commitTransaction(tx)
+			if err != tt.wantErr {
+				t.Errorf("expected error %v, got %v", tt.wantErr, err)
+			}
+
+			if err := mock.ExpectationsWereMet(); err != nil {
+				t.Errorf("unmet expectations: %v", err)
+			}
+		})
+	}
+}
+
+func TestDBPostgresCommitTransactionLedgerMismatch(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatalf("failed to create mock: %v", err)
+	}
+	defer db.Close()
+
+	dbPg := &dbPostgres{db: db}
+	tx := &cmn.Transaction{TxID: "tx", PaymentSysID: "pay-id", AccountID: 123, Amount: 100}
+
+	mock.ExpectBegin()
+	mock.ExpectQuery("SELECT balance, overdraft_limit, system FROM accounts.account").
+		WithArgs(tx.AccountID).
+		WillReturnRows(accountRow(5000, 0, false))
+	mock.ExpectExec("INSERT INTO transactions.transaction").
+		WillReturnResult(sqlmock.NewResult(1, 1))
+	expectLedgerBalance(mock, tx.AccountID, 4000)
+	mock.ExpectRollback()
+
+	_, err = dbPg.commitTransaction(tx)
+	if err != errLedgerMismatch {
+		t.Errorf("expected errLedgerMismatch, got %v", err)
+	}
+
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("unmet expectations: %v", err)
+	}
+}
+
+func TestDBPostgresCommitTransactionAccountLookup(t *testing.T) {
+	transient := errors.New("connection reset by peer")
+	tests := []struct {
+		name      string
+		err       error
+		wantErr   error
+		notExists bool
+	}{
+		{name: "missing account", err: sql.ErrNoRows, wantErr: errAccountNotExist, notExists: true},
+		{name: "transient error", err: transient, wantErr: transient},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			db, mock, err := sqlmock.New()
+			if err != nil {
+				t.Fatalf("failed to create mock: %v", err)
+			}
+			defer db.Close()
+
+			dbPg := &dbPostgres{db: db}
+			tx := &cmn.Transaction{TxID: "tx", PaymentSysID: "pay-id", AccountID: 123, Amount: 100}
+
+			mock.ExpectBegin()
+			mock.ExpectQuery("SELECT balance, overdraft_limit, system FROM accounts.account").
+				WithArgs(tx.AccountID).
+				WillReturnError(tt.err)
+			mock.ExpectRollback()
+
+			// only a missing account rejects the leg, anything else is retried
+			_, err = dbPg.commitTransaction(tx)
+			if !errors.Is(err, tt.wantErr) || errors.Is(err, errAccountNotExist) != tt.notExists {
+				t.Errorf("expected %v, got %v", tt.wantErr, err)
+			}
+
+			if err := mock.ExpectationsWereMet(); err != nil {
+				t.Errorf("unmet expectations: %v", err)
+			}
+		})
+	}
+}
+
 func TestDBPostgresCommitTransactionAlreadyProcessed(t *testing.T) {
 	db, mock, err := sqlmock.New()
 	if err != nil {
@@ -58,19 +282,62 @@ func TestDBPostgresCommitTransactionAlreadyProcessed(t *testing.T) {
 	dbPg := &dbPostgres{db: db}
 
 	tx := &cmn.Transaction{
-		TxID:      "test-tx-id",
-		AccountID: 123,
+		TxID:         "test-tx-id",
+		PaymentSysID: "pay-id",
+		AccountID:    123,
+		Amount:       1000,
 	}
 
+	// the balance isn't touched again and the original outcome is returned
 	mock.ExpectBegin()
-	mock.ExpectQuery("SELECT EXISTS").
-		WithArgs(tx.TxID).
-		WillReturnRows(sqlmock.NewRows([]string{"exists"}).AddRow(true))
+	mock.ExpectQuery("SELECT balance, overdraft_limit, system FROM accounts.account").
+		WithArgs(tx.AccountID).
+		WillReturnRows(accountRow(6000, 0, false))
+	mock.ExpectExec("INSERT INTO transactions.transaction").
+		WillReturnResult(sqlmock.NewResult(0, 0))
 	mock.ExpectRollback()
+	mock.ExpectQuery("SELECT id, kafka_id, balance_after FROM transactions.transaction").
+		WithArgs(tx.PaymentSysID, tx.AccountID, "CREDIT").
+		WillReturnRows(sqlmock.NewRows([]string{"id", "kafka_id", "balance_after"}).AddRow("test-tx-id", "first-kafka-id", 6000))
+
+	outcome, err := dbPg.commitTransaction(tx)
+	if err != nil {
+		t.Errorf("unexpected error: %v", err)
+	}
+	if !outcome.Duplicate || outcome.Balance != 6000 || outcome.KafkaID != "first-kafka-id" {
+		t.Errorf("expected original outcome, got %+v", outcome)
+	}
+
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("unmet expectations: %v", err)
+	}
+}
+
+func TestDBPostgresStartSaga(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatalf("failed to create mock: %v", err)
+	}
+	defer db.Close()
 
-	err = dbPg.commitTransaction(tx)
-	if err != errTxProcessed {
-		t.Errorf("expected errTxProcessed, got %v", err)
+	dbPg := &dbPostgres{db: db}
+	transfer := &cmn.Transfer{PaymentSysID: "pay-id", SourceAccountID: 1, TargetAccountID: 2, Amount: 100}
+
+	// already debited by an earlier delivery
+	mock.ExpectExec("INSERT INTO transactions.saga .* ON CONFLICT \\(payment_sys_id\\) DO NOTHING").
+		WithArgs("pay-id", 1, 2, 100, "kafka-id").
+		WillReturnResult(sqlmock.NewResult(0, 0))
+	mock.ExpectQuery("SELECT payment_sys_id, .* FROM transactions.saga WHERE payment_sys_id").
+		WithArgs("pay-id").
+		WillReturnRows(sqlmock.NewRows([]string{"payment_sys_id", "source_account_id", "target_account_id", "amount", "kafka_id", "state", "failure_reason"}).
+			AddRow("pay-id", 1, 2, 100, "first-kafka-id", "DEBITED", ""))
+
+	saga, err := dbPg.startSaga(transfer, "kafka-id")
+	if err != nil {
+		t.Errorf("unexpected error: %v", err)
+	}
+	if saga.State != sagaDebited || saga.KafkaID != "first-kafka-id" || saga.Amount != 100 {
+		t.Errorf("unexpected saga %+v", saga)
 	}
 
 	if err := mock.ExpectationsWereMet(); err != nil {
@@ -78,7 +345,7 @@ func TestDBPostgresCommitTransactionAlreadyProcessed(t *testing.T) {
 	}
 }
 
-func TestDBPostgresGetAccountByID(t *testing.T) {
+func TestDBPostgresUpdateSaga(t *testing.T) {
 	db, mock, err := sqlmock.New()
 	if err != nil {
 		t.Fatalf("failed to create mock: %v", err)
@@ -87,21 +354,248 @@ func TestDBPostgresGetAccountByID(t *testing.T) {
 
 	dbPg := &dbPostgres{db: db}
 
-	mock.ExpectQuery("SELECT id, user_id, balance from accounts.account WHERE id").
-		WithArgs(123).
-		WillReturnRows(sqlmock.NewRows([]string{"id", "user_id", "balance"}).
-			AddRow(123, 1, 1000))
+	mock.ExpectExec("UPDATE transactions.saga SET state (.+) AND state = ").
+		WithArgs("pay-id", string(sagaDebited), string(sagaCompensating), "credit rejected").
+		WillReturnResult(sqlmock.NewResult(0, 1))
+	// already moved on by another delivery
+	mock.ExpectExec("UPDATE transactions.saga SET state (.+) AND state = ").
+		WithArgs("pay-id", string(sagaDebited), string(sagaCompensating), "credit rejected").
+		WillReturnResult(sqlmock.NewResult(0, 0))
 
-	account, err := dbPg.getAccountByID(123)
+	if err := dbPg.updateSaga("pay-id", sagaDebited, sagaCompensating, "credit rejected"); err != nil {
+		t.Errorf("unexpected error: %v", err)
+	}
+	if err := dbPg.updateSaga("pay-id", sagaDebited, sagaCompensating, "credit rejected"); !errors.Is(err, errSagaMoved) {
+		t.Errorf("expected errSagaMoved, got %v", err)
+	}
+
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("unmet expectations: %v", err)
+	}
+}
+
+func TestDBPostgresGetUnfinishedSagas(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatalf("failed to create mock: %v", err)
+	}
+	defer db.Close()
+
+	dbPg := &dbPostgres{db: db}
+
+	mock.ExpectQuery("SELECT payment_sys_id, .* FROM transactions.saga\\s+WHERE state NOT IN").
+		WithArgs(string(sagaCompleted), string(sagaCompensated), string(sagaFailed)).
+		WillReturnRows(sqlmock.NewRows([]string{"payment_sys_id", "source_account_id", "target_account_id", "amount", "kafka_id", "state", "failure_reason"}).
+			AddRow("pay-1", 1, 2, 100, "k1", "STARTED", "").
+			AddRow("pay-2", 3, 4, 50, "k2", "COMPENSATING", "credit rejected"))
+
+	sagas, err := dbPg.getUnfinishedSagas()
 	if err != nil {
 		t.Errorf("unexpected error: %v", err)
 	}
+	if len(sagas) != 2 {
+		t.Fatalf("expected 2 sagas, got %d", len(sagas))
+	}
+	if sagas[1].State != sagaCompensating || sagas[1].FailureReason != "credit rejected" {
+		t.Errorf("unexpected saga %+v", sagas[1])
+	}
+
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("unmet expectations: %v", err)
+	}
+}
+
+func TestDBPostgresCommitTransactionsIsolatesFailures(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatalf("failed to create mock: %v", err)
+	}
+	defer db.Close()
+
+	dbPg := &dbPostgres{db: db}
+
+	credit := &cmn.Transaction{TxID: "tx-1", PaymentSysID: "pay-1", AccountID: 2, Amount: 100}
+	debit := &cmn.Transaction{TxID: "tx-2", PaymentSysID: "pay-2", AccountID: 1, Amount: -500}
+	duplicate := &cmn.Transaction{TxID: "tx-3", PaymentSysID: "pay-3", AccountID: 3, Amount: 100}
+
+	// applied in account order, each in its own savepoint
+	mock.ExpectBegin()
+
+	mock.ExpectExec("SAVEPOINT batch_item").WillReturnResult(sqlmock.NewResult(0, 0))
+	mock.ExpectQuery("SELECT balance, overdraft_limit, system FROM accounts.account").
+		WithArgs(debit.AccountID).
+		WillReturnRows(accountRow(100, 0, false))
+	mock.ExpectExec("INSERT INTO transactions.transaction").
+		WillReturnResult(sqlmock.NewResult(1, 1))
+	expectLedgerBalance(mock, debit.AccountID, 100)
+	mock.ExpectExec("ROLLBACK TO SAVEPOINT batch_item").WillReturnResult(sqlmock.NewResult(0, 0))
+
+	mock.ExpectExec("SAVEPOINT batch_item").WillReturnResult(sqlmock.NewResult(0, 0))
+	expectApplyCredit(mock, credit, 0)
+	mock.ExpectExec("RELEASE SAVEPOINT batch_item").WillReturnResult(sqlmock.NewResult(0, 0))
+
+	mock.ExpectExec("SAVEPOINT batch_item").WillReturnResult(sqlmock.NewResult(0, 0))
+	mock.ExpectQuery("SELECT balance, overdraft_limit, system FROM accounts.account").
+		WithArgs(duplicate.AccountID).
+		WillReturnRows(accountRow(100, 0, false))
+	mock.ExpectExec("INSERT INTO transactions.transaction").
+		WillReturnResult(sqlmock.NewResult(0, 0))
+	mock.ExpectExec("ROLLBACK TO SAVEPOINT batch_item").WillReturnResult(sqlmock.NewResult(0, 0))
+	mock.ExpectQuery("SELECT id, kafka_id, balance_after FROM transactions.transaction").
+		WithArgs(duplicate.PaymentSysID, duplicate.AccountID, "CREDIT").
+		WillReturnRows(sqlmock.NewRows([]string{"id", "kafka_id", "balance_after"}).AddRow("tx-3", "first", 100))
+
+	mock.ExpectCommit()
+
+	results := dbPg.commitTransactions([]*cmn.Transaction{credit, debit, duplicate})
 
-	if account.AccountID != 123 {
-		t.Errorf("expected account ID 123, got %d", account.AccountID)
+	if results[0].Err != nil || results[0].Outcome.Balance != 100 {
+		t.Errorf("expected credit applied, got %+v", results[0])
+	}
+	if !errors.Is(results[1].Err, errInsufficientFunds) {
+		t.Errorf("expected debit rejected, got %+v", results[1])
+	}
+	if results[2].Err != nil || !results[2].Outcome.Duplicate || results[2].Outcome.KafkaID != "first" {
+		t.Errorf("expected original outcome of duplicate, got %+v", results[2])
 	}
 
 	if err := mock.ExpectationsWereMet(); err != nil {
 		t.Errorf("unmet expectations: %v", err)
 	}
 }
+
+func TestDBPostgresCommitTransactionsCommitFails(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatalf("failed to create mock: %v", err)
+	}
+	defer db.Close()
+
+	dbPg := &dbPostgres{db: db}
+	tx := &cmn.Transaction{TxID: "tx-1", PaymentSysID: "pay-1", AccountID: 1, Amount: 100}
+
+	mock.ExpectBegin()
+	mock.ExpectExec("SAVEPOINT batch_item").WillReturnResult(sqlmock.NewResult(0, 0))
+	expectApplyCredit(mock, tx, 0)
+	mock.ExpectExec("RELEASE SAVEPOINT batch_item").WillReturnResult(sqlmock.NewResult(0, 0))
+	mock.ExpectCommit().WillReturnError(errors.New("connection lost"))
+
+	results := dbPg.commitTransactions([]*cmn.Transaction{tx})
+	if results[0].Err == nil || results[0].Outcome != nil {
+		t.Errorf("expected every item to fail with the commit, got %+v", results[0])
+	}
+}
+
+// BenchmarkCommitTransactions compares committing credits one at a time with committing them
+// in batches. by default the database is sqlmock, where only commits are given a latency as
+// they're the cost batching saves. set TX_BENCH_POSTGRES=1 to run against the real database at POSTGRES_HOST instead,
+// which leaves benchmark accounts and their ledger lines behind.
+//
+//	go test -run ^$ -bench CommitTransactions ./svc/transaction-service
+func BenchmarkCommitTransactions(b *testing.B) {
+	for _, size := range []int{1, 10, 50} {
+		name := "unbatched"
+		if size > 1 {
+			name = fmt.Sprintf("batch-%d", size)
+		}
+		b.Run(name, func(b *testing.B) {
+			if os.Getenv("TX_BENCH_POSTGRES") == "1" {
+				benchmarkPostgres(b, size)
+			} else {
+				benchmarkMock(b, size)
+			}
+		})
+	}
+}
+
+// sqlmock can't delay a commit, so a durable commit's cost is charged to its begin
+const benchCommitLatency = time.Millisecond
+
+func benchCredits(n int, accounts []int32) []*cmn.Transaction {
+	txs := make([]*cmn.Transaction, n)
+	for i := range txs {
+		txs[i] = &cmn.Transaction{
+			TxID:         uuid.NewString(),
+			PaymentSysID: uuid.NewString(),
+			AccountID:    accounts[i%len(accounts)],
+			KafkaID:      fmt.Sprintf("bench:0:%d", i),
+			Amount:       1,
+		}
+	}
+	return txs
+}
+
+func benchmarkMock(b *testing.B, size int) {
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		b.Fatalf("failed to create mock: %v", err)
+	}
+	defer db.Close()
+
+	// one account, so applying in account order keeps the expectations in order
+	txs := benchCredits(b.N, []int32{1})
+	for start := 0; start < len(txs); start += size {
+		batch := txs[start:min(start+size, len(txs))]
+		mock.ExpectBegin().WillDelayFor(benchCommitLatency)
+		for i, tx := range batch {
+			if size > 1 {
+				mock.ExpectExec("SAVEPOINT batch_item").WillReturnResult(sqlmock.NewResult(0, 0))
+			}
+			expectApplyCredit(mock, tx, int64(start+i))
+			if size > 1 {
+				mock.ExpectExec("RELEASE SAVEPOINT batch_item").WillReturnResult(sqlmock.NewResult(0, 0))
+			}
+		}
+		mock.ExpectCommit()
+	}
+
+	b.ResetTimer()
+	commitAll(b, &dbPostgres{db: db}, txs, size)
+	b.StopTimer()
+
+	if err := mock.ExpectationsWereMet(); err != nil {
+		b.Errorf("unmet expectations: %v", err)
+	}
+}
+
+func benchmarkPostgres(b *testing.B, size int) {
+	db, err := cmn.InitPostgres(cmn.DefaultConfig)
+	if err != nil {
+		b.Skipf("no database: %v", err)
+	}
+	defer db.Close()
+
+	// spread over a few accounts owned by the system user
+	accounts := make([]int32, 10)
+	for i := range accounts {
+		err := db.QueryRow(`
+			INSERT INTO accounts.account (name, user_id) VALUES ('benchmark', -1) RETURNING id
+		`).Scan(&accounts[i])
+		if err != nil {
+			b.Fatalf("failed to create account: %v", err)
+		}
+	}
+	txs := benchCredits(b.N, accounts)
+
+	b.ResetTimer()
+	commitAll(b, &dbPostgres{db: db}, txs, size)
+}
+
+func commitAll(b *testing.B, db *dbPostgres, txs []*cmn.Transaction, size int) {
+	if size == 1 {
+		for _, tx := range txs {
+			if _, err := db.commitTransaction(tx); err != nil {
+				b.Fatalf("commit failed: %v", err)
+			}
+		}
+		return
+	}
+
+	for start := 0; start < len(txs); start += size {
+		for _, res := range db.commitTransactions(txs[start:min(start+size, len(txs))]) {
+			if res.Err != nil {
+				b.Fatalf("commit failed: %v", res.Err)
+			}
+		}
+	}
+}
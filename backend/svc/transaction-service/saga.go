@@ -0,0 +1,155 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+
+	"github.com/segmentio/kafka-go"
+	cmn "github.com/timkins666/distributed-playground/backend/pkg/common"
+)
+
+type sagaState string
+
+// a transfer debits the source, then credits the target. if the credit is rejected the
+// debit is reversed by a compensating credit to the source.
+const (
+	sagaStarted      sagaState = "STARTED"
+	sagaDebited      sagaState = "DEBITED"
+	sagaCompleted    sagaState = "COMPLETED"
+	sagaCompensating sagaState = "COMPENSATING"
+	sagaCompensated  sagaState = "COMPENSATED"
+	sagaFailed       sagaState = "FAILED"
+)
+
+func (s sagaState) terminal() bool {
+	return s == sagaCompleted || s == sagaCompensated || s == sagaFailed
+}
+
+var (
+	errorInvalidTransfer = cmn.Unprocessable(errors.New("parsed transfer but bad data"))
+	// another delivery or a resume moved the saga on first, it's picked up again from its new state
+	errSagaMoved = errors.New("saga state changed concurrently")
+)
+
+// durable state of a transfer, stored in transactions.saga
+type transferSaga struct {
+	cmn.Transfer
+	// origin of the transfer, recorded against each leg
+	KafkaID       string
+	State         sagaState
+	FailureReason string
+}
+
+func (s *transferSaga) debit() *cmn.Transaction {
+	return &cmn.Transaction{
+		PaymentSysID: s.PaymentSysID,
+		AccountID:    s.SourceAccountID,
+		Amount:       -s.Amount,
+	}
+}
+
+func (s *transferSaga) credit() *cmn.Transaction {
+	return &cmn.Transaction{
+		PaymentSysID: s.PaymentSysID,
+		AccountID:    s.TargetAccountID,
+		Amount:       s.Amount,
+	}
+}
+
+// returns the debited funds to the source
+func (s *transferSaga) compensation() *cmn.Transaction {
+	return &cmn.Transaction{
+		PaymentSysID: s.PaymentSysID,
+		AccountID:    s.SourceAccountID,
+		Amount:       s.Amount,
+		Compensates:  s.debit().IdempotentID(),
+	}
+}
+
+func handleTransferMessage(msg kafka.Message, appCtx *transactionCtx) error {
+	transfer, err := cmn.FromBytes[cmn.Transfer](msg.Value)
+	if err != nil {
+		appCtx.logger.Printf("received bytes:\n%s", msg.Value)
+		return cmn.Unprocessable(err)
+	}
+
+	if !transfer.Valid() {
+		appCtx.logger.Printf("%s:%+v", errorInvalidTransfer, transfer)
+		return errorInvalidTransfer
+	}
+
+	// a redelivered transfer picks up its saga where it left off
+	saga, err := appCtx.db.startSaga(transfer, cmn.MessageID(msg))
+	if err != nil {
+		return err
+	}
+	return runSaga(saga, appCtx)
+}
+
+// runSaga drives the saga to a terminal state, recording each step. legs are idempotent so
+// a step interrupted before its state was recorded is safe to repeat.
+func runSaga(saga *transferSaga, appCtx *transactionCtx) error {
+	for !saga.State.terminal() {
+		next, reason, err := sagaStep(saga, appCtx)
+		if err != nil {
+			return fmt.Errorf("transfer %s in state %s: %w", saga.PaymentSysID, saga.State, err)
+		}
+		if err := appCtx.db.updateSaga(saga.PaymentSysID, saga.State, next, reason); err != nil {
+			return err
+		}
+		appCtx.logger.Printf("Transfer %s %s -> %s", saga.PaymentSysID, saga.State, next)
+		saga.State, saga.FailureReason = next, reason
+	}
+	return nil
+}
+
+// sagaStep applies the leg for the current state and returns the state to move to
+func sagaStep(saga *transferSaga, appCtx *transactionCtx) (sagaState, string, error) {
+	switch saga.State {
+	case sagaStarted:
+		_, err := applyTransaction(saga.debit(), saga.KafkaID, appCtx)
+		if errors.Is(err, cmn.ErrUnprocessable) {
+			return sagaFailed, "debit rejected: " + err.Error(), nil
+		}
+		if err != nil {
+			return "", "", err
+		}
+		return sagaDebited, "", nil
+
+	case sagaDebited:
+		_, err := applyTransaction(saga.credit(), saga.KafkaID, appCtx)
+		if errors.Is(err, cmn.ErrUnprocessable) {
+			return sagaCompensating, "credit rejected: " + err.Error(), nil
+		}
+		if err != nil {
+			return "", "", err
+		}
+		return sagaCompleted, "", nil
+
+	case sagaCompensating:
+		// if this is rejected the money is stuck, the saga stays put for someone to look at
+		_, err := applyTransaction(saga.compensation(), saga.KafkaID, appCtx)
+		if err != nil {
+			return "", "", err
+		}
+		return sagaCompensated, saga.FailureReason, nil
+	}
+
+	return "", "", fmt.Errorf("unknown saga state %s", saga.State)
+}
+
+// resumeSagas finishes any transfers interrupted by a restart
+func resumeSagas(appCtx *transactionCtx) {
+	sagas, err := appCtx.db.getUnfinishedSagas()
+	if err != nil {
+		appCtx.logger.Printf("failed to load unfinished sagas: %s", err)
+		return
+	}
+
+	for _, saga := range sagas {
+		appCtx.logger.Printf("Resuming transfer %s from %s", saga.PaymentSysID, saga.State)
+		if err := runSaga(saga, appCtx); err != nil {
+			appCtx.logger.Printf("failed to resume saga: %s", err)
+		}
+	}
+}
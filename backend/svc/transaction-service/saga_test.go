@@ -0,0 +1,157 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"testing"
+
+	"github.com/bmizerany/assert"
+	"github.com/segmentio/kafka-go"
+	cmn "github.com/timkins666/distributed-playground/backend/pkg/common"
+	tu "github.com/timkins666/distributed-playground/backend/pkg/testutils"
+)
+
+func transferMsg(t *testing.T, transfer cmn.Transfer) kafka.Message {
+	val, err := cmn.ToBytes(transfer)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return kafka.Message{Topic: cmn.Topics.TransferRequested().S(), Value: val}
+}
+
+func TestHandleTransferMessage(t *testing.T) {
+	transfer := cmn.Transfer{PaymentSysID: "pay-1", SourceAccountID: 1, TargetAccountID: 2, Amount: 100}
+
+	tests := []struct {
+		name      string
+		transfer  cmn.Transfer
+		missing   map[int32]bool
+		wantState sagaState
+		// account and amount of each leg applied, in order
+		wantLegs [][2]int64
+	}{
+		{
+			name:      "both legs applied",
+			transfer:  transfer,
+			wantState: sagaCompleted,
+			wantLegs:  [][2]int64{{1, -100}, {2, 100}},
+		},
+		{
+			name:      "debit rejected",
+			transfer:  transfer,
+			missing:   map[int32]bool{1: true},
+			wantState: sagaFailed,
+		},
+		{
+			name:      "credit rejected is compensated",
+			transfer:  transfer,
+			missing:   map[int32]bool{2: true},
+			wantState: sagaCompensated,
+			wantLegs:  [][2]int64{{1, -100}, {1, 100}},
+		},
+		{
+			name:      "opening balance",
+			transfer:  cmn.Transfer{PaymentSysID: "pay-1", SourceAccountID: cmn.SystemAccountOpeningBalances, TargetAccountID: 2, Amount: 100},
+			wantState: sagaCompleted,
+			wantLegs:  [][2]int64{{int64(cmn.SystemAccountOpeningBalances), -100}, {2, 100}},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			mockDB := &mockTransactionDB{missingAccounts: tt.missing}
+			appCtx := &transactionCtx{cancelCtx: context.Background(), logger: cmn.AppLogger(), writer: &tu.MockKafkaWriter{}, db: mockDB}
+
+			err := handleTransferMessage(transferMsg(t, tt.transfer), appCtx)
+			assert.Equal(t, nil, err)
+
+			assert.Equal(t, tt.wantState, mockDB.sagas["pay-1"].State)
+			assert.Equal(t, len(tt.wantLegs), len(mockDB.transactions))
+			for i, leg := range tt.wantLegs {
+				assert.Equal(t, int32(leg[0]), mockDB.transactions[i].AccountID)
+				assert.Equal(t, leg[1], mockDB.transactions[i].Amount)
+			}
+		})
+	}
+}
+
+func TestHandleTransferMessageCompensationRecordsReason(t *testing.T) {
+	mockDB := &mockTransactionDB{missingAccounts: map[int32]bool{2: true}}
+	appCtx := &transactionCtx{cancelCtx: context.Background(), logger: cmn.AppLogger(), writer: &tu.MockKafkaWriter{}, db: mockDB}
+
+	transfer := cmn.Transfer{PaymentSysID: "pay-1", SourceAccountID: 1, TargetAccountID: 2, Amount: 100}
+	assert.Equal(t, nil, handleTransferMessage(transferMsg(t, transfer), appCtx))
+
+	refund := mockDB.transactions[1]
+	assert.Equal(t, cmn.LegCompensation, refund.Leg())
+	assert.Equal(t, mockDB.transactions[0].TxID, refund.Compensates)
+	assert.Equal(t, true, mockDB.sagas["pay-1"].FailureReason != "")
+}
+
+func TestHandleTransferMessageInvalid(t *testing.T) {
+	appCtx := &transactionCtx{cancelCtx: context.Background(), logger: cmn.AppLogger(), writer: &tu.MockKafkaWriter{}, db: &mockTransactionDB{}}
+
+	err := handleTransferMessage(kafka.Message{Value: []byte("nope")}, appCtx)
+	assert.Equal(t, true, errors.Is(err, cmn.ErrUnprocessable))
+
+	err = handleTransferMessage(transferMsg(t, cmn.Transfer{PaymentSysID: "pay-1", SourceAccountID: 1, TargetAccountID: 1, Amount: 100}), appCtx)
+	assert.Equal(t, errorInvalidTransfer, err)
+}
+
+func TestHandleTransferMessageRetryDoesNotRepeatLegs(t *testing.T) {
+	mockDB := &mockTransactionDB{}
+	appCtx := &transactionCtx{cancelCtx: context.Background(), logger: cmn.AppLogger(), writer: &tu.MockKafkaWriter{}, db: mockDB}
+	msg := transferMsg(t, cmn.Transfer{PaymentSysID: "pay-1", SourceAccountID: 1, TargetAccountID: 2, Amount: 100})
+
+	// debit recorded but the saga was interrupted before the credit
+	_, err := mockDB.startSaga(&cmn.Transfer{PaymentSysID: "pay-1", SourceAccountID: 1, TargetAccountID: 2, Amount: 100}, "k")
+	assert.Equal(t, nil, err)
+	saga := mockDB.sagas["pay-1"]
+	_, err = applyTransaction(saga.debit(), "k", appCtx)
+	assert.Equal(t, nil, err)
+
+	// redelivered, the debit is a no-op
+	assert.Equal(t, nil, handleTransferMessage(msg, appCtx))
+	assert.Equal(t, sagaCompleted, mockDB.sagas["pay-1"].State)
+	assert.Equal(t, 2, len(mockDB.transactions))
+
+	// and once complete nothing else happens
+	assert.Equal(t, nil, handleTransferMessage(msg, appCtx))
+	assert.Equal(t, 2, len(mockDB.transactions))
+}
+
+func TestHandleTransferMessageTransientError(t *testing.T) {
+	mockDB := &mockTransactionDB{commitErr: errors.New("db down")}
+	appCtx := &transactionCtx{cancelCtx: context.Background(), logger: cmn.AppLogger(), writer: &tu.MockKafkaWriter{}, db: mockDB}
+	msg := transferMsg(t, cmn.Transfer{PaymentSysID: "pay-1", SourceAccountID: 1, TargetAccountID: 2, Amount: 100})
+
+	err := handleTransferMessage(msg, appCtx)
+	assert.NotEqual(t, nil, err)
+	assert.Equal(t, false, errors.Is(err, cmn.ErrUnprocessable))
+	assert.Equal(t, sagaStarted, mockDB.sagas["pay-1"].State)
+}
+
+func TestResumeSagas(t *testing.T) {
+	mockDB := &mockTransactionDB{sagas: map[string]*transferSaga{
+		"pay-1": {
+			Transfer: cmn.Transfer{PaymentSysID: "pay-1", SourceAccountID: 1, TargetAccountID: 2, Amount: 100},
+			State:    sagaDebited,
+		},
+		"pay-2": {
+			Transfer: cmn.Transfer{PaymentSysID: "pay-2", SourceAccountID: 3, TargetAccountID: 4, Amount: 50},
+			State:    sagaCompensating,
+		},
+		"pay-3": {
+			Transfer: cmn.Transfer{PaymentSysID: "pay-3", SourceAccountID: 5, TargetAccountID: 6, Amount: 10},
+			State:    sagaCompleted,
+		},
+	}}
+	appCtx := &transactionCtx{cancelCtx: context.Background(), logger: cmn.AppLogger(), writer: &tu.MockKafkaWriter{}, db: mockDB}
+
+	resumeSagas(appCtx)
+
+	assert.Equal(t, sagaCompleted, mockDB.sagas["pay-1"].State)
+	assert.Equal(t, sagaCompensated, mockDB.sagas["pay-2"].State)
+	// one credit, one compensation, nothing for the finished saga
+	assert.Equal(t, 2, len(mockDB.transactions))
+}
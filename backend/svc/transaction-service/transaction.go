@@ -1,18 +1,22 @@
 package main
 
 import (
+	"context"
 	"errors"
 	"fmt"
-	"strconv"
+	"time"
 
-	"github.com/google/uuid"
 	"github.com/segmentio/kafka-go"
 	cmn "github.com/timkins666/distributed-playground/backend/pkg/common"
 )
 
 var (
-	errTxProcessed     = errors.New("transaction already processed")
 	errAccountNotExist = errors.New("account doesn't exist")
+	errTxConflict      = errors.New("transaction ID already used by a different transaction")
+	// the debit would take the balance past the account's overdraft limit
+	errInsufficientFunds = errors.New("insufficient funds")
+	// the account's cached balance has drifted from its ledger, it's frozen until fixed
+	errLedgerMismatch = errors.New("account balance doesn't match ledger")
 )
 
 func main() {
@@ -22,69 +26,130 @@ func main() {
 	appCtx := newAppCtx(cancelCtx)
 	defer appCtx.close()
 
-	for {
-		select {
-		case <-cancelCtx.Done():
-			return
-		default:
-			msg, err := appCtx.txReqReader.ReadMessage(appCtx.cancelCtx)
-			if err != nil {
-				appCtx.logger.Println(err)
-				continue
-			}
-			if err := processMessage(msg, &appCtx); err != nil {
-				appCtx.logger.Printf("error in processMessage: %s", err)
-			}
+	// a transfer that fails is moved to the next retry tier so it doesn't hold up the account's
+	// other transfers, and dead lettered once out of retries or if it can never succeed. each leg
+	// is applied by the saga, nothing else asks for transactions.
+	transferHandler := cmn.WithRetry(func(_ context.Context, msg kafka.Message) error {
+		err := handleTransferMessage(msg, &appCtx)
+		if err != nil {
+			appCtx.logger.Printf("error in handleTransferMessage: %s", err)
 		}
+		return err
+	}, appCtx.retryPolicy, appCtx.writer, appCtx.logger)
+
+	if appCtx.batcher != nil {
+		go appCtx.batcher.run(cancelCtx)
+	}
+
+	resumeSagas(&appCtx)
+
+	for _, reader := range appCtx.retryReaders {
+		go cmn.Consume(cancelCtx, reader, transferHandler, appCtx.logger)
 	}
+
+	// transfers are keyed by source account, so each account's are handled in order while
+	// different accounts and partitions are handled in parallel
+	cmn.ConsumeOrdered(cancelCtx, appCtx.transferReader, transferHandler, appCtx.concurrency, appCtx.logger)
 }
 
-var (
-	errorParsingTransaction    = errors.New("error parsing transaction")
-	errorInvalidTransaction    = errors.New("parsed transaction but bad data")
-	errorCommittingTransaction = errors.New("error committing transaction, this is probably bad")
-)
+var errorCommittingTransaction = errors.New("error committing transaction, this is probably bad")
+
+// typed reasons for the errors that reject a transaction
+var failureReasons = map[error]cmn.TxFailureReason{
+	errAccountNotExist:   cmn.TxFailureAccountNotFound,
+	errTxConflict:        cmn.TxFailureConflict,
+	errInsufficientFunds: cmn.TxFailureInsufficientFunds,
+	errLedgerMismatch:    cmn.TxFailureLedgerMismatch,
+}
+
+// applyTransaction commits a single leg. errors wrapping cmn.ErrUnprocessable mean the leg
+// was rejected and will never succeed.
+func applyTransaction(tx *cmn.Transaction, kafkaID string, appCtx *transactionCtx) (*txOutcome, error) {
+	// stable across redeliveries so the transaction is only applied once
+	tx.TxID = tx.IdempotentID()
+	tx.KafkaID = kafkaID
 
-func processMessage(msg kafka.Message, appCtx *transactionCtx) error {
-	tx, err := cmn.FromBytes[cmn.Transaction](msg.Value)
+	outcome, err := commitTransaction(tx, appCtx)
+	for cause, reason := range failureReasons {
+		if errors.Is(err, cause) {
+			if err := sendTransactionFailed(tx, reason, err, appCtx); err != nil {
+				return nil, err
+			}
+			return nil, cmn.Unprocessable(err)
+		}
+	}
 	if err != nil {
 		appCtx.logger.Println(err)
-		appCtx.logger.Printf("received bytes:\n%s", msg.Value)
-		return errorParsingTransaction
+		return nil, errorCommittingTransaction
 	}
 
-	if !tx.Valid() {
-		appCtx.logger.Printf("%s:%+v", errorInvalidTransaction, tx)
-		return errorInvalidTransaction
+	// a redelivery carries on as normal so downstream sees the original outcome again
+	if outcome.Duplicate {
+		appCtx.logger.Printf("Transaction %s already applied, balance was %d", outcome.TxID, outcome.Balance)
+	} else {
+		appCtx.logger.Printf("Completed transaction %+v, balance now %d", tx, outcome.Balance)
 	}
+	// not committing the message means it's redelivered as a duplicate and sent again
+	if err := sendTransactionCompleted(tx, outcome, appCtx); err != nil {
+		return nil, err
+	}
+	return outcome, nil
+}
 
-	tx.TxID = uuid.NewString()
-	tx.KafkaID = fmt.Sprintf("%s:%d:%d", msg.Topic, msg.Partition, msg.Offset)
-
-	err = appCtx.db.commitTransaction(tx)
-	if err != nil {
-		appCtx.logger.Println(err)
-		return errorCommittingTransaction
+// commits the transaction on its own, or as part of a batch if batching is enabled
+func commitTransaction(tx *cmn.Transaction, appCtx *transactionCtx) (*txOutcome, error) {
+	if appCtx.batcher != nil {
+		return appCtx.batcher.commit(appCtx.cancelCtx, tx)
 	}
+	return appCtx.db.commitTransaction(tx)
+}
 
-	// TODO: tx complete kafka message => frontend and redis invalidator
-	appCtx.logger.Printf("Completed transaction %+v", tx)
-	invalidateCache(tx, appCtx)
-	return nil
+func sendTransactionCompleted(tx *cmn.Transaction, outcome *txOutcome, appCtx *transactionCtx) error {
+	return sendTransactionEvent(cmn.Topics.TransactionComplete(), cmn.TransactionEvent{
+		TxID:         outcome.TxID,
+		PaymentSysID: tx.PaymentSysID,
+		AccountID:    tx.AccountID,
+		Leg:          tx.Leg(),
+		Amount:       tx.Amount,
+		Balance:      outcome.Balance,
+		KafkaID:      outcome.KafkaID,
+		Timestamp:    time.Now(),
+	}, appCtx)
 }
 
-// TODO: replace this hacky invalidation with a separate invalidation consumer
-func invalidateCache(tx *cmn.Transaction, appCtx *transactionCtx) {
-	if appCtx.redisClient == nil {
-		return
+func sendTransactionFailed(tx *cmn.Transaction, reason cmn.TxFailureReason, cause error, appCtx *transactionCtx) error {
+	appCtx.logger.Printf("Transaction %s failed: %s", tx.TxID, reason)
+	return sendTransactionEvent(cmn.Topics.TransactionFailed(), cmn.TransactionEvent{
+		TxID:         tx.TxID,
+		PaymentSysID: tx.PaymentSysID,
+		AccountID:    tx.AccountID,
+		Leg:          tx.Leg(),
+		Amount:       tx.Amount,
+		KafkaID:      tx.KafkaID,
+		Reason:       reason,
+		Error:        cause.Error(),
+		Timestamp:    time.Now(),
+	}, appCtx)
+}
+
+// publishes a transaction outcome keyed by account, so events for an account stay in order
+func sendTransactionEvent(topic cmn.Topic, event cmn.TransactionEvent, appCtx *transactionCtx) error {
+	key, err := cmn.ToBytes(event.AccountID)
+	if err != nil {
+		return err
 	}
-	acc, err := appCtx.db.getAccountByID(tx.AccountID)
+	val, err := cmn.ToBytes(event)
 	if err != nil {
-		appCtx.logger.Println(err)
-		return
+		return err
 	}
 
-	key := cmn.RedisKey(cmn.RedisKeyUserAccounts, strconv.Itoa(int(acc.UserID)))
-	appCtx.logger.Printf("Invalidating redis key %s", key)
-	appCtx.redisClient.Del(appCtx.cancelCtx, key)
+	err = appCtx.writer.WriteMessages(appCtx.cancelCtx, kafka.Message{
+		Topic: topic.S(),
+		Key:   key,
+		Value: val,
+	})
+	if err != nil {
+		return fmt.Errorf("failed to publish %s for %s: %w", topic, event.TxID, err)
+	}
+	return nil
 }
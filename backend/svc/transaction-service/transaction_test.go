@@ -3,10 +3,11 @@ package main
 import (
 	"context"
 	"errors"
+	"fmt"
 	"testing"
 
-	"github.com/segmentio/kafka-go"
 	cmn "github.com/timkins666/distributed-playground/backend/pkg/common"
+	tu "github.com/timkins666/distributed-playground/backend/pkg/testutils"
 )
 
 type mockTransactionDB struct {
@@ -14,62 +15,93 @@ type mockTransactionDB struct {
 	accounts     map[int32]*cmn.Account
 	commitErr    error
 	accountErr   error
+	// transactions on these accounts fail with errAccountNotExist
+	missingAccounts map[int32]bool
+	sagas           map[string]*transferSaga
+	outcomes        map[string]*txOutcome
+	// sizes of the batches committed
+	batches []int
 }
 
-func (m *mockTransactionDB) commitTransaction(transaction *cmn.Transaction) error {
+func (m *mockTransactionDB) commitTransactions(transactions []*cmn.Transaction) []txResult {
+	m.batches = append(m.batches, len(transactions))
+	results := make([]txResult, len(transactions))
+	for i, tx := range transactions {
+		results[i].Outcome, results[i].Err = m.commitTransaction(tx)
+	}
+	return results
+}
+
+func (m *mockTransactionDB) commitTransaction(transaction *cmn.Transaction) (*txOutcome, error) {
 	if m.commitErr != nil {
-		return m.commitErr
+		return nil, m.commitErr
 	}
+	if m.missingAccounts[transaction.AccountID] {
+		return nil, errAccountNotExist
+	}
+	if outcome, ok := m.outcomes[transaction.TxID]; ok {
+		duplicate := *outcome
+		duplicate.Duplicate = true
+		return &duplicate, nil
+	}
+
+	outcome := &txOutcome{TxID: transaction.TxID, KafkaID: transaction.KafkaID}
+	if acc, ok := m.accounts[transaction.AccountID]; ok {
+		acc.Balance += transaction.Amount
+		outcome.Balance = acc.Balance
+	}
+	if m.outcomes == nil {
+		m.outcomes = map[string]*txOutcome{}
+	}
+	m.outcomes[transaction.TxID] = outcome
 	m.transactions = append(m.transactions, transaction)
-	return nil
+	return outcome, nil
 }
 
-func (m *mockTransactionDB) getAccountByID(accountID int32) (*cmn.Account, error) {
-	if m.accountErr != nil {
-		return nil, m.accountErr
+func (m *mockTransactionDB) startSaga(transfer *cmn.Transfer, kafkaID string) (*transferSaga, error) {
+	if m.sagas == nil {
+		m.sagas = map[string]*transferSaga{}
 	}
-	if acc, ok := m.accounts[accountID]; ok {
-		return acc, nil
+	if _, ok := m.sagas[transfer.PaymentSysID]; !ok {
+		m.sagas[transfer.PaymentSysID] = &transferSaga{Transfer: *transfer, KafkaID: kafkaID, State: sagaStarted}
 	}
-	return nil, errors.New("account not found")
+	saga := *m.sagas[transfer.PaymentSysID]
+	return &saga, nil
 }
 
-func TestProcessMessage(t *testing.T) {
+func (m *mockTransactionDB) updateSaga(paymentSysID string, from, to sagaState, reason string) error {
+	if m.sagas[paymentSysID].State != from {
+		return errSagaMoved
+	}
+	m.sagas[paymentSysID].State = to
+	m.sagas[paymentSysID].FailureReason = reason
+	return nil
+}
+
+func (m *mockTransactionDB) getUnfinishedSagas() ([]*transferSaga, error) {
+	var sagas []*transferSaga
+	for _, s := range m.sagas {
+		if !s.State.terminal() {
+			saga := *s
+			sagas = append(sagas, &saga)
+		}
+	}
+	return sagas, nil
+}
+
+func TestApplyTransaction(t *testing.T) {
 	tests := []struct {
 		name      string
-		tx        *cmn.Transaction
 		commitErr error
 		wantErr   error
 	}{
 		{
-			name:    "invalid message",
-			tx:      nil,
-			wantErr: errorParsingTransaction,
-		},
-		{
-			name: "invalid transaction",
-			tx: &cmn.Transaction{
-				PaymentSysID: "",
-			},
-			wantErr: errorInvalidTransaction,
-		},
-		{
-			name: "commit error",
-			tx: &cmn.Transaction{
-				PaymentSysID: "123",
-				Amount:       100,
-				AccountID:    42,
-			},
+			name:      "commit error",
 			commitErr: errors.New("db error"),
 			wantErr:   errorCommittingTransaction,
 		},
 		{
-			name: "success",
-			tx: &cmn.Transaction{
-				PaymentSysID: "123",
-				Amount:       100,
-				AccountID:    42,
-			},
+			name:    "success",
 			wantErr: nil,
 		},
 	}
@@ -84,26 +116,12 @@ func TestProcessMessage(t *testing.T) {
 			appCtx := &transactionCtx{
 				cancelCtx: context.Background(),
 				logger:    cmn.AppLogger(),
+				writer:    &tu.MockKafkaWriter{},
 				db:        mockDB,
 			}
 
-			var msgValue []byte
-			if tt.tx != nil {
-				var err error
-				msgValue, err = cmn.ToBytes(*tt.tx)
-				if err != nil {
-					t.Fatalf("setup error: %v", err)
-				}
-			}
-
-			msg := kafka.Message{
-				Value:     msgValue,
-				Topic:     "test-topic",
-				Partition: 0,
-				Offset:    1,
-			}
-
-			err := processMessage(msg, appCtx)
+			tx := &cmn.Transaction{PaymentSysID: "123", Amount: 100, AccountID: 42}
+			_, err := applyTransaction(tx, "test-topic:0:1", appCtx)
 
 			if tt.wantErr != nil {
 				if err != tt.wantErr {
@@ -113,30 +131,177 @@ func TestProcessMessage(t *testing.T) {
 				t.Errorf("unexpected error: %v", err)
 			}
 
-			if tt.wantErr == nil && tt.tx != nil {
-				if len(mockDB.transactions) != 1 {
-					t.Errorf("expected 1 transaction, got %d", len(mockDB.transactions))
-				}
+			if tt.wantErr == nil && len(mockDB.transactions) != 1 {
+				t.Errorf("expected 1 transaction, got %d", len(mockDB.transactions))
 			}
 		})
 	}
 }
 
-func TestInvalidateCache(t *testing.T) {
-	mockDB := &mockTransactionDB{
-		accounts: map[int32]*cmn.Account{
-			42: {AccountID: 42, UserID: 1, Balance: 1000},
+func TestApplyTransactionRedelivery(t *testing.T) {
+	mockDB := &mockTransactionDB{}
+	appCtx := &transactionCtx{
+		cancelCtx: context.Background(),
+		logger:    cmn.AppLogger(),
+		writer:    &tu.MockKafkaWriter{},
+		db:        mockDB,
+	}
+
+	// same transaction from a different message, e.g. after a crash before commit
+	for offset := range 2 {
+		tx := &cmn.Transaction{PaymentSysID: "123", Amount: -100, AccountID: 42}
+		_, err := applyTransaction(tx, fmt.Sprintf("transfer-requested:0:%d", offset), appCtx)
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+	}
+
+	if len(mockDB.transactions) != 1 {
+		t.Errorf("expected transaction applied once, got %d", len(mockDB.transactions))
+	}
+}
+
+func TestApplyTransactionUnknownAccountNotRetried(t *testing.T) {
+	appCtx := &transactionCtx{
+		cancelCtx: context.Background(),
+		logger:    cmn.AppLogger(),
+		writer:    &tu.MockKafkaWriter{},
+		db:        &mockTransactionDB{commitErr: errAccountNotExist},
+	}
+
+	_, err := applyTransaction(&cmn.Transaction{PaymentSysID: "123", Amount: 100, AccountID: 42}, "k", appCtx)
+
+	if !errors.Is(err, cmn.ErrUnprocessable) {
+		t.Errorf("expected unprocessable error, got %v", err)
+	}
+}
+
+func TestApplyTransactionEvents(t *testing.T) {
+	tests := []struct {
+		name       string
+		tx         cmn.Transaction
+		commitErr  error
+		wantTopic  cmn.Topic
+		wantReason cmn.TxFailureReason
+	}{
+		{
+			name:      "completed",
+			tx:        cmn.Transaction{PaymentSysID: "123", Amount: -100, AccountID: 42},
+			wantTopic: cmn.Topics.TransactionComplete(),
+		},
+		{
+			name:       "unknown account",
+			tx:         cmn.Transaction{PaymentSysID: "123", Amount: -100, AccountID: 42},
+			commitErr:  errAccountNotExist,
+			wantTopic:  cmn.Topics.TransactionFailed(),
+			wantReason: cmn.TxFailureAccountNotFound,
+		},
+		{
+			name:       "insufficient funds",
+			tx:         cmn.Transaction{PaymentSysID: "123", Amount: -100, AccountID: 42},
+			commitErr:  errInsufficientFunds,
+			wantTopic:  cmn.Topics.TransactionFailed(),
+			wantReason: cmn.TxFailureInsufficientFunds,
 		},
+		{
+			name:       "ledger mismatch",
+			tx:         cmn.Transaction{PaymentSysID: "123", Amount: 100, AccountID: 42},
+			commitErr:  errLedgerMismatch,
+			wantTopic:  cmn.Topics.TransactionFailed(),
+			wantReason: cmn.TxFailureLedgerMismatch,
+		},
+		{
+			name:       "conflict",
+			tx:         cmn.Transaction{TxID: "used", PaymentSysID: "123", Amount: -100, AccountID: 42},
+			commitErr:  errTxConflict,
+			wantTopic:  cmn.Topics.TransactionFailed(),
+			wantReason: cmn.TxFailureConflict,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			writer := &tu.MockKafkaWriter{}
+			appCtx := &transactionCtx{
+				cancelCtx: context.Background(),
+				logger:    cmn.AppLogger(),
+				writer:    writer,
+				db: &mockTransactionDB{
+					commitErr: tt.commitErr,
+					accounts:  map[int32]*cmn.Account{42: {AccountID: 42, Balance: 1000}},
+				},
+			}
+
+			tx := tt.tx
+			applyTransaction(&tx, "transfer-requested:2:7", appCtx)
+
+			if len(writer.Messages) != 1 {
+				t.Fatalf("expected 1 event, got %d", len(writer.Messages))
+			}
+			msg := writer.Messages[0]
+			if msg.Topic != tt.wantTopic.S() {
+				t.Errorf("expected topic %s, got %s", tt.wantTopic, msg.Topic)
+			}
+
+			event, err := cmn.FromBytes[cmn.TransactionEvent](msg.Value)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if event.Reason != tt.wantReason {
+				t.Errorf("expected reason %q, got %q", tt.wantReason, event.Reason)
+			}
+			if event.PaymentSysID != "123" || event.AccountID != 42 || event.Amount != tt.tx.Amount {
+				t.Errorf("unexpected event %+v", event)
+			}
+			if event.KafkaID != "transfer-requested:2:7" {
+				t.Errorf("expected kafka origin, got %q", event.KafkaID)
+			}
+			if tt.wantReason == "" && (event.Balance != 900 || event.Leg != cmn.LegDebit || event.TxID == "") {
+				t.Errorf("unexpected completed event %+v", event)
+			}
+		})
 	}
+}
 
+func TestApplyTransactionRedeliveryResendsOutcome(t *testing.T) {
+	writer := &tu.MockKafkaWriter{}
 	appCtx := &transactionCtx{
-		cancelCtx:   context.Background(),
-		db:          mockDB,
-		redisClient: nil,
+		cancelCtx: context.Background(),
+		logger:    cmn.AppLogger(),
+		writer:    writer,
+		db:        &mockTransactionDB{accounts: map[int32]*cmn.Account{42: {AccountID: 42, Balance: 1000}}},
 	}
 
-	tx := &cmn.Transaction{AccountID: 42}
+	for offset := range 2 {
+		tx := &cmn.Transaction{PaymentSysID: "123", Amount: 100, AccountID: 42}
+		if _, err := applyTransaction(tx, fmt.Sprintf("transfer-requested:0:%d", offset), appCtx); err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+	}
 
-	// Should not panic with nil redis client
-	invalidateCache(tx, appCtx)
-}
\ No newline at end of file
+	if len(writer.Messages) != 2 {
+		t.Fatalf("expected 2 events, got %d", len(writer.Messages))
+	}
+	first, _ := cmn.FromBytes[cmn.TransactionEvent](writer.Messages[0].Value)
+	second, _ := cmn.FromBytes[cmn.TransactionEvent](writer.Messages[1].Value)
+
+	// the original outcome, not applied again
+	if second.Balance != 1100 || second.KafkaID != first.KafkaID || second.TxID != first.TxID {
+		t.Errorf("expected original outcome %+v, got %+v", first, second)
+	}
+}
+
+func TestApplyTransactionPublishFailureRetried(t *testing.T) {
+	appCtx := &transactionCtx{
+		cancelCtx: context.Background(),
+		logger:    cmn.AppLogger(),
+		writer:    &tu.MockKafkaWriter{WriteErr: errors.New("kafka down")},
+		db:        &mockTransactionDB{},
+	}
+
+	_, err := applyTransaction(&cmn.Transaction{PaymentSysID: "123", Amount: 100, AccountID: 42}, "k", appCtx)
+
+	if err == nil || errors.Is(err, cmn.ErrUnprocessable) {
+		t.Errorf("expected retryable error, got %v", err)
+	}
+}
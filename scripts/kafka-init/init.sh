@@ -2,11 +2,21 @@
 
 echo checking topics created
 
-topics="payment-requested payment-verified payment-failed transaction-requested transaction-completed transaction-failed"
+topics="payment-requested payment-verified payment-failed transfer-requested transaction-completed transaction-failed account-changed reconciliation-breaks"
+
+# retry tiers and dead letter topics, see pkg/common/retry.go
+topics="$topics payment-requested.retry.1 payment-requested.retry.2 payment-requested.retry.3"
+topics="$topics transfer-requested.retry.1 transfer-requested.retry.2 transfer-requested.retry.3"
+topics="$topics payment-requested.dlq transfer-requested.dlq"
 
 for topic in $topics; do
     # /opt/bitnami/kafka/bin/
     kafka-topics.sh --create --if-not-exists --bootstrap-server "$KAFKA_BROKER" --topic "$topic"
 done;
 
+# transaction-service handles partitions in parallel, so throughput grows with these
+for topic in transfer-requested; do
+    kafka-topics.sh --alter --bootstrap-server "$KAFKA_BROKER" --topic "$topic" --partitions "${TX_PARTITIONS:-6}" 2>/dev/null || true
+done;
+
 echo 'done'
\ No newline at end of file
@@ -6,40 +6,239 @@ CREATE SCHEMA IF NOT EXISTS transactions;
 
 CREATE TABLE IF NOT EXISTS transactions.transaction (
     id UUID PRIMARY KEY,
+    payment_sys_id UUID NOT NULL,
     kafka_id TEXT NOT NULL,
     account_id INT NOT NULL,
-    amount INT NOT NULL,
-    created_at TIMESTAMP DEFAULT now()
+    leg TEXT NOT NULL CHECK (leg IN ('DEBIT', 'CREDIT', 'COMPENSATION')),
+    amount BIGINT NOT NULL,
+    balance_after BIGINT NOT NULL,
+    created_at TIMESTAMP DEFAULT now(),
+    -- each leg of a payment is applied to an account at most once
+    UNIQUE (payment_sys_id, account_id, leg)
+);
+
+-- an account's history, newest first, see account-service history.go
+CREATE INDEX IF NOT EXISTS transaction_account_history
+    ON transactions.transaction (account_id, created_at DESC, id DESC);
+
+-- progress of each transfer through its legs, see transaction-service saga.go
+CREATE TABLE IF NOT EXISTS transactions.saga (
+    payment_sys_id UUID PRIMARY KEY,
+    source_account_id INT NOT NULL,
+    target_account_id INT NOT NULL,
+    amount BIGINT NOT NULL,
+    kafka_id TEXT NOT NULL,
+    state TEXT NOT NULL DEFAULT 'STARTED'
+        CHECK (state IN ('STARTED', 'DEBITED', 'COMPLETED', 'COMPENSATING', 'COMPENSATED', 'FAILED')),
+    failure_reason TEXT,
+    created_at TIMESTAMP NOT NULL DEFAULT now(),
+    updated_at TIMESTAMP NOT NULL DEFAULT now()
 );
 
+CREATE INDEX IF NOT EXISTS saga_unfinished_idx ON transactions.saga (created_at)
+    WHERE state NOT IN ('COMPLETED', 'COMPENSATED', 'FAILED');
+
 -- accounts
 CREATE SCHEMA IF NOT EXISTS accounts;
 
 CREATE TABLE IF NOT EXISTS accounts."user" (
     id SERIAL PRIMARY KEY, 
     username TEXT UNIQUE NOT NULL,
-    roles TEXT[] NOT NULL DEFAULT '{}'
+    roles TEXT[] NOT NULL DEFAULT '{}',
+    -- bcrypt, null for users that can't log in
+    password_hash BYTEA
+);
+
+-- usernames are looked up case insensitively, see auth-service getUserByName
+CREATE UNIQUE INDEX IF NOT EXISTS user_username_lower ON accounts."user" (LOWER(username));
+
+-- refresh tokens descended from one login, revoked together on logout or reuse
+CREATE TABLE IF NOT EXISTS accounts.refresh_token_family (
+    id UUID PRIMARY KEY,
+    user_id INT NOT NULL REFERENCES accounts."user"(id),
+    created_at TIMESTAMPTZ NOT NULL DEFAULT now(),
+    revoked_at TIMESTAMPTZ
 );
 
+-- see auth-service rotateRefreshToken
+CREATE TABLE IF NOT EXISTS accounts.refresh_token (
+    -- sha256 of the token, which is only ever held by the client
+    token_hash BYTEA PRIMARY KEY,
+    family_id UUID NOT NULL REFERENCES accounts.refresh_token_family(id),
+    expires_at TIMESTAMPTZ NOT NULL,
+    -- set once exchanged for the next token in the family
+    used_at TIMESTAMPTZ,
+    -- the access token issued alongside, revoked with the family
+    access_token_id TEXT NOT NULL,
+    access_expires_at TIMESTAMPTZ NOT NULL,
+    created_at TIMESTAMPTZ NOT NULL DEFAULT now()
+);
+
+CREATE INDEX IF NOT EXISTS refresh_token_family_idx ON accounts.refresh_token (family_id);
+
+-- banks accounts can be opened with, see account-service getBanks
+CREATE TABLE IF NOT EXISTS accounts.bank (
+    id SERIAL PRIMARY KEY,
+    name TEXT UNIQUE NOT NULL
+);
+
+INSERT INTO accounts.bank (id, name) VALUES (1, 'BankOfTim') ON CONFLICT DO NOTHING;
+
 CREATE TABLE IF NOT EXISTS accounts.account (
     id SERIAL PRIMARY KEY,
     name TEXT NOT NULL,
     user_id INT NOT NULL REFERENCES accounts."user"(id),
-    balance BIGINT NOT NULL DEFAULT 0
+    balance BIGINT NOT NULL DEFAULT 0,
+    -- how far below zero debits may take the balance, set by admins
+    overdraft_limit BIGINT NOT NULL DEFAULT 0 CHECK (overdraft_limit >= 0),
+    -- owned by the bank, not subject to overdraft limits
+    system BOOLEAN NOT NULL DEFAULT false
+);
+
+-- funds reserved for validated payments until the debit is committed
+CREATE TABLE IF NOT EXISTS accounts.hold (
+    payment_sys_id UUID PRIMARY KEY,
+    account_id INT NOT NULL REFERENCES accounts.account(id),
+    amount BIGINT NOT NULL CHECK (amount > 0),
+    status TEXT NOT NULL, -- ACTIVE, CONSUMED, RELEASED
+    created_at TIMESTAMP DEFAULT now(),
+    updated_at TIMESTAMP DEFAULT now(),
+    expires_at TIMESTAMP NOT NULL
 );
 
+CREATE INDEX IF NOT EXISTS hold_active ON accounts.hold (account_id) WHERE status = 'ACTIVE';
+
+-- accounts owned by the bank itself, with negative ids so they never clash with customers
+INSERT INTO accounts."user" (id, username, roles) VALUES (-1, 'system', '{system}')
+    ON CONFLICT DO NOTHING;
+
+-- the only admin. users created by the auth service are customers only. it has no password
+-- so can't log in until one is set, see "Authentication" in the README.
+INSERT INTO accounts."user" (id, username, roles) VALUES (-2, 'admin', '{admin,customer}')
+    ON CONFLICT DO NOTHING;
+
+INSERT INTO accounts.account (id, name, user_id, system) VALUES
+    -- the kind bank funding opening balances
+    (-1, 'Opening balances', -1, true),
+    -- funds between the debit and credit legs of a transfer. not locked or cached, its
+    -- balance is only derived from the ledger.
+    (-2, 'Transfers in flight', -1, true)
+    ON CONFLICT DO NOTHING;
+
+-- kafka messages staged in the same transaction as account writes
+CREATE TABLE IF NOT EXISTS accounts.outbox (
+    id BIGSERIAL PRIMARY KEY,
+    topic TEXT NOT NULL,
+    key BYTEA,
+    value BYTEA NOT NULL,
+    created_at TIMESTAMP DEFAULT now(),
+    sent_at TIMESTAMP
+);
+
+CREATE INDEX IF NOT EXISTS account_outbox_unsent ON accounts.outbox (id) WHERE sent_at IS NULL;
+
+-- Ledger, in the transactions schema but after accounts which it references
+
+-- double-entry ledger. each payment has one journal entry; every leg applied posts a line for
+-- its account and an opposite line for the in-flight account, so an entry always sums to zero
+-- and an account's balance is the sum of its lines.
+CREATE TABLE IF NOT EXISTS transactions.journal_entry (
+    payment_sys_id UUID PRIMARY KEY,
+    created_at TIMESTAMP NOT NULL DEFAULT now()
+);
+
+CREATE TABLE IF NOT EXISTS transactions.journal_line (
+    id BIGSERIAL PRIMARY KEY,
+    payment_sys_id UUID NOT NULL REFERENCES transactions.journal_entry(payment_sys_id),
+    tx_id UUID NOT NULL REFERENCES transactions.transaction(id),
+    account_id INT NOT NULL REFERENCES accounts.account(id),
+    -- positive increases the account's balance
+    amount BIGINT NOT NULL CHECK (amount <> 0),
+    -- the account's balance after this line, NULL for the in-flight account whose running total isn't kept
+    balance_after BIGINT,
+    created_at TIMESTAMP NOT NULL DEFAULT now()
+);
+
+CREATE INDEX IF NOT EXISTS journal_line_account ON transactions.journal_line (account_id, id DESC);
+CREATE INDEX IF NOT EXISTS journal_line_entry ON transactions.journal_line (payment_sys_id);
+
+-- balances derived from the ledger. the cached accounts.account.balance must match, except
+-- for the in-flight account which isn't cached.
+CREATE OR REPLACE VIEW transactions.ledger_balance AS
+    SELECT account_id, SUM(amount) AS balance FROM transactions.journal_line GROUP BY account_id;
+
+CREATE OR REPLACE FUNCTION transactions.check_entry_balanced() RETURNS trigger AS $$
+BEGIN
+    IF (SELECT SUM(amount) FROM transactions.journal_line WHERE payment_sys_id = NEW.payment_sys_id) <> 0 THEN
+        RAISE EXCEPTION 'journal entry % does not balance', NEW.payment_sys_id;
+    END IF;
+    RETURN NULL;
+END;
+$$ LANGUAGE plpgsql;
+
+-- checked at commit, once all of a leg's lines are in
+DROP TRIGGER IF EXISTS journal_entry_balanced ON transactions.journal_line;
+CREATE CONSTRAINT TRIGGER journal_entry_balanced
+    AFTER INSERT ON transactions.journal_line
+    DEFERRABLE INITIALLY DEFERRED
+    FOR EACH ROW EXECUTE FUNCTION transactions.check_entry_balanced();
+
+CREATE OR REPLACE FUNCTION transactions.journal_line_immutable() RETURNS trigger AS $$
+BEGIN
+    RAISE EXCEPTION 'journal lines are append only';
+END;
+$$ LANGUAGE plpgsql;
+
+DROP TRIGGER IF EXISTS journal_line_append_only ON transactions.journal_line;
+CREATE TRIGGER journal_line_append_only
+    BEFORE UPDATE OR DELETE ON transactions.journal_line
+    FOR EACH ROW EXECUTE FUNCTION transactions.journal_line_immutable();
+
 -- Payments
 CREATE SCHEMA IF NOT EXISTS payments;
 
 CREATE TABLE IF NOT EXISTS payments.transfer (
     system_id UUID NOT NULL PRIMARY KEY,
     app_id UUID NOT NULL,
+    user_id INT NOT NULL REFERENCES accounts."user"(id),
     source_account_id INT NOT NULL REFERENCES accounts.account("id"),
     target_account_id INT NOT NULL REFERENCES accounts.account("id"),
     amount BIGINT NOT NULL,
     status TEXT NOT NULL,
-    created_at TIMESTAMP DEFAULT now()
+    failure_reason TEXT,
+    created_at TIMESTAMP DEFAULT now(),
+    updated_at TIMESTAMP DEFAULT now(),
+    debited_at TIMESTAMP,
+    credited_at TIMESTAMP,
+    -- times the sweeper has republished the payment, see payment-service sweeper.go
+    redrive_count INT NOT NULL DEFAULT 0
 );
 
+CREATE INDEX IF NOT EXISTS payment_unfinished ON payments.transfer (status, updated_at)
+    WHERE status IN ('PENDING', 'VERIFIED');
+
+-- client AppIDs are idempotency keys, scoped to the user
+CREATE TABLE IF NOT EXISTS payments.idempotency_key (
+    user_id INT NOT NULL REFERENCES accounts."user"(id),
+    app_id TEXT NOT NULL,
+    request_hash TEXT NOT NULL,
+    system_id UUID NOT NULL,
+    created_at TIMESTAMP DEFAULT now(),
+    expires_at TIMESTAMP NOT NULL,
+    PRIMARY KEY (user_id, app_id)
+);
+
+-- kafka messages staged in the same transaction as payment writes
+CREATE TABLE IF NOT EXISTS payments.outbox (
+    id BIGSERIAL PRIMARY KEY,
+    topic TEXT NOT NULL,
+    key BYTEA,
+    value BYTEA NOT NULL,
+    created_at TIMESTAMP DEFAULT now(),
+    sent_at TIMESTAMP
+);
+
+CREATE INDEX IF NOT EXISTS payment_outbox_unsent ON payments.outbox (id) WHERE sent_at IS NULL;
+
 
 COMMIT;
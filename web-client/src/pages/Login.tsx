@@ -30,7 +30,7 @@ export default function Login() {
     const res = await fetch(`${gatewayHost}/login`, {
       method: "POST",
       headers: { "Content-Type": "application/json" },
-      body: JSON.stringify({ username, password: "test" }),
+      body: JSON.stringify({ username, password: "demo-password" }),
     });
 
     if (!res.ok) {
@@ -3,6 +3,7 @@ export interface Account {
   username: string;
   name: string;
   balance: number;
+  availableBalance: number;
   bankId: number;
   bankName: string;
 }
\ No newline at end of file